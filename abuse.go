@@ -0,0 +1,358 @@
+package piping_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const reportPath = "/report"
+
+const transferIDHeader = "X-Piping-Transfer-Id"
+
+// maxReports bounds the reports waiting for admins
+const maxReports = 1000
+
+// maxReportableTransfers bounds the recent transfers which receivers can report
+const maxReportableTransfers = 10000
+
+// maxReportBytes limits the JSON body of a report
+const maxReportBytes = 4096
+
+// Blocklist is the paths, client IPs and SHA-256 hashes of contents blocked by confirmed abuse reports
+type Blocklist struct {
+	Paths  []string `json:"paths"`
+	IPs    []string `json:"ips"`
+	SHA256 []string `json:"sha256"`
+}
+
+// reportableTransfer is what a report of the transfer adds to the blocklist
+type reportableTransfer struct {
+	path     string
+	senderIP string
+	// sha256 is the hash of the content if computed
+	sha256 string
+}
+
+type abuseReport struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	TransferID string    `json:"transferId"`
+	Reason     string    `json:"reason"`
+	ReporterIP string    `json:"reporterIp"`
+	Path       string    `json:"path"`
+	SenderIP   string    `json:"senderIp"`
+	SHA256     string    `json:"sha256,omitempty"`
+}
+
+type reportRequest struct {
+	TransferID string `json:"transferId"`
+	Reason     string `json:"reason"`
+}
+
+type abuseStore struct {
+	// filePath is the file persisting the blocklist
+	filePath string
+	mutex    sync.Mutex
+	paths    map[string]bool
+	ips      map[string]bool
+	hashes   map[string]bool
+	reports  []*abuseReport
+	// transfers are reportable transfers by transfer ID, the oldest of which are forgotten first
+	transfers     map[string]reportableTransfer
+	transferOrder []string
+}
+
+// EnableAbuseReports lets receivers report malicious transfers at /report.
+// Reports confirmed by admins at /admin/reports add the path, the IP of the sender and the hash of the content
+// to the blocklist persisted to the file, which is consulted before pipes are created.
+func (s *PipingServer) EnableAbuseReports(filePath string) error {
+	store := &abuseStore{filePath: filePath, transfers: map[string]reportableTransfer{}}
+	blocklist, err := readBlocklist(filePath)
+	if err != nil {
+		return err
+	}
+	store.setBlocklist(blocklist)
+	s.abuse = store
+	return nil
+}
+
+// ReloadBlocklist reads the blocklist file edited outside the server again, which is safe while serving.
+// Reports waiting for admins are kept.
+func (s *PipingServer) ReloadBlocklist() error {
+	if s.abuse == nil {
+		return nil
+	}
+	blocklist, err := readBlocklist(s.abuse.filePath)
+	if err != nil {
+		return err
+	}
+	s.abuse.mutex.Lock()
+	defer s.abuse.mutex.Unlock()
+	s.abuse.setBlocklist(blocklist)
+	return nil
+}
+
+// readBlocklist returns the empty blocklist if the file does not exist
+func readBlocklist(filePath string) (Blocklist, error) {
+	var blocklist Blocklist
+	b, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return blocklist, nil
+	}
+	if err != nil {
+		return blocklist, err
+	}
+	if err := json.Unmarshal(b, &blocklist); err != nil {
+		return blocklist, fmt.Errorf("invalid blocklist file %s: %w", filePath, err)
+	}
+	return blocklist, nil
+}
+
+// setBlocklist replaces the blocklist
+// NOTE: as.mutex should be locked unless as is not shared yet
+func (as *abuseStore) setBlocklist(blocklist Blocklist) {
+	as.paths, as.ips, as.hashes = map[string]bool{}, map[string]bool{}, map[string]bool{}
+	for _, path := range blocklist.Paths {
+		as.paths[path] = true
+	}
+	for _, ip := range blocklist.IPs {
+		as.ips[ip] = true
+	}
+	for _, hash := range blocklist.SHA256 {
+		as.hashes[hash] = true
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// NOTE: as.mutex should be locked
+func (as *abuseStore) blocklist() Blocklist {
+	return Blocklist{Paths: sortedKeys(as.paths), IPs: sortedKeys(as.ips), SHA256: sortedKeys(as.hashes)}
+}
+
+// save writes the blocklist to a temporary file and renames it, so that a crash leaves either the old or the new file
+// NOTE: as.mutex should be locked
+func (as *abuseStore) save() error {
+	b, err := json.MarshalIndent(as.blocklist(), "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(as.filePath), filepath.Base(as.filePath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(b); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), as.filePath)
+}
+
+// isBlocked returns true if the path or the IP is blocked
+func (as *abuseStore) isBlocked(path string, ip string) bool {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+	return as.paths[path] || as.ips[ip]
+}
+
+func (as *abuseStore) addTransfer(transferID string, transfer reportableTransfer) {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+	if _, ok := as.transfers[transferID]; !ok {
+		if len(as.transferOrder) >= maxReportableTransfers {
+			delete(as.transfers, as.transferOrder[0])
+			as.transferOrder = as.transferOrder[1:]
+		}
+		as.transferOrder = append(as.transferOrder, transferID)
+	}
+	as.transfers[transferID] = transfer
+}
+
+// setTransferHash records the hash of the content of the transfer when it has been read
+func (as *abuseStore) setTransferHash(transferID string, sum string) {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+	if transfer, ok := as.transfers[transferID]; ok {
+		transfer.sha256 = sum
+		as.transfers[transferID] = transfer
+	}
+}
+
+func (as *abuseStore) isBlockedHash(sum string) bool {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+	return as.hashes[sum]
+}
+
+// report queues the report of the transfer, returning false if the transfer is unknown or the queue is full
+func (as *abuseStore) report(r *abuseReport) (ok bool, isFull bool) {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+	transfer, ok := as.transfers[r.TransferID]
+	if !ok {
+		return false, false
+	}
+	if len(as.reports) >= maxReports {
+		return false, true
+	}
+	r.Path, r.SenderIP, r.SHA256 = transfer.path, transfer.senderIP, transfer.sha256
+	as.reports = append(as.reports, r)
+	return true, false
+}
+
+// resolve removes the report, adding its entries to the blocklist if confirmed
+func (as *abuseStore) resolve(id string, confirm bool) (bool, error) {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+	for i, r := range as.reports {
+		if r.ID != id {
+			continue
+		}
+		as.reports = append(as.reports[:i], as.reports[i+1:]...)
+		if !confirm {
+			return true, nil
+		}
+		as.paths[r.Path] = true
+		as.ips[r.SenderIP] = true
+		if r.SHA256 != "" {
+			as.hashes[r.SHA256] = true
+		}
+		return true, as.save()
+	}
+	return false, nil
+}
+
+// checkBlocklist responds 403 if the path or the client is blocked
+func (s *PipingServer) checkBlocklist(resWriter http.ResponseWriter, req *http.Request) bool {
+	if s.abuse == nil || !s.abuse.isBlocked(req.URL.Path, clientIP(req)) {
+		return true
+	}
+	s.writeError(resWriter, req, 403, ErrorCodeBlocked, fmt.Sprintf("The path '%s' or the client is blocked.", req.URL.Path))
+	return false
+}
+
+// recordReportableTransfer lets the receiver report the transfer with the transfer ID
+func (s *PipingServer) recordReportableTransfer(req *http.Request, pi *pipe, receiverResWriter http.ResponseWriter) {
+	if s.abuse == nil {
+		return
+	}
+	s.abuse.addTransfer(pi.transferID, reportableTransfer{path: req.URL.Path, senderIP: clientIP(req)})
+	receiverResWriter.Header().Set(transferIDHeader, pi.transferID)
+	receiverResWriter.Header().Add("Access-Control-Expose-Headers", transferIDHeader)
+}
+
+// handleReport queues a report of a transfer by its receiver with a JSON body such as {"transferId": "...", "reason": "malware"}
+func (s *PipingServer) handleReport(resWriter http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		resWriter.Header().Set("Allow", "POST")
+		s.writeError(resWriter, req, 405, ErrorCodeMethodNotAllowed, fmt.Sprintf("Unsupported method: %s.", req.Method))
+		return
+	}
+	var body reportRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxReportBytes)).Decode(&body); err != nil || body.TransferID == "" {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, `Invalid report. (e.g. {"transferId": "...", "reason": "malware"})`)
+		return
+	}
+	r := &abuseReport{ID: newID(s.random()), Time: s.now(), TransferID: body.TransferID, Reason: body.Reason, ReporterIP: clientIP(req)}
+	ok, isFull := s.abuse.report(r)
+	if isFull {
+		s.writeError(resWriter, req, 503, ErrorCodeReportLimit, "The number of reports has reached limits.")
+		return
+	}
+	if !ok {
+		s.writeError(resWriter, req, 404, ErrorCodeTransferNotFound, fmt.Sprintf("The transfer '%s' does not exist or has been forgotten.", body.TransferID))
+		return
+	}
+	s.logf(req, "Transfer %s on %s has been reported by %s: %q", r.TransferID, r.Path, r.ReporterIP, r.Reason)
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	resWriter.Header().Set("Content-Type", "application/json")
+	resWriter.WriteHeader(202)
+	json.NewEncoder(resWriter).Encode(r)
+}
+
+// handleAdminReports lists reports, or confirms or dismisses the report specified by the "id" query parameter
+// with POST and the "action" query parameter "confirm" or "dismiss"
+func (s *PipingServer) handleAdminReports(resWriter http.ResponseWriter, req *http.Request) {
+	if s.abuse == nil {
+		http.NotFound(resWriter, req)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		s.abuse.mutex.Lock()
+		reports := append([]*abuseReport{}, s.abuse.reports...)
+		s.abuse.mutex.Unlock()
+		writeJSON(resWriter, reports)
+	case "POST":
+		query := req.URL.Query()
+		action := query.Get("action")
+		if action != "confirm" && action != "dismiss" {
+			s.writeError(resWriter, req, 400, ErrorCodeBadRequest, "Invalid action: "+action)
+			return
+		}
+		ok, err := s.abuse.resolve(query.Get("id"), action == "confirm")
+		if !ok {
+			http.NotFound(resWriter, req)
+			return
+		}
+		if err != nil {
+			s.logf(req, "Failed to save the blocklist: %v", err)
+		}
+		s.logf(req, "Report %s has been %sed", query.Get("id"), action)
+		resWriter.WriteHeader(204)
+	default:
+		resWriter.Header().Set("Allow", "GET, POST")
+		s.writeError(resWriter, req, 405, ErrorCodeMethodNotAllowed, "Unsupported method: "+req.Method+".")
+	}
+}
+
+// handleAdminBlocklist gets the blocklist, or replaces it by PUT with a JSON body
+func (s *PipingServer) handleAdminBlocklist(resWriter http.ResponseWriter, req *http.Request) {
+	if s.abuse == nil {
+		http.NotFound(resWriter, req)
+		return
+	}
+	s.abuse.mutex.Lock()
+	defer s.abuse.mutex.Unlock()
+	switch req.Method {
+	case "GET":
+	case "PUT":
+		var blocklist Blocklist
+		if err := json.NewDecoder(req.Body).Decode(&blocklist); err != nil {
+			s.writeError(resWriter, req, 400, ErrorCodeBadRequest, "Invalid blocklist: "+err.Error())
+			return
+		}
+		s.abuse.setBlocklist(blocklist)
+		if err := s.abuse.save(); err != nil {
+			s.logf(req, "Failed to save the blocklist: %v", err)
+		}
+		s.logf(req, "The blocklist has been replaced")
+	default:
+		resWriter.Header().Set("Allow", "GET, PUT")
+		s.writeError(resWriter, req, 405, ErrorCodeMethodNotAllowed, "Unsupported method: "+req.Method+".")
+		return
+	}
+	writeJSON(resWriter, s.abuse.blocklist())
+}
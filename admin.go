@@ -0,0 +1,120 @@
+package piping_server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const adminPathPrefix = "/admin/"
+
+// defaultDebugPathDuration is the tracing duration when "duration" is not specified
+const defaultDebugPathDuration = 10 * time.Minute
+
+func isAdminPath(path string) bool {
+	return strings.HasPrefix(path, adminPathPrefix)
+}
+
+// authorizeAdmin checks "Authorization: Bearer <AdminToken>"
+func (s *PipingServer) authorizeAdmin(req *http.Request) bool {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken())) == 1
+}
+
+func writeJSON(resWriter http.ResponseWriter, v interface{}) {
+	resWriter.Header().Set("Content-Type", "application/json")
+	resWriter.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(resWriter).Encode(v)
+}
+
+type logLevelResponse struct {
+	Level string `json:"level"`
+}
+
+func (s *PipingServer) handleAdmin(resWriter http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == adminPathPrefix && req.Method == "GET" {
+		s.handleAdminDashboard(resWriter, req)
+		return
+	}
+	if !s.authorizeAdmin(req) {
+		resWriter.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		s.writeError(resWriter, req, 401, ErrorCodeUnauthorized, "Unauthorized.")
+		return
+	}
+	switch strings.TrimPrefix(req.URL.Path, adminPathPrefix) {
+	case "log-level":
+		s.handleAdminLogLevel(resWriter, req)
+	case "debug-paths":
+		s.handleAdminDebugPaths(resWriter, req)
+	case "pipes":
+		s.handleAdminPipes(resWriter, req)
+	case "stats":
+		s.handleAdminStats(resWriter, req)
+	case "errors":
+		s.handleAdminErrors(resWriter, req)
+	case "events":
+		s.handleAdminEvents(resWriter, req)
+	case "graphql":
+		s.handleAdminGraphQL(resWriter, req)
+	case "waiters":
+		s.handleAdminWaiters(resWriter, req)
+	case "reports":
+		s.handleAdminReports(resWriter, req)
+	case "blocklist":
+		s.handleAdminBlocklist(resWriter, req)
+	default:
+		http.NotFound(resWriter, req)
+	}
+}
+
+// handleAdminLogLevel gets the log level, or sets it by PUT with the "level" query parameter
+func (s *PipingServer) handleAdminLogLevel(resWriter http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+	case "PUT":
+		level, err := ParseLogLevel(req.URL.Query().Get("level"))
+		if err != nil {
+			s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+			return
+		}
+		s.SetLogLevel(level)
+		s.logf(req, "Log level has been changed to %s", level)
+	default:
+		resWriter.Header().Set("Allow", "GET, PUT")
+		s.writeError(resWriter, req, 405, ErrorCodeMethodNotAllowed, "Unsupported method: "+req.Method+".")
+		return
+	}
+	writeJSON(resWriter, logLevelResponse{Level: s.LogLevel().String()})
+}
+
+// handleAdminDebugPaths lists traced path patterns, adds one by POST or removes one by DELETE
+// with the "pattern" and "duration" query parameters
+func (s *PipingServer) handleAdminDebugPaths(resWriter http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	switch req.Method {
+	case "GET":
+	case "POST":
+		d := defaultDebugPathDuration
+		if q := query.Get("duration"); q != "" {
+			var err error
+			if d, err = time.ParseDuration(q); err != nil || d <= 0 {
+				s.writeError(resWriter, req, 400, ErrorCodeBadRequest, "Invalid duration: "+q)
+				return
+			}
+		}
+		if err := s.EnableDebugPath(query.Get("pattern"), d); err != nil || query.Get("pattern") == "" {
+			s.writeError(resWriter, req, 400, ErrorCodeBadRequest, "Invalid pattern: "+query.Get("pattern"))
+			return
+		}
+		s.logf(req, "Tracing %s for %s", query.Get("pattern"), d)
+	case "DELETE":
+		s.DisableDebugPath(query.Get("pattern"))
+	default:
+		resWriter.Header().Set("Allow", "GET, POST, DELETE")
+		s.writeError(resWriter, req, 405, ErrorCodeMethodNotAllowed, "Unsupported method: "+req.Method+".")
+		return
+	}
+	writeJSON(resWriter, s.DebugPaths())
+}
@@ -0,0 +1,81 @@
+package piping_server
+
+import (
+	_ "embed"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+//go:embed admin_dashboard.html
+var adminDashboardHTML []byte
+
+type adminStats struct {
+	TransferredBytes int64 `json:"transferredBytes"`
+	ActivePipes      int   `json:"activePipes"`
+	// CommittedMemoryBytes is the approximate memory limited by PipingServer.MemoryCeiling
+	CommittedMemoryBytes int64 `json:"committedMemoryBytes"`
+	// Waiters is the number of pipe requests in flight limited by PipingServer.MaxWaiters
+	Waiters         int   `json:"waiters"`
+	RejectedWaiters int64 `json:"rejectedWaiters"`
+}
+
+// handleAdminDashboard serves the dashboard page, which has no data until the token is entered
+func (s *PipingServer) handleAdminDashboard(resWriter http.ResponseWriter, req *http.Request) {
+	resWriter.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resWriter.Header().Set("Cache-Control", "no-store")
+	s.setSecurityHeaders(resWriter, req, s.StaticSecurityHeaders)
+	resWriter.Write(adminDashboardHTML)
+}
+
+func (s *PipingServer) activePipePaths() []string {
+	s.mutex.Lock()
+	paths := make([]string, 0, len(s.pathToPipe))
+	for path := range s.pathToPipe {
+		paths = append(paths, path)
+	}
+	s.mutex.Unlock()
+	sort.Strings(paths)
+	return paths
+}
+
+func (s *PipingServer) handleAdminStats(resWriter http.ResponseWriter, req *http.Request) {
+	waiters, rejectedWaiters := s.waiters.counts()
+	writeJSON(resWriter, adminStats{
+		TransferredBytes:     atomic.LoadInt64(&s.transferredBytes),
+		ActivePipes:          len(s.activePipePaths()),
+		CommittedMemoryBytes: s.committedMemoryBytes(),
+		Waiters:              waiters,
+		RejectedWaiters:      rejectedWaiters,
+	})
+}
+
+// handleAdminPipes lists active pipes, or cancels the pipe specified by the "path" query parameter by DELETE
+func (s *PipingServer) handleAdminPipes(resWriter http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		pipes := []progress{}
+		for _, path := range s.activePipePaths() {
+			pipes = append(pipes, s.pipeProgress(path))
+		}
+		writeJSON(resWriter, pipes)
+	case "DELETE":
+		path := req.URL.Query().Get("path")
+		pi, ok := s.cancelPipe(path)
+		if !ok {
+			http.NotFound(resWriter, req)
+			return
+		}
+		s.events.publish(pipeEvent{Type: eventPipeCanceled, Time: time.Now(), Path: path, TransferID: pi.transferID, RequestID: requestID(req)})
+		s.logf(req, "Pipe %s has been canceled", path)
+		resWriter.WriteHeader(204)
+	default:
+		resWriter.Header().Set("Allow", "GET, DELETE")
+		s.writeError(resWriter, req, 405, ErrorCodeMethodNotAllowed, "Unsupported method: "+req.Method+".")
+	}
+}
+
+func (s *PipingServer) handleAdminErrors(resWriter http.ResponseWriter, req *http.Request) {
+	writeJSON(resWriter, s.recentErrors.list())
+}
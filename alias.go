@@ -0,0 +1,129 @@
+package piping_server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const shortenPath = "/shorten"
+
+const aliasPathPrefix = "/s/"
+
+// DefaultAliasTTL is the lifetime of an alias without the "ttl" query parameter
+const DefaultAliasTTL = time.Hour
+
+type alias struct {
+	target    string
+	expiresAt time.Time
+}
+
+type aliasStore struct {
+	mutex   sync.Mutex
+	aliases map[string]alias
+}
+
+func newAliasStore() *aliasStore {
+	return &aliasStore{aliases: map[string]alias{}}
+}
+
+type aliasResponse struct {
+	Alias     string    `json:"alias"`
+	URL       string    `json:"url"`
+	Path      string    `json:"path"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// add creates a new alias like "/s/blue-fox-42" of the target path
+func (st *aliasStore) add(target string, expiresAt time.Time, now time.Time, random io.Reader) string {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for name, a := range st.aliases {
+		if !now.Before(a.expiresAt) {
+			delete(st.aliases, name)
+		}
+	}
+	for {
+		name := aliasPathPrefix + fmt.Sprintf("%s-%s-%d", randomWord(random, adjectiveWords), randomWord(random, nounWords), randomInt(random, 100))
+		if _, ok := st.aliases[name]; !ok {
+			st.aliases[name] = alias{target: target, expiresAt: expiresAt}
+			return name
+		}
+	}
+}
+
+func (st *aliasStore) resolve(name string, now time.Time) (string, bool) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	a, ok := st.aliases[name]
+	if !ok || !now.Before(a.expiresAt) {
+		return "", false
+	}
+	return a.target, true
+}
+
+// removeTarget removes aliases of the path whose pipe has completed
+func (st *aliasStore) removeTarget(target string) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for name, a := range st.aliases {
+		if a.target == target {
+			delete(st.aliases, name)
+		}
+	}
+}
+
+// handleShorten creates a short alias of the path specified by the "path" query parameter
+func (s *PipingServer) handleShorten(resWriter http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		resWriter.Header().Set("Allow", "POST")
+		s.writeError(resWriter, req, 405, ErrorCodeMethodNotAllowed, fmt.Sprintf("Unsupported method: %s.", req.Method))
+		return
+	}
+	path := req.URL.Query().Get("path")
+	if !isPipingPath(path) {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, fmt.Sprintf("Invalid path '%s'. (e.g. '/p/mypath123')", path))
+		return
+	}
+	ttl := DefaultAliasTTL
+	if q := req.URL.Query().Get("ttl"); q != "" {
+		d, err := time.ParseDuration(q)
+		if err != nil || d <= 0 {
+			s.writeError(resWriter, req, 400, ErrorCodeBadRequest, fmt.Sprintf("Invalid ttl '%s'. (e.g. '1h')", q))
+			return
+		}
+		ttl = d
+	}
+	if s.MaxTransferDuration > 0 && ttl > s.MaxTransferDuration {
+		ttl = s.MaxTransferDuration
+	}
+	now := s.now()
+	expiresAt := now.Add(ttl).UTC()
+	name := s.aliases.add(path, expiresAt, now, s.random())
+	s.infof(req, "Alias %s of %s has been created until %s", name, path, expiresAt.Format(time.RFC3339))
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	writeJSON(resWriter, aliasResponse{Alias: name, URL: s.externalURL(req, name), Path: path, ExpiresAt: expiresAt})
+}
+
+// resolveAlias returns the request to the target path of the alias, or false if the alias is unknown or expired
+func (s *PipingServer) resolveAlias(req *http.Request) (*http.Request, bool) {
+	target, ok := s.aliases.resolve(req.URL.Path, s.now())
+	if !ok {
+		return nil, false
+	}
+	r2 := new(http.Request)
+	*r2 = *req
+	r2.URL = new(url.URL)
+	*r2.URL = *req.URL
+	r2.URL.Path = target
+	r2.URL.RawPath = ""
+	return r2, true
+}
+
+func isAliasPath(path string) bool {
+	return strings.HasPrefix(path, aliasPathPrefix)
+}
@@ -0,0 +1,162 @@
+package piping_server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errArchiveFailed = errors.New("archive failed")
+
+// ArchiveSink stores copies of transfers on paths matching PipingServer.ArchivePaths.
+// Spooled transfers are archived when spooled, and pushed transfers when the push target accepts them.
+// A sink storing to object storage such as S3 can be implemented by embedders.
+type ArchiveSink interface {
+	// Archive starts storing a copy of the transfer of the sender request
+	Archive(req *http.Request) (ArchiveWriter, error)
+}
+
+// ArchiveWriter receives the copy of a transfer as the receiver gets it
+type ArchiveWriter interface {
+	Write(p []byte) (int, error)
+	// Commit stores the copy of the completed transfer
+	Commit() error
+	// Discard removes the copy of the aborted transfer
+	Discard()
+}
+
+// DirArchiveSink stores copies of transfers in the directory with JSON metadata
+type DirArchiveSink struct {
+	Dir string
+}
+
+type dirArchiveMetadata struct {
+	Path               string    `json:"path"`
+	RequestID          string    `json:"requestId"`
+	RemoteAddr         string    `json:"remoteAddr"`
+	ContentType        string    `json:"contentType,omitempty"`
+	ContentDisposition string    `json:"contentDisposition,omitempty"`
+	StartedAt          time.Time `json:"startedAt"`
+	FinishedAt         time.Time `json:"finishedAt"`
+}
+
+type dirArchiveWriter struct {
+	file     *os.File
+	name     string
+	metadata dirArchiveMetadata
+}
+
+func (sink *DirArchiveSink) Archive(req *http.Request) (ArchiveWriter, error) {
+	if err := os.MkdirAll(sink.Dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(sink.Dir, ".archiving-*")
+	if err != nil {
+		return nil, err
+	}
+	startedAt := time.Now().UTC()
+	return &dirArchiveWriter{
+		file: file,
+		// e.g. 20060102T150405.000000000Z_p%2Fmypath_<request ID>
+		name: filepath.Join(sink.Dir, fmt.Sprintf("%s_%s_%s", startedAt.Format("20060102T150405.000000000Z"), url.PathEscape(strings.TrimPrefix(req.URL.Path, "/")), requestID(req))),
+		metadata: dirArchiveMetadata{
+			Path:               req.URL.Path,
+			RequestID:          requestID(req),
+			RemoteAddr:         req.RemoteAddr,
+			ContentType:        req.Header.Get("Content-Type"),
+			ContentDisposition: req.Header.Get("Content-Disposition"),
+			StartedAt:          startedAt,
+		},
+	}, nil
+}
+
+func (w *dirArchiveWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+func (w *dirArchiveWriter) Commit() error {
+	if err := w.file.Sync(); err != nil {
+		w.Discard()
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	w.metadata.FinishedAt = time.Now().UTC()
+	metadata, err := json.Marshal(w.metadata)
+	if err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	if err := os.WriteFile(w.name+".json", metadata, 0600); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	return os.Rename(w.file.Name(), w.name)
+}
+
+func (w *dirArchiveWriter) Discard() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// isArchivedPath returns true if the path matches one of ArchivePaths, or ArchivePaths is empty
+func (s *PipingServer) isArchivedPath(p string) bool {
+	if len(s.ArchivePaths) == 0 {
+		return true
+	}
+	for _, pattern := range s.ArchivePaths {
+		if matched, _ := path.Match(pattern, p); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// startArchive returns nil if the transfer is not archived
+func (s *PipingServer) startArchive(req *http.Request) (ArchiveWriter, error) {
+	if s.ArchiveSink == nil || !s.isArchivedPath(req.URL.Path) {
+		return nil, nil
+	}
+	archive, err := s.ArchiveSink.Archive(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errArchiveFailed, err)
+	}
+	return archive, nil
+}
+
+// finishArchive commits the archive of the completed transfer, or discards it if the transfer has failed with err
+func finishArchive(archive ArchiveWriter, err error) error {
+	if archive == nil {
+		return err
+	}
+	if err != nil {
+		archive.Discard()
+		return err
+	}
+	if err := archive.Commit(); err != nil {
+		return fmt.Errorf("%w: %v", errArchiveFailed, err)
+	}
+	return nil
+}
+
+// archiveWriter wraps write errors of the archive to abort the transfer
+type archiveWriter struct {
+	w ArchiveWriter
+}
+
+func (w archiveWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		return n, fmt.Errorf("%w: %v", errArchiveFailed, err)
+	}
+	return n, nil
+}
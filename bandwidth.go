@@ -0,0 +1,162 @@
+package piping_server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultTrafficClass is the class of transfers without X-Piping-Traffic-Class or a path rule selecting a class
+const DefaultTrafficClass = "default"
+
+// trafficClassHeader selects the traffic class of the transfer by the sender
+const trafficClassHeader = "X-Piping-Traffic-Class"
+
+// bandwidthChunkSize bounds bytes granted at once so that a bulk transfer delays the others by at most a chunk
+const bandwidthChunkSize = 16 * 1024
+
+// bandwidthRequest waits for its turn to send n bytes
+type bandwidthRequest struct {
+	class string
+	n     int
+	// tag is the virtual start time, which the scheduler serves in ascending order
+	tag   float64
+	ready chan struct{}
+}
+
+// bandwidthScheduler shares the egress rate among traffic classes by their weights with start-time fair queueing.
+// A class gets the whole rate while the others are idle.
+type bandwidthScheduler struct {
+	bytesPerSecond int64
+	weights        map[string]int
+	mutex          sync.Mutex
+	// finishTags are the virtual finish times of the last requests of the classes
+	finishTags  map[string]float64
+	virtualTime float64
+	queue       []*bandwidthRequest
+	dispatching bool
+	// linkFreeAt is when the bytes granted so far have been sent at the rate
+	linkFreeAt time.Time
+}
+
+// EnableBandwidthScheduler limits the total egress of pipes to receivers to bytesPerSecond,
+// sharing it among traffic classes by weights (e.g. {"interactive": 8, "bulk": 1}).
+// The class DefaultTrafficClass has the weight 1 unless weights specify it.
+func (s *PipingServer) EnableBandwidthScheduler(bytesPerSecond int64, weights map[string]int) error {
+	if bytesPerSecond <= 0 {
+		return errors.New("the egress rate should be positive")
+	}
+	classWeights := map[string]int{DefaultTrafficClass: 1}
+	for class, weight := range weights {
+		if class == "" || weight <= 0 {
+			return fmt.Errorf("invalid traffic class %q: the weight should be positive", class)
+		}
+		classWeights[class] = weight
+	}
+	s.bandwidth = &bandwidthScheduler{bytesPerSecond: bytesPerSecond, weights: classWeights, finishTags: map[string]float64{}}
+	return nil
+}
+
+// trafficClass returns the class of the path rule, X-Piping-Traffic-Class of the sender, or DefaultTrafficClass
+func (s *PipingServer) trafficClass(req *http.Request) (string, error) {
+	if s.bandwidth == nil {
+		return DefaultTrafficClass, nil
+	}
+	// NOTE: The operator decides the class of paths with rules, which senders cannot override
+	if rule := s.pathRule(req.URL.Path); rule != nil && rule.TrafficClass != "" {
+		return rule.TrafficClass, nil
+	}
+	class := req.Header.Get(trafficClassHeader)
+	if class == "" {
+		return DefaultTrafficClass, nil
+	}
+	if _, ok := s.bandwidth.weights[class]; !ok {
+		return "", fmt.Errorf("Unknown traffic class '%s'.", class)
+	}
+	return class, nil
+}
+
+// scheduledReader waits for the turn of its class after each read of at most bandwidthChunkSize
+type scheduledReader struct {
+	r         io.Reader
+	scheduler *bandwidthScheduler
+	class     string
+}
+
+func (r *scheduledReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthChunkSize {
+		p = p[:bandwidthChunkSize]
+	}
+	n, err := r.r.Read(p)
+	if n != 0 {
+		r.scheduler.wait(r.class, n)
+	}
+	return n, err
+}
+
+// scheduledReader returns the reader sending at the turns of the class, or r if the scheduler is disabled
+func (s *PipingServer) scheduledReader(r io.Reader, class string) io.Reader {
+	if s.bandwidth == nil {
+		return r
+	}
+	return &scheduledReader{r: r, scheduler: s.bandwidth, class: class}
+}
+
+// wait blocks until n bytes of the class can be sent
+func (b *bandwidthScheduler) wait(class string, n int) {
+	weight, ok := b.weights[class]
+	if !ok {
+		weight = b.weights[DefaultTrafficClass]
+	}
+	req := &bandwidthRequest{class: class, n: n, ready: make(chan struct{})}
+	b.mutex.Lock()
+	req.tag = b.virtualTime
+	if finishTag := b.finishTags[class]; finishTag > req.tag {
+		req.tag = finishTag
+	}
+	b.finishTags[class] = req.tag + float64(n)/float64(weight)
+	b.queue = append(b.queue, req)
+	if !b.dispatching {
+		b.dispatching = true
+		go b.dispatch()
+	}
+	b.mutex.Unlock()
+	<-req.ready
+}
+
+// dispatch grants the request with the smallest tag whenever the link is free until the queue is empty
+func (b *bandwidthScheduler) dispatch() {
+	for {
+		b.mutex.Lock()
+		if len(b.queue) == 0 {
+			b.dispatching = false
+			b.mutex.Unlock()
+			return
+		}
+		next := 0
+		for i, req := range b.queue {
+			if req.tag < b.queue[next].tag {
+				next = i
+			}
+		}
+		req := b.queue[next]
+		b.queue = append(b.queue[:next], b.queue[next+1:]...)
+		b.virtualTime = req.tag
+		now := time.Now()
+		// NOTE: An idle link does not save the rate for a burst
+		if b.linkFreeAt.Before(now) {
+			b.linkFreeAt = now
+		}
+		b.linkFreeAt = b.linkFreeAt.Add(time.Duration(float64(req.n) / float64(b.bytesPerSecond) * float64(time.Second)))
+		wait := b.linkFreeAt.Sub(now)
+		b.mutex.Unlock()
+		close(req.ready)
+		// NOTE: Sleeps only for a debt of a millisecond or more since timers are coarse for small chunks on fast links
+		if wait >= time.Millisecond {
+			time.Sleep(wait)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package piping_server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const base64Encoding = "base64"
+
+// base64Requested returns true for "encoding=base64", or an error for other encodings
+func base64Requested(req *http.Request) (bool, error) {
+	switch encoding := req.URL.Query().Get("encoding"); encoding {
+	case "":
+		return false, nil
+	case base64Encoding:
+		return true, nil
+	default:
+		return false, fmt.Errorf("Unsupported encoding '%s'. (base64)", encoding)
+	}
+}
+
+// base64EncodingReader encodes the stream into standard base64 while reading
+type base64EncodingReader struct {
+	r io.Reader
+	// encoded is not read yet
+	encoded []byte
+	// raw is the tail shorter than 3 bytes to be encoded with the next read
+	raw []byte
+	eof bool
+	buf []byte
+}
+
+func newBase64EncodingReader(r io.Reader) *base64EncodingReader {
+	return &base64EncodingReader{r: r, buf: make([]byte, 3*1024)}
+}
+
+func (r *base64EncodingReader) Read(p []byte) (int, error) {
+	for len(r.encoded) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		n, err := r.r.Read(r.buf)
+		r.raw = append(r.raw, r.buf[:n]...)
+		if err == io.EOF {
+			r.eof = true
+			r.encoded = []byte(base64.StdEncoding.EncodeToString(r.raw))
+			r.raw = nil
+			continue
+		}
+		full := len(r.raw) / 3 * 3
+		r.encoded = []byte(base64.StdEncoding.EncodeToString(r.raw[:full]))
+		r.raw = append(r.raw[:0], r.raw[full:]...)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.encoded)
+	r.encoded = r.encoded[n:]
+	return n, nil
+}
@@ -0,0 +1,39 @@
+package piping_server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// stripBasePath returns the request without BasePath in its URL path.
+// It returns false if the request is not under BasePath.
+func (s *PipingServer) stripBasePath(req *http.Request) (*http.Request, bool) {
+	basePath := strings.TrimSuffix(s.BasePath, "/")
+	if basePath == "" {
+		return req, true
+	}
+	p := strings.TrimPrefix(req.URL.Path, basePath)
+	if len(p) == len(req.URL.Path) || (p != "" && !strings.HasPrefix(p, "/")) {
+		return nil, false
+	}
+	if p == "" {
+		p = "/"
+	}
+	r2 := new(http.Request)
+	*r2 = *req
+	r2.URL = new(url.URL)
+	*r2.URL = *req.URL
+	r2.URL.Path = p
+	r2.URL.RawPath = ""
+	return r2, true
+}
+
+// externalBasePath returns the path prefix seen by clients.
+// X-Forwarded-Prefix from a reverse proxy stripping the prefix takes precedence over BasePath.
+func (s *PipingServer) externalBasePath(req *http.Request) string {
+	if prefix := req.Header.Get("X-Forwarded-Prefix"); prefix != "" {
+		return "/" + strings.Trim(prefix, "/")
+	}
+	return strings.TrimSuffix(s.BasePath, "/")
+}
@@ -0,0 +1,140 @@
+package piping_server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// bridgeResponseWriter is the response of a request made by a bridge of another protocol such as FTP.
+// It writes the body of a successful response to the writer returned by start, keeping the body of an error as its message.
+type bridgeResponseWriter struct {
+	header     http.Header
+	statusCode int
+	// start is called on the status of success and returns the writer of the body, which is discarded if start is nil
+	start   func(header http.Header) (io.Writer, error)
+	body    io.Writer
+	err     error
+	message strings.Builder
+	// aborted is true if the handler has aborted the response
+	aborted bool
+}
+
+func newBridgeResponseWriter(start func(header http.Header) (io.Writer, error)) *bridgeResponseWriter {
+	return &bridgeResponseWriter{header: http.Header{}, start: start}
+}
+
+func (w *bridgeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bridgeResponseWriter) WriteHeader(statusCode int) {
+	// NOTE: Informational responses are not final
+	if w.statusCode != 0 || statusCode < 200 {
+		return
+	}
+	w.statusCode = statusCode
+	if w.succeeded() && w.start != nil {
+		w.body, w.err = w.start(w.header)
+	}
+}
+
+func (w *bridgeResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(200)
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.body != nil {
+		return w.body.Write(p)
+	}
+	if !w.succeeded() && w.message.Len() < 1024 {
+		w.message.Write(p)
+	}
+	return len(p), nil
+}
+
+func (w *bridgeResponseWriter) Flush() {}
+
+func (w *bridgeResponseWriter) succeeded() bool {
+	return !w.aborted && 200 <= w.statusCode && w.statusCode < 300
+}
+
+// errorMessage returns the first line of the error response without the "[ERROR]" prefix
+func (w *bridgeResponseWriter) errorMessage() string {
+	if w.aborted {
+		return "The transfer has been aborted."
+	}
+	message, _, _ := strings.Cut(strings.TrimPrefix(w.message.String(), "[ERROR] "), "\n")
+	if message == "" {
+		message = http.StatusText(w.statusCode)
+	}
+	return message
+}
+
+// bridgeConn is the connection or session of a client of a bridge
+type bridgeConn interface {
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// newBridgeRequest returns the request of the method on the pipe for a client of the protocol.
+// The body of PUT has an unknown length and is spooled if no receiver is waiting, since devices and clients of bridges time out waiting for receivers.
+func (s *PipingServer) newBridgeRequest(ctx context.Context, protocol string, method string, pipePath string, body io.Reader, conn bridgeConn) (*http.Request, error) {
+	pipeURL := &url.URL{Path: pipePath}
+	if method == "PUT" && s.spool != nil {
+		pipeURL.RawQuery = "spool=true"
+	}
+	req, err := http.NewRequestWithContext(ctx, method, pipeURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.RequestURI = pipeURL.RequestURI()
+	req.Host = conn.LocalAddr().String()
+	req.RemoteAddr = conn.RemoteAddr().String()
+	req.Header.Set("User-Agent", protocol)
+	if method == "PUT" {
+		req.ContentLength = -1
+		if contentType := mime.TypeByExtension(path.Ext(pipePath)); contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+	}
+	return req, nil
+}
+
+// serveBridgeRequest serves the request made by a bridge until the transfer finishes
+func (s *PipingServer) serveBridgeRequest(w *bridgeResponseWriter, req *http.Request) {
+	defer func() {
+		// NOTE: Recovers as net/http, since the handler panics with http.ErrAbortHandler to abort the response
+		if err := recover(); err != nil {
+			if err != http.ErrAbortHandler {
+				s.logger.Printf("panic serving %s: %v\n%s", req.URL.Path, err, debug.Stack())
+			}
+			w.aborted = true
+		}
+	}()
+	req = withRequestID(w, req, s.random())
+	req = s.logRequestLine(req)
+	s.servePath(w, req)
+	// NOTE: The status is 200 if the handler has written nothing as in net/http
+	w.WriteHeader(200)
+}
+
+// listLine returns the line of the entry in the format of "ls -l" for listings of bridges
+func listLine(entry davEntry, modifiedAt time.Time) string {
+	if entry.isCollection {
+		return fmt.Sprintf("drwxr-xr-x 1 piping piping 0 %s %s", modifiedAt.Format("Jan _2 15:04"), entry.name)
+	}
+	size := entry.contentLength
+	if size == "" {
+		size = "0"
+	}
+	return fmt.Sprintf("-rw-r--r-- 1 piping piping %s %s %s", size, modifiedAt.Format("Jan _2 15:04"), entry.name)
+}
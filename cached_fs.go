@@ -0,0 +1,50 @@
+package piping_server
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// cachedFS caches contents of regular files in memory
+// so that files of a compressed archive are decompressed only once
+type cachedFS struct {
+	fsys fs.FS
+	// name -> []byte
+	contents sync.Map
+}
+
+func newCachedFS(fsys fs.FS) *cachedFS {
+	return &cachedFS{fsys: fsys}
+}
+
+type cachedFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *cachedFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *cachedFile) Close() error               { return nil }
+
+func (c *cachedFS) Open(name string) (fs.File, error) {
+	f, err := c.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return f, err
+	}
+	if content, ok := c.contents.Load(name); ok {
+		f.Close()
+		return &cachedFile{Reader: bytes.NewReader(content.([]byte)), info: info}, nil
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	c.contents.Store(name, content)
+	return &cachedFile{Reader: bytes.NewReader(content), info: info}, nil
+}
@@ -0,0 +1,140 @@
+package piping_server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errChaosReset = errors.New("transfer reset by chaos mode")
+
+// chaos is fault injection requested by the "chaos" query parameter of a sender or a receiver
+// (e.g. "latency=500ms,reset-after=1024,rate=4096") to let clients test their retry logic
+type chaos struct {
+	// latency delays handling the request
+	latency time.Duration
+	// resetAfter aborts the connections of the sender and the receiver after the bytes (negative to disable)
+	resetAfter int64
+	// bytesPerSecond slows down the transfer (0 for no limit)
+	bytesPerSecond int64
+}
+
+func parseChaos(req *http.Request) (chaos, error) {
+	c := chaos{resetAfter: -1}
+	value := req.URL.Query().Get("chaos")
+	if value == "" {
+		return c, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		key, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return c, fmt.Errorf("invalid chaos %q: %q is not key=value", value, pair)
+		}
+		var err error
+		switch key {
+		case "latency":
+			c.latency, err = time.ParseDuration(v)
+		case "reset-after":
+			c.resetAfter, err = strconv.ParseInt(v, 10, 64)
+			if err == nil && c.resetAfter < 0 {
+				err = errors.New("negative bytes")
+			}
+		case "rate":
+			c.bytesPerSecond, err = strconv.ParseInt(v, 10, 64)
+			if err == nil && c.bytesPerSecond <= 0 {
+				err = errors.New("non-positive bytes per second")
+			}
+		default:
+			return c, fmt.Errorf("invalid chaos %q: unknown key %q", value, key)
+		}
+		if err != nil {
+			return c, fmt.Errorf("invalid chaos %q: %s: %v", value, key, err)
+		}
+	}
+	return c, nil
+}
+
+// applyChaosLatency validates the "chaos" query parameter and sleeps for its latency, returning false after writing an error
+func (s *PipingServer) applyChaosLatency(resWriter http.ResponseWriter, req *http.Request) bool {
+	c, err := parseChaos(req)
+	if err != nil {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+		return false
+	}
+	if c.latency <= 0 {
+		return true
+	}
+	s.debugf(req, "Chaos mode delays %s", c.latency)
+	timer := time.NewTimer(c.latency)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+// chaosReader applies the chaos of the sender and the receiver to the transfer, taking the severer one
+func chaosReader(r io.Reader, senderReq *http.Request, receiverReq *http.Request) io.Reader {
+	// NOTE: validated by applyChaosLatency
+	c, _ := parseChaos(senderReq)
+	if receiverReq != nil {
+		rc, _ := parseChaos(receiverReq)
+		if rc.resetAfter >= 0 && (c.resetAfter < 0 || rc.resetAfter < c.resetAfter) {
+			c.resetAfter = rc.resetAfter
+		}
+		if rc.bytesPerSecond > 0 && (c.bytesPerSecond <= 0 || rc.bytesPerSecond < c.bytesPerSecond) {
+			c.bytesPerSecond = rc.bytesPerSecond
+		}
+	}
+	if c.resetAfter >= 0 {
+		r = &resetReader{r: r, n: c.resetAfter}
+	}
+	if c.bytesPerSecond > 0 {
+		r = &throttledReader{r: r, bytesPerSecond: c.bytesPerSecond, startedAt: time.Now()}
+	}
+	return r
+}
+
+// resetReader fails after reading n bytes
+type resetReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *resetReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errChaosReset
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	return n, err
+}
+
+// throttledReader reads at most bytesPerSecond on average
+type throttledReader struct {
+	r              io.Reader
+	bytesPerSecond int64
+	startedAt      time.Time
+	n              int64
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.bytesPerSecond {
+		p = p[:r.bytesPerSecond]
+	}
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if wait := time.Duration(float64(r.n)/float64(r.bytesPerSecond)*float64(time.Second)) - time.Since(r.startedAt); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
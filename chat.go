@@ -0,0 +1,231 @@
+package piping_server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const chatPathPrefix = "/chat/"
+
+// DefaultChatHistory is the default number of lines kept in a chat room
+const DefaultChatHistory = 50
+
+const (
+	// maxChatLineBytes bounds a line, and maxChatRooms bounds the memory of rooms with ChatHistory
+	maxChatLineBytes = 1024
+	maxChatRooms     = 1000
+	// chatRoomTTL is the time after the last line for which a room without participants is kept
+	chatRoomTTL = time.Hour
+	// chatBufferSize is the number of lines buffered for a participant, who misses lines beyond it
+	chatBufferSize = 64
+)
+
+type chatLine struct {
+	Time time.Time `json:"time"`
+	Name string    `json:"name,omitempty"`
+	Text string    `json:"text"`
+}
+
+func (l chatLine) String() string {
+	if l.Name == "" {
+		return l.Text
+	}
+	return l.Name + ": " + l.Text
+}
+
+type chatRoom struct {
+	history      []chatLine
+	participants map[chan chatLine]struct{}
+	lastPostedAt time.Time
+}
+
+type chatRooms struct {
+	mutex sync.Mutex
+	rooms map[string]*chatRoom
+}
+
+func newChatRooms() *chatRooms {
+	return &chatRooms{rooms: map[string]*chatRoom{}}
+}
+
+// room returns the room, creating it unless the number of rooms has reached limits. The caller should lock the mutex.
+func (c *chatRooms) room(name string, now time.Time) (*chatRoom, bool) {
+	if r, ok := c.rooms[name]; ok {
+		return r, true
+	}
+	for n, r := range c.rooms {
+		if len(r.participants) == 0 && now.Sub(r.lastPostedAt) >= chatRoomTTL {
+			delete(c.rooms, n)
+		}
+	}
+	if len(c.rooms) >= maxChatRooms {
+		return nil, false
+	}
+	r := &chatRoom{participants: map[chan chatLine]struct{}{}, lastPostedAt: now}
+	c.rooms[name] = r
+	return r, true
+}
+
+// join returns the history and the channel of lines posted afterwards
+func (c *chatRooms) join(name string, now time.Time) ([]chatLine, <-chan chatLine, func(), bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	r, ok := c.room(name, now)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	ch := make(chan chatLine, chatBufferSize)
+	r.participants[ch] = struct{}{}
+	history := append([]chatLine(nil), r.history...)
+	return history, ch, func() {
+		c.mutex.Lock()
+		delete(r.participants, ch)
+		c.mutex.Unlock()
+	}, true
+}
+
+// post broadcasts the line to the participants, returning the number of them
+func (c *chatRooms) post(name string, line chatLine, historySize int) (int, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	r, ok := c.room(name, line.Time)
+	if !ok {
+		return 0, false
+	}
+	r.lastPostedAt = line.Time
+	r.history = append(r.history, line)
+	if len(r.history) > historySize {
+		r.history = append(r.history[:0], r.history[len(r.history)-historySize:]...)
+	}
+	for ch := range r.participants {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+	return len(r.participants), true
+}
+
+// handleChat broadcasts lines posted to /chat/<room> to participants streaming the room by GET.
+// Participants receive the history first. "name" on POST prefixes lines with it.
+func (s *PipingServer) handleChat(resWriter http.ResponseWriter, req *http.Request) {
+	if s.ChatHistory <= 0 {
+		http.NotFound(resWriter, req)
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, chatPathPrefix)
+	if !isValidClipName(name) {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, fmt.Sprintf("Invalid room name '%s'. (e.g. '/chat/myroom')", name))
+		return
+	}
+	if req.Method != "OPTIONS" && !s.checkRateLimit(resWriter, req) {
+		return
+	}
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	switch {
+	case req.Method == "GET":
+		s.streamChat(resWriter, req, name)
+	case s.isSenderMethod(req.Method):
+		s.postChat(resWriter, req, name)
+	case req.Method == "OPTIONS":
+		s.handleOptions(resWriter, req)
+	default:
+		resWriter.Header().Set("Allow", "GET, POST, PUT, OPTIONS")
+		s.writeError(resWriter, req, 405, ErrorCodeMethodNotAllowed, fmt.Sprintf("Unsupported method: %s.", req.Method))
+	}
+}
+
+// streamChat streams lines of the room as text, or as Server-Sent Events of JSON if accepted
+func (s *PipingServer) streamChat(resWriter http.ResponseWriter, req *http.Request, name string) {
+	flusher, ok := resWriter.(http.Flusher)
+	if !ok {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, "Streaming is not supported.")
+		return
+	}
+	history, lineCh, leave, ok := s.chatRooms.join(name, s.now())
+	if !ok {
+		s.writeError(resWriter, req, 503, ErrorCodeChatLimit, "The number of chat rooms has reached limits.")
+		return
+	}
+	defer leave()
+	isEventStream := accepts(req, "text/event-stream")
+	write := func(line chatLine) error {
+		if isEventStream {
+			data, _ := json.Marshal(line)
+			_, err := fmt.Fprintf(resWriter, "data: %s\n\n", data)
+			return err
+		}
+		_, err := fmt.Fprintln(resWriter, line)
+		return err
+	}
+	if isEventStream {
+		resWriter.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		resWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	resWriter.Header().Set("Cache-Control", "no-store")
+	resWriter.Header().Set("X-Content-Type-Options", "nosniff")
+	resWriter.WriteHeader(200)
+	for _, line := range history {
+		if write(line) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	s.infof(req, "A participant has joined the chat room %s", name)
+	timeoutCh, stopTimer := s.timeoutChannel(s.maxDuration(req))
+	defer stopTimer()
+	for {
+		select {
+		case line := <-lineCh:
+			if write(line) != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		case <-timeoutCh:
+			return
+		}
+	}
+}
+
+// postChat broadcasts each line of the body as it arrives, so that a streaming body works as an interactive chat
+func (s *PipingServer) postChat(resWriter http.ResponseWriter, req *http.Request, name string) {
+	sender := req.URL.Query().Get("name")
+	if len(sender) > 64 {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, "The name should be at most 64 bytes.")
+		return
+	}
+	scanner := bufio.NewScanner(req.Body)
+	scanner.Buffer(make([]byte, 0, 256), maxChatLineBytes)
+	posted := 0
+	participants := 0
+	for scanner.Scan() {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if text == "" {
+			continue
+		}
+		n, ok := s.chatRooms.post(name, chatLine{Time: s.now(), Name: sender, Text: text}, s.ChatHistory)
+		if !ok {
+			s.writeError(resWriter, req, 503, ErrorCodeChatLimit, "The number of chat rooms has reached limits.")
+			return
+		}
+		posted++
+		participants = n
+	}
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		s.writeError(resWriter, req, 413, ErrorCodePayloadTooLarge, fmt.Sprintf("A line exceeds the maximum size of %d bytes.", maxChatLineBytes))
+		return
+	} else if err != nil {
+		return
+	}
+	s.infof(req, "%d line(s) have been posted to the chat room %s", posted, name)
+	resWriter.Header().Set("Content-Type", "text/plain")
+	resWriter.Write([]byte(fmt.Sprintf("[INFO] Posted %d line(s) to %d participant(s) of the room '%s'.\n", posted, participants, name)))
+}
@@ -0,0 +1,506 @@
+// Package client sends and receives data through Piping Server, and opens tunnels paired by the server.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nwtgck/go-piping-server/version"
+)
+
+var userAgent = "piping-server-client/" + version.Version
+
+// Client is a client of Piping Server. The zero value is ready to use.
+type Client struct {
+	// Header is added to every request such as X-Piping-Encrypt-Password
+	Header http.Header
+	// TLSConfig configures HTTPS connections (nil for the default)
+	TLSConfig *tls.Config
+	// Messages receives the response body to the sender such as "[INFO] Spooled on ..." (nil to discard)
+	Messages io.Writer
+
+	once   sync.Once
+	client *http.Client
+}
+
+// StatusError is the error response of the server
+type StatusError struct {
+	StatusCode int
+	// Code is the error code such as "sender_conflict", which is empty if the server does not tell
+	Code    string
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// newStatusError reads the error response, which is JSON or plain text like "[ERROR] message"
+func newStatusError(res *http.Response) *StatusError {
+	b, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	statusErr := &StatusError{StatusCode: res.StatusCode}
+	var body struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") && json.Unmarshal(b, &body) == nil {
+		statusErr.Code = body.Code
+		statusErr.Message = body.Message
+		return statusErr
+	}
+	statusErr.Message = strings.TrimPrefix(strings.TrimSpace(string(b)), "[ERROR] ")
+	return statusErr
+}
+
+func (c *Client) httpClient() *http.Client {
+	c.once.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if c.TLSConfig != nil {
+			transport.TLSClientConfig = c.TLSConfig
+		}
+		c.client = &http.Client{Transport: transport}
+	})
+	return c.client
+}
+
+func (c *Client) newRequest(ctx context.Context, method string, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("User-Agent", userAgent)
+	return req, nil
+}
+
+// Send sends the body to the receivers of the URL, returning after the transfer completes.
+// size is the length of the body, or -1 if unknown. contentType is forwarded to the receivers unless empty.
+func (c *Client) Send(ctx context.Context, url string, body io.Reader, size int64, contentType string) error {
+	req, err := c.newRequest(ctx, "PUT", url, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		// NOTE: http.NoBody is required to send "Content-Length: 0" explicitly
+		req.Body = http.NoBody
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return c.send(req, c.Messages)
+}
+
+// send sends the request of a sender, returning after the transfer completes
+func (c *Client) send(req *http.Request, messages io.Writer) error {
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return newStatusError(res)
+	}
+	if messages == nil {
+		messages = io.Discard
+	}
+	// NOTE: The response ends when the transfer completes
+	_, err = io.Copy(messages, res.Body)
+	return err
+}
+
+// parallelStripeSize is the size of stripes of parallel transfers, which is the same as that of the server
+const parallelStripeSize = 1024 * 1024
+
+// parityReader reads the parity of parallel parts after its header, which is the XOR of each row of stripes padded with zeros
+type parityReader struct {
+	file   io.ReaderAt
+	size   int64
+	parts  int
+	row    int64
+	parity []byte
+	stripe []byte
+	buf    []byte
+}
+
+func (r *parityReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.row >= r.size {
+			return 0, io.EOF
+		}
+		if r.parity == nil {
+			r.parity = make([]byte, parallelStripeSize)
+			r.stripe = make([]byte, parallelStripeSize)
+		}
+		// NOTE: The parity of a row is as long as its first stripe
+		parity := r.parity[:stripeLength(r.size, r.row)]
+		for i := range parity {
+			parity[i] = 0
+		}
+		for i := 0; i < r.parts; i++ {
+			stripe := r.stripe[:stripeLength(r.size, r.row+int64(i)*parallelStripeSize)]
+			if _, err := io.ReadFull(io.NewSectionReader(r.file, r.row+int64(i)*parallelStripeSize, int64(len(stripe))), stripe); err != nil {
+				return 0, err
+			}
+			for j, b := range stripe {
+				parity[j] ^= b
+			}
+		}
+		r.buf = parity
+		r.row += int64(r.parts) * parallelStripeSize
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// stripeLength returns the length of the stripe at the offset of the file
+func stripeLength(size int64, offset int64) int {
+	if offset >= size {
+		return 0
+	}
+	if size-offset < parallelStripeSize {
+		return int(size - offset)
+	}
+	return parallelStripeSize
+}
+
+// SendParallel sends the file in parts to the pipes of "<url>.part<N>" in parallel, and returns after all of them complete.
+// The server reassembles them for the receiver of the URL with ?parallel=<parts>, which fills high-latency paths better than a single stream.
+// With parity, the parity of the parts is also sent to "<url>.parity" for the receiver with ?parity=1, so that the transfer survives one of the streams failing.
+func (c *Client) SendParallel(ctx context.Context, pipeURL string, file io.ReaderAt, size int64, contentType string, parts int, parity bool) error {
+	u, err := url.Parse(pipeURL)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	streams := parts
+	if parity {
+		streams++
+	}
+	errCh := make(chan error, streams)
+	for i := 0; i < streams; i++ {
+		partURL := *u
+		partURL.RawPath = ""
+		var body io.Reader
+		var partSize int64
+		if i < parts {
+			// NOTE: Part i has stripes i, i+parts, i+2*parts, ...
+			var stripes []io.Reader
+			for offset := int64(i) * parallelStripeSize; offset < size; offset += int64(parts) * parallelStripeSize {
+				n := int64(stripeLength(size, offset))
+				stripes = append(stripes, io.NewSectionReader(file, offset, n))
+				partSize += n
+			}
+			partURL.Path = fmt.Sprintf("%s.part%d", u.Path, i)
+			body = io.MultiReader(stripes...)
+		} else {
+			header := make([]byte, 8)
+			binary.BigEndian.PutUint64(header, uint64(size))
+			partSize = int64(len(header))
+			for offset := int64(0); offset < size; offset += int64(parts) * parallelStripeSize {
+				partSize += int64(stripeLength(size, offset))
+			}
+			partURL.Path = u.Path + ".parity"
+			body = io.MultiReader(bytes.NewReader(header), &parityReader{file: file, size: size, parts: parts})
+		}
+		req, err := c.newRequest(ctx, "PUT", partURL.String(), body)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = partSize
+		if partSize == 0 {
+			req.Body = http.NoBody
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		// NOTE: Messages of the other parts are the same as the first
+		messages := io.Discard
+		if i == 0 {
+			messages = c.Messages
+		}
+		go func() {
+			err := c.send(req, messages)
+			if err != nil && !parity {
+				cancel()
+			}
+			errCh <- err
+		}()
+	}
+	var errs []error
+	for i := 0; i < streams; i++ {
+		if err := <-errCh; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// NOTE: The receiver recovers one failed stream by the parity
+	if len(errs) == 0 || (parity && len(errs) == 1) {
+		return nil
+	}
+	return errs[0]
+}
+
+// ResumeSpool spools the file on the URL with ?spool=true and X-Piping-Idempotency-Key of idempotencyKey.
+// If the server has kept a partial spool of an interrupted call with the same key, only blocks of the file differing from it are sent.
+func (c *Client) ResumeSpool(ctx context.Context, pipeURL string, file io.ReaderAt, size int64, contentType string, idempotencyKey string) error {
+	u, err := url.Parse(pipeURL)
+	if err != nil {
+		return err
+	}
+	i := strings.Index(u.Path, "/p/")
+	if i < 0 {
+		return fmt.Errorf("invalid URL: %s (e.g. https://ppng.io/p/mypath)", pipeURL)
+	}
+	blocksURL := *u
+	blocksURL.Path = u.Path[:i] + "/api/spool/blocks"
+	blocksURL.RawPath = ""
+	blocksURL.RawQuery = url.Values{"path": {u.Path[i:]}}.Encode()
+	reused, blockSize, err := c.reusableBlocks(ctx, blocksURL.String(), file, size, idempotencyKey)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	query.Set("spool", "true")
+	u.RawQuery = query.Encode()
+	newRequest := func(reused []int64) (*http.Request, error) {
+		// NOTE: The body consists of the blocks not reused
+		var sections []io.Reader
+		var offset int64
+		for _, block := range reused {
+			if start := block * blockSize; offset < start {
+				sections = append(sections, io.NewSectionReader(file, offset, start-offset))
+			}
+			offset = (block + 1) * blockSize
+		}
+		sections = append(sections, io.NewSectionReader(file, offset, size-offset))
+		req, err := c.newRequest(ctx, "PUT", u.String(), io.MultiReader(sections...))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size - int64(len(reused))*blockSize
+		if req.ContentLength == 0 {
+			req.Body = http.NoBody
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.Header.Set("X-Piping-Idempotency-Key", idempotencyKey)
+		if len(reused) != 0 {
+			req.Header.Set("X-Piping-Spool-Reuse", formatBlockRanges(reused))
+		}
+		return req, nil
+	}
+	req, err := newRequest(reused)
+	if err != nil {
+		return err
+	}
+	err = c.send(req, c.Messages)
+	var statusErr *StatusError
+	if len(reused) != 0 && errors.As(err, &statusErr) && statusErr.Code == "partial_spool_not_found" {
+		// NOTE: The partial spool has expired or a receiver has connected since the blocks were compared
+		if req, err = newRequest(nil); err != nil {
+			return err
+		}
+		return c.send(req, c.Messages)
+	}
+	return err
+}
+
+// formatBlockRanges formats the ascending blocks as ranges (e.g. "0-99,101-101")
+func formatBlockRanges(blocks []int64) string {
+	var ranges []string
+	for i := 0; i < len(blocks); {
+		j := i
+		for j+1 < len(blocks) && blocks[j+1] == blocks[j]+1 {
+			j++
+		}
+		ranges = append(ranges, fmt.Sprintf("%d-%d", blocks[i], blocks[j]))
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
+
+// reusableBlocks returns the blocks of the file equal to those of the partial spool kept by the server
+func (c *Client) reusableBlocks(ctx context.Context, blocksURL string, file io.ReaderAt, size int64, idempotencyKey string) ([]int64, int64, error) {
+	req, err := c.newRequest(ctx, "GET", blocksURL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("X-Piping-Idempotency-Key", idempotencyKey)
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, 0, nil
+	}
+	if res.StatusCode/100 != 2 {
+		return nil, 0, newStatusError(res)
+	}
+	var blocks struct {
+		BlockSize int64    `json:"blockSize"`
+		Blocks    []string `json:"blocks"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&blocks); err != nil {
+		return nil, 0, err
+	}
+	if blocks.BlockSize <= 0 {
+		return nil, 0, nil
+	}
+	var reused []int64
+	h := sha256.New()
+	for i, blockHash := range blocks.Blocks {
+		offset := int64(i) * blocks.BlockSize
+		if offset+blocks.BlockSize > size {
+			break
+		}
+		h.Reset()
+		if _, err := io.Copy(h, io.NewSectionReader(file, offset, blocks.BlockSize)); err != nil {
+			return nil, 0, err
+		}
+		if hex.EncodeToString(h.Sum(nil)) == blockHash {
+			reused = append(reused, int64(i))
+		}
+	}
+	return reused, blocks.BlockSize, nil
+}
+
+// Receive receives from the sender of the URL. The caller should read and close the body of the response.
+func (c *Client) Receive(ctx context.Context, url string) (*http.Response, error) {
+	req, err := c.newRequest(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		return nil, newStatusError(res)
+	}
+	return res, nil
+}
+
+// tunnelConn is a tunnel with data of the peer already buffered by reading the response
+type tunnelConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *tunnelConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite half-closes the tunnel, letting the peer finish sending
+func (c *tunnelConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// Tunnel waits for the peer opening the tunnel of the same name on the server enabling CONNECT tunnels,
+// and returns the connection to the peer
+func (c *Client) Tunnel(ctx context.Context, serverURL string, name string) (net.Conn, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+	address := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		address = net.JoinHostPort(u.Hostname(), port)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		config := &tls.Config{}
+		if c.TLSConfig != nil {
+			config = c.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		// NOTE: HTTP/1.1 is negotiated because CONNECT of HTTP/2 is not paired
+		config.NextProtos = []string{"http/1.1"}
+		conn = tls.Client(conn, config)
+	}
+	// NOTE: The deadline interrupts waiting for the peer when the context is done
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	r, err := c.connect(ctx, conn, name)
+	close(stop)
+	<-stopped
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &tunnelConn{Conn: conn, r: r}, nil
+}
+
+// connect sends CONNECT and reads the response, which the server sends when the peer has come
+func (c *Client) connect(ctx context.Context, conn net.Conn, name string) (*bufio.Reader, error) {
+	req, err := c.newRequest(ctx, "CONNECT", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = &url.URL{Host: name}
+	req.Host = name
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		defer res.Body.Close()
+		return nil, newStatusError(res)
+	}
+	return r, nil
+}
@@ -0,0 +1,160 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	piping_server "github.com/nwtgck/go-piping-server"
+	"gotest.tools/v3/assert"
+)
+
+func newTestServer() *httptest.Server {
+	pipingServer := piping_server.NewServer("", log.New(io.Discard, "", 0))
+	pipingServer.EnableConnect = true
+	return httptest.NewServer(http.HandlerFunc(pipingServer.Handler))
+}
+
+func TestSendAndReceive(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	c := &Client{Header: http.Header{"X-Piping": {"hello"}}}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Send(context.Background(), server.URL+"/p/mypath", strings.NewReader("this is a content"), 17, "text/plain")
+	}()
+	res, err := c.Receive(context.Background(), server.URL+"/p/mypath")
+	assert.NilError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	assert.NilError(t, err)
+	assert.Equal(t, string(body), "this is a content")
+	assert.Equal(t, res.Header.Get("Content-Type"), "text/plain")
+	assert.Equal(t, res.Header.Get("X-Piping"), "hello")
+	assert.NilError(t, <-errCh)
+}
+
+func TestSendError(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	c := &Client{Header: http.Header{"Content-Range": {"bytes 0-0/1"}, "Accept": {"application/json"}}}
+	err := c.Send(context.Background(), server.URL+"/p/mypath", strings.NewReader("a"), 1, "")
+	var statusErr *StatusError
+	assert.Assert(t, errors.As(err, &statusErr))
+	assert.Equal(t, statusErr.StatusCode, 400)
+	assert.Equal(t, statusErr.Code, "range_not_supported")
+	assert.Equal(t, statusErr.Message, "Content-Range is not supported for now in PUT")
+}
+
+func TestTunnel(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	c := &Client{}
+
+	connCh := make(chan error, 1)
+	go func() {
+		conn, err := c.Tunnel(context.Background(), server.URL, "mytunnel:1")
+		if err != nil {
+			connCh <- err
+			return
+		}
+		defer conn.Close()
+		_, err = io.Copy(conn, conn)
+		connCh <- err
+	}()
+	conn, err := c.Tunnel(context.Background(), server.URL, "mytunnel:1")
+	assert.NilError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	assert.NilError(t, err)
+	assert.NilError(t, conn.(*tunnelConn).CloseWrite())
+	echoed, err := io.ReadAll(conn)
+	assert.NilError(t, err)
+	assert.Equal(t, string(echoed), "ping")
+	assert.NilError(t, <-connCh)
+}
+
+func TestTunnelCanceled(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	c := &Client{}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := c.Tunnel(ctx, server.URL, "mytunnel:1")
+	assert.Equal(t, err, context.DeadlineExceeded)
+}
+
+func TestResumeSpool(t *testing.T) {
+	pipingServer := piping_server.NewServer("", log.New(io.Discard, "", 0))
+	assert.NilError(t, pipingServer.EnableSpool(t.TempDir()))
+	server := httptest.NewServer(http.HandlerFunc(pipingServer.Handler))
+	defer server.Close()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 200*1024)
+
+	// The first send is interrupted
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	assert.NilError(t, err)
+	fmt.Fprintf(conn, "PUT /p/mypath?spool=true HTTP/1.1\r\nHost: localhost\r\nX-Piping-Idempotency-Key: mykey\r\nContent-Length: %d\r\n\r\n", len(data))
+	conn.Write(data[:len(data)-1024])
+	conn.Close()
+
+	c := &Client{}
+	for {
+		reused, _, err := c.reusableBlocks(context.Background(), server.URL+"/api/spool/blocks?path=/p/mypath", bytes.NewReader(data), int64(len(data)), "mykey")
+		assert.NilError(t, err)
+		if len(reused) != 0 {
+			// NOTE: The last block may not have been written before the interruption
+			assert.Assert(t, len(reused) >= 2)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NilError(t, c.ResumeSpool(context.Background(), server.URL+"/p/mypath", bytes.NewReader(data), int64(len(data)), "text/plain", "mykey"))
+	res, err := c.Receive(context.Background(), server.URL+"/p/mypath")
+	assert.NilError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(body, data))
+	assert.Equal(t, res.Header.Get("Content-Type"), "text/plain")
+}
+
+func TestFormatBlockRanges(t *testing.T) {
+	assert.Equal(t, formatBlockRanges([]int64{0, 1, 2, 4, 6, 7}), "0-2,4-4,6-7")
+}
+
+func TestSendParallel(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	c := &Client{}
+	data := bytes.Repeat([]byte("0123456789"), parallelStripeSize/2)
+
+	for _, parity := range []bool{false, true} {
+		query := "?parallel=3"
+		if parity {
+			query += "&parity=1"
+		}
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- c.SendParallel(context.Background(), server.URL+"/p/mypath", bytes.NewReader(data), int64(len(data)), "text/plain", 3, parity)
+		}()
+		res, err := c.Receive(context.Background(), server.URL+"/p/mypath"+query)
+		assert.NilError(t, err)
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		assert.NilError(t, err)
+		assert.Assert(t, bytes.Equal(body, data))
+		assert.Equal(t, res.Header.Get("Content-Type"), "text/plain")
+		assert.NilError(t, <-errCh)
+	}
+}
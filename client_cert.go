@@ -0,0 +1,138 @@
+package piping_server
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ClientCertPolicy grants clients authenticated by certificates with the identity paths and quotas
+type ClientCertPolicy struct {
+	// Identity is the common name, a DNS name or a URI (e.g. "spiffe://example.org/ci") of client certificates
+	Identity string
+	// PathPrefixes are prefixes of paths which the clients can send to and receive from (any path if empty)
+	PathPrefixes []string
+	// MaxConcurrent limits concurrent pipe requests of the identity (0 for no limit)
+	MaxConcurrent int
+}
+
+// ParseClientCertPolicy parses comma-separated key=value pairs
+// (e.g. "identity=spiffe://example.org/ci,path-prefix=/p/ci/,max-concurrent=4").
+// Keys are identity, path-prefix (repeatable) and max-concurrent.
+func ParseClientCertPolicy(s string) (ClientCertPolicy, error) {
+	var policy ClientCertPolicy
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return policy, fmt.Errorf("invalid client certificate policy %q: %q is not key=value", s, pair)
+		}
+		var err error
+		switch key {
+		case "identity":
+			policy.Identity = value
+		case "path-prefix":
+			policy.PathPrefixes = append(policy.PathPrefixes, value)
+		case "max-concurrent":
+			policy.MaxConcurrent, err = strconv.Atoi(value)
+		default:
+			return policy, fmt.Errorf("invalid client certificate policy %q: unknown key %q", s, key)
+		}
+		if err != nil {
+			return policy, fmt.Errorf("invalid client certificate policy %q: %s: %w", s, key, err)
+		}
+	}
+	if policy.Identity == "" {
+		return policy, fmt.Errorf("invalid client certificate policy %q: identity is required", s)
+	}
+	return policy, nil
+}
+
+func (p *ClientCertPolicy) allowsPath(path string) bool {
+	if len(p.PathPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range p.PathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// certIdentities returns the common name, DNS names and URIs of the certificate
+func certIdentities(cert *x509.Certificate) []string {
+	identities := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	return identities
+}
+
+// clientCertPolicy returns the policy of the verified client certificate of the request.
+// It returns false if the request has no verified client certificate.
+func (s *PipingServer) clientCertPolicy(req *http.Request) (*ClientCertPolicy, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return nil, false
+	}
+	identities := certIdentities(req.TLS.VerifiedChains[0][0])
+	for i := range s.ClientCertPolicies {
+		policy := &s.ClientCertPolicies[i]
+		for _, identity := range identities {
+			if identity != "" && identity == policy.Identity {
+				return policy, true
+			}
+		}
+	}
+	return nil, true
+}
+
+// authorizeClientCert responds 403 if the client certificate has no policy allowing the path.
+// Any path is allowed to verified client certificates if no policy is configured.
+func (s *PipingServer) authorizeClientCert(resWriter http.ResponseWriter, req *http.Request) bool {
+	if len(s.ClientCertPolicies) == 0 {
+		return true
+	}
+	policy, ok := s.clientCertPolicy(req)
+	if !ok || policy != nil && policy.allowsPath(req.URL.Path) {
+		return true
+	}
+	s.writeError(resWriter, req, 403, ErrorCodeClientCertForbidden, fmt.Sprintf("The client certificate is not allowed on the path '%s'.", req.URL.Path))
+	return false
+}
+
+// clientCertQuotas counts concurrent pipe requests by identity
+type clientCertQuotas struct {
+	mutex  sync.Mutex
+	active map[string]int
+}
+
+func newClientCertQuotas() *clientCertQuotas {
+	return &clientCertQuotas{active: map[string]int{}}
+}
+
+// admitClientCert responds 429 if the identity of the client certificate has reached MaxConcurrent
+func (s *PipingServer) admitClientCert(resWriter http.ResponseWriter, req *http.Request) (func(), bool) {
+	policy, _ := s.clientCertPolicy(req)
+	if policy == nil || policy.MaxConcurrent <= 0 {
+		return func() {}, true
+	}
+	q := s.clientCertQuotas
+	q.mutex.Lock()
+	if q.active[policy.Identity] >= policy.MaxConcurrent {
+		q.mutex.Unlock()
+		s.writeError(resWriter, req, 429, ErrorCodeClientCertQuota, fmt.Sprintf("The client certificate '%s' has reached %d concurrent requests.", policy.Identity, policy.MaxConcurrent))
+		return nil, false
+	}
+	q.active[policy.Identity]++
+	q.mutex.Unlock()
+	return func() {
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		if q.active[policy.Identity]--; q.active[policy.Identity] == 0 {
+			delete(q.active, policy.Identity)
+		}
+	}, true
+}
@@ -0,0 +1,186 @@
+package piping_server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const clipPathPrefix = "/clip/"
+
+// DefaultClipMaxBytes is the default max size of a clip
+const DefaultClipMaxBytes = 64 * 1024
+
+// DefaultClipTTL is the default lifetime of a clip
+const DefaultClipTTL = 10 * time.Minute
+
+// maxClips bounds the memory used by clips with ClipMaxBytes
+const maxClips = 1000
+
+type clip struct {
+	body        []byte
+	contentType string
+	// once deletes the clip when it is got
+	once      bool
+	expiresAt time.Time
+}
+
+type clipStore struct {
+	mutex sync.Mutex
+	clips map[string]*clip
+}
+
+func newClipStore() *clipStore {
+	return &clipStore{clips: map[string]*clip{}}
+}
+
+// put stores the clip unless the store is full
+func (st *clipStore) put(name string, c *clip, now time.Time) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for n, old := range st.clips {
+		if !now.Before(old.expiresAt) {
+			delete(st.clips, n)
+		}
+	}
+	if _, ok := st.clips[name]; !ok && len(st.clips) >= maxClips {
+		return false
+	}
+	st.clips[name] = c
+	return true
+}
+
+// get returns the clip and deletes it if it is one-time and remove is true
+func (st *clipStore) get(name string, remove bool, now time.Time) (*clip, bool) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	c, ok := st.clips[name]
+	if !ok || !now.Before(c.expiresAt) {
+		return nil, false
+	}
+	if c.once && remove {
+		delete(st.clips, name)
+	}
+	return c, true
+}
+
+// bytes returns the total size of the bodies of the clips
+func (st *clipStore) bytes() int64 {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	var n int64
+	for _, c := range st.clips {
+		n += int64(len(c.body))
+	}
+	return n
+}
+
+func (st *clipStore) delete(name string) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	_, ok := st.clips[name]
+	delete(st.clips, name)
+	return ok
+}
+
+func isValidClipName(name string) bool {
+	if name == "" || len(name) > 128 {
+		return false
+	}
+	for _, c := range name {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// handleClip stores a small text in memory by POST or PUT, and returns it by GET until it expires.
+// "once=true" on POST deletes the clip when it is got.
+func (s *PipingServer) handleClip(resWriter http.ResponseWriter, req *http.Request) {
+	if s.ClipMaxBytes <= 0 {
+		http.NotFound(resWriter, req)
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, clipPathPrefix)
+	if !isValidClipName(name) {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, fmt.Sprintf("Invalid clip name '%s'. (e.g. '/clip/mytext')", name))
+		return
+	}
+	if req.Method != "OPTIONS" && !s.checkRateLimit(resWriter, req) {
+		return
+	}
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	switch {
+	case req.Method == "GET" || req.Method == "HEAD":
+		c, ok := s.clips.get(name, req.Method == "GET", s.now())
+		if !ok {
+			s.writeError(resWriter, req, 404, ErrorCodeClipNotFound, fmt.Sprintf("The clip '%s' does not exist or has expired.", name))
+			return
+		}
+		resWriter.Header().Set("Content-Type", c.contentType)
+		resWriter.Header().Set("Content-Length", strconv.Itoa(len(c.body)))
+		resWriter.Header().Set("Cache-Control", "no-store")
+		resWriter.Header().Set("X-Content-Type-Options", "nosniff")
+		resWriter.Header().Set("X-Robots-Tag", "none")
+		s.setSecurityHeaders(resWriter, req, s.PipeSecurityHeaders)
+		if req.Method == "GET" {
+			resWriter.Write(c.body)
+		}
+	case s.isSenderMethod(req.Method):
+		if req.ContentLength > s.ClipMaxBytes {
+			s.writeError(resWriter, req, 413, ErrorCodePayloadTooLarge, fmt.Sprintf("The clip exceeds the maximum size of %d bytes.", s.ClipMaxBytes))
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(req.Body, s.ClipMaxBytes+1))
+		if err != nil {
+			return
+		}
+		if int64(len(body)) > s.ClipMaxBytes {
+			s.writeError(resWriter, req, 413, ErrorCodePayloadTooLarge, fmt.Sprintf("The clip exceeds the maximum size of %d bytes.", s.ClipMaxBytes))
+			return
+		}
+		ttl := s.ClipTTL
+		if ttl <= 0 {
+			ttl = DefaultClipTTL
+		}
+		if q := req.URL.Query().Get("ttl"); q != "" {
+			d, err := time.ParseDuration(q)
+			if err != nil || d <= 0 {
+				s.writeError(resWriter, req, 400, ErrorCodeBadRequest, fmt.Sprintf("Invalid ttl '%s'. (e.g. '5m')", q))
+				return
+			}
+			if d < ttl {
+				ttl = d
+			}
+		}
+		contentType := req.Header.Get("Content-Type")
+		if contentType == "" || contentType == "application/x-www-form-urlencoded" {
+			// NOTE: curl -d sends application/x-www-form-urlencoded
+			contentType = "text/plain; charset=utf-8"
+		}
+		c := &clip{body: body, contentType: contentType, once: req.URL.Query().Get("once") == "true", expiresAt: s.now().Add(ttl)}
+		if !s.clips.put(name, c, s.now()) {
+			s.writeError(resWriter, req, 503, ErrorCodeClipLimit, "The number of clips has reached limits.")
+			return
+		}
+		s.infof(req, "Clip %s of %d bytes has been stored for %s (once: %t)", name, len(body), ttl, c.once)
+		resWriter.Header().Set("Content-Type", "text/plain")
+		resWriter.Write([]byte(fmt.Sprintf("[INFO] Stored the clip '%s' for %s.\n", name, ttl)))
+	case req.Method == "DELETE":
+		if !s.clips.delete(name) {
+			s.writeError(resWriter, req, 404, ErrorCodeClipNotFound, fmt.Sprintf("The clip '%s' does not exist.", name))
+			return
+		}
+		resWriter.WriteHeader(204)
+	case req.Method == "OPTIONS":
+		s.handleOptions(resWriter, req)
+	default:
+		resWriter.Header().Set("Allow", "GET, HEAD, POST, PUT, DELETE, OPTIONS")
+		s.writeError(resWriter, req, 405, ErrorCodeMethodNotAllowed, fmt.Sprintf("Unsupported method: %s.", req.Method))
+	}
+}
@@ -0,0 +1,91 @@
+package piping_server
+
+import (
+	"crypto/rand"
+	"io"
+	"time"
+)
+
+// Clock tells the current time and fires timers. Tests can replace PipingServer.Clock to simulate expiry and timeouts without sleeping.
+type Clock interface {
+	Now() time.Time
+	// After is time.After of the clock
+	After(d time.Duration) <-chan time.Time
+	// NewTimer is time.NewTimer of the clock
+	NewTimer(d time.Duration) Timer
+	// AfterFunc is time.AfterFunc of the clock, whose timer has no channel
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer of Clock
+type Timer interface {
+	// C returns the channel receiving the time when the timer fires
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// systemClock is the Clock of the system time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{timer: time.NewTimer(d)}
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return systemTimer{timer: time.AfterFunc(d, f)}
+}
+
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t systemTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+func (t systemTimer) Reset(d time.Duration) bool {
+	return t.timer.Reset(d)
+}
+
+// clock returns Clock, or the system clock if Clock is nil
+func (s *PipingServer) clock() Clock {
+	if s.Clock == nil {
+		return systemClock{}
+	}
+	return s.Clock
+}
+
+// now returns the time of Clock
+func (s *PipingServer) now() time.Time {
+	return s.clock().Now()
+}
+
+// timeoutChannel returns a channel fired by Clock after the duration (nil for no limit) and a function to stop it
+func (s *PipingServer) timeoutChannel(d time.Duration) (<-chan time.Time, func()) {
+	if d <= 0 {
+		return nil, func() {}
+	}
+	timer := s.clock().NewTimer(d)
+	return timer.C(), func() { timer.Stop() }
+}
+
+// random returns Rand, or crypto/rand.Reader if Rand is nil
+func (s *PipingServer) random() io.Reader {
+	if s.Rand == nil {
+		return rand.Reader
+	}
+	return s.Rand
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager returns the manager obtaining and renewing certificates of the domains from Let's Encrypt,
+// which are cached in the directory (piping-server/acme in the user cache directory if empty)
+func newACMEManager(domains []string, cacheDir string, email string) (*autocert.Manager, error) {
+	if cacheDir == "" {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		cacheDir = filepath.Join(userCacheDir, "piping-server", "acme")
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      email,
+	}, nil
+}
+
+// acmeHTTPHandler answers HTTP-01 challenges on plain HTTP and passes other requests to the handler
+func acmeHTTPHandler(manager *autocert.Manager, handler http.Handler) http.Handler {
+	if manager == nil {
+		return handler
+	}
+	return manager.HTTPHandler(handler)
+}
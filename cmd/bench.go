@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	piping_server "github.com/nwtgck/go-piping-server"
+	"github.com/spf13/cobra"
+)
+
+var benchConcurrencies []int
+var benchChunkSizes []int
+var benchTransferBytes int64
+var benchDuration time.Duration
+
+func init() {
+	benchCmd.Flags().IntSliceVarP(&benchConcurrencies, "concurrency", "", []int{1, 4, 16, 64}, "Numbers of concurrent pipes")
+	benchCmd.Flags().IntSliceVarP(&benchChunkSizes, "chunk-size", "", []int{4 * 1024, 32 * 1024, 256 * 1024}, "Sizes of writes of senders in bytes")
+	benchCmd.Flags().Int64VarP(&benchTransferBytes, "transfer-bytes", "", 4*1024*1024, "Bytes of each transfer")
+	benchCmd.Flags().DurationVarP(&benchDuration, "duration", "", 3*time.Second, "Duration of each run")
+	RootCmd.AddCommand(benchCmd)
+}
+
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Benchmark an in-process server across concurrency levels and chunk sizes",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if benchTransferBytes <= 0 || benchDuration <= 0 {
+			return fmt.Errorf("--transfer-bytes and --duration should be positive")
+		}
+		pipingServer := piping_server.NewServer("", log.New(io.Discard, "", 0))
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		server := &http.Server{Handler: http.HandlerFunc(pipingServer.Handler), ConnContext: pipingServer.ConnContext}
+		go server.Serve(ln)
+		defer server.Close()
+		url := "http://" + ln.Addr().String()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "concurrency\tchunk size\tpipes/s\tMiB/s\talloc/pipe\tpeak heap\t")
+		for _, concurrency := range benchConcurrencies {
+			for _, chunkSize := range benchChunkSizes {
+				if concurrency <= 0 || chunkSize <= 0 {
+					return fmt.Errorf("--concurrency and --chunk-size should be positive")
+				}
+				result, err := runBench(url, concurrency, chunkSize)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(w, "%d\t%d\t%.1f\t%.1f\t%d\t%d\t\n", concurrency, chunkSize, result.pipesPerSecond, result.mibPerSecond, result.allocBytesPerPipe, result.peakHeapBytes)
+			}
+		}
+		return w.Flush()
+	},
+}
+
+type benchResult struct {
+	pipesPerSecond    float64
+	mibPerSecond      float64
+	allocBytesPerPipe uint64
+	peakHeapBytes     uint64
+}
+
+// benchBody writes n bytes in chunks of chunkSize
+type benchBody struct {
+	chunk []byte
+	n     int64
+}
+
+func (b *benchBody) Read(p []byte) (int, error) {
+	if b.n <= 0 {
+		return 0, io.EOF
+	}
+	if len(p) > len(b.chunk) {
+		p = p[:len(b.chunk)]
+	}
+	if int64(len(p)) > b.n {
+		p = p[:b.n]
+	}
+	n := copy(p, b.chunk)
+	b.n -= int64(n)
+	return n, nil
+}
+
+// runBench transfers through pipes by the concurrent senders and receivers for benchDuration
+func runBench(url string, concurrency int, chunkSize int) (benchResult, error) {
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: concurrency * 2}}
+	defer client.CloseIdleConnections()
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var pipes, transferred, peakHeap uint64
+	var firstErr error
+	var firstErrOnce sync.Once
+	stopSampling := make(chan struct{})
+	samplingDone := make(chan struct{})
+	go func() {
+		defer close(samplingDone)
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			if m.HeapInuse > peakHeap {
+				peakHeap = m.HeapInuse
+			}
+			select {
+			case <-ticker.C:
+			case <-stopSampling:
+				return
+			}
+		}
+	}()
+	startedAt := time.Now()
+	deadline := startedAt.Add(benchDuration)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			chunk := make([]byte, chunkSize)
+			for n := 0; time.Now().Before(deadline); n++ {
+				path := fmt.Sprintf("%s/p/bench-%d-%d-%d", url, concurrency, worker, n)
+				if err := benchTransfer(client, path, chunk); err != nil {
+					firstErrOnce.Do(func() { firstErr = err })
+					return
+				}
+				atomic.AddUint64(&pipes, 1)
+				atomic.AddUint64(&transferred, uint64(benchTransferBytes))
+			}
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(startedAt)
+	close(stopSampling)
+	<-samplingDone
+	if firstErr != nil {
+		return benchResult{}, firstErr
+	}
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	result := benchResult{
+		pipesPerSecond: float64(pipes) / elapsed.Seconds(),
+		mibPerSecond:   float64(transferred) / 1024 / 1024 / elapsed.Seconds(),
+		peakHeapBytes:  peakHeap,
+	}
+	if pipes != 0 {
+		result.allocBytesPerPipe = (after.TotalAlloc - before.TotalAlloc) / pipes
+	}
+	return result, nil
+}
+
+func benchTransfer(client *http.Client, path string, chunk []byte) error {
+	senderErrCh := make(chan error, 1)
+	go func() {
+		req, err := http.NewRequest("POST", path, &benchBody{chunk: chunk, n: benchTransferBytes})
+		if err != nil {
+			senderErrCh <- err
+			return
+		}
+		req.ContentLength = benchTransferBytes
+		res, err := client.Do(req)
+		if err != nil {
+			senderErrCh <- err
+			return
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			senderErrCh <- fmt.Errorf("sender got %s", res.Status)
+			return
+		}
+		senderErrCh <- nil
+	}()
+	res, err := client.Get(path)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 || n != benchTransferBytes {
+		return fmt.Errorf("receiver got %s with %d bytes", res.Status, n)
+	}
+	return <-senderErrCh
+}
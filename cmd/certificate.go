@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// certificateReloader holds the certificate replaceable without restart
+type certificateReloader struct {
+	crtPath string
+	keyPath string
+	// NOTE: *tls.Certificate
+	certificate atomic.Value
+}
+
+func newCertificateReloader(crtPath string, keyPath string) (*certificateReloader, error) {
+	r := &certificateReloader{crtPath: crtPath, keyPath: keyPath}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the certificate from the files, keeping the current one on error
+func (r *certificateReloader) reload() error {
+	certificate, err := tls.LoadX509KeyPair(r.crtPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+	r.certificate.Store(&certificate)
+	return nil
+}
+
+func (r *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate.Load().(*tls.Certificate), nil
+}
+
+// fileStamp identifies a version of a file
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFileStamp(path string) fileStamp {
+	// NOTE: os.Stat follows symlinks swapped by Kubernetes secrets and spiffe-helper
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+// watch reloads the certificate when the files change until stopCh is closed.
+// Handshakes after the reload use the new certificate while established connections keep transferring.
+func (r *certificateReloader) watch(logger *log.Logger, interval time.Duration, stopCh <-chan struct{}) {
+	crtStamp, keyStamp := statFileStamp(r.crtPath), statFileStamp(r.keyPath)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+		newCrtStamp, newKeyStamp := statFileStamp(r.crtPath), statFileStamp(r.keyPath)
+		if newCrtStamp == crtStamp && newKeyStamp == keyStamp {
+			continue
+		}
+		crtStamp, keyStamp = newCrtStamp, newKeyStamp
+		// NOTE: A half-written pair fails and is reloaded when the other file is written
+		if err := r.reload(); err != nil {
+			logger.Printf("Failed to reload the certificate: %v", err)
+			continue
+		}
+		logger.Printf("The certificate has been reloaded from %s", r.crtPath)
+	}
+}
@@ -0,0 +1,320 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nwtgck/go-piping-server/client"
+	"github.com/spf13/cobra"
+)
+
+var clientHeaders []string
+var clientInsecure bool
+var clientPassword string
+var clientQuiet bool
+var clientResumeKey string
+var clientParallel int
+var clientParity bool
+var tunnelListen string
+var tunnelForward string
+
+func init() {
+	clientCmd.PersistentFlags().StringArrayVarP(&clientHeaders, "header", "H", nil, "Header of requests (e.g. \"X-Piping: value\") (repeatable)")
+	clientCmd.PersistentFlags().BoolVarP(&clientInsecure, "insecure", "k", false, "Skip verifying the certificate of the server")
+	clientCmd.PersistentFlags().StringVarP(&clientPassword, "password", "", "", "Password of server-side encryption, encrypting on send and decrypting on receive")
+	clientSendCmd.Flags().BoolVarP(&clientQuiet, "quiet", "q", false, "Not print messages of the server")
+	clientSendCmd.Flags().StringVarP(&clientResumeKey, "resume-key", "", "", "Spool the file with the idempotency key, sending only blocks changed from the partial spool of an interrupted send with the same key")
+	clientSendCmd.Flags().IntVarP(&clientParallel, "parallel", "", 0, "Number of parallel streams sending the file, which the receiver should also specify (0 for a single stream)")
+	clientReceiveCmd.Flags().IntVarP(&clientParallel, "parallel", "", 0, "Number of parallel streams of the sender (0 for a single stream)")
+	clientSendCmd.Flags().BoolVarP(&clientParity, "parity", "", false, "Also send the parity of the parallel streams so that the transfer survives one of them failing")
+	clientReceiveCmd.Flags().BoolVarP(&clientParity, "parity", "", false, "Recover one failed parallel stream by the parity of the sender")
+	clientTunnelCmd.Flags().StringVarP(&tunnelListen, "listen", "", "", "Address accepting local connections to relay through tunnels (e.g. 127.0.0.1:2222)")
+	clientTunnelCmd.Flags().StringVarP(&tunnelForward, "forward", "", "", "Address to connect to for each tunnel (e.g. 127.0.0.1:22)")
+	clientCmd.AddCommand(clientSendCmd, clientReceiveCmd, clientTunnelCmd)
+	RootCmd.AddCommand(clientCmd)
+}
+
+var clientCmd = &cobra.Command{
+	Use:   "client",
+	Short: "Send, receive and tunnel through a Piping Server",
+}
+
+var clientSendCmd = &cobra.Command{
+	Use:   "send <url> [file]",
+	Short: "Send a file or stdin to receivers",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := newClient("X-Piping-Encrypt-Password")
+		if err != nil {
+			return err
+		}
+		if !clientQuiet {
+			c.Messages = os.Stderr
+		}
+		ctx, stop := signalContext()
+		defer stop()
+		if len(args) == 1 || args[1] == "-" {
+			if clientResumeKey != "" {
+				return errors.New("--resume-key should be specified with a file")
+			}
+			if clientParallel != 0 {
+				return errors.New("--parallel should be specified with a file")
+			}
+			return c.Send(ctx, args[0], os.Stdin, -1, "")
+		}
+		file, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		contentType := mime.TypeByExtension(filepath.Ext(args[1]))
+		if clientResumeKey != "" && clientParallel != 0 {
+			return errors.New("--resume-key should not be specified with --parallel")
+		}
+		if clientParity && clientParallel == 0 {
+			return errors.New("--parity should be specified with --parallel")
+		}
+		if clientParallel != 0 {
+			return c.SendParallel(ctx, args[0], file, info.Size(), contentType, clientParallel, clientParity)
+		}
+		if clientResumeKey != "" {
+			return c.ResumeSpool(ctx, args[0], file, info.Size(), contentType, clientResumeKey)
+		}
+		return c.Send(ctx, args[0], file, info.Size(), contentType)
+	},
+}
+
+var clientReceiveCmd = &cobra.Command{
+	Use:   "receive <url> [file]",
+	Short: "Receive into a file or stdout",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := newClient("X-Piping-Decrypt-Password")
+		if err != nil {
+			return err
+		}
+		ctx, stop := signalContext()
+		defer stop()
+		receiveURL := args[0]
+		if clientParity && clientParallel == 0 {
+			return errors.New("--parity should be specified with --parallel")
+		}
+		if clientParallel != 0 {
+			u, err := url.Parse(receiveURL)
+			if err != nil {
+				return err
+			}
+			query := u.Query()
+			query.Set("parallel", strconv.Itoa(clientParallel))
+			if clientParity {
+				query.Set("parity", "1")
+			}
+			u.RawQuery = query.Encode()
+			receiveURL = u.String()
+		}
+		res, err := c.Receive(ctx, receiveURL)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if len(args) == 1 || args[1] == "-" {
+			_, err = io.Copy(os.Stdout, res.Body)
+			return err
+		}
+		file, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, res.Body); err != nil {
+			file.Close()
+			os.Remove(args[1])
+			return err
+		}
+		return file.Close()
+	},
+}
+
+var clientTunnelCmd = &cobra.Command{
+	Use:   "tunnel <server-url> <name>",
+	Short: "Relay stdin and stdout, or local connections, with the peer opening the same tunnel (--enable-connect on the server)",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if tunnelListen != "" && tunnelForward != "" {
+			return errors.New("--listen should not be specified with --forward")
+		}
+		c, err := newClient("")
+		if err != nil {
+			return err
+		}
+		ctx, stop := signalContext()
+		defer stop()
+		logger := log.New(os.Stderr, "", log.LstdFlags)
+		switch {
+		case tunnelListen != "":
+			return runTunnelListener(ctx, logger, c, args[0], args[1])
+		case tunnelForward != "":
+			return runTunnelForwarder(ctx, logger, c, args[0], args[1])
+		}
+		conn, err := c.Tunnel(ctx, args[0], args[1])
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		go func() {
+			io.Copy(conn, os.Stdin)
+			closeWrite(conn)
+		}()
+		// NOTE: Returns without waiting for stdin when the peer finishes like netcat
+		_, err = io.Copy(os.Stdout, conn)
+		return err
+	},
+}
+
+// newClient returns the client with --header, --insecure and --password sent by the header
+func newClient(passwordHeader string) (*client.Client, error) {
+	c := &client.Client{Header: http.Header{}}
+	for _, header := range clientHeaders {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid header: %s (should be \"Name: value\")", header)
+		}
+		c.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if clientInsecure {
+		c.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if clientPassword != "" && passwordHeader != "" {
+		c.Header.Set(passwordHeader, clientPassword)
+	}
+	return c, nil
+}
+
+// signalContext returns the context canceled by Ctrl+C
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+// closeWrite half-closes the tunnel to let the peer finish sending, or closes it if not supported
+func closeWrite(tunnel net.Conn) {
+	if conn, ok := tunnel.(interface{ CloseWrite() error }); ok {
+		conn.CloseWrite()
+		return
+	}
+	tunnel.Close()
+}
+
+// relayTunnel relays bytes in both directions until both ends finish
+func relayTunnel(tunnel net.Conn, local net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(tunnel, local)
+		closeWrite(tunnel)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(local, tunnel)
+		closeWrite(local)
+	}()
+	wg.Wait()
+	tunnel.Close()
+	local.Close()
+}
+
+// tunnelRetryInterval is the interval of retrying to open a tunnel after failures other than timeouts of waiting for the peer
+const tunnelRetryInterval = 3 * time.Second
+
+// openTunnel opens the tunnel, retrying while no peer comes within the max duration of the server
+func openTunnel(ctx context.Context, logger *log.Logger, c *client.Client, serverURL string, name string) (net.Conn, error) {
+	for {
+		conn, err := c.Tunnel(ctx, serverURL, name)
+		var statusErr *client.StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusRequestTimeout {
+			continue
+		}
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+		logger.Printf("Failed to open the tunnel %s: %v", name, err)
+		select {
+		case <-time.After(tunnelRetryInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// runTunnelListener opens a tunnel for each local connection
+func runTunnelListener(ctx context.Context, logger *log.Logger, c *client.Client, serverURL string, name string) error {
+	ln, err := net.Listen("tcp", tunnelListen)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	logger.Printf("Relaying connections to %s through the tunnel %s", ln.Addr(), name)
+	for {
+		local, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		// NOTE: Each connection is paired with the one of the forwarder in order
+		tunnel, err := openTunnel(ctx, logger, c, serverURL, name)
+		if err != nil {
+			local.Close()
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go relayTunnel(tunnel, local)
+	}
+}
+
+// runTunnelForwarder waits for tunnels and connects each to the forwarded address
+func runTunnelForwarder(ctx context.Context, logger *log.Logger, c *client.Client, serverURL string, name string) error {
+	logger.Printf("Forwarding the tunnel %s to %s", name, tunnelForward)
+	for {
+		tunnel, err := openTunnel(ctx, logger, c, serverURL, name)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			local, err := net.Dial("tcp", tunnelForward)
+			if err != nil {
+				logger.Printf("Failed to connect to %s: %v", tunnelForward, err)
+				tunnel.Close()
+				return
+			}
+			relayTunnel(tunnel, local)
+		}()
+	}
+}
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfigFile reads a YAML, TOML or JSON file whose keys are flag names
+// (e.g. "http-port: 8080") and sets flags not specified in the command line nor skipped.
+// Precedence: command-line flags > environment variables > config file > defaults
+func loadConfigFile(flags *pflag.FlagSet, path string, skippedNames map[string]bool) error {
+	config, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	// Apply in a stable order for deterministic errors
+	var keys []string
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		flag := flags.Lookup(key)
+		if flag == nil || key == "config" {
+			return fmt.Errorf("unknown option %q in %s (options are the long flag names such as http-port)", key, path)
+		}
+		// Command-line flags and environment variables take precedence
+		if flag.Changed || skippedNames[key] {
+			continue
+		}
+		values, err := configValueToFlagValues(config[key])
+		if err != nil {
+			return fmt.Errorf("invalid value of %s in %s: %w", key, path, err)
+		}
+		for _, value := range values {
+			if err := flag.Value.Set(value); err != nil {
+				return fmt.Errorf("invalid value of %s in %s: %w", key, path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// readConfigFile parses a YAML, TOML or JSON file by its extension
+func readConfigFile(path string) (map[string]interface{}, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := map[string]interface{}{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &config)
+	case ".toml":
+		err = toml.Unmarshal(content, &config)
+	case ".json":
+		err = json.Unmarshal(content, &config)
+	default:
+		return nil, fmt.Errorf("unsupported config file extension %s (.yaml, .yml, .toml or .json)", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// configValueToFlagValues converts a value in a config file to arguments of a flag
+func configValueToFlagValues(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		var values []string
+		for _, e := range v {
+			switch e.(type) {
+			case []interface{}, map[string]interface{}:
+				return nil, fmt.Errorf("nested value is not supported")
+			}
+			values = append(values, fmt.Sprint(e))
+		}
+		return values, nil
+	case map[string]interface{}:
+		var keys []string
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var values []string
+		for _, key := range keys {
+			values = append(values, fmt.Sprintf("%s=%v", key, v[key]))
+		}
+		return values, nil
+	case nil:
+		return nil, fmt.Errorf("empty value")
+	}
+	return []string{fmt.Sprint(value)}, nil
+}
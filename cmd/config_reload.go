@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	piping_server "github.com/nwtgck/go-piping-server"
+	"github.com/spf13/pflag"
+)
+
+// configReloader applies the config file and the files of blocked contents to the running server again
+type configReloader struct {
+	// path is the config file, or "" without it
+	path string
+	// flags are the flags of the command, whose values given by the command line keep taking precedence
+	flags *pflag.FlagSet
+	// envNames are the flags set by environment variables, which keep taking precedence
+	envNames map[string]bool
+	server   *piping_server.PipingServer
+	// trafficClassWeights is nil without the bandwidth scheduler
+	trafficClassWeights map[string]int
+}
+
+// reload replaces --admin-token, --rate-limit-requests, --rate-limit-window, --path-rule,
+// --blocked-hashes-file and --blocklist-file, keeping the current ones on error.
+// Other options in the config file need a restart.
+func (r *configReloader) reload() error {
+	var config map[string]interface{}
+	if r.path != "" {
+		var err error
+		if config, err = readConfigFile(r.path); err != nil {
+			return err
+		}
+	}
+	reloaded := pflag.NewFlagSet("reload", pflag.ContinueOnError)
+	var reloadedAdminToken string
+	var reloadedRateLimitRequests int
+	var reloadedRateLimitWindow time.Duration
+	var reloadedPathRules []string
+	reloaded.StringVar(&reloadedAdminToken, "admin-token", "", "")
+	reloaded.IntVar(&reloadedRateLimitRequests, "rate-limit-requests", 0, "")
+	reloaded.DurationVar(&reloadedRateLimitWindow, "rate-limit-window", piping_server.DefaultRateLimitWindow, "")
+	reloaded.StringArrayVar(&reloadedPathRules, "path-rule", nil, "")
+	for key, value := range config {
+		if r.flags.Lookup(key) == nil || key == "config" {
+			return fmt.Errorf("unknown option %q in %s (options are the long flag names such as http-port)", key, r.path)
+		}
+		flag := reloaded.Lookup(key)
+		if flag == nil || r.isFixed(key) {
+			continue
+		}
+		values, err := configValueToFlagValues(value)
+		if err != nil {
+			return fmt.Errorf("invalid value of %s in %s: %w", key, r.path, err)
+		}
+		for _, v := range values {
+			if err := flag.Value.Set(v); err != nil {
+				return fmt.Errorf("invalid value of %s in %s: %w", key, r.path, err)
+			}
+		}
+	}
+	// NOTE: The values given by the command line and environment variables were set at startup
+	if r.isFixed("admin-token") {
+		reloadedAdminToken = adminToken
+	}
+	if r.isFixed("rate-limit-requests") {
+		reloadedRateLimitRequests = rateLimitRequests
+	}
+	if r.isFixed("rate-limit-window") {
+		reloadedRateLimitWindow = rateLimitWindow
+	}
+	if r.isFixed("path-rule") {
+		reloadedPathRules = pathRules
+	}
+	rules, err := parsePathRules(reloadedPathRules, r.trafficClassWeights)
+	if err != nil {
+		return err
+	}
+	var hashes map[string]bool
+	if blockedHashesFile != "" {
+		if hashes, err = piping_server.LoadBlockedHashes(blockedHashesFile); err != nil {
+			return err
+		}
+	}
+	if err := r.server.ReloadBlocklist(); err != nil {
+		return err
+	}
+	r.server.Reload(piping_server.ReloadableConfig{
+		AdminToken:        reloadedAdminToken,
+		RateLimitRequests: reloadedRateLimitRequests,
+		RateLimitWindow:   reloadedRateLimitWindow,
+		PathRules:         rules,
+		BlockedSHA256:     hashes,
+	})
+	return nil
+}
+
+// isFixed returns true if the flag is given by the command line or an environment variable
+func (r *configReloader) isFixed(name string) bool {
+	return r.flags.Lookup(name).Changed || r.envNames[name]
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	piping_server "github.com/nwtgck/go-piping-server"
+	"github.com/spf13/pflag"
+	"gotest.tools/v3/assert"
+)
+
+func TestConfigReloader(t *testing.T) {
+	savedAdminToken, savedRateLimitRequests, savedRateLimitWindow, savedPathRules, savedBlockedHashesFile := adminToken, rateLimitRequests, rateLimitWindow, pathRules, blockedHashesFile
+	t.Cleanup(func() {
+		adminToken, rateLimitRequests, rateLimitWindow, pathRules, blockedHashesFile = savedAdminToken, savedRateLimitRequests, savedRateLimitWindow, savedPathRules, savedBlockedHashesFile
+	})
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	var httpPort uint16
+	flags.StringVar(&adminToken, "admin-token", "", "")
+	flags.IntVar(&rateLimitRequests, "rate-limit-requests", 0, "")
+	flags.DurationVar(&rateLimitWindow, "rate-limit-window", piping_server.DefaultRateLimitWindow, "")
+	flags.StringArrayVar(&pathRules, "path-rule", nil, "")
+	flags.Uint16Var(&httpPort, "http-port", 8080, "")
+	assert.NilError(t, flags.Parse([]string{"--admin-token=cli"}))
+	// Set by PIPING_RATE_LIMIT_WINDOW
+	rateLimitWindow = 2 * time.Minute
+	dir := t.TempDir()
+	blockedHashesFile = filepath.Join(dir, "blocked-hashes.txt")
+	assert.NilError(t, os.WriteFile(blockedHashesFile, nil, 0600))
+	configPath := filepath.Join(dir, "config.yaml")
+	server := piping_server.NewServer("", log.New(io.Discard, "", 0))
+	reloader := &configReloader{path: configPath, flags: flags, envNames: map[string]bool{"rate-limit-window": true}, server: server}
+
+	hash := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	assert.NilError(t, os.WriteFile(blockedHashesFile, []byte(hash+"\n"), 0600))
+	assert.NilError(t, os.WriteFile(configPath, []byte(`
+http-port: 8888
+admin-token: file
+rate-limit-requests: 10
+rate-limit-window: 5m
+path-rule:
+  - pattern=/p/private/*,auth-token=secret
+`), 0600))
+	assert.NilError(t, reloader.reload())
+	// The command line and environment variables take precedence
+	assert.Equal(t, server.AdminToken, "cli")
+	assert.Equal(t, server.RateLimitWindow, 2*time.Minute)
+	assert.Equal(t, server.RateLimitRequests, 10)
+	assert.Equal(t, len(server.PathRules), 1)
+	assert.DeepEqual(t, server.PathRules[0].AuthTokens, []string{"secret"})
+	assert.DeepEqual(t, server.BlockedSHA256, map[string]bool{hash: true})
+	// Options not reloaded need a restart
+	assert.Equal(t, httpPort, uint16(8080))
+
+	// Removed options are reset to the defaults
+	assert.NilError(t, os.WriteFile(configPath, []byte("http-port: 8888\n"), 0600))
+	assert.NilError(t, reloader.reload())
+	assert.Equal(t, server.RateLimitRequests, 0)
+	assert.Equal(t, len(server.PathRules), 0)
+
+	// The current configuration is kept on error
+	assert.NilError(t, os.WriteFile(configPath, []byte("rate-limit-requests: 10\npath-rule: invalid\n"), 0600))
+	assert.Assert(t, reloader.reload() != nil)
+	assert.Equal(t, server.RateLimitRequests, 0)
+	assert.NilError(t, os.WriteFile(configPath, []byte("no-such-option: 1\n"), 0600))
+	assert.ErrorContains(t, reloader.reload(), "unknown option")
+}
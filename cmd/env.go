@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+const envPrefix = "PIPING_"
+
+// flagEnvName returns the environment variable name of the flag (e.g. http-port -> PIPING_HTTP_PORT)
+func flagEnvName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadEnv sets flags not specified in the command line from PIPING_* environment variables
+// and returns the names of the flags set
+func loadEnv(flags *pflag.FlagSet) (map[string]bool, error) {
+	setNames := map[string]bool{}
+	var err error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if err != nil || flag.Changed || flag.Name == "help" {
+			return
+		}
+		value, ok := os.LookupEnv(flagEnvName(flag.Name))
+		if !ok {
+			return
+		}
+		values := []string{value}
+		// A string array flag does not split values by itself.
+		// NOTE: Values are split by newlines since values such as --path-rule contain commas
+		if flag.Value.Type() == "stringArray" {
+			values = strings.Split(strings.TrimRight(value, "\n"), "\n")
+		}
+		for _, v := range values {
+			if setErr := flag.Value.Set(v); setErr != nil {
+				err = fmt.Errorf("invalid value of %s: %w", flagEnvName(flag.Name), setErr)
+				return
+			}
+		}
+		setNames[flag.Name] = true
+	})
+	return setNames, err
+}
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+	"gotest.tools/v3/assert"
+)
+
+func TestLoadEnv(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	var pathRules, listenAddresses, archivePaths []string
+	var httpPort uint16
+	flags.StringArrayVar(&pathRules, "path-rule", nil, "")
+	flags.StringArrayVar(&listenAddresses, "listen", nil, "")
+	flags.StringSliceVar(&archivePaths, "archive-paths", nil, "")
+	flags.Uint16Var(&httpPort, "http-port", 8080, "")
+	assert.NilError(t, flags.Parse([]string{"--http-port=80"}))
+	t.Setenv("PIPING_PATH_RULE", "pattern=/p/x/*,max-bytes=10")
+	t.Setenv("PIPING_LISTEN", "tcp://:8080\nunix:///run/piping-server.sock\n")
+	t.Setenv("PIPING_ARCHIVE_PATHS", "/p/a/*,/p/b/*")
+	t.Setenv("PIPING_HTTP_PORT", "8888")
+
+	setNames, err := loadEnv(flags)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, pathRules, []string{"pattern=/p/x/*,max-bytes=10"})
+	assert.DeepEqual(t, listenAddresses, []string{"tcp://:8080", "unix:///run/piping-server.sock"})
+	assert.DeepEqual(t, archivePaths, []string{"/p/a/*", "/p/b/*"})
+	// The command line takes precedence
+	assert.Equal(t, httpPort, uint16(80))
+	assert.DeepEqual(t, setNames, map[string]bool{"path-rule": true, "listen": true, "archive-paths": true})
+}
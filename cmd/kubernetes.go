@@ -0,0 +1,311 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	piping_server "github.com/nwtgck/go-piping-server"
+)
+
+// serviceAccountDir has the credentials mounted to pods
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// podInfo is the metadata of the pod exposed by the downward API
+// ref: https://kubernetes.io/docs/concepts/workloads/pods/downward-api/
+type podInfo struct {
+	name      string
+	namespace string
+	ip        string
+	node      string
+}
+
+// readPodInfo reads POD_NAME, POD_NAMESPACE, POD_IP and NODE_NAME set from the downward API,
+// falling back to the hostname and the namespace of the service account
+func readPodInfo() (*podInfo, error) {
+	pod := &podInfo{
+		name:      os.Getenv("POD_NAME"),
+		namespace: os.Getenv("POD_NAMESPACE"),
+		ip:        os.Getenv("POD_IP"),
+		node:      os.Getenv("NODE_NAME"),
+	}
+	if pod.name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		pod.name = hostname
+	}
+	if pod.namespace == "" {
+		b, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("failed to know the namespace (set POD_NAMESPACE by the downward API): %w", err)
+		}
+		pod.namespace = strings.TrimSpace(string(b))
+	}
+	return pod, nil
+}
+
+// statsdTags returns DogStatsD tags labeling metrics with the pod
+func (p *podInfo) statsdTags() []string {
+	tags := []string{"pod:" + p.name, "namespace:" + p.namespace}
+	if p.node != "" {
+		tags = append(tags, "node:"+p.node)
+	}
+	return tags
+}
+
+// kubernetesClient calls the API server with the service account of the pod
+type kubernetesClient struct {
+	baseURL   string
+	tokenPath string
+	client    *http.Client
+}
+
+func newInClusterKubernetesClient() (*kubernetesClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster (KUBERNETES_SERVICE_HOST is not set)")
+	}
+	caPEM, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no certificates in the CA of the service account")
+	}
+	transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: rootCAs}}
+	return &kubernetesClient{
+		baseURL:   "https://" + net.JoinHostPort(host, port),
+		tokenPath: serviceAccountDir + "/token",
+		client:    &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}, nil
+}
+
+// do sends the object as JSON and decodes the response into out if successful, returning the status code
+func (c *kubernetesClient) do(ctx context.Context, method string, path string, in interface{}, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return 0, err
+	}
+	// NOTE: The token is read every time because bound service account tokens are rotated
+	token, err := os.ReadFile(c.tokenPath)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return res.StatusCode, fmt.Errorf("%s %s: %s: %s", method, path, res.Status, strings.TrimSpace(string(b)))
+	}
+	if out == nil {
+		return res.StatusCode, nil
+	}
+	return res.StatusCode, json.NewDecoder(res.Body).Decode(out)
+}
+
+// lease is a Lease of coordination.k8s.io/v1
+// ref: https://kubernetes.io/docs/concepts/architecture/leases/
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+// microTimeLayout is the layout of MicroTime of Kubernetes
+const microTimeLayout = "2006-01-02T15:04:05.000000Z07:00"
+
+const (
+	leaseDuration    = 15 * time.Second
+	leaseRetryPeriod = 5 * time.Second
+)
+
+// leaseElector elects one leader among replicas by holding the lease
+type leaseElector struct {
+	client    *kubernetesClient
+	namespace string
+	name      string
+	identity  string
+	// observedRenewTime and observedAt tell when the holder has renewed the lease last by the local clock,
+	// since clocks of replicas may be skewed
+	observedRenewTime string
+	observedAt        time.Time
+}
+
+func (e *leaseElector) path() string {
+	return fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", e.namespace, e.name)
+}
+
+// tryAcquireOrRenew returns true if this replica holds the lease
+func (e *leaseElector) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+	now := time.Now()
+	nowString := now.UTC().Format(microTimeLayout)
+	var l lease
+	status, err := e.client.do(ctx, "GET", e.path(), nil, &l)
+	if status == http.StatusNotFound {
+		l = lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   leaseMetadata{Name: e.name, Namespace: e.namespace},
+			Spec:       leaseSpec{HolderIdentity: e.identity, LeaseDurationSeconds: int(leaseDuration / time.Second), AcquireTime: nowString, RenewTime: nowString},
+		}
+		status, err = e.client.do(ctx, "POST", fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", e.namespace), &l, nil)
+		if status == http.StatusConflict {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	if l.Spec.RenewTime != e.observedRenewTime || l.Spec.HolderIdentity == e.identity {
+		e.observedRenewTime = l.Spec.RenewTime
+		e.observedAt = now
+	}
+	duration := time.Duration(l.Spec.LeaseDurationSeconds) * time.Second
+	if l.Spec.HolderIdentity != "" && l.Spec.HolderIdentity != e.identity && now.Before(e.observedAt.Add(duration)) {
+		return false, nil
+	}
+	if l.Spec.HolderIdentity != e.identity {
+		l.Spec.AcquireTime = nowString
+		l.Spec.LeaseTransitions++
+	}
+	l.Spec.HolderIdentity = e.identity
+	l.Spec.LeaseDurationSeconds = int(leaseDuration / time.Second)
+	l.Spec.RenewTime = nowString
+	// NOTE: resourceVersion makes the update fail with 409 if another replica has updated the lease first
+	status, err = e.client.do(ctx, "PUT", e.path(), &l, nil)
+	if status == http.StatusConflict {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// release lets another replica take the lease immediately
+func (e *leaseElector) release(ctx context.Context) error {
+	var l lease
+	if _, err := e.client.do(ctx, "GET", e.path(), nil, &l); err != nil {
+		return err
+	}
+	if l.Spec.HolderIdentity != e.identity {
+		return nil
+	}
+	l.Spec.HolderIdentity = ""
+	l.Spec.LeaseDurationSeconds = 1
+	l.Spec.RenewTime = time.Now().UTC().Format(microTimeLayout)
+	_, err := e.client.do(ctx, "PUT", e.path(), &l, nil)
+	return err
+}
+
+// runLeaderElection runs the task while this replica holds the lease until stopCh is closed.
+// The task should return when its stop channel is closed.
+func runLeaderElection(logger *log.Logger, e *leaseElector, task func(stopCh <-chan struct{}), stopCh <-chan struct{}) {
+	var taskStopCh chan struct{}
+	var renewedAt time.Time
+	stopTask := func() {
+		if taskStopCh != nil {
+			close(taskStopCh)
+			taskStopCh = nil
+			logger.Printf("Lost the leadership of lease %s/%s", e.namespace, e.name)
+		}
+	}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), leaseRetryPeriod)
+		isLeader, err := e.tryAcquireOrRenew(ctx)
+		cancel()
+		if err != nil {
+			logger.Printf("Failed to renew lease %s/%s: %v", e.namespace, e.name, err)
+		}
+		switch {
+		case isLeader:
+			renewedAt = time.Now()
+			if taskStopCh == nil {
+				logger.Printf("Became the leader of lease %s/%s as %s", e.namespace, e.name, e.identity)
+				taskStopCh = make(chan struct{})
+				go task(taskStopCh)
+			}
+		case err == nil || time.Since(renewedAt) >= leaseDuration-leaseRetryPeriod:
+			// NOTE: Keeps the task on transient errors until another replica may take the lease
+			stopTask()
+		}
+		select {
+		case <-time.After(leaseRetryPeriod):
+		case <-stopCh:
+			if taskStopCh != nil {
+				stopTask()
+				ctx, cancel := context.WithTimeout(context.Background(), leaseRetryPeriod)
+				if err := e.release(ctx); err != nil {
+					logger.Printf("Failed to release lease %s/%s: %v", e.namespace, e.name, err)
+				}
+				cancel()
+			}
+			return
+		}
+	}
+}
+
+// spoolSweepInterval is the interval of the leader sweeping the shared spool directory
+const spoolSweepInterval = time.Minute
+
+// runSpoolJanitor sweeps the spool directory shared by replicas until stopCh is closed
+func runSpoolJanitor(logger *log.Logger, pipingServer *piping_server.PipingServer, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(spoolSweepInterval)
+	defer ticker.Stop()
+	for {
+		removed, err := pipingServer.SweepSpool()
+		if err != nil {
+			logger.Printf("Failed to sweep the spool: %v", err)
+		} else if removed > 0 {
+			logger.Printf("Swept %d expired files of the spool", removed)
+		}
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func newTestKubernetesClient(t *testing.T, baseURL string) *kubernetesClient {
+	t.Helper()
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	assert.NilError(t, os.WriteFile(tokenPath, []byte("token1\n"), 0600))
+	return &kubernetesClient{baseURL: baseURL, tokenPath: tokenPath, client: http.DefaultClient}
+}
+
+// decodeLease decodes the body of the request, checking the times are MicroTime
+func decodeLease(t *testing.T, req fakeAPIRequest) lease {
+	t.Helper()
+	var l lease
+	assert.NilError(t, json.Unmarshal([]byte(req.body), &l))
+	for _, s := range []string{l.Spec.AcquireTime, l.Spec.RenewTime} {
+		_, err := time.Parse(microTimeLayout, s)
+		assert.NilError(t, err)
+	}
+	return l
+}
+
+const leasesPath = "/apis/coordination.k8s.io/v1/namespaces/default/leases"
+
+func TestKubernetesClient(t *testing.T) {
+	baseURL, requestCh := serveFakeAPI(t, []fakeAPIResponse{
+		{200, `{"kind":"Lease","apiVersion":"coordination.k8s.io/v1","metadata":{"name":"piping-server","namespace":"default","resourceVersion":"1234"},"spec":{"holderIdentity":"piping-server-0","leaseDurationSeconds":15,"leaseTransitions":2}}`},
+		{403, `{"kind":"Status","apiVersion":"v1","metadata":{},"status":"Failure","message":"leases.coordination.k8s.io \"piping-server\" is forbidden","reason":"Forbidden","code":403}`},
+	})
+	c := newTestKubernetesClient(t, baseURL)
+	ctx := context.Background()
+
+	var l lease
+	status, err := c.do(ctx, "GET", leasesPath+"/piping-server", nil, &l)
+	assert.NilError(t, err)
+	assert.Equal(t, status, 200)
+	assert.DeepEqual(t, l, lease{
+		APIVersion: "coordination.k8s.io/v1",
+		Kind:       "Lease",
+		Metadata:   leaseMetadata{Name: "piping-server", Namespace: "default", ResourceVersion: "1234"},
+		Spec:       leaseSpec{HolderIdentity: "piping-server-0", LeaseDurationSeconds: 15, LeaseTransitions: 2},
+	})
+	req := <-requestCh
+	assert.Equal(t, req.header.Get("Authorization"), "Bearer token1")
+	assert.Equal(t, req.header.Get("Accept"), "application/json")
+
+	// The rotated token is used
+	assert.NilError(t, os.WriteFile(c.tokenPath, []byte("token2\n"), 0600))
+	status, err = c.do(ctx, "PUT", leasesPath+"/piping-server", &l, nil)
+	assert.Equal(t, status, 403)
+	assert.ErrorContains(t, err, `PUT `+leasesPath+`/piping-server: 403 Forbidden: {"kind":"Status"`)
+	req = <-requestCh
+	assert.Equal(t, req.header.Get("Authorization"), "Bearer token2")
+	assert.Equal(t, req.header.Get("Content-Type"), "application/json")
+}
+
+func TestLeaseElector(t *testing.T) {
+	baseURL, requestCh := serveFakeAPI(t, []fakeAPIResponse{
+		// Creates the lease
+		{404, `{"kind":"Status","apiVersion":"v1","metadata":{},"status":"Failure","message":"leases.coordination.k8s.io \"piping-server\" not found","reason":"NotFound","code":404}`},
+		{201, `{}`},
+		// Renews the lease
+		{200, `{"kind":"Lease","apiVersion":"coordination.k8s.io/v1","metadata":{"name":"piping-server","namespace":"default","resourceVersion":"1234"},"spec":{"holderIdentity":"piping-server-1","leaseDurationSeconds":15,"acquireTime":"2023-01-01T00:00:00.000000Z","renewTime":"2023-01-01T00:00:10.000000Z","leaseTransitions":0}}`},
+		{200, `{}`},
+		// Another replica holds the lease
+		{200, `{"kind":"Lease","apiVersion":"coordination.k8s.io/v1","metadata":{"name":"piping-server","namespace":"default","resourceVersion":"1240"},"spec":{"holderIdentity":"piping-server-0","leaseDurationSeconds":15,"acquireTime":"2023-01-01T00:01:00.000000Z","renewTime":"2023-01-01T00:01:00.000000Z","leaseTransitions":1}}`},
+		// The other replica has not renewed the lease for the duration
+		{200, `{"kind":"Lease","apiVersion":"coordination.k8s.io/v1","metadata":{"name":"piping-server","namespace":"default","resourceVersion":"1240"},"spec":{"holderIdentity":"piping-server-0","leaseDurationSeconds":15,"acquireTime":"2023-01-01T00:01:00.000000Z","renewTime":"2023-01-01T00:01:00.000000Z","leaseTransitions":1}}`},
+		// Another replica has updated the lease first
+		{409, `{"kind":"Status","apiVersion":"v1","metadata":{},"status":"Failure","message":"Operation cannot be fulfilled on leases.coordination.k8s.io \"piping-server\": the object has been modified; please apply your changes to the latest version and try again","reason":"Conflict","code":409}`},
+		// Releases the lease
+		{200, `{"kind":"Lease","apiVersion":"coordination.k8s.io/v1","metadata":{"name":"piping-server","namespace":"default","resourceVersion":"1250"},"spec":{"holderIdentity":"piping-server-1","leaseDurationSeconds":15,"acquireTime":"2023-01-01T00:02:00.000000Z","renewTime":"2023-01-01T00:02:00.000000Z","leaseTransitions":2}}`},
+		{200, `{}`},
+	})
+	e := &leaseElector{client: newTestKubernetesClient(t, baseURL), namespace: "default", name: "piping-server", identity: "piping-server-1"}
+	ctx := context.Background()
+
+	isLeader, err := e.tryAcquireOrRenew(ctx)
+	assert.NilError(t, err)
+	assert.Assert(t, isLeader)
+	assertFakeAPIRequest(t, <-requestCh, "GET", leasesPath+"/piping-server", "")
+	req := <-requestCh
+	assert.Equal(t, req.method, "POST")
+	assert.Equal(t, req.path, leasesPath)
+	created := decodeLease(t, req)
+	assert.DeepEqual(t, created.Metadata, leaseMetadata{Name: "piping-server", Namespace: "default"})
+	assert.Equal(t, created.Spec.HolderIdentity, "piping-server-1")
+	assert.Equal(t, created.Spec.LeaseDurationSeconds, 15)
+	assert.Equal(t, created.Spec.AcquireTime, created.Spec.RenewTime)
+
+	isLeader, err = e.tryAcquireOrRenew(ctx)
+	assert.NilError(t, err)
+	assert.Assert(t, isLeader)
+	<-requestCh
+	req = <-requestCh
+	assert.Equal(t, req.method, "PUT")
+	assert.Equal(t, req.path, leasesPath+"/piping-server")
+	renewed := decodeLease(t, req)
+	// The resource version makes the update conditional
+	assert.Equal(t, renewed.Metadata.ResourceVersion, "1234")
+	assert.Equal(t, renewed.Spec.HolderIdentity, "piping-server-1")
+	assert.Equal(t, renewed.Spec.AcquireTime, "2023-01-01T00:00:00.000000Z")
+	assert.Assert(t, renewed.Spec.RenewTime != "2023-01-01T00:00:10.000000Z")
+	assert.Equal(t, renewed.Spec.LeaseTransitions, 0)
+
+	// The lease of the other replica is valid for the duration by the local clock, even though its renewTime is old
+	isLeader, err = e.tryAcquireOrRenew(ctx)
+	assert.NilError(t, err)
+	assert.Assert(t, !isLeader)
+	<-requestCh
+	e.observedAt = e.observedAt.Add(-leaseDuration)
+	isLeader, err = e.tryAcquireOrRenew(ctx)
+	assert.NilError(t, err)
+	assert.Assert(t, !isLeader)
+	<-requestCh
+	req = <-requestCh
+	taken := decodeLease(t, req)
+	assert.Equal(t, taken.Metadata.ResourceVersion, "1240")
+	assert.Equal(t, taken.Spec.HolderIdentity, "piping-server-1")
+	assert.Equal(t, taken.Spec.AcquireTime, taken.Spec.RenewTime)
+	assert.Equal(t, taken.Spec.LeaseTransitions, 2)
+
+	assert.NilError(t, e.release(ctx))
+	<-requestCh
+	req = <-requestCh
+	assert.Equal(t, req.method, "PUT")
+	released := decodeLease(t, req)
+	assert.Equal(t, released.Metadata.ResourceVersion, "1250")
+	assert.Equal(t, released.Spec.HolderIdentity, "")
+	assert.Equal(t, released.Spec.LeaseDurationSeconds, 1)
+}
+
+func TestReadPodInfo(t *testing.T) {
+	t.Setenv("POD_NAME", "piping-server-1")
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("POD_IP", "10.1.2.3")
+	t.Setenv("NODE_NAME", "node-a")
+	pod, err := readPodInfo()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, pod.statsdTags(), []string{"pod:piping-server-1", "namespace:default", "node:node-a"})
+	assert.Equal(t, pod.ip, "10.1.2.3")
+}
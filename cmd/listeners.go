@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listener is a listener to serve Piping Server on
+type listener struct {
+	net.Listener
+	name string
+	tls  bool
+	// mtls requires client certificates verified by --mtls-ca-path
+	mtls bool
+}
+
+// systemdListenFdsStart is the first file descriptor passed by systemd socket activation
+const systemdListenFdsStart = 3
+
+// systemdListeners returns the sockets passed by systemd socket activation
+// ref: https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+func systemdListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	var listeners []net.Listener
+	for i := 0; i < nfds; i++ {
+		name := fmt.Sprintf("systemd-fd-%d", systemdListenFdsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(systemdListenFdsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// listen listens on the address such as "tcp://:8080", "tls://:8443", "unix:///run/piping-server.sock",
+// "systemd" or "systemd+tls"
+func listen(address string) ([]listener, error) {
+	scheme, addr := address, ""
+	if i := strings.Index(address, "://"); i != -1 {
+		scheme, addr = address[:i], address[i+len("://"):]
+	}
+	switch scheme {
+	case "tcp", "tls":
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []listener{{Listener: ln, name: address, tls: scheme == "tls"}}, nil
+	case "unix", "unix+tls":
+		// Remove the stale socket
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		ln, err := net.Listen("unix", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []listener{{Listener: ln, name: address, tls: scheme == "unix+tls"}}, nil
+	case "systemd", "systemd+tls":
+		lns, err := systemdListeners()
+		if err != nil {
+			return nil, err
+		}
+		var listeners []listener
+		for _, ln := range lns {
+			listeners = append(listeners, listener{Listener: ln, name: "systemd " + ln.Addr().String(), tls: scheme == "systemd+tls"})
+		}
+		return listeners, nil
+	}
+	return nil, fmt.Errorf("unsupported listen address: %s (e.g. tcp://:8080, tls://:8443, unix:///run/piping-server.sock, systemd)", address)
+}
+
+// advertisedListener returns the TCP listener to advertise to clients, preferring plain HTTP
+func advertisedListener(listeners []listener) (*net.TCPAddr, bool, error) {
+	var tlsAddr *net.TCPAddr
+	for _, ln := range listeners {
+		addr, ok := ln.Addr().(*net.TCPAddr)
+		if !ok || ln.mtls {
+			continue
+		}
+		if !ln.tls {
+			return addr, false, nil
+		}
+		if tlsAddr == nil {
+			tlsAddr = addr
+		}
+	}
+	if tlsAddr == nil {
+		return nil, false, errors.New("no listener on TCP to advertise")
+	}
+	return tlsAddr, true, nil
+}
@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// journaldSocketPath is the socket of the native protocol of journald
+// ref: https://systemd.io/JOURNAL_NATIVE_PROTOCOL/
+const journaldSocketPath = "/run/systemd/journal/socket"
+
+// syslogPriority is the facility "daemon" and the severity "info"
+const syslogPriority = 3*8 + 6
+
+// newLogWriter returns the writer of the log output and whether it timestamps lines by itself
+func newLogWriter() (io.Writer, bool, error) {
+	switch logOutput {
+	case "stderr":
+		return os.Stderr, false, nil
+	case "file":
+		if logFile == "" {
+			return nil, false, errors.New("--log-file should be specified with --log-output=file")
+		}
+		w, err := openRotatingFile(logFile, fileLogRotation())
+		return w, false, err
+	case "syslog":
+		w, err := newSyslogWriter(syslogAddr, syslogTag)
+		return w, true, err
+	case "journald":
+		w, err := newJournaldWriter(syslogTag)
+		return w, true, err
+	}
+	return nil, false, fmt.Errorf("invalid log output: %s", logOutput)
+}
+
+// syslogWriter writes log lines as RFC 5424 messages, reconnecting once on failures of writes
+type syslogWriter struct {
+	network  string
+	addr     string
+	hostname string
+	tag      string
+	mutex    sync.Mutex
+	conn     net.Conn
+}
+
+// newSyslogWriter connects to the address such as "udp://host:514", "tcp://host:601" or "unix:///dev/log" (local syslog if empty)
+func newSyslogWriter(rawAddr string, tag string) (*syslogWriter, error) {
+	w := &syslogWriter{network: "unixgram", addr: "/dev/log", tag: tag}
+	if rawAddr != "" {
+		u, err := url.Parse(rawAddr)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "udp", "tcp":
+			w.network, w.addr = u.Scheme, u.Host
+		case "unix":
+			w.addr = u.Path
+		default:
+			return nil, fmt.Errorf("invalid syslog address: %s (e.g. udp://localhost:514)", rawAddr)
+		}
+	}
+	w.hostname, _ = os.Hostname()
+	if w.hostname == "" {
+		w.hostname = "-"
+	}
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *syslogWriter) connect() error {
+	if w.conn != nil {
+		w.conn.Close()
+	}
+	conn, err := net.DialTimeout(w.network, w.addr, 10*time.Second)
+	if err != nil {
+		w.conn = nil
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", syslogPriority, time.Now().Format(time.RFC3339Nano), w.hostname, w.tag, os.Getpid(), bytes.TrimSuffix(p, []byte("\n")))
+	if w.network == "tcp" {
+		// Octet counting framing
+		// ref: https://datatracker.ietf.org/doc/html/rfc6587#section-3.4.1
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for i := 0; ; i++ {
+		if w.conn != nil {
+			if _, err := w.conn.Write([]byte(msg)); err == nil || i == 1 {
+				return len(p), err
+			}
+		}
+		if err := w.connect(); err != nil || i == 1 {
+			return 0, err
+		}
+	}
+}
+
+// journaldWriter writes log lines with journal fields
+type journaldWriter struct {
+	tag  string
+	conn net.Conn
+}
+
+func newJournaldWriter(tag string) (*journaldWriter, error) {
+	conn, err := net.Dial("unixgram", journaldSocketPath)
+	if err != nil {
+		return nil, err
+	}
+	return &journaldWriter{tag: tag, conn: conn}, nil
+}
+
+func (w *journaldWriter) Write(p []byte) (int, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "PRIORITY=6\nSYSLOG_IDENTIFIER=%s\nSYSLOG_PID=%d\n", w.tag, os.Getpid())
+	// NOTE: The binary form of the field allows newlines in messages
+	message := bytes.TrimSuffix(p, []byte("\n"))
+	buf.WriteString("MESSAGE\n")
+	binary.Write(&buf, binary.LittleEndian, uint64(len(message)))
+	buf.Write(message)
+	buf.WriteByte('\n')
+	if _, err := w.conn.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedLogTimeLayout is the suffix of rotated log files, which sorts them in order of time
+const rotatedLogTimeLayout = "2006-01-02T15-04-05.000"
+
+// logRotation is when and how log files are rotated
+type logRotation struct {
+	// maxBytes is the size to rotate a log file at (0 for no limit)
+	maxBytes int64
+	// maxAge is the age to rotate a log file at (0 for no limit)
+	maxAge time.Duration
+	// maxBackups is the number of rotated files kept (0 to keep all)
+	maxBackups int
+	compress   bool
+}
+
+func fileLogRotation() logRotation {
+	return logRotation{maxBytes: logMaxBytes, maxAge: logMaxAge, maxBackups: logMaxBackups, compress: logCompress}
+}
+
+// rotatingFile appends to the log file, renaming it to "<path>.<time>" (and gzipping it) when rotated
+type rotatingFile struct {
+	path     string
+	rotation logRotation
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	// cleanupMutex serializes compressing and removing rotated files in the background
+	cleanupMutex sync.Mutex
+}
+
+func openRotatingFile(path string, rotation logRotation) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, rotation: rotation}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.openedAt = file, info.Size(), time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.size > 0 && (f.rotation.maxBytes > 0 && f.size+int64(len(p)) > f.rotation.maxBytes || f.rotation.maxAge > 0 && time.Since(f.openedAt) >= f.rotation.maxAge) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// NOTE: f.mutex should be locked
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	rotatedPath := f.path + "." + time.Now().Format(rotatedLogTimeLayout)
+	if err := os.Rename(f.path, rotatedPath); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	go f.cleanup(rotatedPath)
+	return nil
+}
+
+// cleanup compresses the rotated file and removes the oldest rotated files beyond maxBackups
+func (f *rotatingFile) cleanup(rotatedPath string) {
+	f.cleanupMutex.Lock()
+	defer f.cleanupMutex.Unlock()
+	if f.rotation.compress {
+		// NOTE: The rotated file is kept uncompressed on failures
+		if err := gzipFile(rotatedPath); err == nil {
+			os.Remove(rotatedPath)
+		}
+	}
+	if f.rotation.maxBackups <= 0 {
+		return
+	}
+	backups := f.backups()
+	for len(backups) > f.rotation.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// backups returns the rotated files from the oldest
+func (f *rotatingFile) backups() []string {
+	matches, _ := filepath.Glob(f.path + ".*")
+	var backups []string
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(match, f.path+"."), ".gz")
+		if _, err := time.Parse(rotatedLogTimeLayout, suffix); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+	return backups
+}
+
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	gzipWriter := gzip.NewWriter(dst)
+	if _, err := io.Copy(gzipWriter, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	return dst.Close()
+}
+
+func (f *rotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Close()
+}
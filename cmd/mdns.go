@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// mdnsServiceType is the DNS-SD service type of Piping Server
+const mdnsServiceType = "_piping._tcp.local."
+
+// mdnsTTL is the TTL of advertised records, which is the one recommended for records with host names
+// ref: https://datatracker.ietf.org/doc/html/rfc6762#section-10
+const mdnsTTL = 120
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsService is a DNS-SD service instance advertised by Multicast DNS
+// ref: https://datatracker.ietf.org/doc/html/rfc6763
+type mdnsService struct {
+	// instance is the name of the instance such as "myhost._piping._tcp.local."
+	instance string
+	// host is the host name such as "myhost.local."
+	host string
+	port uint16
+	ips  []net.IP
+	txt  []string
+}
+
+func newMDNSService(name string, port uint16, basePath string, isTLS bool) (*mdnsService, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	hostname = strings.Split(hostname, ".")[0]
+	if name == "" {
+		name = hostname
+	}
+	var ips []net.IP
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && !ipNet.IP.IsLoopback() {
+			ips = append(ips, ipNet.IP.To4())
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no IPv4 address to advertise by mDNS")
+	}
+	scheme := "http"
+	if isTLS {
+		scheme = "https"
+	}
+	if basePath == "" {
+		basePath = "/"
+	}
+	return &mdnsService{
+		instance: strings.ReplaceAll(name, ".", "-") + "." + mdnsServiceType,
+		host:     hostname + ".local.",
+		port:     port,
+		ips:      ips,
+		txt:      []string{"path=" + basePath, "scheme=" + scheme},
+	}, nil
+}
+
+// response returns the records of the service with the TTL, which is 0 for goodbye
+func (m *mdnsService) response(ttl uint32) ([]byte, error) {
+	serviceType := dnsmessage.MustNewName(mdnsServiceType)
+	instance, err := dnsmessage.NewName(m.instance)
+	if err != nil {
+		return nil, err
+	}
+	host, err := dnsmessage.NewName(m.host)
+	if err != nil {
+		return nil, err
+	}
+	header := func(name dnsmessage.Name, t dnsmessage.Type) dnsmessage.ResourceHeader {
+		class := dnsmessage.ClassINET
+		// NOTE: Records other than the shared PTR are unique to this host, which are marked with the cache-flush bit
+		if t != dnsmessage.TypePTR {
+			class |= 0x8000
+		}
+		return dnsmessage.ResourceHeader{Name: name, Type: t, Class: class, TTL: ttl}
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: []dnsmessage.Resource{
+			{Header: header(serviceType, dnsmessage.TypePTR), Body: &dnsmessage.PTRResource{PTR: instance}},
+			{Header: header(instance, dnsmessage.TypeSRV), Body: &dnsmessage.SRVResource{Target: host, Port: m.port}},
+			{Header: header(instance, dnsmessage.TypeTXT), Body: &dnsmessage.TXTResource{TXT: m.txt}},
+		},
+	}
+	for _, ip := range m.ips {
+		var a [4]byte
+		copy(a[:], ip)
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: header(host, dnsmessage.TypeA), Body: &dnsmessage.AResource{A: a}})
+	}
+	return msg.Pack()
+}
+
+// isQueried returns true if the query asks for any record of the service
+func (m *mdnsService) isQueried(packet []byte) bool {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(packet)
+	if err != nil || header.Response {
+		return false
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return false
+	}
+	for _, question := range questions {
+		name := strings.ToLower(question.Name.String())
+		if name == mdnsServiceType || name == strings.ToLower(m.instance) || name == strings.ToLower(m.host) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenMDNS listens on port 5353 joining the mDNS group on every multicast interface.
+// NOTE: net.ListenMulticastUDP is not used because it binds to the group address on Linux, from which responses cannot be sent.
+func listenMDNS() (*ipv4.PacketConn, error) {
+	listenConfig := net.ListenConfig{Control: reuseMDNSPort}
+	conn, err := listenConfig.ListenPacket(context.Background(), "udp4", net.JoinHostPort("0.0.0.0", strconv.Itoa(mdnsGroup.Port)))
+	if err != nil {
+		return nil, err
+	}
+	packetConn := ipv4.NewPacketConn(conn)
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	joined := 0
+	for i := range interfaces {
+		iface := &interfaces[i]
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		if packetConn.JoinGroup(iface, mdnsGroup) == nil {
+			joined++
+		}
+	}
+	if joined == 0 {
+		conn.Close()
+		return nil, errors.New("no interface to join the mDNS group")
+	}
+	// NOTE: Responses are sent with TTL 255 as required and looped back to responders on the same host
+	packetConn.SetMulticastTTL(255)
+	packetConn.SetMulticastLoopback(true)
+	return packetConn, nil
+}
+
+// runMDNS answers queries for the service until stopCh is closed, announcing it at start and saying goodbye at stop
+func runMDNS(logger *log.Logger, m *mdnsService, stopCh <-chan struct{}) {
+	conn, err := listenMDNS()
+	if err != nil {
+		logger.Printf("Failed to advertise by mDNS: %v", err)
+		return
+	}
+	defer conn.Close()
+	response, err := m.response(mdnsTTL)
+	if err != nil {
+		logger.Printf("Failed to advertise by mDNS: %v", err)
+		return
+	}
+	logger.Printf("Advertising %s on %s:%d by mDNS", m.instance, m.host, m.port)
+	go func() {
+		// NOTE: Announces twice as recommended
+		for i := 0; i < 2; i++ {
+			conn.WriteTo(response, nil, mdnsGroup)
+			select {
+			case <-time.After(time.Second):
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	go func() {
+		<-stopCh
+		if goodbye, err := m.response(0); err == nil {
+			conn.WriteTo(goodbye, nil, mdnsGroup)
+		}
+		conn.Close()
+	}()
+	buf := make([]byte, 9000)
+	for {
+		n, _, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if m.isQueried(buf[:n]) {
+			conn.WriteTo(response, nil, mdnsGroup)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestMDNSServiceResponse(t *testing.T) {
+	m := &mdnsService{
+		instance: "test._piping._tcp.local.",
+		host:     "test.local.",
+		port:     8080,
+		ips:      []net.IP{net.IPv4(192, 0, 2, 10).To4()},
+		txt:      []string{"path=/", "scheme=http"},
+	}
+	packet, err := m.response(mdnsTTL)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, packet, []byte{
+		// ID 0, QR and AA, no questions, 4 answers
+		0x00, 0x00, 0x84, 0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00,
+		// _piping._tcp.local. PTR IN TTL 120 test._piping._tcp.local.
+		0x07, '_', 'p', 'i', 'p', 'i', 'n', 'g', 0x04, '_', 't', 'c', 'p', 0x05, 'l', 'o', 'c', 'a', 'l', 0x00,
+		0x00, 0x0c, 0x00, 0x01, 0x00, 0x00, 0x00, 0x78, 0x00, 0x19,
+		0x04, 't', 'e', 's', 't', 0x07, '_', 'p', 'i', 'p', 'i', 'n', 'g', 0x04, '_', 't', 'c', 'p', 0x05, 'l', 'o', 'c', 'a', 'l', 0x00,
+		// test._piping._tcp.local. SRV cache-flush IN TTL 120 0 0 8080 test.local.
+		0xc0, 0x2a, 0x00, 0x21, 0x80, 0x01, 0x00, 0x00, 0x00, 0x78, 0x00, 0x12,
+		0x00, 0x00, 0x00, 0x00, 0x1f, 0x90, 0x04, 't', 'e', 's', 't', 0x05, 'l', 'o', 'c', 'a', 'l', 0x00,
+		// test._piping._tcp.local. TXT cache-flush IN TTL 120 "path=/" "scheme=http"
+		0xc0, 0x2a, 0x00, 0x10, 0x80, 0x01, 0x00, 0x00, 0x00, 0x78, 0x00, 0x13,
+		0x06, 'p', 'a', 't', 'h', '=', '/', 0x0b, 's', 'c', 'h', 'e', 'm', 'e', '=', 'h', 't', 't', 'p',
+		// test.local. A cache-flush IN TTL 120 192.0.2.10
+		0x04, 't', 'e', 's', 't', 0x05, 'l', 'o', 'c', 'a', 'l', 0x00, 0x00, 0x01, 0x80, 0x01, 0x00, 0x00, 0x00, 0x78, 0x00, 0x04,
+		192, 0, 2, 10,
+	})
+
+	// Goodbye has the TTL of 0
+	packet, err = m.response(0)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, packet[36:40], []byte{0, 0, 0, 0})
+}
+
+func TestMDNSServiceIsQueried(t *testing.T) {
+	m := &mdnsService{instance: "test._piping._tcp.local.", host: "test.local."}
+	query := func(name string) []byte {
+		packet := []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+		for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+			packet = append(packet, byte(len(label)))
+			packet = append(packet, label...)
+		}
+		// QTYPE ANY, QCLASS IN
+		return append(packet, 0x00, 0x00, 0xff, 0x00, 0x01)
+	}
+	assert.Assert(t, m.isQueried(query("_piping._tcp.local.")))
+	// Names are case-insensitive
+	assert.Assert(t, m.isQueried(query("TEST._piping._tcp.local.")))
+	assert.Assert(t, m.isQueried(query("test.local.")))
+	assert.Assert(t, !m.isQueried(query("_http._tcp.local.")))
+	// Responses are not queries
+	response := query("_piping._tcp.local.")
+	response[2] = 0x84
+	assert.Assert(t, !m.isQueried(response))
+}
@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package cmd
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// reuseMDNSPort lets the socket share port 5353 with other mDNS responders such as Bonjour
+func reuseMDNSPort(network, address string, c syscall.RawConn) error {
+	var err error
+	if controlErr := c.Control(func(fd uintptr) {
+		err = windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_REUSEADDR, 1)
+	}); controlErr != nil {
+		return controlErr
+	}
+	return err
+}
@@ -0,0 +1,396 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// portMappingLifetime is the lease of a port mapping, which is renewed at half of it
+const portMappingLifetime = time.Hour
+
+const portMappingDescription = "piping-server"
+
+// portMapper maps external ports of the router to this host
+type portMapper interface {
+	externalIP() (net.IP, error)
+	// addMapping maps the external TCP port to the same port of this host
+	addMapping(port int, lifetime time.Duration) error
+	deleteMapping(port int) error
+}
+
+// natPMPPort is the port of NAT-PMP servers
+const natPMPPort = 5351
+
+// natPMP maps ports with NAT-PMP
+// ref: https://datatracker.ietf.org/doc/html/rfc6886
+type natPMP struct {
+	gateway *net.UDPAddr
+}
+
+// defaultGateway returns the gateway of the default route in /proc/net/route
+func defaultGateway() (net.IP, error) {
+	b, err := os.ReadFile("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(b), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gateway, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			return nil, err
+		}
+		ip := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(ip, uint32(gateway))
+		return ip, nil
+	}
+	return nil, errors.New("no default route")
+}
+
+// request sends the request to the gateway with retransmissions, returning the response
+func (n *natPMP) request(req []byte, responseSize int) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, n.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	res := make([]byte, 16)
+	timeout := 250 * time.Millisecond
+	for i := 0; i < 5; i++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		size, err := conn.Read(res)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				timeout *= 2
+				continue
+			}
+			return nil, err
+		}
+		if size < responseSize || res[1] != req[1]+128 {
+			continue
+		}
+		if result := binary.BigEndian.Uint16(res[2:4]); result != 0 {
+			return nil, fmt.Errorf("NAT-PMP result code %d", result)
+		}
+		return res[:size], nil
+	}
+	return nil, fmt.Errorf("no NAT-PMP response from %s", n.gateway.IP)
+}
+
+func (n *natPMP) externalIP() (net.IP, error) {
+	res, err := n.request([]byte{0, 0}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(res[8:12]), nil
+}
+
+// mapPort requests the mapping of the TCP port, returning the mapped external port
+func (n *natPMP) mapPort(port int, lifetime time.Duration) (int, error) {
+	req := make([]byte, 12)
+	req[1] = 2 // TCP
+	binary.BigEndian.PutUint16(req[4:6], uint16(port))
+	// NOTE: The suggested external port is 0 for deletion
+	if lifetime > 0 {
+		binary.BigEndian.PutUint16(req[6:8], uint16(port))
+	}
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+	res, err := n.request(req, 16)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(res[10:12])), nil
+}
+
+func (n *natPMP) addMapping(port int, lifetime time.Duration) error {
+	mappedPort, err := n.mapPort(port, lifetime)
+	if err != nil {
+		return err
+	}
+	if mappedPort != port {
+		n.mapPort(port, 0)
+		return fmt.Errorf("the router has mapped port %d instead of %d", mappedPort, port)
+	}
+	return nil
+}
+
+func (n *natPMP) deleteMapping(port int) error {
+	_, err := n.mapPort(port, 0)
+	return err
+}
+
+// upnpIGD maps ports with the WANIPConnection or WANPPPConnection service of a UPnP Internet Gateway Device
+type upnpIGD struct {
+	controlURL  string
+	serviceType string
+	// localIP is the address of this host seen by the router
+	localIP string
+}
+
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// findService returns the service of port mapping in the device tree
+func (d *upnpDevice) findService() (string, string, bool) {
+	for _, service := range d.Services {
+		if strings.Contains(service.ServiceType, ":WANIPConnection:") || strings.Contains(service.ServiceType, ":WANPPPConnection:") {
+			return service.ServiceType, service.ControlURL, true
+		}
+	}
+	for i := range d.Devices {
+		if serviceType, controlURL, ok := d.Devices[i].findService(); ok {
+			return serviceType, controlURL, ok
+		}
+	}
+	return "", "", false
+}
+
+// discoverUPnPIGD finds the gateway by SSDP
+func discoverUPnPIGD() (*upnpIGD, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	search := "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\nST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, errors.New("no UPnP Internet Gateway Device found")
+		}
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil || res.Header.Get("Location") == "" {
+			continue
+		}
+		if igd, err := newUPnPIGD(res.Header.Get("Location")); err == nil {
+			return igd, nil
+		}
+	}
+}
+
+// newUPnPIGD reads the description of the device at the location
+func newUPnPIGD(location string) (*upnpIGD, error) {
+	locationURL, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(res.Body).Decode(&root); err != nil {
+		return nil, err
+	}
+	serviceType, controlURL, ok := root.Device.findService()
+	if !ok {
+		return nil, errors.New("no service of port mapping in the UPnP device")
+	}
+	base := locationURL
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return nil, err
+		}
+	}
+	resolvedControlURL, err := base.Parse(controlURL)
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: The local address of a connection to the router is the one reachable from it
+	conn, err := net.Dial("udp", net.JoinHostPort(locationURL.Hostname(), "1900"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	localIP := conn.LocalAddr().(*net.UDPAddr).IP.String()
+	return &upnpIGD{controlURL: resolvedControlURL.String(), serviceType: serviceType, localIP: localIP}, nil
+}
+
+// call invokes the SOAP action with the arguments as pairs of names and values, returning the response body
+func (u *upnpIGD) call(action string, args ...string) ([]byte, error) {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%s xmlns:u="%s">`, action, u.serviceType)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&body, "<%s>", args[i])
+		xml.EscapeText(&body, []byte(args[i+1]))
+		fmt.Fprintf(&body, "</%s>", args[i])
+	}
+	fmt.Fprintf(&body, "</u:%s></s:Body></s:Envelope>", action)
+	req, err := http.NewRequest("POST", u.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, u.serviceType, action))
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("UPnP %s has failed with %s: %s", action, res.Status, soapValue(b, "errorDescription"))
+	}
+	return b, nil
+}
+
+// soapValue returns the text of the first element with the local name in the SOAP body
+func soapValue(body []byte, name string) string {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == name {
+			var value string
+			decoder.DecodeElement(&value, &start)
+			return value
+		}
+	}
+}
+
+func (u *upnpIGD) externalIP() (net.IP, error) {
+	b, err := u.call("GetExternalIPAddress")
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(soapValue(b, "NewExternalIPAddress"))
+	if ip == nil {
+		return nil, errors.New("no external IP address from the UPnP device")
+	}
+	return ip, nil
+}
+
+func (u *upnpIGD) addMapping(port int, lifetime time.Duration) error {
+	_, err := u.call("AddPortMapping",
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(port),
+		"NewProtocol", "TCP",
+		"NewInternalPort", strconv.Itoa(port),
+		"NewInternalClient", u.localIP,
+		"NewEnabled", "1",
+		"NewPortMappingDescription", portMappingDescription,
+		"NewLeaseDuration", strconv.Itoa(int(lifetime/time.Second)),
+	)
+	return err
+}
+
+func (u *upnpIGD) deleteMapping(port int) error {
+	_, err := u.call("DeletePortMapping", "NewRemoteHost", "", "NewExternalPort", strconv.Itoa(port), "NewProtocol", "TCP")
+	return err
+}
+
+// newPortMapper returns the mapper of the method: "upnp", "natpmp" or "auto" trying UPnP and then NAT-PMP
+func newPortMapper(method string) (portMapper, error) {
+	switch method {
+	case "upnp":
+		return discoverUPnPIGD()
+	case "natpmp":
+		gateway, err := defaultGateway()
+		if err != nil {
+			return nil, err
+		}
+		return &natPMP{gateway: &net.UDPAddr{IP: gateway, Port: natPMPPort}}, nil
+	case "auto":
+		igd, upnpErr := discoverUPnPIGD()
+		if upnpErr == nil {
+			return igd, nil
+		}
+		gateway, err := defaultGateway()
+		if err != nil {
+			return nil, fmt.Errorf("%v, and %v for NAT-PMP", upnpErr, err)
+		}
+		n := &natPMP{gateway: &net.UDPAddr{IP: gateway, Port: natPMPPort}}
+		if _, err := n.externalIP(); err != nil {
+			return nil, fmt.Errorf("%v, and %v", upnpErr, err)
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("invalid port mapping: %s (upnp, natpmp or auto)", method)
+}
+
+// mappedPorts returns the ports of TCP listeners and whether each is HTTPS
+func mappedPorts(listeners []listener) map[int]bool {
+	ports := map[int]bool{}
+	for _, ln := range listeners {
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+			ports[addr.Port] = ln.tls
+		}
+	}
+	return ports
+}
+
+// runPortMapping maps the ports and renews the mappings until stopCh is closed, which deletes them
+func runPortMapping(logger *log.Logger, mapper portMapper, ports map[int]bool, stopCh <-chan struct{}) {
+	externalIP, err := mapper.externalIP()
+	if err != nil {
+		logger.Printf("Failed to get the external IP address for port mapping: %v", err)
+		return
+	}
+	for port, isTLS := range ports {
+		if err := mapper.addMapping(port, portMappingLifetime); err != nil {
+			logger.Printf("Failed to map port %d: %v", port, err)
+			continue
+		}
+		scheme := "http"
+		if isTLS {
+			scheme = "https"
+		}
+		logger.Printf("Reachable at %s://%s by port mapping", scheme, net.JoinHostPort(externalIP.String(), strconv.Itoa(port)))
+	}
+	ticker := time.NewTicker(portMappingLifetime / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for port := range ports {
+				if err := mapper.addMapping(port, portMappingLifetime); err != nil {
+					logger.Printf("Failed to renew the mapping of port %d: %v", port, err)
+				}
+			}
+		case <-stopCh:
+			for port := range ports {
+				mapper.deleteMapping(port)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+// serveFakeNATPMP replies to each request with the response in order, sending the requests to the returned channel
+func serveFakeNATPMP(t *testing.T, responses [][]byte) (*natPMP, <-chan []byte) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NilError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	requestCh := make(chan []byte, len(responses))
+	go func() {
+		buf := make([]byte, 64)
+		for _, response := range responses {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			requestCh <- append([]byte(nil), buf[:n]...)
+			conn.WriteToUDP(response, addr)
+		}
+	}()
+	return &natPMP{gateway: conn.LocalAddr().(*net.UDPAddr)}, requestCh
+}
+
+func TestNATPMP(t *testing.T) {
+	n, requestCh := serveFakeNATPMP(t, [][]byte{
+		// Version 0, opcode 128, result 0, epoch 1 and 203.0.113.7
+		{0, 128, 0, 0, 0, 0, 0, 1, 203, 0, 113, 7},
+		// Version 0, opcode 130, result 0, epoch 2, internal port 8080, mapped port 8080 and lifetime 3600
+		{0, 130, 0, 0, 0, 0, 0, 2, 0x1f, 0x90, 0x1f, 0x90, 0, 0, 0x0e, 0x10},
+		{0, 130, 0, 0, 0, 0, 0, 3, 0x1f, 0x90, 0, 0, 0, 0, 0, 0},
+	})
+	ip, err := n.externalIP()
+	assert.NilError(t, err)
+	assert.Equal(t, ip.String(), "203.0.113.7")
+	assert.DeepEqual(t, <-requestCh, []byte{0, 0})
+
+	assert.NilError(t, n.addMapping(8080, time.Hour))
+	// Version 0, opcode 2 (TCP), reserved, internal port 8080, suggested external port 8080 and lifetime 3600
+	assert.DeepEqual(t, <-requestCh, []byte{0, 2, 0, 0, 0x1f, 0x90, 0x1f, 0x90, 0, 0, 0x0e, 0x10})
+
+	// Deletion has the external port and the lifetime of 0
+	assert.NilError(t, n.deleteMapping(8080))
+	assert.DeepEqual(t, <-requestCh, []byte{0, 2, 0, 0, 0x1f, 0x90, 0, 0, 0, 0, 0, 0})
+}
+
+func TestNATPMPErrors(t *testing.T) {
+	n, requestCh := serveFakeNATPMP(t, [][]byte{
+		// The router maps another external port
+		{0, 130, 0, 0, 0, 0, 0, 1, 0x1f, 0x90, 0x1f, 0x91, 0, 0, 0x0e, 0x10},
+		{0, 130, 0, 0, 0, 0, 0, 1, 0x1f, 0x90, 0, 0, 0, 0, 0, 0},
+		// Result 2 (not authorized)
+		{0, 130, 0, 2, 0, 0, 0, 1, 0x1f, 0x90, 0, 0, 0, 0, 0, 0},
+	})
+	assert.ErrorContains(t, n.addMapping(8080, time.Hour), "the router has mapped port 8081 instead of 8080")
+	<-requestCh
+	// The mapping of the other port is deleted
+	assert.DeepEqual(t, <-requestCh, []byte{0, 2, 0, 0, 0x1f, 0x90, 0, 0, 0, 0, 0, 0})
+	assert.ErrorContains(t, n.addMapping(8080, time.Hour), "NAT-PMP result code 2")
+}
+
+func TestUPnPIGD(t *testing.T) {
+	type soapRequest struct {
+		action string
+		body   string
+	}
+	requestCh := make(chan soapRequest, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rootDesc.xml" {
+			io.WriteString(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <serviceList>
+      <service><serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType><controlURL>/ctl/L3F</controlURL></service>
+    </serviceList>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType><controlURL>/ctl/IPConn</controlURL></service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		requestCh <- soapRequest{action: r.Header.Get("SOAPAction"), body: string(body)}
+		switch {
+		case strings.HasSuffix(r.Header.Get("SOAPAction"), `#GetExternalIPAddress"`):
+			io.WriteString(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"><NewExternalIPAddress>203.0.113.7</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+		case strings.HasSuffix(r.Header.Get("SOAPAction"), `#AddPortMapping"`):
+			io.WriteString(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:AddPortMappingResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"/></s:Body></s:Envelope>`)
+		default:
+			w.WriteHeader(500)
+			io.WriteString(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>714</errorCode><errorDescription>NoSuchEntryInArray</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+		}
+	}))
+	defer server.Close()
+
+	igd, err := newUPnPIGD(server.URL + "/rootDesc.xml")
+	assert.NilError(t, err)
+	assert.Equal(t, igd.serviceType, "urn:schemas-upnp-org:service:WANIPConnection:1")
+	assert.Equal(t, igd.controlURL, server.URL+"/ctl/IPConn")
+	assert.Equal(t, igd.localIP, "127.0.0.1")
+
+	ip, err := igd.externalIP()
+	assert.NilError(t, err)
+	assert.Equal(t, ip.String(), "203.0.113.7")
+	assert.Equal(t, <-requestCh, soapRequest{
+		action: `"urn:schemas-upnp-org:service:WANIPConnection:1#GetExternalIPAddress"`,
+		body:   `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:GetExternalIPAddress xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"></u:GetExternalIPAddress></s:Body></s:Envelope>`,
+	})
+
+	assert.NilError(t, igd.addMapping(8080, time.Hour))
+	assert.Equal(t, <-requestCh, soapRequest{
+		action: `"urn:schemas-upnp-org:service:WANIPConnection:1#AddPortMapping"`,
+		body:   `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:AddPortMapping xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"><NewRemoteHost></NewRemoteHost><NewExternalPort>8080</NewExternalPort><NewProtocol>TCP</NewProtocol><NewInternalPort>8080</NewInternalPort><NewInternalClient>127.0.0.1</NewInternalClient><NewEnabled>1</NewEnabled><NewPortMappingDescription>piping-server</NewPortMappingDescription><NewLeaseDuration>3600</NewLeaseDuration></u:AddPortMapping></s:Body></s:Envelope>`,
+	})
+
+	// The error description of the fault is reported
+	assert.ErrorContains(t, igd.deleteMapping(8080), "UPnP DeletePortMapping has failed with 500 Internal Server Error: NoSuchEntryInArray")
+	assert.Equal(t, <-requestCh, soapRequest{
+		action: `"urn:schemas-upnp-org:service:WANIPConnection:1#DeletePortMapping"`,
+		body:   `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:DeletePortMapping xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"><NewRemoteHost></NewRemoteHost><NewExternalPort>8080</NewExternalPort><NewProtocol>TCP</NewProtocol></u:DeletePortMapping></s:Body></s:Envelope>`,
+	})
+}
@@ -0,0 +1,316 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	piping_server "github.com/nwtgck/go-piping-server"
+)
+
+// registration is the instance registered in a service registry
+type registration struct {
+	// id is unique to the instance such as "piping-server-myhost-8080"
+	id      string
+	name    string
+	address string
+	port    int
+	scheme  string
+}
+
+func (r *registration) url() string {
+	return r.scheme + "://" + net.JoinHostPort(r.address, strconv.Itoa(r.port))
+}
+
+// errNotRegistered is returned by heartbeat if the registry has lost the registration (e.g. restart of the agent)
+var errNotRegistered = errors.New("not registered")
+
+// serviceRegistry is Consul or etcd
+type serviceRegistry interface {
+	register(ctx context.Context) error
+	// heartbeat reports the result of the health check, which is nil if healthy
+	heartbeat(ctx context.Context, healthErr error) error
+	deregister(ctx context.Context) error
+}
+
+// registrationTTL is the time after which the registry regards the instance as unhealthy without heartbeats
+const registrationTTL = 30 * time.Second
+
+// registrationInterval is the interval of heartbeats and retries of registration, which tests shorten
+var registrationInterval = 10 * time.Second
+
+// registryURL parses the URL of the registry, adding http:// if the scheme is omitted
+func registryURL(addr string) (*url.URL, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid registry address: %s", addr)
+	}
+	return u, nil
+}
+
+// localAddressTo returns the local IP address from which the host is reachable
+func localAddressTo(u *url.URL) (string, error) {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	// NOTE: Connecting UDP sends no packet but chooses the route
+	conn, err := net.Dial("udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+// sendJSON sends the object as JSON and decodes the response into out if successful, returning the status code
+func sendJSON(ctx context.Context, client *http.Client, method string, url string, header http.Header, in interface{}, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return res.StatusCode, fmt.Errorf("%s %s: %s: %s", method, req.URL.Path, res.Status, strings.TrimSpace(string(b)))
+	}
+	if out == nil {
+		return res.StatusCode, nil
+	}
+	return res.StatusCode, json.NewDecoder(res.Body).Decode(out)
+}
+
+// consulRegistry registers the instance to the local Consul agent with a TTL check
+// ref: https://developer.hashicorp.com/consul/api-docs/agent/service
+type consulRegistry struct {
+	baseURL      string
+	token        string
+	client       *http.Client
+	registration *registration
+}
+
+func (c *consulRegistry) header() http.Header {
+	header := http.Header{}
+	if c.token != "" {
+		header.Set("X-Consul-Token", c.token)
+	}
+	return header
+}
+
+func (c *consulRegistry) checkID() string {
+	return "service:" + c.registration.id
+}
+
+func (c *consulRegistry) register(ctx context.Context) error {
+	r := c.registration
+	service := map[string]interface{}{
+		"ID":      r.id,
+		"Name":    r.name,
+		"Address": r.address,
+		"Port":    r.port,
+		"Meta":    map[string]string{"scheme": r.scheme},
+		"Check": map[string]interface{}{
+			"CheckID": c.checkID(),
+			"Name":    "Piping Server liveness",
+			"TTL":     registrationTTL.String(),
+			// NOTE: An instance killed without deregistration is removed eventually
+			"DeregisterCriticalServiceAfter": "10m",
+		},
+	}
+	_, err := sendJSON(ctx, c.client, "PUT", c.baseURL+"/v1/agent/service/register", c.header(), service, nil)
+	return err
+}
+
+func (c *consulRegistry) heartbeat(ctx context.Context, healthErr error) error {
+	update := map[string]string{"Status": "passing", "Output": "Piping Server is alive"}
+	if healthErr != nil {
+		update = map[string]string{"Status": "critical", "Output": healthErr.Error()}
+	}
+	status, err := sendJSON(ctx, c.client, "PUT", c.baseURL+"/v1/agent/check/update/"+url.PathEscape(c.checkID()), c.header(), update, nil)
+	if status == http.StatusNotFound {
+		return errNotRegistered
+	}
+	return err
+}
+
+func (c *consulRegistry) deregister(ctx context.Context) error {
+	_, err := sendJSON(ctx, c.client, "PUT", c.baseURL+"/v1/agent/service/deregister/"+url.PathEscape(c.registration.id), c.header(), nil, nil)
+	return err
+}
+
+// etcdRegistry puts the instance under the key prefix with a lease kept alive while healthy
+// ref: https://etcd.io/docs/v3.5/dev-guide/api_grpc_gateway/
+type etcdRegistry struct {
+	baseURL      string
+	prefix       string
+	client       *http.Client
+	registration *registration
+	leaseID      string
+}
+
+func (e *etcdRegistry) key() string {
+	return e.prefix + e.registration.id
+}
+
+func (e *etcdRegistry) register(ctx context.Context) error {
+	var granted struct {
+		ID string `json:"ID"`
+	}
+	if _, err := sendJSON(ctx, e.client, "POST", e.baseURL+"/v3/lease/grant", nil, map[string]int64{"TTL": int64(registrationTTL / time.Second)}, &granted); err != nil {
+		return err
+	}
+	r := e.registration
+	value, err := json.Marshal(map[string]interface{}{"id": r.id, "name": r.name, "address": r.address, "port": r.port, "url": r.url()})
+	if err != nil {
+		return err
+	}
+	put := map[string]string{
+		"key":   base64.StdEncoding.EncodeToString([]byte(e.key())),
+		"value": base64.StdEncoding.EncodeToString(value),
+		"lease": granted.ID,
+	}
+	if _, err := sendJSON(ctx, e.client, "POST", e.baseURL+"/v3/kv/put", nil, put, nil); err != nil {
+		return err
+	}
+	e.leaseID = granted.ID
+	return nil
+}
+
+func (e *etcdRegistry) heartbeat(ctx context.Context, healthErr error) error {
+	// NOTE: The lease expires and the key is deleted unless healthy
+	if healthErr != nil {
+		return nil
+	}
+	var keptAlive struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+	}
+	if _, err := sendJSON(ctx, e.client, "POST", e.baseURL+"/v3/lease/keepalive", nil, map[string]string{"ID": e.leaseID}, &keptAlive); err != nil {
+		return err
+	}
+	if ttl, _ := strconv.Atoi(keptAlive.Result.TTL); ttl <= 0 {
+		return errNotRegistered
+	}
+	return nil
+}
+
+func (e *etcdRegistry) deregister(ctx context.Context) error {
+	_, err := sendJSON(ctx, e.client, "POST", e.baseURL+"/v3/lease/revoke", nil, map[string]string{"ID": e.leaseID}, nil)
+	return err
+}
+
+// newRegistration returns the registration of the listener. The address is the IP address of the pod on Kubernetes
+// or the one from which the registry is reachable unless specified.
+func newRegistration(name string, address string, addr *net.TCPAddr, isTLS bool, pod *podInfo, registry *url.URL) (*registration, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	if pod != nil {
+		host = pod.name
+		if address == "" {
+			address = pod.ip
+		}
+	}
+	if address == "" {
+		if address, err = localAddressTo(registry); err != nil {
+			return nil, err
+		}
+	}
+	scheme := "http"
+	if isTLS {
+		scheme = "https"
+	}
+	return &registration{
+		id:      fmt.Sprintf("%s-%s-%d", name, host, addr.Port),
+		name:    name,
+		address: address,
+		port:    addr.Port,
+		scheme:  scheme,
+	}, nil
+}
+
+// checkHealth returns an error if the server is not alive like the systemd watchdog
+func checkHealth(pipingServer *piping_server.PipingServer, listeners []listener) error {
+	if err := pipingServer.CheckLiveness(registrationInterval / 2); err != nil {
+		return err
+	}
+	return checkListeners(listeners, registrationInterval/2)
+}
+
+// runRegistration keeps the instance registered while the server is alive, and deregisters it when stopCh is closed
+func runRegistration(logger *log.Logger, kind string, registry serviceRegistry, pipingServer *piping_server.PipingServer, listeners []listener, stopCh <-chan struct{}) {
+	registered := false
+	ticker := time.NewTicker(registrationInterval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), registrationInterval)
+		if !registered {
+			if err := registry.register(ctx); err != nil {
+				logger.Printf("Failed to register to %s: %v", kind, err)
+			} else {
+				logger.Printf("Registered to %s", kind)
+				registered = true
+			}
+		}
+		if registered {
+			err := registry.heartbeat(ctx, checkHealth(pipingServer, listeners))
+			if err == errNotRegistered {
+				logger.Printf("Registration to %s has been lost", kind)
+				registered = false
+			} else if err != nil {
+				logger.Printf("Failed to send a heartbeat to %s: %v", kind, err)
+			}
+		}
+		cancel()
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			if registered {
+				ctx, cancel := context.WithTimeout(context.Background(), registrationInterval)
+				if err := registry.deregister(ctx); err != nil {
+					logger.Printf("Failed to deregister from %s: %v", kind, err)
+				}
+				cancel()
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	piping_server "github.com/nwtgck/go-piping-server"
+	"gotest.tools/v3/assert"
+)
+
+// fakeAPIResponse is a response of the fake API server
+type fakeAPIResponse struct {
+	status int
+	body   string
+}
+
+// fakeAPIRequest is a request received by the fake API server
+type fakeAPIRequest struct {
+	method string
+	path   string
+	body   string
+	header http.Header
+}
+
+// serveFakeAPI replies to each request with the response in order, sending the requests to the returned channel.
+// Requests after the responses run out get 200 with no body.
+func serveFakeAPI(t *testing.T, responses []fakeAPIResponse) (string, <-chan fakeAPIRequest) {
+	t.Helper()
+	requestCh := make(chan fakeAPIRequest, 16)
+	responseCh := make(chan fakeAPIResponse, len(responses))
+	for _, response := range responses {
+		responseCh <- response
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requestCh <- fakeAPIRequest{method: r.Method, path: r.URL.Path, body: string(body), header: r.Header}
+		select {
+		case response := <-responseCh:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(response.status)
+			io.WriteString(w, response.body)
+		default:
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, requestCh
+}
+
+func assertFakeAPIRequest(t *testing.T, req fakeAPIRequest, method string, path string, body string) {
+	t.Helper()
+	assert.Equal(t, req.method, method)
+	assert.Equal(t, req.path, path)
+	assert.Equal(t, req.body, body)
+}
+
+var testRegistration = &registration{
+	id:      "piping-server-test-8080",
+	name:    "piping-server",
+	address: "192.0.2.10",
+	port:    8080,
+	scheme:  "http",
+}
+
+func TestConsulRegistry(t *testing.T) {
+	baseURL, requestCh := serveFakeAPI(t, []fakeAPIResponse{
+		{200, ""},
+		{200, ""},
+		{200, ""},
+		{404, `CheckID "service:piping-server-test-8080" does not have associated TTL`},
+		{200, ""},
+	})
+	c := &consulRegistry{baseURL: baseURL, token: "secret", client: http.DefaultClient, registration: testRegistration}
+	ctx := context.Background()
+
+	assert.NilError(t, c.register(ctx))
+	req := <-requestCh
+	assertFakeAPIRequest(t, req, "PUT", "/v1/agent/service/register", `{"Address":"192.0.2.10","Check":{"CheckID":"service:piping-server-test-8080","DeregisterCriticalServiceAfter":"10m","Name":"Piping Server liveness","TTL":"30s"},"ID":"piping-server-test-8080","Meta":{"scheme":"http"},"Name":"piping-server","Port":8080}`)
+	assert.Equal(t, req.header.Get("X-Consul-Token"), "secret")
+	assert.Equal(t, req.header.Get("Content-Type"), "application/json")
+
+	assert.NilError(t, c.heartbeat(ctx, nil))
+	assertFakeAPIRequest(t, <-requestCh, "PUT", "/v1/agent/check/update/service:piping-server-test-8080", `{"Output":"Piping Server is alive","Status":"passing"}`)
+	assert.NilError(t, c.heartbeat(ctx, errors.New("pipes are not responsive")))
+	assertFakeAPIRequest(t, <-requestCh, "PUT", "/v1/agent/check/update/service:piping-server-test-8080", `{"Output":"pipes are not responsive","Status":"critical"}`)
+	// The agent has lost the check
+	assert.Equal(t, c.heartbeat(ctx, nil), errNotRegistered)
+	<-requestCh
+
+	assert.NilError(t, c.deregister(ctx))
+	assertFakeAPIRequest(t, <-requestCh, "PUT", "/v1/agent/service/deregister/piping-server-test-8080", "")
+}
+
+func TestEtcdRegistry(t *testing.T) {
+	baseURL, requestCh := serveFakeAPI(t, []fakeAPIResponse{
+		{200, `{"header":{"cluster_id":"14841639068965178418","member_id":"10276657743932975437","revision":"5","raft_term":"2"},"ID":"7587862072907194373","TTL":"30"}`},
+		{200, `{"header":{"cluster_id":"14841639068965178418","member_id":"10276657743932975437","revision":"6","raft_term":"2"}}`},
+		{200, `{"result":{"header":{"cluster_id":"14841639068965178418","member_id":"10276657743932975437","revision":"6","raft_term":"2"},"ID":"7587862072907194373","TTL":"30"}}`},
+		// The lease has expired
+		{200, `{"result":{"header":{"cluster_id":"14841639068965178418","member_id":"10276657743932975437","revision":"6","raft_term":"2"},"ID":"7587862072907194373"}}`},
+		{200, `{"header":{"cluster_id":"14841639068965178418","member_id":"10276657743932975437","revision":"7","raft_term":"2"}}`},
+	})
+	e := &etcdRegistry{baseURL: baseURL, prefix: "/services/piping-server/", client: http.DefaultClient, registration: testRegistration}
+	ctx := context.Background()
+
+	assert.NilError(t, e.register(ctx))
+	assertFakeAPIRequest(t, <-requestCh, "POST", "/v3/lease/grant", `{"TTL":30}`)
+	// The key is "/services/piping-server/piping-server-test-8080" and the value is
+	// {"address":"192.0.2.10","id":"piping-server-test-8080","name":"piping-server","port":8080,"url":"http://192.0.2.10:8080"}
+	assertFakeAPIRequest(t, <-requestCh, "POST", "/v3/kv/put", `{"key":"L3NlcnZpY2VzL3BpcGluZy1zZXJ2ZXIvcGlwaW5nLXNlcnZlci10ZXN0LTgwODA=","lease":"7587862072907194373","value":"eyJhZGRyZXNzIjoiMTkyLjAuMi4xMCIsImlkIjoicGlwaW5nLXNlcnZlci10ZXN0LTgwODAiLCJuYW1lIjoicGlwaW5nLXNlcnZlciIsInBvcnQiOjgwODAsInVybCI6Imh0dHA6Ly8xOTIuMC4yLjEwOjgwODAifQ=="}`)
+
+	assert.NilError(t, e.heartbeat(ctx, nil))
+	assertFakeAPIRequest(t, <-requestCh, "POST", "/v3/lease/keepalive", `{"ID":"7587862072907194373"}`)
+	// The lease is left to expire without keepalive unless healthy
+	assert.NilError(t, e.heartbeat(ctx, errors.New("pipes are not responsive")))
+	assert.Equal(t, e.heartbeat(ctx, nil), errNotRegistered)
+	assertFakeAPIRequest(t, <-requestCh, "POST", "/v3/lease/keepalive", `{"ID":"7587862072907194373"}`)
+
+	assert.NilError(t, e.deregister(ctx))
+	assertFakeAPIRequest(t, <-requestCh, "POST", "/v3/lease/revoke", `{"ID":"7587862072907194373"}`)
+}
+
+func TestRunRegistrationRetry(t *testing.T) {
+	savedRegistrationInterval := registrationInterval
+	registrationInterval = 10 * time.Millisecond
+	t.Cleanup(func() { registrationInterval = savedRegistrationInterval })
+	baseURL, requestCh := serveFakeAPI(t, []fakeAPIResponse{
+		{500, "Unexpected response code: 500 (Raft leader not found)"},
+		{200, ""},
+		{404, `CheckID "service:piping-server-test-8080" does not have associated TTL`},
+	})
+	c := &consulRegistry{baseURL: baseURL, client: http.DefaultClient, registration: testRegistration}
+	stopCh := make(chan struct{})
+	go runRegistration(log.New(io.Discard, "", 0), "Consul", c, piping_server.NewServer("", log.New(io.Discard, "", 0)), nil, stopCh)
+	// The failed registration is retried
+	assert.Equal(t, (<-requestCh).path, "/v1/agent/service/register")
+	assert.Equal(t, (<-requestCh).path, "/v1/agent/service/register")
+	// The lost registration is registered again
+	assert.Equal(t, (<-requestCh).path, "/v1/agent/check/update/service:piping-server-test-8080")
+	assert.Equal(t, (<-requestCh).path, "/v1/agent/service/register")
+	assert.Equal(t, (<-requestCh).path, "/v1/agent/check/update/service:piping-server-test-8080")
+	close(stopCh)
+	// Deregistered on stop after heartbeats in flight
+	for req := range requestCh {
+		if req.path == "/v1/agent/service/deregister/piping-server-test-8080" {
+			return
+		}
+		assert.Equal(t, req.path, "/v1/agent/check/update/service:piping-server-test-8080")
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchReloadSignal runs the reloaders on SIGHUP without affecting active transfers
+func watchReloadSignal(logger *log.Logger, reloaders []func() error) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for range sigCh {
+		logger.Printf("Reloading...")
+		for _, reload := range reloaders {
+			if err := reload(); err != nil {
+				logger.Printf("Failed to reload: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package cmd
+
+import "log"
+
+// watchReloadSignal does nothing because Windows has no SIGHUP
+func watchReloadSignal(logger *log.Logger, reloaders []func() error) {
+}
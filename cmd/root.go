@@ -1,18 +1,27 @@
 package cmd
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/lucas-clemente/quic-go/http3"
 	piping_server "github.com/nwtgck/go-piping-server"
 	"github.com/nwtgck/go-piping-server/version"
 	"github.com/spf13/cobra"
-	"golang.org/x/net/http2"
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/net/http2/h2c"
 )
 
@@ -22,8 +31,143 @@ var enableHttps bool
 var httpsPort uint16
 var keyPath string
 var crtPath string
+var autoSelfSigned bool
+var selfSignedDir string
+var selfSignedHosts []string
+var certificateWatchInterval time.Duration
+var acmeDomains []string
+var acmeCacheDir string
+var acmeEmail string
+var mtlsPort uint16
+var mtlsCAPath string
+var clientCertPolicies []string
+var torControlAddr string
+var torControlPassword string
+var torKeyPath string
+var portMapping string
+var enableMDNS bool
+var mdnsName string
+var enableKubernetes bool
+var kubernetesLease string
+var consulAddr string
+var consulToken string
+var etcdEndpoint string
+var etcdPrefix string
+var registerName string
+var registerAddress string
 var enableHttp3 bool
 var staticPath string
+var readHeaderTimeout time.Duration
+var idleTimeout time.Duration
+var writeTimeout time.Duration
+var maxHeaderBytes int
+var http2MaxConcurrentStreams uint32
+var http2MaxReadFrameSize uint32
+var http2MaxUploadBufferPerStream int32
+var http2MaxUploadBufferPerConnection int32
+var tlsMinVersion string
+var tcpNoDelay bool
+var tcpKeepAlive time.Duration
+var tcpReadBuffer int
+var tcpWriteBuffer int
+var maxTransferDuration time.Duration
+var receiverHeartbeatInterval time.Duration
+var receiverQueueLength int
+var receiverInformationalResponses bool
+var transcodeContentEncoding bool
+var errorStatusCodes map[string]int
+var senderMethods []string
+var allowedRequestHeaders []string
+var allowPrivateNetwork bool
+var enableSecurityHeaders bool
+var hstsMaxAge time.Duration
+var hstsPreload bool
+var redirectHTTPS bool
+var robotsTxtPath string
+var faviconPath string
+var templateDir string
+var staticSPA bool
+var basePath string
+var externalURL string
+var listenAddresses []string
+var configPath string
+
+// commandFlags are the flags of the command run
+var commandFlags *pflag.FlagSet
+
+// envFlagNames are the flags set by environment variables
+var envFlagNames map[string]bool
+var logLevel string
+var logOutput string
+var syslogAddr string
+var syslogTag string
+var logSamplingRules []string
+var logFile string
+var logMaxBytes int64
+var logMaxAge time.Duration
+var logMaxBackups int
+var logCompress bool
+var securityLogFile string
+var adminToken string
+var pushAllowedHosts []string
+var pushMaxBytes int64
+var fetchAllowedHosts []string
+var clamdAddress string
+var virusScanAction string
+var spoolDir string
+var spoolTTL time.Duration
+var spoolMaxBytes int64
+var spoolSync bool
+var reservationsFile string
+var blocklistFile string
+var blockedHashesFile string
+var smtpAddr string
+var smtpFrom string
+var smtpUsername string
+var smtpPassword string
+var notifyAllowedDomains []string
+var mqttBroker string
+var mqttTopicPrefix string
+var mqttClientID string
+var mqttUsername string
+var mqttPassword string
+var statsdAddr string
+var statsdPrefix string
+var statsdTags []string
+var statsdInterval time.Duration
+var maxReservationTTL time.Duration
+var archiveDir string
+var archivePaths []string
+var pathRules []string
+var egressRate int64
+var trafficClasses []string
+var rateLimitRequests int
+var rateLimitWindow time.Duration
+var generatedPathWords int
+var clipMaxBytes int64
+var clipTTL time.Duration
+var chatHistory int
+var enableConnect bool
+var enableWebDAV bool
+var enableS3 bool
+var s3Credentials []string
+var ftpPort uint16
+var ftpUsername string
+var ftpPassword string
+var ftpTLS bool
+var ftpPublicHost string
+var ftpPassivePorts string
+var sshPort uint16
+var sshHostKey string
+var sshPassword string
+var sshAuthorizedKeys string
+var enableChaos bool
+var zeroCopy bool
+var memoryCeiling int64
+var maxWaiters int
+var normalizePaths bool
+var rejectConfusablePaths bool
+var ownershipWindow time.Duration
 
 func init() {
 	cobra.OnInitialize()
@@ -33,8 +177,202 @@ func init() {
 	RootCmd.PersistentFlags().Uint16VarP(&httpsPort, "https-port", "", 8443, "HTTPS port")
 	RootCmd.PersistentFlags().StringVarP(&keyPath, "key-path", "", "", "Private key path")
 	RootCmd.PersistentFlags().StringVarP(&crtPath, "crt-path", "", "", "Certification path")
+	RootCmd.PersistentFlags().BoolVarP(&autoSelfSigned, "auto-selfsigned", "", false, "Generate and persist a self-signed certificate for HTTPS if --key-path and --crt-path are not specified")
+	RootCmd.PersistentFlags().StringVarP(&selfSignedDir, "selfsigned-dir", "", "", "Directory of the self-signed certificate (piping-server in the user config directory if not specified)")
+	RootCmd.PersistentFlags().StringSliceVarP(&selfSignedHosts, "selfsigned-hosts", "", nil, "Host names and IP addresses of the self-signed certificate (localhost, the hostname and addresses of interfaces if not specified)")
+	RootCmd.PersistentFlags().DurationVarP(&certificateWatchInterval, "certificate-watch-interval", "", time.Minute, "Interval of checking --key-path and --crt-path to reload them on changes (0 to disable)")
+	RootCmd.PersistentFlags().StringSliceVarP(&acmeDomains, "acme-domains", "", nil, "Domains to obtain certificates for HTTPS from Let's Encrypt instead of --key-path and --crt-path (plain HTTP should be reachable on port 80 for challenges)")
+	RootCmd.PersistentFlags().StringVarP(&acmeCacheDir, "acme-cache-dir", "", "", "Directory of certificates from Let's Encrypt (piping-server/acme in the user cache directory if not specified)")
+	RootCmd.PersistentFlags().StringVarP(&acmeEmail, "acme-email", "", "", "Contact email of the Let's Encrypt account")
+	RootCmd.PersistentFlags().Uint16VarP(&mtlsPort, "mtls-port", "", 0, "Port of HTTPS requiring client certificates verified by --mtls-ca-path (0 to disable)")
+	RootCmd.PersistentFlags().StringVarP(&mtlsCAPath, "mtls-ca-path", "", "", "CA certificates verifying client certificates on --mtls-port")
+	RootCmd.PersistentFlags().StringArrayVarP(&clientCertPolicies, "client-cert-policy", "", nil, "Paths and quotas of client certificates on --mtls-port by identity, rejecting others if specified (e.g. identity=spiffe://example.org/ci,path-prefix=/p/ci/,max-concurrent=4) (repeatable)")
+	RootCmd.PersistentFlags().StringVarP(&torControlAddr, "tor-control", "", "", "Control port of Tor (e.g. 127.0.0.1:9051) to publish the server as an onion service")
+	RootCmd.PersistentFlags().StringVarP(&torControlPassword, "tor-control-password", "", "", "Password of the Tor control port, cookie authentication if not specified")
+	RootCmd.PersistentFlags().StringVarP(&torKeyPath, "tor-key-path", "", "", "File persisting the key of the onion service to keep its address across restarts")
+	RootCmd.PersistentFlags().StringVarP(&portMapping, "port-mapping", "", "", "Map ports of the router to the listeners by upnp, natpmp or auto to be reachable from the internet")
+	RootCmd.PersistentFlags().BoolVarP(&enableMDNS, "mdns", "", false, "Advertise the server as _piping._tcp on the LAN by mDNS")
+	RootCmd.PersistentFlags().StringVarP(&mdnsName, "mdns-name", "", "", "Instance name advertised by mDNS (the hostname if not specified)")
+	RootCmd.PersistentFlags().BoolVarP(&enableKubernetes, "kubernetes", "", false, "Run as a Kubernetes pod, reading POD_NAME, POD_NAMESPACE and NODE_NAME from the downward API to label metrics")
+	RootCmd.PersistentFlags().StringVarP(&kubernetesLease, "kubernetes-lease", "", "", "Lease to elect the leader among replicas, which sweeps the spool directory shared by them")
+	RootCmd.PersistentFlags().StringVarP(&consulAddr, "consul-addr", "", "", "Consul agent (e.g. http://127.0.0.1:8500) to register the server to with a health check")
+	RootCmd.PersistentFlags().StringVarP(&consulToken, "consul-token", "", "", "ACL token of Consul")
+	RootCmd.PersistentFlags().StringVarP(&etcdEndpoint, "etcd-endpoint", "", "", "etcd (e.g. http://127.0.0.1:2379) to register the server to with a lease kept alive while healthy")
+	RootCmd.PersistentFlags().StringVarP(&etcdPrefix, "etcd-prefix", "", "/services/piping-server/", "Key prefix of the registration in etcd")
+	RootCmd.PersistentFlags().StringVarP(&registerName, "register-name", "", "piping-server", "Service name registered to Consul or etcd")
+	RootCmd.PersistentFlags().StringVarP(&registerAddress, "register-address", "", "", "Address registered to Consul or etcd (the pod IP on Kubernetes or the local address reaching the registry if not specified)")
 	RootCmd.PersistentFlags().StringVarP(&staticPath, "static", "", "", "Static resources path")
 	RootCmd.PersistentFlags().BoolVarP(&enableHttp3, "enable-http3", "", false, "Enable HTTP/3 (experimental)")
+	defaultServerConfig := piping_server.DefaultHTTPServerConfig()
+	RootCmd.PersistentFlags().DurationVarP(&readHeaderTimeout, "read-header-timeout", "", defaultServerConfig.ReadHeaderTimeout, "Timeout for reading request headers")
+	RootCmd.PersistentFlags().DurationVarP(&idleTimeout, "idle-timeout", "", defaultServerConfig.IdleTimeout, "Keep-alive idle timeout")
+	RootCmd.PersistentFlags().DurationVarP(&writeTimeout, "write-timeout", "", defaultServerConfig.WriteTimeout, "Timeout for writing a response (0 for no timeout, recommended for streaming)")
+	RootCmd.PersistentFlags().IntVarP(&maxHeaderBytes, "max-header-bytes", "", defaultServerConfig.MaxHeaderBytes, "Max bytes of request headers")
+	RootCmd.PersistentFlags().Uint32VarP(&http2MaxConcurrentStreams, "http2-max-concurrent-streams", "", 0, "Max concurrent streams per HTTP/2 connection (0 for default)")
+	RootCmd.PersistentFlags().Uint32VarP(&http2MaxReadFrameSize, "http2-max-read-frame-size", "", 0, "Max HTTP/2 frame size to read in bytes, from 16384 to 16777215 (0 for default)")
+	RootCmd.PersistentFlags().Int32VarP(&http2MaxUploadBufferPerStream, "http2-max-upload-buffer-per-stream", "", 0, "HTTP/2 flow-control window per stream in bytes (0 for default)")
+	RootCmd.PersistentFlags().Int32VarP(&http2MaxUploadBufferPerConnection, "http2-max-upload-buffer-per-connection", "", 0, "HTTP/2 flow-control window per connection in bytes (0 for default)")
+	RootCmd.PersistentFlags().BoolVarP(&tcpNoDelay, "tcp-no-delay", "", true, "Disable Nagle's algorithm on accepted TCP connections")
+	RootCmd.PersistentFlags().DurationVarP(&tcpKeepAlive, "tcp-keepalive", "", 0, "TCP keepalive period of accepted connections (0 for default, negative to disable)")
+	RootCmd.PersistentFlags().IntVarP(&tcpReadBuffer, "tcp-read-buffer", "", 0, "Receive buffer size of accepted TCP connections in bytes (0 for OS default)")
+	RootCmd.PersistentFlags().IntVarP(&tcpWriteBuffer, "tcp-write-buffer", "", 0, "Send buffer size of accepted TCP connections in bytes (0 for OS default)")
+	RootCmd.PersistentFlags().StringVarP(&tlsMinVersion, "tls-min-version", "", "1.2", "Minimum TLS version (1.0, 1.1, 1.2 or 1.3)")
+	RootCmd.PersistentFlags().DurationVarP(&maxTransferDuration, "max-transfer-duration", "", piping_server.DefaultMaxTransferDuration, "Max duration of a transfer (0 for no limit)")
+	RootCmd.PersistentFlags().DurationVarP(&receiverHeartbeatInterval, "receiver-heartbeat-interval", "", 30*time.Second, "Interval of heartbeats to receivers waiting with ?heartbeat=informational or ?heartbeat=event-stream and keepalives of ?frame=grpc-web (0 to disable)")
+	RootCmd.PersistentFlags().IntVarP(&receiverQueueLength, "receiver-queue-length", "", 0, "Number of receivers per path waiting in order for the next transfer while a receiver is connected (0 to reject them)")
+	RootCmd.PersistentFlags().BoolVarP(&receiverInformationalResponses, "receiver-informational-responses", "", false, "Send 103 Early Hints to receivers when waiting and when a sender connects")
+	RootCmd.PersistentFlags().BoolVarP(&transcodeContentEncoding, "transcode-content-encoding", "", false, "Pass Content-Encoding of senders to receivers accepting it and decompress gzip, deflate or zstd for the others, and compress into zstd by ?compress=zstd")
+	RootCmd.PersistentFlags().StringToIntVarP(&errorStatusCodes, "error-status-code", "", map[string]int{}, "HTTP status code by error code (e.g. receiver_limit=409,sender_conflict=423)")
+	RootCmd.PersistentFlags().StringSliceVarP(&senderMethods, "sender-methods", "", nil, "Additional methods behaving as senders like POST and PUT (e.g. PATCH)")
+	RootCmd.PersistentFlags().StringSliceVarP(&allowedRequestHeaders, "allowed-request-headers", "", nil, "Additional request headers allowed by CORS preflight")
+	RootCmd.PersistentFlags().BoolVarP(&allowPrivateNetwork, "allow-private-network", "", false, "Allow access from public origins via Private Network Access preflight")
+	RootCmd.PersistentFlags().BoolVarP(&enableSecurityHeaders, "security-headers", "", true, "Set security headers such as Content-Security-Policy and X-Content-Type-Options")
+	RootCmd.PersistentFlags().DurationVarP(&hstsMaxAge, "hsts-max-age", "", 0, "max-age of Strict-Transport-Security on HTTPS (0 to disable)")
+	RootCmd.PersistentFlags().BoolVarP(&hstsPreload, "hsts-preload", "", false, "Add includeSubDomains and preload to Strict-Transport-Security for the HSTS preload list (--hsts-max-age should be at least 1 year)")
+	RootCmd.PersistentFlags().BoolVarP(&redirectHTTPS, "redirect-https", "", false, "Redirect plain HTTP requests to --https-port except ACME challenges and pipes already joined over HTTP")
+	RootCmd.PersistentFlags().StringVarP(&robotsTxtPath, "robots-txt-path", "", "", "robots.txt path (disallow all by default)")
+	RootCmd.PersistentFlags().StringVarP(&faviconPath, "favicon-path", "", "", "favicon.ico path")
+	RootCmd.PersistentFlags().StringVarP(&templateDir, "template-dir", "", "", "Directory of index.html, help.txt and error.html overriding the pages")
+	RootCmd.PersistentFlags().BoolVarP(&staticSPA, "static-spa", "", false, "Serve index.html for unknown static paths (single page application mode)")
+	RootCmd.PersistentFlags().StringVarP(&basePath, "base-path", "", "", "URL prefix to mount Piping Server under (e.g. /piping)")
+	RootCmd.PersistentFlags().StringVarP(&externalURL, "external-url", "", "", "Base URL seen by clients used for links (e.g. https://piping.example.com/piping), derived from Forwarded headers if not specified")
+	RootCmd.PersistentFlags().StringVarP(&logLevel, "log-level", "", "info", "Log level (error, info or debug), changeable at runtime via /admin/log-level")
+	RootCmd.PersistentFlags().StringVarP(&logOutput, "log-output", "", "stderr", "Log output (stderr, file, syslog or journald)")
+	RootCmd.PersistentFlags().StringVarP(&syslogAddr, "syslog-addr", "", "", "Syslog server with --log-output=syslog (e.g. udp://localhost:514, tcp://localhost:601 or unix:///dev/log), local syslog if not specified")
+	RootCmd.PersistentFlags().StringVarP(&syslogTag, "syslog-tag", "", "piping-server", "Application name in syslog and journald")
+	RootCmd.PersistentFlags().StringArrayVarP(&logSamplingRules, "log-sample", "", nil, "Rule to log only a fraction of request lines of matching paths, the first matching of which applies (e.g. regexp=\\.(js|css|png)$,rate=0.01) (repeatable)")
+	RootCmd.PersistentFlags().StringVarP(&logFile, "log-file", "", "", "File to append logs to with --log-output=file")
+	RootCmd.PersistentFlags().Int64VarP(&logMaxBytes, "log-max-bytes", "", 0, "Size to rotate --log-file and --security-log-file at (0 for no limit)")
+	RootCmd.PersistentFlags().DurationVarP(&logMaxAge, "log-max-age", "", 0, "Age to rotate --log-file and --security-log-file at (e.g. 24h, 0 for no limit)")
+	RootCmd.PersistentFlags().IntVarP(&logMaxBackups, "log-max-backups", "", 0, "Number of rotated log files kept (0 to keep all)")
+	RootCmd.PersistentFlags().BoolVarP(&logCompress, "log-compress", "", false, "Gzip rotated log files")
+	RootCmd.PersistentFlags().StringVarP(&securityLogFile, "security-log-file", "", "", "File to append security events for fail2ban to instead of the log")
+	RootCmd.PersistentFlags().StringVarP(&adminToken, "admin-token", "", "", "Bearer token enabling the admin endpoints under /admin/")
+	RootCmd.PersistentFlags().StringSliceVarP(&pushAllowedHosts, "push-allowed-hosts", "", nil, "Hosts senders can push to with ?push=<url> (e.g. example.com,*.example.com)")
+	RootCmd.PersistentFlags().Int64VarP(&pushMaxBytes, "push-max-bytes", "", 0, "Max bytes of a push (0 for no limit)")
+	RootCmd.PersistentFlags().StringSliceVarP(&fetchAllowedHosts, "fetch-allowed-hosts", "", nil, "Hosts senders can let the server download from with X-Piping-Fetch (e.g. example.com,*.example.com)")
+	RootCmd.PersistentFlags().StringVarP(&clamdAddress, "clamd-address", "", "", "clamd to scan transfers for viruses (e.g. unix:///run/clamav/clamd.ctl, tcp://localhost:3310)")
+	RootCmd.PersistentFlags().StringVarP(&virusScanAction, "virus-scan-action", "", piping_server.VirusScanActionAbort, "Action on a virus found: abort or flag (X-Piping-Virus-Scan trailer)")
+	RootCmd.PersistentFlags().StringVarP(&spoolDir, "spool-dir", "", "", "Directory enabling ?spool=true, which stores encrypted bodies until a receiver comes")
+	RootCmd.PersistentFlags().DurationVarP(&spoolTTL, "spool-ttl", "", piping_server.DefaultSpoolTTL, "Time after which an unreceived spooled body is deleted")
+	RootCmd.PersistentFlags().Int64VarP(&spoolMaxBytes, "spool-max-bytes", "", 0, "Max bytes of a spooled body (0 for no limit)")
+	RootCmd.PersistentFlags().BoolVarP(&spoolSync, "spool-sync", "", false, "fsync spooled bodies before acknowledging the sender")
+	RootCmd.PersistentFlags().StringVarP(&reservationsFile, "reservations-file", "", "", "File persisting path reservations made via /api/reservations, enabling them")
+	RootCmd.PersistentFlags().StringVarP(&blocklistFile, "blocklist-file", "", "", "File persisting the blocklist of paths, IPs and SHA-256 hashes confirmed from abuse reports at /report, enabling them")
+	RootCmd.PersistentFlags().StringVarP(&blockedHashesFile, "blocked-hashes-file", "", "", "File of SHA-256 hashes of banned contents, one per line, whose transfers are aborted")
+	RootCmd.PersistentFlags().StringVarP(&smtpAddr, "smtp-addr", "", "", "SMTP server (host:port) sending emails requested by senders with ?notify=mailto:..., enabling them")
+	RootCmd.PersistentFlags().StringVarP(&smtpFrom, "smtp-from", "", "", "From address of notification emails")
+	RootCmd.PersistentFlags().StringVarP(&smtpUsername, "smtp-username", "", "", "Username of the SMTP server")
+	RootCmd.PersistentFlags().StringVarP(&smtpPassword, "smtp-password", "", "", "Password of the SMTP server")
+	RootCmd.PersistentFlags().StringSliceVarP(&notifyAllowedDomains, "notify-allowed-domains", "", nil, "Domains of recipients of notification emails (e.g. example.com), any if not specified")
+	RootCmd.PersistentFlags().StringVarP(&mqttBroker, "mqtt-broker", "", "", "MQTT broker (host:port) to publish pipe lifecycle events to")
+	RootCmd.PersistentFlags().StringVarP(&mqttTopicPrefix, "mqtt-topic-prefix", "", "piping-server", "Prefix of MQTT topics <prefix>/<path>/<event type>")
+	RootCmd.PersistentFlags().StringVarP(&mqttClientID, "mqtt-client-id", "", "piping-server", "MQTT client ID")
+	RootCmd.PersistentFlags().StringVarP(&mqttUsername, "mqtt-username", "", "", "Username of the MQTT broker")
+	RootCmd.PersistentFlags().StringVarP(&mqttPassword, "mqtt-password", "", "", "Password of the MQTT broker")
+	RootCmd.PersistentFlags().StringVarP(&statsdAddr, "statsd-addr", "", "", "StatsD server (host:port) to emit metrics to over UDP")
+	RootCmd.PersistentFlags().StringVarP(&statsdPrefix, "statsd-prefix", "", "piping_server.", "Prefix of StatsD metric names")
+	RootCmd.PersistentFlags().StringSliceVarP(&statsdTags, "statsd-tags", "", nil, "DogStatsD tags of metrics (e.g. env:prod)")
+	RootCmd.PersistentFlags().DurationVarP(&statsdInterval, "statsd-interval", "", 10*time.Second, "Interval of emitting StatsD gauges")
+	RootCmd.PersistentFlags().DurationVarP(&maxReservationTTL, "max-reservation-ttl", "", 0, "Max lifetime of a path reservation (0 for no limit)")
+	RootCmd.PersistentFlags().StringVarP(&archiveDir, "archive-dir", "", "", "Directory storing copies of transfers for retention")
+	RootCmd.PersistentFlags().StringSliceVarP(&archivePaths, "archive-paths", "", nil, "Path patterns of transfers archived to --archive-dir (e.g. /p/reports/*), all paths if not specified")
+	RootCmd.PersistentFlags().IntVarP(&rateLimitRequests, "rate-limit-requests", "", 0, "Max requests to pipes per client IP in --rate-limit-window (0 for no limit)")
+	RootCmd.PersistentFlags().DurationVarP(&rateLimitWindow, "rate-limit-window", "", piping_server.DefaultRateLimitWindow, "Window of --rate-limit-requests")
+	RootCmd.PersistentFlags().IntVarP(&generatedPathWords, "generated-path-words", "", piping_server.DefaultGeneratedPathWords, "Number of words of paths generated by /api/path (about 7 bits of entropy per word)")
+	RootCmd.PersistentFlags().Int64VarP(&clipMaxBytes, "clip-max-bytes", "", piping_server.DefaultClipMaxBytes, "Max bytes of a clip of /clip/<name> (0 to disable clips)")
+	RootCmd.PersistentFlags().DurationVarP(&clipTTL, "clip-ttl", "", piping_server.DefaultClipTTL, "Max lifetime of a clip")
+	RootCmd.PersistentFlags().IntVarP(&chatHistory, "chat-history", "", piping_server.DefaultChatHistory, "Lines kept in a chat room of /chat/<room> for joining participants (0 to disable chat)")
+	RootCmd.PersistentFlags().BoolVarP(&enableConnect, "enable-connect", "", false, "Pair two CONNECT requests with the same authority (e.g. CONNECT mytunnel:1) as a duplex tunnel")
+	RootCmd.PersistentFlags().BoolVarP(&enableWebDAV, "enable-webdav", "", false, "Serve /dav/ as a WebDAV collection for file managers, where a dropped file is sent to the pipe of the same path under /p/")
+	RootCmd.PersistentFlags().BoolVarP(&enableS3, "enable-s3", "", false, "Serve /s3/ as an S3 endpoint, where PutObject of <bucket>/<key> sends to the pipe of /p/<bucket>/<key> and GetObject receives from it")
+	RootCmd.PersistentFlags().StringSliceVarP(&s3Credentials, "s3-credentials", "", nil, "Credentials verifying Signature Version 4 of S3 requests (e.g. AKID:SECRET)")
+	RootCmd.PersistentFlags().Uint16VarP(&ftpPort, "ftp-port", "", 0, "Port of the FTP bridge, where STOR of a path sends to the pipe of /p/<path> and RETR receives from it (0 to disable)")
+	RootCmd.PersistentFlags().StringVarP(&ftpUsername, "ftp-username", "", "", "Username required by the FTP bridge (any login is accepted if not specified)")
+	RootCmd.PersistentFlags().StringVarP(&ftpPassword, "ftp-password", "", "", "Password required by the FTP bridge with --ftp-username")
+	RootCmd.PersistentFlags().BoolVarP(&ftpTLS, "ftp-tls", "", false, "Allow FTPS by AUTH TLS on --ftp-port with the certificate of HTTPS")
+	RootCmd.PersistentFlags().StringVarP(&ftpPublicHost, "ftp-public-host", "", "", "IPv4 address announced for passive data connections of FTP (e.g. the address outside NAT)")
+	RootCmd.PersistentFlags().StringVarP(&ftpPassivePorts, "ftp-passive-ports", "", "", "Port range of passive data connections of FTP (e.g. 30000-30100)")
+	RootCmd.PersistentFlags().Uint16VarP(&sshPort, "ssh-port", "", 0, "Port of the SSH bridge, where scp and sftp send to and receive from pipes (e.g. scp myfile host:/p/mypath) (0 to disable)")
+	RootCmd.PersistentFlags().StringVarP(&sshHostKey, "ssh-host-key", "", "", "Host key of the SSH bridge, generated if it does not exist (ssh_host_ed25519_key of piping-server in the user config directory if not specified)")
+	RootCmd.PersistentFlags().StringVarP(&sshPassword, "ssh-password", "", "", "Password required by the SSH bridge")
+	RootCmd.PersistentFlags().StringVarP(&sshAuthorizedKeys, "ssh-authorized-keys", "", "", "authorized_keys file of public keys accepted by the SSH bridge (any client is accepted without it and --ssh-password)")
+	RootCmd.PersistentFlags().BoolVarP(&enableChaos, "enable-chaos", "", false, "Let clients inject latency, resets and slow transfers with ?chaos= for testing (do not enable in production)")
+	RootCmd.PersistentFlags().BoolVarP(&zeroCopy, "zero-copy", "", false, "Relay plain HTTP/1.1 bodies with Content-Length without copying them through user space (splice on Linux)")
+	RootCmd.PersistentFlags().Int64VarP(&memoryCeiling, "memory-ceiling", "", 0, "Approximate bytes of memory committed to pipe requests and clips above which new pipes are rejected with 503 (0 for no limit)")
+	RootCmd.PersistentFlags().IntVarP(&maxWaiters, "max-waiters", "", 0, "Max pipe requests in flight above which new pipes are rejected with 503 (0 for no limit)")
+	RootCmd.PersistentFlags().BoolVarP(&normalizePaths, "normalize-paths", "", false, "Normalize paths of pipes to Unicode NFC")
+	RootCmd.PersistentFlags().BoolVarP(&rejectConfusablePaths, "reject-confusable-paths", "", false, "Reject paths of pipes with invisible characters or segments mixing scripts (e.g. Latin and Cyrillic)")
+	RootCmd.PersistentFlags().DurationVarP(&ownershipWindow, "ownership-window", "", 0, "Require X-Piping-Owner-Token of the receiver from a sender connecting from another IP within the duration after the receiver has created the pipe (0 to disable)")
+	RootCmd.PersistentFlags().StringArrayVarP(&pathRules, "path-rule", "", nil, "Rule by path applied in order (e.g. pattern=/p/public/*,max-bytes=1048576 or regexp=^/p/internal/,auth-token=secret,max-transfer-duration=0) (repeatable)")
+	RootCmd.PersistentFlags().Int64VarP(&egressRate, "egress-rate", "", 0, "Total bytes per second of pipes to receivers shared among traffic classes by weights (0 for no limit)")
+	RootCmd.PersistentFlags().StringArrayVarP(&trafficClasses, "traffic-class", "", nil, "Traffic class with its weight for --egress-rate, selected by X-Piping-Traffic-Class or traffic-class of --path-rule (e.g. interactive=8) (repeatable)")
+	RootCmd.PersistentFlags().StringVarP(&configPath, "config", "", "", "Config file (.yaml, .toml or .json) with flag names as keys")
+	RootCmd.PersistentFlags().StringArrayVarP(&listenAddresses, "listen", "", nil, "Address to listen on instead of --http-port: tcp://:8080, tls://:8443, unix:///run/piping-server.sock or systemd (repeatable)")
+}
+
+// parsePathRules parses --path-rule, checking their traffic classes by the weights if not nil
+func parsePathRules(values []string, trafficClassWeights map[string]int) ([]piping_server.PathRule, error) {
+	var rules []piping_server.PathRule
+	for _, value := range values {
+		rule, err := piping_server.ParsePathRule(value)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := trafficClassWeights[rule.TrafficClass]; trafficClassWeights != nil && rule.TrafficClass != "" && rule.TrafficClass != piping_server.DefaultTrafficClass && !ok {
+			return nil, fmt.Errorf("unknown traffic class of --path-rule: %s", rule.TrafficClass)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	switch v {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid TLS version: %s", v)
+}
+
+// createListeners listens on the addresses specified by the flags
+func createListeners() ([]listener, error) {
+	var listeners []listener
+	if len(listenAddresses) == 0 {
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", httpPort))
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener{Listener: ln, name: fmt.Sprintf("HTTP on %d", httpPort)})
+	}
+	for _, address := range listenAddresses {
+		lns, err := listen(address)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, lns...)
+	}
+	if enableHttps {
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", httpsPort))
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener{Listener: ln, name: fmt.Sprintf("HTTPS on %d", httpsPort), tls: true})
+	}
+	if mtlsPort != 0 {
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", mtlsPort))
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener{Listener: ln, name: fmt.Sprintf("mTLS on %d", mtlsPort), tls: true, mtls: true})
+	}
+	return listeners, nil
 }
 
 var RootCmd = &cobra.Command{
@@ -42,41 +380,544 @@ var RootCmd = &cobra.Command{
 	Short:        "piping-server",
 	Long:         "Infinitely transfer between any device over pure HTTP",
 	SilenceUsage: true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		commandFlags = cmd.Flags()
+		var err error
+		envFlagNames, err = loadEnv(cmd.Flags())
+		if err != nil {
+			return err
+		}
+		if configPath != "" {
+			return loadConfigFile(cmd.Flags(), configPath, envFlagNames)
+		}
+		return nil
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if showsVersion {
 			fmt.Printf("%s (%s)\n", version.Version, runtime.Version())
 			return nil
 		}
-		logger := log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds)
-		logger.Printf("Piping Server %s (%s)", version.Version, runtime.Version())
-		pipingServer := piping_server.NewServer(staticPath, logger)
-		errCh := make(chan error)
-		if enableHttps || enableHttp3 {
-			if keyPath == "" {
-				return errors.New("--key-path should be specified")
+		if isService, err := runAsWindowsService(runServer); isService {
+			return err
+		}
+		logWriter, timestamps, err := newLogWriter()
+		if err != nil {
+			return err
+		}
+		logFlags := log.LstdFlags | log.Lmicroseconds
+		if timestamps {
+			logFlags = 0
+		}
+		return runServer(log.New(logWriter, "", logFlags), nil)
+	},
+}
+
+// runServer runs Piping Server until an error occurs, the process is upgraded or stopCh is closed
+func runServer(logger *log.Logger, stopCh <-chan struct{}) error {
+	logger.Printf("Piping Server %s (%s)", version.Version, runtime.Version())
+	pipingServer := piping_server.NewServer(staticPath, logger)
+	pipingServer.MaxTransferDuration = maxTransferDuration
+	pipingServer.ReceiverHeartbeatInterval = receiverHeartbeatInterval
+	pipingServer.ReceiverQueueLength = receiverQueueLength
+	pipingServer.ReceiverInformationalResponses = receiverInformationalResponses
+	pipingServer.TranscodeContentEncoding = transcodeContentEncoding
+	for code, statusCode := range errorStatusCodes {
+		if statusCode < 400 || statusCode > 599 {
+			return fmt.Errorf("invalid status code for %s: %d", code, statusCode)
+		}
+	}
+	pipingServer.ErrorStatusCodes = errorStatusCodes
+	pipingServer.AllowedRequestHeaders = allowedRequestHeaders
+	pipingServer.AllowPrivateNetwork = allowPrivateNetwork
+	if !enableSecurityHeaders {
+		pipingServer.StaticSecurityHeaders = nil
+		pipingServer.PipeSecurityHeaders = nil
+	}
+	pipingServer.HSTSMaxAge = hstsMaxAge
+	if hstsPreload {
+		if hstsMaxAge < 365*24*time.Hour {
+			return errors.New("--hsts-max-age should be at least 1 year (8760h) with --hsts-preload")
+		}
+		pipingServer.HSTSPreload = true
+	}
+	if redirectHTTPS {
+		if !enableHttps {
+			return errors.New("--enable-https should be specified with --redirect-https")
+		}
+		pipingServer.HTTPSRedirectPort = int(httpsPort)
+	}
+	pipingServer.StaticSPA = staticSPA
+	pipingServer.BasePath = basePath
+	if externalURL != "" {
+		u, err := url.Parse(externalURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("invalid external URL: %s (an absolute http or https URL without query)", externalURL)
+		}
+		pipingServer.ExternalURL = externalURL
+	}
+	pipingServer.AdminToken = adminToken
+	pipingServer.PushAllowedHosts = pushAllowedHosts
+	pipingServer.PushMaxBytes = pushMaxBytes
+	pipingServer.FetchAllowedHosts = fetchAllowedHosts
+	if virusScanAction != piping_server.VirusScanActionAbort && virusScanAction != piping_server.VirusScanActionFlag {
+		return fmt.Errorf("invalid virus scan action: %s", virusScanAction)
+	}
+	pipingServer.ClamdAddress = clamdAddress
+	pipingServer.VirusScanAction = virusScanAction
+	pipingServer.SpoolTTL = spoolTTL
+	pipingServer.SpoolMaxBytes = spoolMaxBytes
+	pipingServer.SpoolSync = spoolSync
+	var pod *podInfo
+	if enableKubernetes {
+		var err error
+		if pod, err = readPodInfo(); err != nil {
+			return err
+		}
+		logger.Printf("Running as pod %s/%s", pod.namespace, pod.name)
+	}
+	if kubernetesLease != "" {
+		if pod == nil {
+			return errors.New("--kubernetes should be specified with --kubernetes-lease")
+		}
+		pipingServer.SpoolShared = true
+	}
+	pipingServer.MaxReservationTTL = maxReservationTTL
+	pipingServer.RateLimitRequests = rateLimitRequests
+	pipingServer.RateLimitWindow = rateLimitWindow
+	pipingServer.GeneratedPathWords = generatedPathWords
+	pipingServer.ClipMaxBytes = clipMaxBytes
+	pipingServer.ClipTTL = clipTTL
+	pipingServer.ChatHistory = chatHistory
+	pipingServer.EnableConnect = enableConnect
+	pipingServer.EnableWebDAV = enableWebDAV
+	pipingServer.EnableS3 = enableS3
+	if len(s3Credentials) != 0 {
+		if !enableS3 {
+			return errors.New("--enable-s3 should be specified with --s3-credentials")
+		}
+		pipingServer.S3Credentials = map[string]string{}
+		for _, credential := range s3Credentials {
+			accessKeyID, secret, ok := strings.Cut(credential, ":")
+			if !ok || accessKeyID == "" || secret == "" {
+				return fmt.Errorf("invalid S3 credential of %s (should be <access key ID>:<secret access key>)", accessKeyID)
+			}
+			pipingServer.S3Credentials[accessKeyID] = secret
+		}
+	}
+	pipingServer.EnableChaos = enableChaos
+	pipingServer.ZeroCopy = zeroCopy
+	pipingServer.MemoryCeiling = memoryCeiling
+	pipingServer.MaxWaiters = maxWaiters
+	pipingServer.NormalizePaths = normalizePaths
+	pipingServer.RejectConfusablePaths = rejectConfusablePaths
+	pipingServer.OwnershipWindow = ownershipWindow
+	// trafficClassWeights is nil without the bandwidth scheduler
+	var trafficClassWeights map[string]int
+	if egressRate > 0 {
+		trafficClassWeights = map[string]int{}
+		for _, trafficClass := range trafficClasses {
+			name, weight, ok := strings.Cut(trafficClass, "=")
+			n, err := strconv.Atoi(weight)
+			if !ok || err != nil {
+				return fmt.Errorf("invalid traffic class: %s (e.g. interactive=8)", trafficClass)
+			}
+			trafficClassWeights[name] = n
+		}
+		if err := pipingServer.EnableBandwidthScheduler(egressRate, trafficClassWeights); err != nil {
+			return err
+		}
+	} else if len(trafficClasses) != 0 {
+		return errors.New("--egress-rate should be specified with --traffic-class")
+	}
+	rules, err := parsePathRules(pathRules, trafficClassWeights)
+	if err != nil {
+		return err
+	}
+	pipingServer.PathRules = rules
+	for _, clientCertPolicy := range clientCertPolicies {
+		policy, err := piping_server.ParseClientCertPolicy(clientCertPolicy)
+		if err != nil {
+			return err
+		}
+		pipingServer.ClientCertPolicies = append(pipingServer.ClientCertPolicies, policy)
+	}
+	for _, logSamplingRule := range logSamplingRules {
+		rule, err := piping_server.ParseLogSamplingRule(logSamplingRule)
+		if err != nil {
+			return err
+		}
+		pipingServer.LogSampling = append(pipingServer.LogSampling, rule)
+	}
+	if archiveDir != "" {
+		pipingServer.ArchiveSink = &piping_server.DirArchiveSink{Dir: archiveDir}
+		pipingServer.ArchivePaths = archivePaths
+	}
+	if reservationsFile != "" {
+		if err := pipingServer.EnableReservations(reservationsFile); err != nil {
+			return err
+		}
+	}
+	if smtpAddr != "" {
+		if smtpFrom == "" {
+			return errors.New("--smtp-from should be specified with --smtp-addr")
+		}
+		pipingServer.SMTP = &piping_server.SMTPConfig{Addr: smtpAddr, From: smtpFrom, Username: smtpUsername, Password: smtpPassword, AllowedDomains: notifyAllowedDomains}
+	}
+	if blockedHashesFile != "" {
+		hashes, err := piping_server.LoadBlockedHashes(blockedHashesFile)
+		if err != nil {
+			return err
+		}
+		pipingServer.BlockedSHA256 = hashes
+	}
+	if blocklistFile != "" {
+		if err := pipingServer.EnableAbuseReports(blocklistFile); err != nil {
+			return err
+		}
+	}
+	if spoolDir != "" {
+		if err := pipingServer.EnableSpool(spoolDir); err != nil {
+			return err
+		}
+	}
+	level, err := piping_server.ParseLogLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	pipingServer.SetLogLevel(level)
+	if securityLogFile != "" {
+		f, err := openRotatingFile(securityLogFile, fileLogRotation())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		pipingServer.SecurityLogger = log.New(f, "", log.LstdFlags)
+	}
+	if robotsTxtPath != "" {
+		robotsTxt, err := os.ReadFile(robotsTxtPath)
+		if err != nil {
+			return err
+		}
+		pipingServer.RobotsTxt = string(robotsTxt)
+	}
+	if faviconPath != "" {
+		favicon, err := os.ReadFile(faviconPath)
+		if err != nil {
+			return err
+		}
+		pipingServer.Favicon = favicon
+	}
+	if templateDir != "" {
+		templates, err := piping_server.LoadTemplates(templateDir)
+		if err != nil {
+			return err
+		}
+		pipingServer.Templates = templates
+	}
+	for _, method := range senderMethods {
+		pipingServer.SenderMethods = append(pipingServer.SenderMethods, strings.ToUpper(method))
+	}
+	if http2MaxReadFrameSize != 0 && (http2MaxReadFrameSize < 16384 || http2MaxReadFrameSize > 16777215) {
+		return errors.New("--http2-max-read-frame-size should be from 16384 to 16777215")
+	}
+	if http2MaxUploadBufferPerStream < 0 || http2MaxUploadBufferPerConnection < 0 {
+		return errors.New("--http2-max-upload-buffer-per-stream and --http2-max-upload-buffer-per-connection should not be negative")
+	}
+	if tcpReadBuffer < 0 || tcpWriteBuffer < 0 {
+		return errors.New("--tcp-read-buffer and --tcp-write-buffer should not be negative")
+	}
+	socketOptions := socketOptions{noDelay: tcpNoDelay, keepAlive: tcpKeepAlive, readBuffer: tcpReadBuffer, writeBuffer: tcpWriteBuffer}
+	tlsVersion, err := parseTLSVersion(tlsMinVersion)
+	if err != nil {
+		return err
+	}
+	serverConfig := piping_server.HTTPServerConfig{
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+		WriteTimeout:      writeTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+		TLSConfig:         &tls.Config{MinVersion: tlsVersion},
+
+		HTTP2MaxConcurrentStreams:         http2MaxConcurrentStreams,
+		HTTP2MaxReadFrameSize:             http2MaxReadFrameSize,
+		HTTP2MaxUploadBufferPerStream:     http2MaxUploadBufferPerStream,
+		HTTP2MaxUploadBufferPerConnection: http2MaxUploadBufferPerConnection,
+	}
+	listeners, err := inheritedListeners()
+	if err != nil {
+		return err
+	}
+	if listeners == nil {
+		listeners, err = createListeners()
+		if err != nil {
+			return err
+		}
+	}
+	var acmeManager *autocert.Manager
+	if len(acmeDomains) != 0 {
+		if keyPath != "" || crtPath != "" || autoSelfSigned {
+			return errors.New("--acme-domains should not be specified with --key-path, --crt-path or --auto-selfsigned")
+		}
+		if enableHttp3 {
+			return errors.New("--enable-http3 is not supported with --acme-domains")
+		}
+		acmeManager, err = newACMEManager(acmeDomains, acmeCacheDir, acmeEmail)
+		if err != nil {
+			return err
+		}
+		serverConfig.TLSConfig.GetCertificate = acmeManager.GetCertificate
+	}
+	if autoSelfSigned && keyPath == "" && crtPath == "" {
+		crtPath, keyPath, err = selfSignedPaths(selfSignedDir)
+		if err != nil {
+			return err
+		}
+		hosts := selfSignedHosts
+		if len(hosts) == 0 {
+			hosts = defaultSelfSignedHosts()
+		}
+		generated, err := ensureSelfSignedCertificate(crtPath, keyPath, hosts)
+		if err != nil {
+			return err
+		}
+		if generated {
+			logger.Printf("Generated a self-signed certificate for %s in %s", strings.Join(hosts, ", "), crtPath)
+		}
+	}
+	for _, ln := range listeners {
+		if ln.tls && acmeManager == nil && (keyPath == "" || crtPath == "") {
+			return errors.New("--key-path and --crt-path should be specified for HTTPS")
+		}
+	}
+	var clientCAs *x509.CertPool
+	if mtlsPort != 0 {
+		if mtlsCAPath == "" {
+			return errors.New("--mtls-ca-path should be specified with --mtls-port")
+		}
+		caPEM, err := os.ReadFile(mtlsCAPath)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("no certificates in %s", mtlsCAPath)
+		}
+	}
+	var reloaders []func() error
+	if keyPath != "" && crtPath != "" {
+		certificateReloader, err := newCertificateReloader(crtPath, keyPath)
+		if err != nil {
+			return err
+		}
+		serverConfig.TLSConfig.GetCertificate = certificateReloader.getCertificate
+		reloaders = append(reloaders, certificateReloader.reload)
+		if certificateWatchInterval > 0 {
+			go certificateReloader.watch(logger, certificateWatchInterval, stopCh)
+		}
+	}
+	errCh := make(chan error)
+	if enableHttp3 {
+		if keyPath == "" {
+			return errors.New("--key-path should be specified")
+		}
+		if crtPath == "" {
+			return errors.New("--crt-path should be specified")
+		}
+		go func() {
+			logger.Printf("Listening HTTP/3 on %d...\n", httpsPort)
+			errCh <- http3.ListenAndServeQUIC(fmt.Sprintf(":%d", httpsPort), crtPath, keyPath, http.HandlerFunc(pipingServer.Handler))
+		}()
+	}
+	var servers []*http.Server
+	for _, ln := range listeners {
+		server := &http.Server{Handler: h2c.NewHandler(acmeHTTPHandler(acmeManager, http.HandlerFunc(pipingServer.Handler)), serverConfig.HTTP2Server()), ConnContext: pipingServer.ConnContext}
+		if ln.tls {
+			server.Handler = http.HandlerFunc(pipingServer.Handler)
+		}
+		serverConfig.Apply(server)
+		if ln.mtls {
+			server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			server.TLSConfig.ClientCAs = clientCAs
+		}
+		servers = append(servers, server)
+		go func(server *http.Server, ln listener) {
+			logger.Printf("Listening %s...\n", ln.name)
+			// NOTE: ln is kept unwrapped to pass its file on upgrade
+			tuned := tunedListener{Listener: ln.Listener, options: socketOptions}
+			var err error
+			if ln.tls {
+				// NOTE: The certificate is given by GetCertificate
+				err = server.ServeTLS(tuned, "", "")
+			} else {
+				err = server.Serve(tuned)
+			}
+			// NOTE: The server is closed on upgrade
+			if err != http.ErrServerClosed {
+				errCh <- err
 			}
-			if crtPath == "" {
-				return errors.New("--crt-path should be specified")
+		}(server, ln)
+	}
+	upgradedCh := make(chan struct{})
+	go watchUpgradeSignal(logger, listeners, servers, upgradedCh)
+	configReloader := &configReloader{path: configPath, flags: commandFlags, envNames: envFlagNames, server: pipingServer, trafficClassWeights: trafficClassWeights}
+	reloaders = append(reloaders, configReloader.reload)
+	go watchReloadSignal(logger, reloaders)
+	if err := sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid())); err != nil {
+		logger.Printf("Failed to notify systemd: %v", err)
+	}
+	go runWatchdog(logger, pipingServer, listeners)
+	if mqttBroker != "" {
+		go pipingServer.RunMQTTBridge(piping_server.MQTTConfig{Addr: mqttBroker, TopicPrefix: mqttTopicPrefix, ClientID: mqttClientID, Username: mqttUsername, Password: mqttPassword}, stopCh)
+	}
+	if ftpPort != 0 {
+		ftpConfig := piping_server.FTPConfig{Username: ftpUsername, Password: ftpPassword, PublicHost: ftpPublicHost}
+		if ftpPassivePorts != "" {
+			min, max, _ := strings.Cut(ftpPassivePorts, "-")
+			portMin, err1 := strconv.ParseUint(min, 10, 16)
+			portMax, err2 := strconv.ParseUint(max, 10, 16)
+			if err1 != nil || err2 != nil || portMin == 0 || portMin > portMax {
+				return fmt.Errorf("invalid FTP passive ports: %s (e.g. 30000-30100)", ftpPassivePorts)
 			}
-			go func() {
-				logger.Printf("Listening HTTPS on %d...\n", httpsPort)
-				errCh <- http.ListenAndServeTLS(fmt.Sprintf(":%d", httpsPort), crtPath, keyPath, http.HandlerFunc(pipingServer.Handler))
-			}()
-			if enableHttp3 {
-				go func() {
-					logger.Printf("Listening HTTP/3 on %d...\n", httpsPort)
-					errCh <- http3.ListenAndServeQUIC(fmt.Sprintf(":%d", httpsPort), crtPath, keyPath, http.HandlerFunc(pipingServer.Handler))
-				}()
+			ftpConfig.PassivePortMin, ftpConfig.PassivePortMax = int(portMin), int(portMax)
+		}
+		if ftpTLS {
+			if serverConfig.TLSConfig.GetCertificate == nil {
+				return errors.New("--key-path and --crt-path, or --acme-domains should be specified with --ftp-tls")
 			}
+			ftpConfig.TLSConfig = serverConfig.TLSConfig.Clone()
+		}
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", ftpPort))
+		if err != nil {
+			return err
 		}
+		defer ln.Close()
 		go func() {
-			server := &http.Server{
-				Addr:    fmt.Sprintf(":%d", httpPort),
-				Handler: h2c.NewHandler(http.HandlerFunc(pipingServer.Handler), &http2.Server{}),
+			logger.Printf("Listening FTP on %d...\n", ftpPort)
+			if err := pipingServer.ServeFTP(ln, ftpConfig); !errors.Is(err, net.ErrClosed) {
+				errCh <- err
 			}
-			logger.Printf("Listening HTTP on %d...\n", httpPort)
-			errCh <- server.ListenAndServe()
 		}()
-		return <-errCh
-	},
+	}
+	if sshPort != 0 {
+		sshConfig := piping_server.SSHConfig{Password: sshPassword}
+		hostKeyPath, err := sshHostKeyPath(sshHostKey)
+		if err != nil {
+			return err
+		}
+		hostKey, generated, err := loadSSHHostKey(hostKeyPath)
+		if err != nil {
+			return err
+		}
+		if generated {
+			logger.Printf("Generated an SSH host key in %s", hostKeyPath)
+		}
+		sshConfig.HostKey = hostKey
+		if sshAuthorizedKeys != "" {
+			sshConfig.AuthorizedKeys, err = loadAuthorizedKeys(sshAuthorizedKeys)
+			if err != nil {
+				return err
+			}
+		}
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", sshPort))
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+		go func() {
+			logger.Printf("Listening SSH on %d (host key %s)...\n", sshPort, ssh.FingerprintSHA256(hostKey.PublicKey()))
+			if err := pipingServer.ServeSSH(ln, sshConfig); !errors.Is(err, net.ErrClosed) {
+				errCh <- err
+			}
+		}()
+	}
+	if enableMDNS {
+		addr, isTLS, err := advertisedListener(listeners)
+		if err != nil {
+			return err
+		}
+		service, err := newMDNSService(mdnsName, uint16(addr.Port), basePath, isTLS)
+		if err != nil {
+			return err
+		}
+		go runMDNS(logger, service, stopCh)
+	}
+	if portMapping != "" {
+		if portMapping != "upnp" && portMapping != "natpmp" && portMapping != "auto" {
+			return fmt.Errorf("invalid port mapping: %s (upnp, natpmp or auto)", portMapping)
+		}
+		go func() {
+			mapper, err := newPortMapper(portMapping)
+			if err != nil {
+				logger.Printf("Failed to map ports: %v", err)
+				return
+			}
+			runPortMapping(logger, mapper, mappedPorts(listeners), stopCh)
+		}()
+	}
+	if torControlAddr != "" {
+		target, err := onionTarget(listeners)
+		if err != nil {
+			return err
+		}
+		go runOnionService(logger, torControlAddr, torControlPassword, torKeyPath, target, stopCh)
+	}
+	if kubernetesLease != "" {
+		client, err := newInClusterKubernetesClient()
+		if err != nil {
+			return err
+		}
+		elector := &leaseElector{client: client, namespace: pod.namespace, name: kubernetesLease, identity: pod.name}
+		go runLeaderElection(logger, elector, func(taskStopCh <-chan struct{}) {
+			runSpoolJanitor(logger, pipingServer, taskStopCh)
+		}, stopCh)
+	}
+	for _, r := range []struct {
+		kind string
+		addr string
+	}{{"Consul", consulAddr}, {"etcd", etcdEndpoint}} {
+		if r.addr == "" {
+			continue
+		}
+		u, err := registryURL(r.addr)
+		if err != nil {
+			return err
+		}
+		addr, isTLS, err := advertisedListener(listeners)
+		if err != nil {
+			return err
+		}
+		reg, err := newRegistration(registerName, registerAddress, addr, isTLS, pod, u)
+		if err != nil {
+			return err
+		}
+		client := &http.Client{Timeout: registrationInterval}
+		baseURL := strings.TrimSuffix(u.String(), "/")
+		var registry serviceRegistry = &consulRegistry{baseURL: baseURL, token: consulToken, client: client, registration: reg}
+		if r.kind == "etcd" {
+			registry = &etcdRegistry{baseURL: baseURL, prefix: etcdPrefix, client: client, registration: reg}
+		}
+		go runRegistration(logger, r.kind, registry, pipingServer, listeners, stopCh)
+	}
+	if statsdAddr != "" {
+		tags := statsdTags
+		if pod != nil {
+			tags = append(append([]string{}, statsdTags...), pod.statsdTags()...)
+		}
+		go func() {
+			if err := pipingServer.RunStatsD(piping_server.StatsDConfig{Addr: statsdAddr, Prefix: statsdPrefix, Tags: tags, Interval: statsdInterval}, stopCh); err != nil {
+				logger.Printf("StatsD emitter has failed: %v", err)
+			}
+		}()
+	}
+	select {
+	case err := <-errCh:
+		return err
+	case <-upgradedCh:
+		return nil
+	case <-stopCh:
+		for _, server := range servers {
+			server.Close()
+		}
+		return nil
+	}
 }
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// selfSignedValidity is within the limit of validity which browsers accept for server certificates
+const selfSignedValidity = 825 * 24 * time.Hour
+
+// selfSignedPaths returns the paths of the persisted self-signed certificate and key in the directory
+// (the user config directory if empty)
+func selfSignedPaths(dir string) (string, string, error) {
+	if dir == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return "", "", err
+		}
+		dir = filepath.Join(configDir, "piping-server")
+	}
+	return filepath.Join(dir, "selfsigned.crt"), filepath.Join(dir, "selfsigned.key"), nil
+}
+
+// defaultSelfSignedHosts returns localhost, the hostname and addresses of the interfaces
+func defaultSelfSignedHosts() []string {
+	hosts := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" && hostname != "localhost" {
+		hosts = append(hosts, hostname)
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+			hosts = append(hosts, ipNet.IP.String())
+		}
+	}
+	return hosts
+}
+
+// ensureSelfSignedCertificate generates a self-signed certificate for the hosts (DNS names or IP addresses)
+// unless the files exist, returning true if generated
+func ensureSelfSignedCertificate(crtPath string, keyPath string, hosts []string) (bool, error) {
+	if _, err := os.Stat(crtPath); err == nil {
+		if _, err := os.Stat(keyPath); err == nil {
+			return false, nil
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return false, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{Organization: []string{"Piping Server"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return false, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(crtPath), 0700); err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return false, err
+	}
+	// NOTE: The key is written first so that an existing certificate always has its key
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return false, err
+	}
+	if err := os.WriteFile(crtPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
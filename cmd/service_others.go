@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import "log"
+
+// runAsWindowsService does nothing because services are only for Windows
+func runAsWindowsService(run func(logger *log.Logger, stopCh <-chan struct{}) error) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,157 @@
+//go:build windows
+// +build windows
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const windowsServiceName = "go-piping-server"
+
+func init() {
+	serviceCmd.AddCommand(serviceInstallCmd)
+	serviceCmd.AddCommand(serviceUninstallCmd)
+	RootCmd.AddCommand(serviceCmd)
+}
+
+var serviceCmd = &cobra.Command{
+	Use:   "service",
+	Short: "Manage the Windows service",
+}
+
+var serviceInstallCmd = &cobra.Command{
+	Use:   "install [-- server flags]",
+	Short: "Install as a Windows service running with the flags",
+	Args:  cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		exePath, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		exePath, err = filepath.Abs(exePath)
+		if err != nil {
+			return err
+		}
+		m, err := mgr.Connect()
+		if err != nil {
+			return err
+		}
+		defer m.Disconnect()
+		if s, err := m.OpenService(windowsServiceName); err == nil {
+			s.Close()
+			return fmt.Errorf("service %s already exists", windowsServiceName)
+		}
+		s, err := m.CreateService(windowsServiceName, exePath, mgr.Config{
+			DisplayName: "Piping Server",
+			Description: "Infinitely transfer between any device over pure HTTP",
+			StartType:   mgr.StartAutomatic,
+		}, args...)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		if err := eventlog.InstallAsEventCreate(windowsServiceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+			s.Delete()
+			return err
+		}
+		fmt.Printf("Service %s installed with: %s\n", windowsServiceName, strings.Join(args, " "))
+		return nil
+	},
+}
+
+var serviceUninstallCmd = &cobra.Command{
+	Use:   "uninstall",
+	Short: "Uninstall the Windows service",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		m, err := mgr.Connect()
+		if err != nil {
+			return err
+		}
+		defer m.Disconnect()
+		s, err := m.OpenService(windowsServiceName)
+		if err != nil {
+			return fmt.Errorf("service %s is not installed", windowsServiceName)
+		}
+		defer s.Close()
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		if err := eventlog.Remove(windowsServiceName); err != nil {
+			return err
+		}
+		fmt.Printf("Service %s uninstalled\n", windowsServiceName)
+		return nil
+	},
+}
+
+// eventLogWriter writes log lines to the Windows event log
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	if err := w.elog.Info(1, string(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type windowsService struct {
+	run  func(logger *log.Logger, stopCh <-chan struct{}) error
+	elog *eventlog.Log
+}
+
+func (ws *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	logger := log.New(&eventLogWriter{elog: ws.elog}, "", 0)
+	stopCh := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ws.run(logger, stopCh)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				ws.elog.Error(1, err.Error())
+				return false, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				close(stopCh)
+				<-errCh
+				return false, 0
+			}
+		}
+	}
+}
+
+// runAsWindowsService runs the server under the service control manager if started as a service
+func runAsWindowsService(run func(logger *log.Logger, stopCh <-chan struct{}) error) (bool, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false, err
+	}
+	elog, err := eventlog.Open(windowsServiceName)
+	if err != nil {
+		return true, err
+	}
+	defer elog.Close()
+	return true, svc.Run(windowsServiceName, &windowsService{run: run, elog: elog})
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"net"
+	"time"
+)
+
+// socketOptions tunes accepted TCP connections for long-haul high-latency transfers
+type socketOptions struct {
+	noDelay bool
+	// keepAlive is the keepalive period (0 for the default, negative to disable)
+	keepAlive time.Duration
+	// readBuffer and writeBuffer are the socket buffer sizes (0 for the OS default)
+	readBuffer  int
+	writeBuffer int
+}
+
+// tunedListener applies socketOptions to TCP connections it accepts.
+// NOTE: The connections are returned as is to keep *net.TCPConn for splice(2) of --zero-copy
+type tunedListener struct {
+	net.Listener
+	options socketOptions
+}
+
+func (l tunedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		// NOTE: Failures of setsockopt do not reject the connection
+		l.options.apply(tcpConn)
+	}
+	return conn, nil
+}
+
+func (o socketOptions) apply(conn *net.TCPConn) {
+	conn.SetNoDelay(o.noDelay)
+	if o.keepAlive < 0 {
+		conn.SetKeepAlive(false)
+	} else if o.keepAlive > 0 {
+		conn.SetKeepAlive(true)
+		conn.SetKeepAlivePeriod(o.keepAlive)
+	}
+	if o.readBuffer > 0 {
+		conn.SetReadBuffer(o.readBuffer)
+	}
+	if o.writeBuffer > 0 {
+		conn.SetWriteBuffer(o.writeBuffer)
+	}
+}
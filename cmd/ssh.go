@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshHostKeyPath returns the path of the host key, which is ssh_host_ed25519_key of piping-server in the user config directory if empty
+func sshHostKeyPath(p string) (string, error) {
+	if p != "" {
+		return p, nil
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "piping-server", "ssh_host_ed25519_key"), nil
+}
+
+// loadSSHHostKey loads the host key, generating an Ed25519 key if the file does not exist so that clients can remember it
+func loadSSHHostKey(p string) (ssh.Signer, bool, error) {
+	keyPEM, err := os.ReadFile(p)
+	if err == nil {
+		signer, err := ssh.ParsePrivateKey(keyPEM)
+		return signer, false, err
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, false, err
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, false, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return nil, false, err
+	}
+	if err := os.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return nil, false, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	return signer, true, err
+}
+
+// loadAuthorizedKeys parses the file in the format of authorized_keys of OpenSSH, ignoring options
+func loadAuthorizedKeys(p string) ([]ssh.PublicKey, error) {
+	content, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ssh.PublicKey
+	for len(bytes.TrimSpace(content)) != 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(content)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		content = rest
+	}
+	return keys, nil
+}
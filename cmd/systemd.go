@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	piping_server "github.com/nwtgck/go-piping-server"
+)
+
+// sdNotify sends the state to systemd. It does nothing if not running as a Type=notify unit.
+// ref: https://www.freedesktop.org/software/systemd/man/sd_notify.html
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+	// Abstract socket
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval to pet the systemd watchdog, or 0 if disabled
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	// Pet twice in the watchdog timeout as recommended
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// checkListeners returns an error if a listener does not accept connections
+func checkListeners(listeners []listener, timeout time.Duration) error {
+	for _, ln := range listeners {
+		conn, err := net.DialTimeout(ln.Addr().Network(), ln.Addr().String(), timeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+// runWatchdog pets the systemd watchdog while the server is alive
+func runWatchdog(logger *log.Logger, pipingServer *piping_server.PipingServer, listeners []listener) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := pipingServer.CheckLiveness(interval); err != nil {
+			logger.Printf("Liveness check failed: %v", err)
+			continue
+		}
+		if err := checkListeners(listeners, interval); err != nil {
+			logger.Printf("Liveness check failed: %v", err)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			logger.Printf("Failed to notify systemd: %v", err)
+		}
+	}
+}
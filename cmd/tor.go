@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// torControl is a connection to the control port of Tor
+// ref: https://spec.torproject.org/control-spec/
+type torControl struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+func dialTorControl(addr string, password string) (*torControl, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &torControl{conn: conn, text: textproto.NewConn(conn)}
+	if err := c.authenticate(password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// command sends the command and returns the lines of the reply without status codes
+func (c *torControl) command(format string, args ...interface{}) ([]string, error) {
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return nil, err
+	}
+	var lines []string
+	for {
+		line, err := c.text.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 4 {
+			return nil, fmt.Errorf("malformed reply of Tor: %q", line)
+		}
+		if line[:3] != "250" {
+			return nil, fmt.Errorf("Tor has replied: %s", line)
+		}
+		lines = append(lines, line[4:])
+		if line[3] == ' ' {
+			return lines, nil
+		}
+	}
+}
+
+// authenticate authenticates with the password, or the cookie if Tor allows it
+func (c *torControl) authenticate(password string) error {
+	if password != "" {
+		_, err := c.command("AUTHENTICATE %s", strconv.Quote(password))
+		return err
+	}
+	lines, err := c.command("PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "AUTH METHODS=") {
+			continue
+		}
+		methods := strings.Fields(line)[1]
+		if strings.Contains(methods, "NULL") {
+			_, err := c.command("AUTHENTICATE")
+			return err
+		}
+		if _, cookiePath, ok := strings.Cut(line, "COOKIEFILE="); ok && strings.Contains(methods, "COOKIE") {
+			cookiePath, err := strconv.Unquote(cookiePath)
+			if err != nil {
+				return err
+			}
+			cookie, err := os.ReadFile(cookiePath)
+			if err != nil {
+				return err
+			}
+			_, err = c.command("AUTHENTICATE %s", hex.EncodeToString(cookie))
+			return err
+		}
+	}
+	return errors.New("no supported authentication of the Tor control port (specify --tor-control-password)")
+}
+
+// addOnion publishes the onion service forwarding port 80 to the target until the connection is closed.
+// The key of the service is persisted to keyPath for the same address across restarts unless keyPath is empty.
+func (c *torControl) addOnion(target string, keyPath string) (string, error) {
+	key := "NEW:ED25519-V3"
+	if keyPath != "" {
+		if b, err := os.ReadFile(keyPath); err == nil {
+			key = strings.TrimSpace(string(b))
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	lines, err := c.command("ADD_ONION %s Port=80,%s", key, target)
+	if err != nil {
+		return "", err
+	}
+	var serviceID string
+	for _, line := range lines {
+		if id := strings.TrimPrefix(line, "ServiceID="); id != line {
+			serviceID = id
+		}
+		if privateKey := strings.TrimPrefix(line, "PrivateKey="); privateKey != line && keyPath != "" {
+			if err := os.WriteFile(keyPath, []byte(privateKey+"\n"), 0600); err != nil {
+				return "", err
+			}
+		}
+	}
+	if serviceID == "" {
+		return "", errors.New("no ServiceID in the reply of ADD_ONION")
+	}
+	return serviceID + ".onion", nil
+}
+
+// wait blocks until the control connection is closed, which removes the onion service
+func (c *torControl) wait() error {
+	for {
+		if _, err := c.text.ReadLine(); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *torControl) Close() error {
+	return c.conn.Close()
+}
+
+// torRetryInterval is the interval of reconnecting to Tor
+const torRetryInterval = 10 * time.Second
+
+// onionTarget returns the local address of the first plain HTTP listener on TCP
+func onionTarget(listeners []listener) (string, error) {
+	for _, ln := range listeners {
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok && !ln.tls {
+			return net.JoinHostPort("127.0.0.1", strconv.Itoa(addr.Port)), nil
+		}
+	}
+	return "", errors.New("--tor-control requires a plain HTTP listener on TCP")
+}
+
+// runOnionService publishes the onion service while Tor is reachable until stopCh is closed
+func runOnionService(logger *log.Logger, controlAddr string, password string, keyPath string, target string, stopCh <-chan struct{}) {
+	for {
+		c, err := dialTorControl(controlAddr, password)
+		if err == nil {
+			var onion string
+			onion, err = c.addOnion(target, keyPath)
+			if err == nil {
+				logger.Printf("Published as an onion service: http://%s", onion)
+				done := make(chan struct{})
+				go func() {
+					select {
+					case <-stopCh:
+						c.Close()
+					case <-done:
+					}
+				}()
+				err = c.wait()
+				close(done)
+			}
+			c.Close()
+		}
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+		logger.Printf("Onion service via %s has failed: %v", controlAddr, err)
+		select {
+		case <-time.After(torRetryInterval):
+		case <-stopCh:
+			return
+		}
+	}
+}
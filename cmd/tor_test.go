@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// torExchange is a command expected by the fake control port and its reply
+type torExchange struct {
+	command string
+	reply   []string
+}
+
+// serveFakeTorControl accepts a connection and replies to the commands in order, returning the channel of the first unexpected command
+func serveFakeTorControl(t *testing.T, exchanges []torExchange) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	unexpectedCh := make(chan string, 1)
+	go func() {
+		defer close(unexpectedCh)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		for _, exchange := range exchanges {
+			line, err := text.ReadLine()
+			if err != nil {
+				unexpectedCh <- err.Error()
+				return
+			}
+			if line != exchange.command {
+				unexpectedCh <- line
+				return
+			}
+			for _, reply := range exchange.reply {
+				text.PrintfLine("%s", reply)
+			}
+		}
+	}()
+	return ln.Addr().String(), unexpectedCh
+}
+
+func TestTorControlCookieAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	cookie := []byte("0123456789abcdef0123456789abcdef")
+	cookiePath := filepath.Join(dir, "control_auth_cookie")
+	assert.NilError(t, os.WriteFile(cookiePath, cookie, 0600))
+	keyPath := filepath.Join(dir, "onion.key")
+	addr, unexpectedCh := serveFakeTorControl(t, []torExchange{
+		{"PROTOCOLINFO 1", []string{
+			"250-PROTOCOLINFO 1",
+			"250-AUTH METHODS=COOKIE,SAFECOOKIE COOKIEFILE=" + strconv.Quote(cookiePath),
+			`250-VERSION Tor="0.4.8.9"`,
+			"250 OK",
+		}},
+		{"AUTHENTICATE " + hex.EncodeToString(cookie), []string{"250 OK"}},
+		{"ADD_ONION NEW:ED25519-V3 Port=80,127.0.0.1:8080", []string{
+			"250-ServiceID=abcdefghijklmnopqrstuvwxyz234567abcdefghijklmnopqrstuvwx",
+			"250-PrivateKey=ED25519-V3:c2VjcmV0",
+			"250 OK",
+		}},
+	})
+	c, err := dialTorControl(addr, "")
+	assert.NilError(t, err)
+	defer c.Close()
+	onion, err := c.addOnion("127.0.0.1:8080", keyPath)
+	assert.NilError(t, err)
+	assert.Equal(t, onion, "abcdefghijklmnopqrstuvwxyz234567abcdefghijklmnopqrstuvwx.onion")
+	key, err := os.ReadFile(keyPath)
+	assert.NilError(t, err)
+	assert.Equal(t, string(key), "ED25519-V3:c2VjcmV0\n")
+	c.Close()
+	assert.Equal(t, <-unexpectedCh, "")
+
+	// The persisted key publishes the same address
+	addr, unexpectedCh = serveFakeTorControl(t, []torExchange{
+		{`AUTHENTICATE "pass\"word"`, []string{"250 OK"}},
+		{"ADD_ONION ED25519-V3:c2VjcmV0 Port=80,127.0.0.1:8080", []string{
+			"250-ServiceID=abcdefghijklmnopqrstuvwxyz234567abcdefghijklmnopqrstuvwx",
+			"250 OK",
+		}},
+	})
+	c, err = dialTorControl(addr, `pass"word`)
+	assert.NilError(t, err)
+	defer c.Close()
+	onion, err = c.addOnion("127.0.0.1:8080", keyPath)
+	assert.NilError(t, err)
+	assert.Equal(t, onion, "abcdefghijklmnopqrstuvwxyz234567abcdefghijklmnopqrstuvwx.onion")
+	c.Close()
+	assert.Equal(t, <-unexpectedCh, "")
+}
+
+func TestTorControlErrors(t *testing.T) {
+	addr, _ := serveFakeTorControl(t, []torExchange{
+		{`AUTHENTICATE "wrong"`, []string{"515 Authentication failed: Password did not match HashedControlPassword value from configuration"}},
+	})
+	_, err := dialTorControl(addr, "wrong")
+	assert.ErrorContains(t, err, "Tor has replied: 515 Authentication failed")
+
+	addr, _ = serveFakeTorControl(t, []torExchange{
+		{"PROTOCOLINFO 1", []string{"250-PROTOCOLINFO 1", "250-AUTH METHODS=HASHEDPASSWORD", "250 OK"}},
+	})
+	_, err = dialTorControl(addr, "")
+	assert.ErrorContains(t, err, "no supported authentication")
+
+	addr, _ = serveFakeTorControl(t, []torExchange{
+		{"PROTOCOLINFO 1", []string{"250-PROTOCOLINFO 1", "250-AUTH METHODS=NULL", "250 OK"}},
+		{"AUTHENTICATE", []string{"250 OK"}},
+		{"ADD_ONION NEW:ED25519-V3 Port=80,127.0.0.1:8080", []string{"250 OK"}},
+	})
+	c, err := dialTorControl(addr, "")
+	assert.NilError(t, err)
+	defer c.Close()
+	_, err = c.addOnion("127.0.0.1:8080", "")
+	assert.ErrorContains(t, err, "no ServiceID")
+}
+
+func TestOnionTarget(t *testing.T) {
+	tlsLn, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer tlsLn.Close()
+	plainLn, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer plainLn.Close()
+	target, err := onionTarget([]listener{{Listener: tlsLn, tls: true}, {Listener: plainLn}})
+	assert.NilError(t, err)
+	assert.Equal(t, target, net.JoinHostPort("127.0.0.1", strconv.Itoa(plainLn.Addr().(*net.TCPAddr).Port)))
+	_, err = onionTarget([]listener{{Listener: tlsLn, tls: true}})
+	assert.ErrorContains(t, err, "plain HTTP listener")
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// upgradeFdsEnv passes the listeners to the upgraded process.
+// Each of ","-separated entries is "<name>|<tls, mtls or plain>" of the file descriptor 3, 4, ...
+const upgradeFdsEnv = "PIPING_UPGRADE_FDS"
+
+// inheritedListeners returns the listeners passed by the previous process, or nil if not upgraded
+func inheritedListeners() ([]listener, error) {
+	entries := os.Getenv(upgradeFdsEnv)
+	if entries == "" {
+		return nil, nil
+	}
+	os.Unsetenv(upgradeFdsEnv)
+	var listeners []listener
+	for i, entry := range strings.Split(entries, ",") {
+		name, kind, _ := strings.Cut(entry, "|")
+		f := os.NewFile(uintptr(3+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener{Listener: ln, name: name, tls: kind == "tls" || kind == "mtls", mtls: kind == "mtls"})
+	}
+	return listeners, nil
+}
+
+// startUpgradedProcess starts the (possibly replaced) executable with the listeners
+func startUpgradedProcess(listeners []listener) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var entries []string
+	var files []*os.File
+	for _, ln := range listeners {
+		filer, ok := ln.Listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("cannot pass the listener %s", ln.name)
+		}
+		f, err := filer.File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		files = append(files, f)
+		kind := "plain"
+		if ln.mtls {
+			kind = "mtls"
+		} else if ln.tls {
+			kind = "tls"
+		}
+		entries = append(entries, ln.name+"|"+kind)
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), upgradeFdsEnv+"="+strings.Join(entries, ","))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	return cmd.Start()
+}
+
+// shutdownServers stops accepting and waits for all active transfers
+func shutdownServers(servers []*http.Server) {
+	wg := new(sync.WaitGroup)
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			server.Shutdown(context.Background())
+		}(server)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchUpgradeSignal hands the listeners over to a new process on SIGUSR2
+// and closes upgradedCh after the active transfers finish
+func watchUpgradeSignal(logger *log.Logger, listeners []listener, servers []*http.Server, upgradedCh chan<- struct{}) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR2)
+	for range sigCh {
+		logger.Printf("Upgrading...")
+		if err := startUpgradedProcess(listeners); err != nil {
+			logger.Printf("Failed to upgrade: %v", err)
+			continue
+		}
+		signal.Stop(sigCh)
+		// NOTE: The upgraded process notifies its MAINPID when ready
+		logger.Printf("Waiting for active transfers to finish before exit...")
+		shutdownServers(servers)
+		close(upgradedCh)
+		return
+	}
+}
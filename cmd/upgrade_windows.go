@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package cmd
+
+import (
+	"log"
+	"net/http"
+)
+
+// watchUpgradeSignal does nothing because Windows has no SIGUSR2
+func watchUpgradeSignal(logger *log.Logger, listeners []listener, servers []*http.Server, upgradedCh chan<- struct{}) {
+}
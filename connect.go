@@ -0,0 +1,134 @@
+package piping_server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const connectEstablished = "HTTP/1.1 200 Connection Established\r\n\r\n"
+
+// tunnelConn is a hijacked connection with data already buffered by the server
+type tunnelConn struct {
+	conn net.Conn
+	r    io.Reader
+}
+
+type tunnelWaiter struct {
+	connCh chan tunnelConn
+}
+
+type tunnels struct {
+	mutex   sync.Mutex
+	waiters map[string]*tunnelWaiter
+}
+
+func newTunnels() *tunnels {
+	return &tunnels{waiters: map[string]*tunnelWaiter{}}
+}
+
+func hijackTunnel(resWriter http.ResponseWriter) (tunnelConn, error) {
+	hijacker, ok := resWriter.(http.Hijacker)
+	if !ok {
+		return tunnelConn{}, fmt.Errorf("hijacking is not supported")
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return tunnelConn{}, err
+	}
+	if _, err := conn.Write([]byte(connectEstablished)); err != nil {
+		conn.Close()
+		return tunnelConn{}, err
+	}
+	return tunnelConn{conn: conn, r: io.MultiReader(io.LimitReader(buf, int64(buf.Reader.Buffered())), conn)}, nil
+}
+
+// handleConnect pairs two CONNECT requests with the same authority (e.g. "CONNECT mytunnel:1")
+// and relays bytes between the connections in both directions
+func (s *PipingServer) handleConnect(resWriter http.ResponseWriter, req *http.Request) {
+	if req.ProtoMajor != 1 {
+		s.writeError(resWriter, req, 505, ErrorCodeBadRequest, "CONNECT is supported only in HTTP/1.1.")
+		return
+	}
+	name := req.Host
+	maxDuration := s.maxDuration(req)
+	s.tunnels.mutex.Lock()
+	waiter, ok := s.tunnels.waiters[name]
+	if ok {
+		delete(s.tunnels.waiters, name)
+		s.tunnels.mutex.Unlock()
+		conn, err := hijackTunnel(resWriter)
+		if err != nil {
+			s.logf(req, "Failed to hijack the tunnel %s: %v", name, err)
+			close(waiter.connCh)
+			return
+		}
+		s.infof(req, "Tunnel %s has been established", name)
+		waiter.connCh <- conn
+		return
+	}
+	waiter = &tunnelWaiter{connCh: make(chan tunnelConn, 1)}
+	s.tunnels.waiters[name] = waiter
+	s.tunnels.mutex.Unlock()
+
+	timeoutCh, stopTimer := s.timeoutChannel(maxDuration)
+	defer stopTimer()
+	var peer tunnelConn
+	paired := false
+	select {
+	case peer, paired = <-waiter.connCh:
+	case <-req.Context().Done():
+	case <-timeoutCh:
+	}
+	if !paired {
+		s.tunnels.mutex.Lock()
+		if s.tunnels.waiters[name] == waiter {
+			delete(s.tunnels.waiters, name)
+			s.tunnels.mutex.Unlock()
+			s.writeError(resWriter, req, 408, ErrorCodeTimeout, fmt.Sprintf("No peer connected to the tunnel '%s' within %s.", name, maxDuration))
+			return
+		}
+		s.tunnels.mutex.Unlock()
+		// NOTE: The peer has taken this waiter just before giving up
+		if peer, paired = <-waiter.connCh; paired {
+			peer.conn.Close()
+			return
+		}
+		s.writeError(resWriter, req, 502, ErrorCodeBadRequest, fmt.Sprintf("The peer of the tunnel '%s' has failed.", name))
+		return
+	}
+	conn, err := hijackTunnel(resWriter)
+	if err != nil {
+		s.logf(req, "Failed to hijack the tunnel %s: %v", name, err)
+		peer.conn.Close()
+		return
+	}
+	if maxDuration > 0 {
+		deadline := time.Now().Add(maxDuration)
+		conn.conn.SetDeadline(deadline)
+		peer.conn.SetDeadline(deadline)
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go relayTunnel(&wg, peer.conn, conn.r)
+	go relayTunnel(&wg, conn.conn, peer.r)
+	wg.Wait()
+	conn.conn.Close()
+	peer.conn.Close()
+	s.infof(req, "Tunnel %s has been closed", name)
+}
+
+// relayTunnel copies until EOF and half-closes the destination to tell it to the peer
+func relayTunnel(wg *sync.WaitGroup, dst net.Conn, src io.Reader) {
+	defer wg.Done()
+	_, err := io.Copy(dst, src)
+	if closeWriter, ok := dst.(interface{ CloseWrite() error }); ok && err == nil {
+		closeWriter.CloseWrite()
+		return
+	}
+	// NOTE: Closing also stops the copy in the other direction
+	dst.Close()
+}
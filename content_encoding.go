@@ -0,0 +1,264 @@
+package piping_server
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const zstdEncoding = "zstd"
+
+// zstdMaxWindowSize is the window size of zstd recommended for Content-Encoding by RFC 8878 not to let a sender make the server allocate much memory
+const zstdMaxWindowSize = 8 << 20
+
+// errInvalidContentEncoding is the error of a body which cannot be decoded by its Content-Encoding
+var errInvalidContentEncoding = errors.New("invalid Content-Encoding body")
+
+// errUnsupportedContentEncoding is the error of a Content-Encoding which the receiver does not accept and the server cannot decode
+var errUnsupportedContentEncoding = errors.New("unsupported Content-Encoding")
+
+// decodableContentEncoding returns true if the server can decompress the encoding (br cannot)
+func decodableContentEncoding(encoding string) bool {
+	switch encoding {
+	case "gzip", "deflate", zstdEncoding:
+		return true
+	}
+	return false
+}
+
+// normalizeContentEncoding returns the lower-case name of the encoding, "" for identity
+func normalizeContentEncoding(contentEncoding string) string {
+	encoding := strings.ToLower(strings.TrimSpace(contentEncoding))
+	switch encoding {
+	case "identity":
+		return ""
+	case "x-gzip":
+		return "gzip"
+	}
+	return encoding
+}
+
+// checkContentEncoding returns errUnsupportedContentEncoding if the receiver can get neither the encoded body nor the decoded one.
+// reencoded is true if the receiver gets another representation, which has no Content-Encoding.
+func checkContentEncoding(acceptEncoding string, contentEncoding string, reencoded bool) error {
+	encoding := normalizeContentEncoding(contentEncoding)
+	if encoding == "" || reencoded || decodableContentEncoding(encoding) || acceptsContentEncoding(acceptEncoding, encoding) {
+		return nil
+	}
+	return fmt.Errorf("%w: the receiver does not accept Content-Encoding '%s', which the server cannot decode", errUnsupportedContentEncoding, contentEncoding)
+}
+
+// acceptsContentEncoding returns true if Accept-Encoding accepts the encoding by its name or "*" with a non-zero q-value
+func acceptsContentEncoding(acceptEncoding string, encoding string) bool {
+	wildcard := false
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		accepted := true
+		if key, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(key) == "q" {
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			accepted = err == nil && q > 0
+		}
+		switch name {
+		case encoding:
+			return accepted
+		case "*":
+			wildcard = accepted
+		}
+	}
+	return wildcard
+}
+
+// contentDecodingReader decompresses the body, reading the header of the format on the first read not to block before the transfer
+type contentDecodingReader struct {
+	r        io.Reader
+	encoding string
+	decoder  io.Reader
+	// zstd is closed at the end of the body to release its buffers
+	zstd *zstd.Decoder
+	// srcErr is the last error of r, which is not an error of the format
+	srcErr error
+	// err is the end of the closed zstd
+	err error
+}
+
+func (r *contentDecodingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.decoder == nil {
+		var err error
+		switch r.encoding {
+		case "deflate":
+			r.decoder, err = zlib.NewReader(r.r)
+		case zstdEncoding:
+			r.zstd, err = zstd.NewReader(readerFunc(r.readSource), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindowSize))
+			r.decoder = r.zstd
+		default:
+			r.decoder, err = gzip.NewReader(r.r)
+		}
+		if err != nil {
+			return 0, decodingError(err)
+		}
+	}
+	n, err := r.decoder.Read(p)
+	if err != nil && r.zstd != nil {
+		r.zstd.Close()
+		if err != io.EOF && err != r.srcErr {
+			err = fmt.Errorf("%w: %v", errInvalidContentEncoding, err)
+		}
+		r.err = err
+		return n, err
+	}
+	if err != nil && err != io.EOF {
+		err = decodingError(err)
+	}
+	return n, err
+}
+
+// readSource reads r, keeping its error to tell it from errors of zstd
+func (r *contentDecodingReader) readSource(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.srcErr = err
+	}
+	return n, err
+}
+
+// readerFunc is an io.Reader of the function
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+// decodingError wraps errors of the format with errInvalidContentEncoding, leaving errors of the sender such as timeouts
+func decodingError(err error) error {
+	var corruptErr flate.CorruptInputError
+	if errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) || errors.Is(err, zlib.ErrHeader) || errors.Is(err, zlib.ErrChecksum) || errors.As(err, &corruptErr) || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: %v", errInvalidContentEncoding, err)
+	}
+	return err
+}
+
+// contentEncoder is a compressor such as gzip.Writer and zstd.Encoder
+type contentEncoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// contentEncodingReader compresses the stream while reading, flushing each read so that the receiver gets it without delay
+type contentEncodingReader struct {
+	r       io.Reader
+	encoded bytes.Buffer
+	encoder contentEncoder
+	eof     bool
+	buf     []byte
+}
+
+func newGzipEncodingReader(r io.Reader) *contentEncodingReader {
+	reader := &contentEncodingReader{r: r, buf: make([]byte, 32*1024)}
+	reader.encoder = gzip.NewWriter(&reader.encoded)
+	return reader
+}
+
+func newZstdEncodingReader(r io.Reader) *contentEncodingReader {
+	reader := &contentEncodingReader{r: r, buf: make([]byte, 32*1024)}
+	// NOTE: The options are valid, so that NewWriter never fails
+	reader.encoder, _ = zstd.NewWriter(&reader.encoded, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(zstdMaxWindowSize))
+	return reader
+}
+
+func (r *contentEncodingReader) Read(p []byte) (int, error) {
+	for r.encoded.Len() == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		n, err := r.r.Read(r.buf)
+		r.encoder.Write(r.buf[:n])
+		if err == io.EOF {
+			r.eof = true
+			r.encoder.Close()
+			continue
+		}
+		if err != nil {
+			r.encoder.Close()
+			return 0, err
+		}
+		if n != 0 {
+			r.encoder.Flush()
+		}
+	}
+	return r.encoded.Read(p)
+}
+
+// compressRequested returns true for "compress=zstd", or an error for other codecs
+func (s *PipingServer) compressRequested(req *http.Request) (bool, error) {
+	switch codec := req.URL.Query().Get("compress"); codec {
+	case "":
+		return false, nil
+	case zstdEncoding:
+		if !s.TranscodeContentEncoding {
+			return false, errors.New("Compression is disabled.")
+		}
+		return true, nil
+	default:
+		return false, fmt.Errorf("Unsupported compression '%s'. (zstd)", codec)
+	}
+}
+
+// compressForReceiver compresses the body without Content-Encoding into zstd for the receiver accepting it by acceptEncoding.
+// It returns true if the body has been compressed.
+func (s *PipingServer) compressForReceiver(req *http.Request, acceptEncoding string, receiverHeader http.Header, body io.Reader, reencoded bool) (io.Reader, bool) {
+	if reencoded {
+		return body, false
+	}
+	receiverHeader.Add("Vary", "Accept-Encoding")
+	if !acceptsContentEncoding(acceptEncoding, zstdEncoding) {
+		return body, false
+	}
+	s.debugf(req, "Compressing into zstd for the receiver")
+	receiverHeader.Del("Content-Length")
+	receiverHeader.Set("Content-Encoding", zstdEncoding)
+	return newZstdEncodingReader(body), true
+}
+
+// negotiateContentEncoding passes the body with the Content-Encoding of the sender to the receiver accepting it by acceptEncoding.
+// Otherwise it decompresses gzip or deflate, recompressing it into gzip if the receiver accepts gzip.
+// reencoded is true if the receiver gets another representation such as base64 or ciphertext, which has no Content-Encoding.
+// The encoding has to be checked by checkContentEncoding beforehand. It returns true if the body has been transcoded.
+func (s *PipingServer) negotiateContentEncoding(req *http.Request, acceptEncoding string, receiverHeader http.Header, contentEncoding string, body io.Reader, reencoded bool) (io.Reader, bool) {
+	encoding := normalizeContentEncoding(contentEncoding)
+	if encoding == "" {
+		return body, false
+	}
+	if !reencoded {
+		receiverHeader.Add("Vary", "Accept-Encoding")
+		if acceptsContentEncoding(acceptEncoding, encoding) {
+			receiverHeader.Set("Content-Encoding", contentEncoding)
+			return body, false
+		}
+	}
+	if !decodableContentEncoding(encoding) {
+		// The receiver gets the other representation of the encoded body
+		return body, false
+	}
+	receiverHeader.Del("Content-Length")
+	body = &contentDecodingReader{r: body, encoding: encoding}
+	if !reencoded && acceptsContentEncoding(acceptEncoding, "gzip") {
+		s.debugf(req, "Transcoding %s into gzip for the receiver", contentEncoding)
+		receiverHeader.Set("Content-Encoding", "gzip")
+		return newGzipEncodingReader(body), true
+	}
+	s.debugf(req, "Decoding %s for the receiver", contentEncoding)
+	return body, true
+}
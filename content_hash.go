@@ -0,0 +1,70 @@
+package piping_server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var errContentBlocked = errors.New("content is blocked")
+
+// LoadBlockedHashes reads hex-encoded SHA-256 hashes, one per line, ignoring empty lines and comments starting with "#"
+func LoadBlockedHashes(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hashes := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.ToLower(strings.Fields(line)[0])
+		if b, err := hex.DecodeString(line); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: invalid SHA-256 hash %q", path, lineNumber, line)
+		}
+		hashes[line] = true
+	}
+	return hashes, scanner.Err()
+}
+
+// isContentHashed returns true if contents are hashed to be checked against blocked hashes or recorded for abuse reports
+func (s *PipingServer) isContentHashed() bool {
+	return len(s.blockedSHA256()) != 0 || s.abuse != nil
+}
+
+// newContentHash returns the hash of the content read from the returned reader, or nil if contents are not hashed
+func (s *PipingServer) newContentHash(r io.Reader) (hash.Hash, io.Reader) {
+	if !s.isContentHashed() {
+		return nil, r
+	}
+	h := sha256.New()
+	return h, io.TeeReader(r, h)
+}
+
+// checkContentHash returns errContentBlocked if the hash is blocked by BlockedSHA256 or confirmed abuse reports
+func (s *PipingServer) checkContentHash(req *http.Request, pi *pipe, h hash.Hash) error {
+	sum := hex.EncodeToString(h.Sum(nil))
+	blocked := s.blockedSHA256()[sum]
+	if s.abuse != nil {
+		if pi != nil {
+			s.abuse.setTransferHash(pi.transferID, sum)
+		}
+		blocked = blocked || s.abuse.isBlockedHash(sum)
+	}
+	if !blocked {
+		return nil
+	}
+	s.logf(req, "Content of %s with SHA-256 %s is blocked", req.URL.Path, sum)
+	return fmt.Errorf("%w: SHA-256 %s", errContentBlocked, sum)
+}
@@ -0,0 +1,41 @@
+package piping_server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// defaultAllowedRequestHeaders are request headers always allowed by preflight
+var defaultAllowedRequestHeaders = []string{"Content-Type", "Content-Disposition", "X-Piping"}
+
+// isAllowedRequestHeader returns true if browsers may send the header
+func (s *PipingServer) isAllowedRequestHeader(header string) bool {
+	canonical := http.CanonicalHeaderKey(header)
+	if strings.HasPrefix(canonical, "X-Piping-") {
+		return true
+	}
+	for _, h := range append(defaultAllowedRequestHeaders, s.AllowedRequestHeaders...) {
+		if http.CanonicalHeaderKey(h) == canonical {
+			return true
+		}
+	}
+	return false
+}
+
+// allowRequestHeaders returns the value of Access-Control-Allow-Headers reflecting allowed headers in Access-Control-Request-Headers
+func (s *PipingServer) allowRequestHeaders(req *http.Request) string {
+	requestHeaders := req.Header.Values("Access-Control-Request-Headers")
+	if len(requestHeaders) == 0 {
+		return strings.Join(append(defaultAllowedRequestHeaders, s.AllowedRequestHeaders...), ", ")
+	}
+	var allowed []string
+	for _, requestHeader := range requestHeaders {
+		for _, header := range strings.Split(requestHeader, ",") {
+			header = strings.TrimSpace(header)
+			if header != "" && s.isAllowedRequestHeader(header) {
+				allowed = append(allowed, header)
+			}
+		}
+	}
+	return strings.Join(allowed, ", ")
+}
@@ -0,0 +1,221 @@
+package piping_server
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+const davPathPrefix = "/dav/"
+
+func isDAVPath(path string) bool {
+	return path == strings.TrimSuffix(davPathPrefix, "/") || strings.HasPrefix(path, davPathPrefix)
+}
+
+// isDAVJunk returns true for files which file managers create beside files, such as AppleDouble files of Finder
+func isDAVJunk(name string) bool {
+	return strings.HasPrefix(name, "._") || name == ".DS_Store" || name == "desktop.ini" || name == "Thumbs.db"
+}
+
+// davEntry is a file or a directory in a collection
+type davEntry struct {
+	name          string
+	isCollection  bool
+	contentLength string
+	contentType   string
+}
+
+// davEntries lists waiting senders and spooled bodies directly under the pipe directory such as "/p/dir/"
+func (s *PipingServer) davEntries(dir string) []davEntry {
+	entries := map[string]davEntry{}
+	for p, header := range s.waitingSenders() {
+		if !strings.HasPrefix(p, dir) {
+			continue
+		}
+		name := strings.TrimPrefix(p, dir)
+		if i := strings.Index(name, "/"); i >= 0 {
+			entries[name[:i]] = davEntry{name: name[:i], isCollection: true}
+			continue
+		}
+		if name == "" {
+			continue
+		}
+		entries[name] = davEntry{name: name, contentLength: header.Get("Content-Length"), contentType: header.Get("Content-Type")}
+	}
+	list := make([]davEntry, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// davHref returns the href of the path in /dav/ seen by clients
+func (s *PipingServer) davHref(req *http.Request, p string) string {
+	return (&url.URL{Path: s.externalBaseOf(req).BasePath + p}).EscapedPath()
+}
+
+// writeDAVResponse writes a response element of a multistatus
+func writeDAVResponse(w io.Writer, href string, entry davEntry) {
+	fmt.Fprintf(w, "<D:response><D:href>")
+	xml.EscapeText(w, []byte(href))
+	fmt.Fprintf(w, "</D:href><D:propstat><D:prop>")
+	fmt.Fprintf(w, "<D:displayname>")
+	xml.EscapeText(w, []byte(entry.name))
+	fmt.Fprintf(w, "</D:displayname>")
+	if entry.isCollection {
+		fmt.Fprintf(w, "<D:resourcetype><D:collection/></D:resourcetype>")
+	} else {
+		fmt.Fprintf(w, "<D:resourcetype/>")
+		if entry.contentLength != "" {
+			fmt.Fprintf(w, "<D:getcontentlength>")
+			xml.EscapeText(w, []byte(entry.contentLength))
+			fmt.Fprintf(w, "</D:getcontentlength>")
+		}
+		if entry.contentType != "" {
+			fmt.Fprintf(w, "<D:getcontenttype>")
+			xml.EscapeText(w, []byte(entry.contentType))
+			fmt.Fprintf(w, "</D:getcontenttype>")
+		}
+	}
+	fmt.Fprintf(w, "</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>")
+}
+
+// handlePropfind lists the collection, or the file if a sender is waiting or its body is spooled
+func (s *PipingServer) handlePropfind(resWriter http.ResponseWriter, req *http.Request, davPath string) {
+	io.Copy(io.Discard, io.LimitReader(req.Body, 64*1024))
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n" + `<D:multistatus xmlns:D="DAV:">`)
+	if strings.HasSuffix(davPath, "/") {
+		writeDAVResponse(&body, s.davHref(req, davPath), davEntry{name: path.Base(davPath), isCollection: true})
+		// NOTE: "Depth: infinity" is not supported as allowed by RFC 4918
+		if req.Header.Get("Depth") != "0" {
+			for _, entry := range s.davEntries("/p/" + strings.TrimPrefix(davPath, davPathPrefix)) {
+				p := davPath + entry.name
+				if entry.isCollection {
+					p += "/"
+				}
+				writeDAVResponse(&body, s.davHref(req, p), entry)
+			}
+		}
+	} else {
+		dir, name := path.Split(davPath)
+		found := false
+		for _, entry := range s.davEntries("/p/" + strings.TrimPrefix(dir, davPathPrefix)) {
+			if entry.name == name {
+				p := davPath
+				if entry.isCollection {
+					p += "/"
+				}
+				writeDAVResponse(&body, s.davHref(req, p), entry)
+				found = true
+			}
+		}
+		if !found {
+			http.NotFound(resWriter, req)
+			return
+		}
+	}
+	body.WriteString("</D:multistatus>\n")
+	resWriter.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	resWriter.WriteHeader(207)
+	io.WriteString(resWriter, body.String())
+}
+
+// handleLock grants a write lock which locks nothing, since Finder mounts collections read-only unless locking is supported
+func (s *PipingServer) handleLock(resWriter http.ResponseWriter, req *http.Request) {
+	io.Copy(io.Discard, io.LimitReader(req.Body, 64*1024))
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(s.random(), b); err != nil {
+		http.Error(resWriter, "500 Internal Server Error", 500)
+		return
+	}
+	token := "opaquelocktoken:" + hex.EncodeToString(b)
+	resWriter.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	resWriter.Header().Set("Lock-Token", "<"+token+">")
+	resWriter.WriteHeader(200)
+	fmt.Fprintf(resWriter, `<?xml version="1.0" encoding="utf-8"?>
+<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock><D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope><D:depth>0</D:depth><D:timeout>Second-3600</D:timeout><D:locktoken><D:href>%s</D:href></D:locktoken></D:activelock></D:lockdiscovery></D:prop>
+`, token)
+}
+
+// handleWebDAV implements WebDAV enough for file managers to mount /dav/ and drop a file into the pipe of the same path.
+// It returns the request rewritten to the pipe for GET, HEAD and PUT of files, or false after responding other methods.
+func (s *PipingServer) handleWebDAV(resWriter http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	davPath := req.URL.Path
+	if davPath == strings.TrimSuffix(davPathPrefix, "/") {
+		davPath = davPathPrefix
+	}
+	isCollection := strings.HasSuffix(davPath, "/")
+	name := path.Base(davPath)
+	resWriter.Header().Set("DAV", "1, 2")
+	resWriter.Header().Set("MS-Author-Via", "DAV")
+	switch req.Method {
+	case "OPTIONS":
+		resWriter.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, PROPPATCH, MKCOL, LOCK, UNLOCK")
+		resWriter.Header().Set("Content-Length", "0")
+		resWriter.WriteHeader(200)
+		return nil, false
+	case "PROPFIND":
+		s.handlePropfind(resWriter, req, davPath)
+		return nil, false
+	case "PROPPATCH":
+		// NOTE: Clients set times of files after PUT, which are accepted and discarded
+		io.Copy(io.Discard, io.LimitReader(req.Body, 64*1024))
+		resWriter.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		resWriter.WriteHeader(207)
+		io.WriteString(resWriter, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+`<D:multistatus xmlns:D="DAV:"><D:response><D:href>`)
+		xml.EscapeText(resWriter, []byte(s.davHref(req, davPath)))
+		io.WriteString(resWriter, "</D:href><D:propstat><D:prop/><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response></D:multistatus>\n")
+		return nil, false
+	case "LOCK":
+		s.handleLock(resWriter, req)
+		return nil, false
+	case "UNLOCK", "DELETE":
+		resWriter.WriteHeader(204)
+		return nil, false
+	case "MKCOL":
+		// NOTE: Directories exist virtually as prefixes of paths
+		resWriter.WriteHeader(201)
+		return nil, false
+	case "GET", "HEAD":
+		if isCollection {
+			s.writeError(resWriter, req, 405, ErrorCodeMethodNotAllowed, "A collection cannot be received.")
+			return nil, false
+		}
+	case "PUT":
+		if isCollection {
+			s.writeError(resWriter, req, 405, ErrorCodeMethodNotAllowed, "A collection cannot be sent.")
+			return nil, false
+		}
+		// NOTE: Windows creates an empty file before writing the content
+		if req.ContentLength == 0 || isDAVJunk(name) {
+			io.Copy(io.Discard, io.LimitReader(req.Body, 1024*1024))
+			resWriter.WriteHeader(201)
+			return nil, false
+		}
+	default:
+		resWriter.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, PROPPATCH, MKCOL, LOCK, UNLOCK")
+		s.writeError(resWriter, req, 405, ErrorCodeMethodNotAllowed, fmt.Sprintf("Unsupported method: %s.", req.Method))
+		return nil, false
+	}
+	r2 := new(http.Request)
+	*r2 = *req
+	r2.URL = new(url.URL)
+	*r2.URL = *req.URL
+	r2.URL.Path = "/p/" + strings.TrimPrefix(davPath, davPathPrefix)
+	r2.URL.RawPath = ""
+	if req.Method == "PUT" && s.spool != nil {
+		// NOTE: Spools the body if no receiver is waiting, since clients time out waiting for receivers
+		query := r2.URL.Query()
+		query.Set("spool", "true")
+		r2.URL.RawQuery = query.Encode()
+	}
+	return r2, true
+}
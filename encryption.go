@@ -0,0 +1,292 @@
+package piping_server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const encryptionAES256GCM = "aes-256-gcm"
+
+// Request headers of server-side encryption.
+// A sender specifies a key or a password to encrypt, and a receiver specifies the same one to decrypt.
+// NOTE: The key is a base64-encoded 32-byte key
+const (
+	encryptHeader         = "X-Piping-Encrypt"
+	encryptKeyHeader      = "X-Piping-Encrypt-Key"
+	encryptPasswordHeader = "X-Piping-Encrypt-Password"
+	decryptKeyHeader      = "X-Piping-Decrypt-Key"
+	decryptPasswordHeader = "X-Piping-Decrypt-Password"
+	// encryptedHeader tells a receiver the algorithm of the ciphertext
+	encryptedHeader = "X-Piping-Encrypted"
+)
+
+// The encrypted stream consists of a header and chunks.
+//
+//	header: magic (6) | key derivation (1) | salt (16) | nonce prefix (7)
+//	chunk:  final flag (1) | length of sealed (4) | sealed
+//
+// The nonce of a chunk is the nonce prefix, the big-endian counter (4) and the final flag (1),
+// so reordered, truncated or extended streams fail to be decrypted.
+var encryptionMagic = []byte("PIPE\x00\x01")
+
+const (
+	keyDerivationRaw    byte = 0
+	keyDerivationScrypt byte = 1
+)
+
+const (
+	encryptionSaltSize        = 16
+	encryptionNoncePrefixSize = 7
+	encryptionMaxChunkSize    = 64 * 1024
+)
+
+var errDecryptionFailed = errors.New("decryption failed")
+
+// encryptionKey is the key or the password specified by headers
+type encryptionKey struct {
+	key      []byte
+	password string
+}
+
+// parseEncryptionKey parses the key or the password in the headers, returning nil if neither is specified
+func parseEncryptionKey(header http.Header, keyHeader string, passwordHeader string) (*encryptionKey, error) {
+	if password := header.Get(passwordHeader); password != "" {
+		return &encryptionKey{password: password}, nil
+	}
+	rawKey := header.Get(keyHeader)
+	if rawKey == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(rawKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s should be a base64-encoded 32-byte key", keyHeader)
+	}
+	return &encryptionKey{key: key}, nil
+}
+
+// parseSenderEncryption returns the key to encrypt with if X-Piping-Encrypt is specified
+func parseSenderEncryption(header http.Header) (*encryptionKey, error) {
+	algorithm := header.Get(encryptHeader)
+	if algorithm == "" {
+		return nil, nil
+	}
+	if strings.ToLower(algorithm) != encryptionAES256GCM {
+		return nil, fmt.Errorf("unsupported %s: %s", encryptHeader, algorithm)
+	}
+	key, err := parseEncryptionKey(header, encryptKeyHeader, encryptPasswordHeader)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%s or %s should be specified", encryptKeyHeader, encryptPasswordHeader)
+	}
+	return key, nil
+}
+
+func (k *encryptionKey) derive(derivation byte, salt []byte) ([]byte, error) {
+	switch derivation {
+	case keyDerivationRaw:
+		if k.key == nil {
+			return nil, errors.New("the stream was encrypted with a key")
+		}
+		return k.key, nil
+	case keyDerivationScrypt:
+		if k.key != nil {
+			return nil, errors.New("the stream was encrypted with a password")
+		}
+		return scrypt.Key([]byte(k.password), salt, 1<<15, 8, 1, 32)
+	}
+	return nil, fmt.Errorf("unknown key derivation: %d", derivation)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(noncePrefix []byte, counter uint32, final byte) []byte {
+	nonce := make([]byte, encryptionNoncePrefixSize+5)
+	copy(nonce, noncePrefix)
+	binary.BigEndian.PutUint32(nonce[encryptionNoncePrefixSize:], counter)
+	nonce[encryptionNoncePrefixSize+4] = final
+	return nonce
+}
+
+// encryptReader encrypts each read of the source as a chunk not to delay interactive streams
+type encryptReader struct {
+	src         io.Reader
+	aead        cipher.AEAD
+	noncePrefix []byte
+	counter     uint32
+	buf         bytes.Buffer
+	plain       []byte
+	finished    bool
+}
+
+func newEncryptReader(src io.Reader, k *encryptionKey) (*encryptReader, error) {
+	derivation := keyDerivationRaw
+	if k.key == nil {
+		derivation = keyDerivationScrypt
+	}
+	salt := make([]byte, encryptionSaltSize)
+	noncePrefix := make([]byte, encryptionNoncePrefixSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return nil, err
+	}
+	key, err := k.derive(derivation, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	r := &encryptReader{src: src, aead: aead, noncePrefix: noncePrefix, plain: make([]byte, encryptionMaxChunkSize)}
+	r.buf.Write(encryptionMagic)
+	r.buf.WriteByte(derivation)
+	r.buf.Write(salt)
+	r.buf.Write(noncePrefix)
+	return r, nil
+}
+
+func (r *encryptReader) seal(plain []byte, final byte) {
+	sealed := r.aead.Seal(nil, chunkNonce(r.noncePrefix, r.counter, final), plain, []byte{final})
+	r.counter++
+	r.buf.WriteByte(final)
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(sealed)))
+	r.buf.Write(size[:])
+	r.buf.Write(sealed)
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.finished {
+			return 0, io.EOF
+		}
+		n, err := r.src.Read(r.plain)
+		if n > 0 {
+			r.seal(r.plain[:n], 0)
+		}
+		if err == io.EOF {
+			r.seal(nil, 1)
+			r.finished = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
+}
+
+func truncatedError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: truncated stream", errDecryptionFailed)
+	}
+	return err
+}
+
+// decryptReader decrypts a stream of encryptReader
+type decryptReader struct {
+	src         io.Reader
+	key         *encryptionKey
+	aead        cipher.AEAD
+	noncePrefix []byte
+	counter     uint32
+	plain       []byte
+	finished    bool
+}
+
+func newDecryptReader(src io.Reader, k *encryptionKey) *decryptReader {
+	return &decryptReader{src: src, key: k}
+}
+
+func (r *decryptReader) readHeader() error {
+	header := make([]byte, len(encryptionMagic)+1+encryptionSaltSize+encryptionNoncePrefixSize)
+	if _, err := io.ReadFull(r.src, header); err != nil {
+		return truncatedError(err)
+	}
+	if !bytes.Equal(header[:len(encryptionMagic)], encryptionMagic) {
+		return fmt.Errorf("%w: not an encrypted stream", errDecryptionFailed)
+	}
+	header = header[len(encryptionMagic):]
+	key, err := r.key.derive(header[0], header[1:1+encryptionSaltSize])
+	if err != nil {
+		return fmt.Errorf("%w: %v", errDecryptionFailed, err)
+	}
+	r.aead, err = newGCM(key)
+	if err != nil {
+		return err
+	}
+	r.noncePrefix = header[1+encryptionSaltSize:]
+	return nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if r.aead == nil {
+		if err := r.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+	for len(r.plain) == 0 {
+		if r.finished {
+			return 0, io.EOF
+		}
+		var chunkHeader [5]byte
+		if _, err := io.ReadFull(r.src, chunkHeader[:]); err != nil {
+			return 0, truncatedError(err)
+		}
+		final := chunkHeader[0]
+		size := binary.BigEndian.Uint32(chunkHeader[1:])
+		if size > encryptionMaxChunkSize+uint32(r.aead.Overhead()) {
+			return 0, fmt.Errorf("%w: too large chunk", errDecryptionFailed)
+		}
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(r.src, sealed); err != nil {
+			return 0, truncatedError(err)
+		}
+		plain, err := r.aead.Open(sealed[:0], chunkNonce(r.noncePrefix, r.counter, final), sealed, []byte{final})
+		if err != nil {
+			return 0, fmt.Errorf("%w: wrong key or corrupted stream", errDecryptionFailed)
+		}
+		r.counter++
+		r.plain = plain
+		r.finished = final == 1
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// encryptTransfer encrypts the body and decrypts it again if the receiver specified the key.
+// Otherwise the receiver gets the ciphertext.
+func encryptTransfer(pi *pipe, receiverHeader http.Header, body io.Reader, key *encryptionKey) (io.Reader, error) {
+	encrypted, err := newEncryptReader(body, key)
+	if err != nil {
+		return nil, &transferFilterError{err: err}
+	}
+	if pi.receiverDecryptionKey != nil {
+		return newDecryptReader(encrypted, pi.receiverDecryptionKey), nil
+	}
+	receiverHeader.Del("Content-Length")
+	receiverHeader.Set("Content-Type", "application/octet-stream")
+	receiverHeader.Set(encryptedHeader, encryptionAES256GCM)
+	receiverHeader.Add("Access-Control-Expose-Headers", encryptedHeader)
+	return encrypted, nil
+}
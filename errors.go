@@ -0,0 +1,123 @@
+package piping_server
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Stable error codes in JSON error responses
+const (
+	ErrorCodeServiceWorkerRejected      = "service_worker_rejected"
+	ErrorCodeReceiverLimit              = "receiver_limit"
+	ErrorCodeReservedPath               = "reserved_path"
+	ErrorCodeRangeNotSupported          = "range_not_supported"
+	ErrorCodeSenderConflict             = "sender_conflict"
+	ErrorCodeSenderTakenOver            = "sender_taken_over"
+	ErrorCodeTimeout                    = "timeout"
+	ErrorCodeMethodNotAllowed           = "method_not_allowed"
+	ErrorCodeUnauthorized               = "unauthorized"
+	ErrorCodeBadRequest                 = "bad_request"
+	ErrorCodePipeCanceled               = "pipe_canceled"
+	ErrorCodePushRejected               = "push_rejected"
+	ErrorCodePushFailed                 = "push_failed"
+	ErrorCodePayloadTooLarge            = "payload_too_large"
+	ErrorCodeFetchRejected              = "fetch_rejected"
+	ErrorCodeFetchFailed                = "fetch_failed"
+	ErrorCodeVirusFound                 = "virus_found"
+	ErrorCodeVirusScanFailed            = "virus_scan_failed"
+	ErrorCodeTransferRejected           = "transfer_rejected"
+	ErrorCodeTransferFilterFailed       = "transfer_filter_failed"
+	ErrorCodeDecryptionFailed           = "decryption_failed"
+	ErrorCodeSpoolFailed                = "spool_failed"
+	ErrorCodePathReserved               = "path_reserved"
+	ErrorCodeReservationNotFound        = "reservation_not_found"
+	ErrorCodeReservationFailed          = "reservation_failed"
+	ErrorCodeArchiveFailed              = "archive_failed"
+	ErrorCodeRateLimited                = "rate_limited"
+	ErrorCodeAliasNotFound              = "alias_not_found"
+	ErrorCodeClipNotFound               = "clip_not_found"
+	ErrorCodeClipLimit                  = "clip_limit"
+	ErrorCodeManifestNotFound           = "manifest_not_found"
+	ErrorCodeManifestLimit              = "manifest_limit"
+	ErrorCodePreconditionFailed         = "precondition_failed"
+	ErrorCodeUnsupportedContentEncoding = "unsupported_content_encoding"
+	ErrorCodeChaosReset                 = "chaos_reset"
+	ErrorCodeMemoryCeiling              = "memory_ceiling"
+	ErrorCodeWaiterBudget               = "waiter_budget"
+	ErrorCodeConfusablePath             = "confusable_path"
+	ErrorCodeOwnerTokenRequired         = "owner_token_required"
+	ErrorCodeBlocked                    = "blocked"
+	ErrorCodeTransferNotFound           = "transfer_not_found"
+	ErrorCodeReportLimit                = "report_limit"
+	ErrorCodeContentBlocked             = "content_blocked"
+	ErrorCodeClientCertForbidden        = "client_cert_forbidden"
+	ErrorCodeClientCertQuota            = "client_cert_quota"
+	ErrorCodeChatLimit                  = "chat_limit"
+	ErrorCodePartialSpoolNotFound       = "partial_spool_not_found"
+	ErrorCodeParallelPartFailed         = "parallel_part_failed"
+	ErrorCodeReceiversFailed            = "receivers_failed"
+)
+
+type errorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// accepts returns true if the client explicitly accepts the media type
+func accepts(req *http.Request, mediaType string) bool {
+	for _, accept := range req.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			t, _, err := mime.ParseMediaType(mediaRange)
+			if err == nil && t == mediaType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeError writes the error as JSON if the client accepts it, otherwise as plain text for curl.
+// The status code can be overridden by PipingServer.ErrorStatusCodes.
+func (s *PipingServer) writeError(resWriter http.ResponseWriter, req *http.Request, statusCode int, code string, message string) {
+	if overriddenStatusCode, ok := s.ErrorStatusCodes[code]; ok {
+		statusCode = overriddenStatusCode
+	}
+	s.recentErrors.add(recentError{
+		Time:       time.Now(),
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		StatusCode: statusCode,
+		Code:       code,
+		Message:    message,
+		RequestID:  requestID(req),
+	})
+	s.logSampledOutRequestLine(req)
+	s.logSecurityEvent(req, code)
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	if s.Templates != nil && s.Templates.Error != nil && accepts(req, "text/html") && !accepts(req, "application/json") {
+		data := s.newTemplateData(req)
+		data.StatusCode = statusCode
+		data.Code = code
+		data.Message = message
+		data.RequestID = requestID(req)
+		resWriter.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resWriter.WriteHeader(statusCode)
+		if err := s.Templates.Error.Execute(resWriter, data); err != nil {
+			s.logf(req, "failed to render error template: %v", err)
+		}
+		return
+	}
+	if accepts(req, "application/json") {
+		resWriter.Header().Set("Content-Type", "application/json")
+		resWriter.WriteHeader(statusCode)
+		json.NewEncoder(resWriter).Encode(errorResponse{Code: code, Message: message, RequestID: requestID(req)})
+		return
+	}
+	resWriter.Header().Set("Content-Type", "text/plain")
+	resWriter.WriteHeader(statusCode)
+	resWriter.Write([]byte("[ERROR] " + message + "\n"))
+}
@@ -0,0 +1,104 @@
+package piping_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Types of pipe lifecycle events
+const (
+	eventSenderConnected   = "sender-connected"
+	eventReceiverConnected = "receiver-connected"
+	eventTransferStarted   = "transfer-started"
+	eventTransferFinished  = "transfer-finished"
+	eventTransferAborted   = "transfer-aborted"
+	eventPipeCanceled      = "pipe-canceled"
+)
+
+// eventBufferSize is the number of events buffered for a subscriber, which misses events beyond it
+const eventBufferSize = 64
+
+type pipeEvent struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Path       string    `json:"path"`
+	TransferID string    `json:"transferId"`
+	RequestID  string    `json:"requestId,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`
+	Code       string    `json:"code,omitempty"`
+}
+
+// eventBroker delivers events to subscribers without blocking transfers
+type eventBroker struct {
+	mutex       sync.Mutex
+	subscribers map[chan pipeEvent]struct{}
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subscribers: map[chan pipeEvent]struct{}{}}
+}
+
+func (b *eventBroker) subscribe() (<-chan pipeEvent, func()) {
+	ch := make(chan pipeEvent, eventBufferSize)
+	b.mutex.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mutex.Unlock()
+	return ch, func() {
+		b.mutex.Lock()
+		delete(b.subscribers, ch)
+		b.mutex.Unlock()
+	}
+}
+
+func (b *eventBroker) publish(e pipeEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (s *PipingServer) publishEvent(req *http.Request, pi *pipe, eventType string, bytes int64, code string) {
+	s.events.publish(pipeEvent{
+		Type:       eventType,
+		Time:       time.Now(),
+		Path:       req.URL.Path,
+		TransferID: pi.transferID,
+		RequestID:  requestID(req),
+		Bytes:      bytes,
+		Code:       code,
+	})
+}
+
+// handleAdminEvents streams pipe lifecycle events as Server-Sent Events
+func (s *PipingServer) handleAdminEvents(resWriter http.ResponseWriter, req *http.Request) {
+	flusher, ok := resWriter.(http.Flusher)
+	if !ok {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, "Streaming is not supported.")
+		return
+	}
+	eventCh, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+	resWriter.Header().Set("Content-Type", "text/event-stream")
+	resWriter.Header().Set("Cache-Control", "no-store")
+	resWriter.WriteHeader(200)
+	flusher.Flush()
+	for {
+		select {
+		case e := <-eventCh:
+			data, _ := json.Marshal(e)
+			if _, err := fmt.Fprintf(resWriter, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
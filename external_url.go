@@ -0,0 +1,78 @@
+package piping_server
+
+import (
+	"net/http"
+	"strings"
+)
+
+const hostnamePath = "/hostname"
+
+type externalBase struct {
+	URL      string `json:"url"`
+	Scheme   string `json:"scheme"`
+	Host     string `json:"host"`
+	BasePath string `json:"basePath"`
+}
+
+// forwardedParams returns the parameters of the first element of the Forwarded header
+// ref: https://datatracker.ietf.org/doc/html/rfc7239
+func forwardedParams(req *http.Request) map[string]string {
+	forwarded := req.Header.Get("Forwarded")
+	if forwarded == "" {
+		return nil
+	}
+	params := map[string]string{}
+	first := strings.Split(forwarded, ",")[0]
+	for _, pair := range strings.Split(first, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		params[strings.ToLower(key)] = strings.Trim(value, `"`)
+	}
+	return params
+}
+
+// externalBaseOf returns the base URL seen by clients. ExternalURL takes precedence, and then the Forwarded header,
+// X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix from a reverse proxy.
+func (s *PipingServer) externalBaseOf(req *http.Request) externalBase {
+	if s.ExternalURL != "" {
+		base := strings.TrimSuffix(s.ExternalURL, "/")
+		scheme, rest, _ := strings.Cut(base, "://")
+		host, basePath, _ := strings.Cut(rest, "/")
+		if basePath != "" {
+			basePath = "/" + basePath
+		}
+		return externalBase{URL: base, Scheme: scheme, Host: host, BasePath: basePath}
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	host := req.Host
+	params := forwardedParams(req)
+	if proto := params["proto"]; proto == "http" || proto == "https" {
+		scheme = proto
+	} else if proto := req.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	if forwardedHost := params["host"]; forwardedHost != "" {
+		host = forwardedHost
+	} else if forwardedHost := req.Header.Get("X-Forwarded-Host"); forwardedHost != "" {
+		host = strings.TrimSpace(strings.Split(forwardedHost, ",")[0])
+	}
+	basePath := s.externalBasePath(req)
+	return externalBase{URL: scheme + "://" + host + basePath, Scheme: scheme, Host: host, BasePath: basePath}
+}
+
+// externalURL returns the absolute URL of the path seen by clients
+func (s *PipingServer) externalURL(req *http.Request, path string) string {
+	return s.externalBaseOf(req).URL + path
+}
+
+// handleHostname responds the base URL seen by clients for the UI to generate links consistent with the help page and QR codes
+func (s *PipingServer) handleHostname(resWriter http.ResponseWriter, req *http.Request) {
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	resWriter.Header().Set("Cache-Control", "no-store")
+	writeJSON(resWriter, s.externalBaseOf(req))
+}
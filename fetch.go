@@ -0,0 +1,59 @@
+package piping_server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const fetchHeader = "X-Piping-Fetch"
+
+// fetchAsSender downloads the URL in X-Piping-Fetch and returns a sender request whose body is the download.
+// The caller must close the body of the returned request.
+// NOTE: The download starts before a receiver connects and is paused by TCP flow control until then.
+func (s *PipingServer) fetchAsSender(resWriter http.ResponseWriter, req *http.Request, rawOrigin string) (*http.Request, bool) {
+	origin, err := url.Parse(rawOrigin)
+	if err == nil {
+		err = checkOutboundURL(origin, s.FetchAllowedHosts)
+	}
+	if err != nil {
+		s.writeError(resWriter, req, 403, ErrorCodeFetchRejected, fmt.Sprintf("Cannot fetch '%s': %v.", rawOrigin, err))
+		return nil, false
+	}
+	if req.ContentLength > 0 {
+		s.writeError(resWriter, req, 400, ErrorCodeFetchRejected, fmt.Sprintf("A body cannot be sent with %s.", fetchHeader))
+		return nil, false
+	}
+	fetchReq, err := http.NewRequestWithContext(req.Context(), "GET", origin.String(), nil)
+	if err != nil {
+		s.writeError(resWriter, req, 403, ErrorCodeFetchRejected, fmt.Sprintf("Cannot fetch '%s': %v.", rawOrigin, err))
+		return nil, false
+	}
+	fetchReq.Header.Set(requestIDHeader, requestID(req))
+	s.infof(req, "Fetching %s for %s", origin.Redacted(), req.URL.Path)
+	fetchRes, err := outboundClient(s.FetchClient, 0, s.FetchAllowedHosts).Do(fetchReq)
+	if err != nil {
+		s.writeError(resWriter, req, 502, ErrorCodeFetchFailed, fmt.Sprintf("Failed to fetch '%s': %v.", origin.Redacted(), err))
+		return nil, false
+	}
+	if fetchRes.StatusCode < 200 || fetchRes.StatusCode >= 300 {
+		fetchRes.Body.Close()
+		s.writeError(resWriter, req, 502, ErrorCodeFetchFailed, fmt.Sprintf("The origin '%s' responded %s.", origin.Redacted(), fetchRes.Status))
+		return nil, false
+	}
+	senderReq := req.Clone(req.Context())
+	senderReq.Body = fetchRes.Body
+	senderReq.ContentLength = fetchRes.ContentLength
+	senderReq.Header.Del("Content-Length")
+	if fetchRes.ContentLength >= 0 {
+		senderReq.Header.Set("Content-Length", strconv.FormatInt(fetchRes.ContentLength, 10))
+	}
+	for _, header := range []string{"Content-Type", "Content-Disposition"} {
+		// The sender can override the headers of the origin
+		if values := fetchRes.Header.Values(header); len(values) == 1 && senderReq.Header.Get(header) == "" {
+			senderReq.Header.Set(header, values[0])
+		}
+	}
+	return senderReq, true
+}
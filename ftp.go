@@ -0,0 +1,524 @@
+package piping_server
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ftpIdleTimeout is the timeout of waiting for a command while no transfer is running
+	ftpIdleTimeout = 5 * time.Minute
+	// ftpDataTimeout is the timeout of establishing a data connection
+	ftpDataTimeout = 30 * time.Second
+	// maxFTPLineBytes bounds a command line
+	maxFTPLineBytes = 4096
+)
+
+// FTPConfig is the configuration of the FTP bridge
+type FTPConfig struct {
+	// TLSConfig enables explicit FTPS by AUTH TLS if not nil
+	TLSConfig *tls.Config
+	// Username and Password are required to log in if Username is not empty, otherwise any login is accepted
+	Username string
+	Password string
+	// PublicHost is the IPv4 address announced by PASV (the local address of the control connection if empty)
+	PublicHost string
+	// PassivePortMin and PassivePortMax are the range of ports of passive data connections (any port if 0)
+	PassivePortMin int
+	PassivePortMax int
+}
+
+// ServeFTP accepts FTP sessions on the listener until it is closed.
+// STOR of a path sends to the pipe of /p/<path> and RETR receives from it, so that devices speaking only FTP hand data to HTTP receivers.
+func (s *PipingServer) ServeFTP(ln net.Listener, config FTPConfig) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			// NOTE: Retries on errors such as running out of file descriptors like http.Server
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveFTPConn(conn, config)
+	}
+}
+
+// ftpSession is the state of a control connection
+type ftpSession struct {
+	server   *PipingServer
+	config   FTPConfig
+	conn     net.Conn
+	reader   *bufio.Reader
+	ctx      context.Context
+	user     string
+	loggedIn bool
+	isTLS    bool
+	// protected is true after PROT P, making data connections TLS
+	protected bool
+	cwd       string
+	// passive is the listener of PASV or EPSV, and activeAddr is the address of PORT or EPRT
+	passive    net.Listener
+	activeAddr string
+	// partial is the beginning of a line whose reading has timed out
+	partial string
+	// pending is commands received during a transfer
+	pending []string
+}
+
+func (s *PipingServer) serveFTPConn(conn net.Conn, config FTPConfig) {
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	session := &ftpSession{server: s, config: config, conn: conn, reader: bufio.NewReader(conn), ctx: ctx, cwd: "/"}
+	defer session.closeData()
+	session.reply(220, "Piping Server FTP bridge ready.")
+	for {
+		var line string
+		if len(session.pending) != 0 {
+			line, session.pending = session.pending[0], session.pending[1:]
+		} else {
+			session.conn.SetReadDeadline(time.Now().Add(ftpIdleTimeout))
+			var err error
+			line, err = session.readLine()
+			if err != nil {
+				return
+			}
+		}
+		command, arg, _ := strings.Cut(line, " ")
+		if !session.handle(strings.ToUpper(command), arg) {
+			return
+		}
+	}
+}
+
+// readLine reads a command line, keeping the beginning of the line if the reading times out
+func (c *ftpSession) readLine() (string, error) {
+	for {
+		fragment, err := c.reader.ReadString('\n')
+		c.partial += fragment
+		if len(c.partial) > maxFTPLineBytes {
+			return "", errors.New("too long command line")
+		}
+		if err != nil {
+			return "", err
+		}
+		// NOTE: Clients send Telnet "Interrupt Process" and "Synch" before ABOR
+		line := strings.TrimLeft(strings.TrimRight(c.partial, "\r\n"), "\xff\xf4\xf2")
+		c.partial = ""
+		if line != "" {
+			return line, nil
+		}
+	}
+}
+
+func (c *ftpSession) reply(code int, message string) {
+	fmt.Fprintf(c.conn, "%d %s\r\n", code, message)
+}
+
+// resolve returns the absolute path of the argument relative to the working directory
+func (c *ftpSession) resolve(arg string) string {
+	if !strings.HasPrefix(arg, "/") {
+		arg = c.cwd + "/" + arg
+	}
+	return path.Clean(arg)
+}
+
+// handle runs the command, returning false to end the session
+func (c *ftpSession) handle(command string, arg string) bool {
+	switch command {
+	case "USER":
+		c.user = arg
+		c.loggedIn = false
+		c.reply(331, "Password required.")
+		return true
+	case "PASS":
+		if c.config.Username != "" && (subtle.ConstantTimeCompare([]byte(c.user), []byte(c.config.Username)) != 1 || subtle.ConstantTimeCompare([]byte(arg), []byte(c.config.Password)) != 1) {
+			c.reply(530, "Login incorrect.")
+			return true
+		}
+		c.loggedIn = true
+		c.reply(230, "Logged in.")
+		return true
+	case "AUTH":
+		if c.config.TLSConfig == nil || c.isTLS {
+			c.reply(502, "TLS is not available.")
+			return true
+		}
+		if arg = strings.ToUpper(arg); arg != "TLS" && arg != "SSL" && arg != "TLS-C" {
+			c.reply(504, "Unsupported security mechanism.")
+			return true
+		}
+		c.reply(234, "Proceed with negotiation.")
+		tlsConn := tls.Server(c.conn, c.config.TLSConfig)
+		tlsConn.SetDeadline(time.Now().Add(ftpDataTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return false
+		}
+		tlsConn.SetDeadline(time.Time{})
+		c.conn = tlsConn
+		c.reader = bufio.NewReader(tlsConn)
+		c.isTLS = true
+		c.loggedIn = false
+		return true
+	case "PBSZ":
+		c.reply(200, "PBSZ=0")
+		return true
+	case "PROT":
+		switch strings.ToUpper(arg) {
+		case "C":
+			c.protected = false
+		case "P":
+			if !c.isTLS {
+				c.reply(503, "PROT P requires AUTH TLS.")
+				return true
+			}
+			c.protected = true
+		default:
+			c.reply(504, "Unsupported protection level.")
+			return true
+		}
+		c.reply(200, "Protection level set.")
+		return true
+	case "FEAT":
+		features := []string{"EPSV", "PASV", "SIZE", "UTF8"}
+		if c.config.TLSConfig != nil {
+			features = append(features, "AUTH TLS", "PBSZ", "PROT")
+		}
+		fmt.Fprintf(c.conn, "211-Features:\r\n %s\r\n211 End\r\n", strings.Join(features, "\r\n "))
+		return true
+	case "SYST":
+		c.reply(215, "UNIX Type: L8")
+		return true
+	case "NOOP", "OPTS":
+		c.reply(200, "OK.")
+		return true
+	case "ABOR":
+		c.reply(226, "No transfer to abort.")
+		return true
+	case "QUIT":
+		c.reply(221, "Bye.")
+		return false
+	}
+	if !c.loggedIn {
+		c.reply(530, "Please log in with USER and PASS.")
+		return true
+	}
+	switch command {
+	case "TYPE":
+		// NOTE: Transfers are binary regardless of the type, since converting line endings would alter data
+		c.reply(200, "Type set.")
+	case "MODE", "STRU":
+		if arg = strings.ToUpper(arg); arg != "S" && arg != "F" {
+			c.reply(504, "Unsupported parameter.")
+			return true
+		}
+		c.reply(200, "OK.")
+	case "PWD", "XPWD":
+		c.reply(257, fmt.Sprintf("\"%s\" is the current directory.", strings.ReplaceAll(c.cwd, "\"", "\"\"")))
+	case "CWD", "XCWD":
+		// NOTE: Directories exist virtually as prefixes of paths
+		c.cwd = c.resolve(arg)
+		c.reply(250, "Directory changed.")
+	case "CDUP", "XCUP":
+		c.cwd = path.Dir(c.cwd)
+		c.reply(250, "Directory changed.")
+	case "MKD", "XMKD":
+		c.reply(257, fmt.Sprintf("\"%s\" created.", strings.ReplaceAll(c.resolve(arg), "\"", "\"\"")))
+	case "RMD", "XRMD", "DELE":
+		c.reply(250, "OK.")
+	case "REST":
+		if arg != "0" {
+			c.reply(504, "Resuming is not supported.")
+			return true
+		}
+		c.reply(350, "Restarting at 0.")
+	case "SIZE":
+		p := c.resolve(arg)
+		dir, name := path.Split(p)
+		for _, entry := range c.server.davEntries("/p" + dir) {
+			if entry.name == name && !entry.isCollection && entry.contentLength != "" {
+				c.reply(213, entry.contentLength)
+				return true
+			}
+		}
+		// NOTE: Not 550 since clients such as curl give up RETR of a file without its sender yet
+		c.reply(450, "The size is unknown until a sender connects.")
+	case "PASV", "EPSV":
+		c.handlePassive(command)
+	case "PORT", "EPRT":
+		c.handleActive(command, arg)
+	case "LIST", "NLST":
+		c.handleList(command, arg)
+	case "RETR", "STOR":
+		return c.handleTransfer(command, c.resolve(arg))
+	default:
+		c.reply(502, "Command not implemented.")
+	}
+	return true
+}
+
+func (c *ftpSession) closeData() {
+	if c.passive != nil {
+		c.passive.Close()
+		c.passive = nil
+	}
+	c.activeAddr = ""
+}
+
+func (c *ftpSession) listenPassive() (net.Listener, error) {
+	host, _, _ := net.SplitHostPort(c.conn.LocalAddr().String())
+	min, max := c.config.PassivePortMin, c.config.PassivePortMax
+	if min <= 0 || max < min {
+		return net.Listen("tcp", net.JoinHostPort(host, "0"))
+	}
+	// NOTE: Starts at a random port not to collide with concurrent sessions
+	n := max - min + 1
+	start := rand.Intn(n)
+	var err error
+	for i := 0; i < n; i++ {
+		var ln net.Listener
+		ln, err = net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(min+(start+i)%n)))
+		if err == nil {
+			return ln, nil
+		}
+	}
+	return nil, err
+}
+
+func (c *ftpSession) handlePassive(command string) {
+	c.closeData()
+	ln, err := c.listenPassive()
+	if err != nil {
+		c.reply(425, "Cannot open a passive connection.")
+		return
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	if command == "EPSV" {
+		c.passive = ln
+		c.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|).", port))
+		return
+	}
+	host := c.config.PublicHost
+	if host == "" {
+		host, _, _ = net.SplitHostPort(c.conn.LocalAddr().String())
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		ln.Close()
+		c.reply(425, "PASV is not available over IPv6, use EPSV.")
+		return
+	}
+	c.passive = ln
+	c.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d).", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+}
+
+// handleActive accepts the address of PORT or EPRT only if its host is the client, in order to prevent FTP bounce attacks
+func (c *ftpSession) handleActive(command string, arg string) {
+	c.closeData()
+	var host, port string
+	if command == "PORT" {
+		parts := strings.Split(arg, ",")
+		if len(parts) == 6 {
+			p1, err1 := strconv.Atoi(parts[4])
+			p2, err2 := strconv.Atoi(parts[5])
+			if err1 == nil && err2 == nil && 0 <= p1 && p1 < 256 && 0 <= p2 && p2 < 256 {
+				host, port = strings.Join(parts[:4], "."), strconv.Itoa(p1<<8|p2)
+			}
+		}
+	} else if len(arg) > 1 {
+		// e.g. |2|::1|2000|
+		if parts := strings.Split(arg, arg[:1]); len(parts) == 5 {
+			host, port = parts[2], parts[3]
+		}
+	}
+	clientHost, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	ip := net.ParseIP(host)
+	if ip == nil || port == "" || !ip.Equal(net.ParseIP(clientHost)) {
+		c.reply(501, "Invalid address.")
+		return
+	}
+	c.activeAddr = net.JoinHostPort(host, port)
+	c.reply(200, "OK.")
+}
+
+// openData establishes the data connection prepared by PASV, EPSV, PORT or EPRT
+func (c *ftpSession) openData() (net.Conn, error) {
+	defer c.closeData()
+	var conn net.Conn
+	var err error
+	switch {
+	case c.passive != nil:
+		if tcpListener, ok := c.passive.(*net.TCPListener); ok {
+			tcpListener.SetDeadline(time.Now().Add(ftpDataTimeout))
+		}
+		conn, err = c.passive.Accept()
+		if err != nil {
+			return nil, err
+		}
+		// NOTE: Others than the client cannot steal the data connection
+		clientHost, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+		dataHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if !net.ParseIP(clientHost).Equal(net.ParseIP(dataHost)) {
+			conn.Close()
+			return nil, errors.New("data connection from another host")
+		}
+	case c.activeAddr != "":
+		conn, err = net.DialTimeout("tcp", c.activeAddr, ftpDataTimeout)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("no data connection")
+	}
+	if c.protected {
+		tlsConn := tls.Server(conn, c.config.TLSConfig)
+		tlsConn.SetDeadline(time.Now().Add(ftpDataTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
+func (c *ftpSession) handleList(command string, arg string) {
+	// NOTE: Options such as "-a" of ls are ignored
+	if strings.HasPrefix(arg, "-") {
+		arg = ""
+	}
+	dir := c.resolve(arg)
+	if dir != "/" {
+		dir += "/"
+	}
+	c.reply(150, "Opening data connection.")
+	data, err := c.openData()
+	if err != nil {
+		c.reply(425, "Cannot open data connection.")
+		return
+	}
+	modifiedAt := c.server.now()
+	w := bufio.NewWriter(data)
+	for _, entry := range c.server.davEntries("/p" + dir) {
+		if command == "NLST" {
+			fmt.Fprintf(w, "%s\r\n", entry.name)
+		} else {
+			fmt.Fprintf(w, "%s\r\n", listLine(entry, modifiedAt))
+		}
+	}
+	err = w.Flush()
+	data.Close()
+	if err != nil {
+		c.reply(426, "Connection closed; transfer aborted.")
+		return
+	}
+	c.reply(226, "Transfer complete.")
+}
+
+// handleTransfer sends the data connection to the pipe by STOR, or receives from the pipe into it by RETR
+func (c *ftpSession) handleTransfer(command string, p string) bool {
+	if p == "/" {
+		c.reply(550, "A file name is required.")
+		return true
+	}
+	c.reply(150, "Opening data connection.")
+	data, err := c.openData()
+	if err != nil {
+		c.reply(425, "Cannot open data connection.")
+		return true
+	}
+	defer data.Close()
+	method := "GET"
+	var body io.Reader
+	if command == "STOR" {
+		method = "PUT"
+		body = data
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	req, err := c.server.newBridgeRequest(ctx, "FTP", method, "/p"+p, body, c.conn)
+	if err != nil {
+		c.reply(553, "Invalid file name.")
+		return true
+	}
+	var start func(http.Header) (io.Writer, error)
+	if command == "RETR" {
+		start = func(http.Header) (io.Writer, error) { return data, nil }
+	}
+	w := newBridgeResponseWriter(start)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.server.serveBridgeRequest(w, req)
+	}()
+	if !c.watchTransfer(done, cancel) {
+		return false
+	}
+	data.Close()
+	switch {
+	case ctx.Err() != nil:
+		c.reply(426, "Transfer aborted.")
+		c.reply(226, "ABOR successful.")
+	case !w.succeeded():
+		c.reply(550, w.errorMessage())
+	default:
+		c.reply(226, "Transfer complete.")
+	}
+	return true
+}
+
+// watchTransfer reads commands until the transfer is done, canceling it on ABOR.
+// It returns false if the control connection is closed.
+func (c *ftpSession) watchTransfer(done <-chan struct{}, cancel context.CancelFunc) bool {
+	type result struct {
+		line string
+		err  error
+	}
+	for {
+		resultCh := make(chan result, 1)
+		go func() {
+			c.conn.SetReadDeadline(time.Time{})
+			line, err := c.readLine()
+			resultCh <- result{line, err}
+		}()
+		var r result
+		select {
+		case <-done:
+			// NOTE: Interrupts the reading, whose partial line is kept for the next command
+			c.conn.SetReadDeadline(time.Unix(1, 0))
+			r = <-resultCh
+			if r.err == nil {
+				c.pending = append(c.pending, r.line)
+			}
+			var ne net.Error
+			return r.err == nil || (errors.As(r.err, &ne) && ne.Timeout())
+		case r = <-resultCh:
+		}
+		if r.err != nil {
+			cancel()
+			<-done
+			return false
+		}
+		if command, _, _ := strings.Cut(r.line, " "); strings.ToUpper(command) == "ABOR" {
+			cancel()
+			<-done
+			return true
+		}
+		c.pending = append(c.pending, r.line)
+	}
+}
@@ -3,13 +3,22 @@ module github.com/nwtgck/go-piping-server
 go 1.18
 
 require (
+	github.com/BurntSushi/toml v1.2.1
+	github.com/gliderlabs/ssh v0.3.5
+	github.com/klauspost/compress v1.15.15
 	github.com/lucas-clemente/quic-go v0.25.0
 	github.com/spf13/cobra v1.3.0
-	golang.org/x/net v0.0.0-20210813160813-60bc85c4be6d
+	github.com/spf13/pflag v1.0.5
+	golang.org/x/crypto v0.0.0-20220826181053-bd7e27e6170d
+	golang.org/x/net v0.0.0-20220826154423-83b083e8dc8b
+	golang.org/x/sys v0.0.0-20220825204002-c680a09ffe64
+	golang.org/x/text v0.3.7
+	gopkg.in/yaml.v3 v3.0.1
 	gotest.tools/v3 v3.2.0
 )
 
 require (
+	github.com/anmitsu/go-shlex v0.0.0-20200514113438-38f4b401e2be // indirect
 	github.com/cheekybits/genny v1.0.0 // indirect
 	github.com/fsnotify/fsnotify v1.5.1 // indirect
 	github.com/go-task/slim-sprig v0.0.0-20210107165309-348f09dbbbc0 // indirect
@@ -21,11 +30,7 @@ require (
 	github.com/marten-seemann/qtls-go1-18 v0.1.0-beta.1 // indirect
 	github.com/nxadm/tail v1.4.8 // indirect
 	github.com/onsi/ginkgo v1.16.4 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5 // indirect
 	golang.org/x/mod v0.5.0 // indirect
-	golang.org/x/sys v0.0.0-20211205182925-97ca703d548d // indirect
-	golang.org/x/text v0.3.7 // indirect
 	golang.org/x/tools v0.1.5 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
@@ -0,0 +1,790 @@
+package piping_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// graphqlSchema describes the GraphQL API served at /admin/graphql
+const graphqlSchema = `type Query {
+  pipes: [Pipe!]!
+  pipe(path: String!): Pipe!
+  stats: Stats!
+}
+
+type Subscription {
+  "Pipe lifecycle events, filtered by the path and the types if specified"
+  pipeEvents(path: String, types: [String!]): PipeEvent!
+}
+
+type Pipe {
+  path: String!
+  status: String!
+  bytes: Float!
+  totalBytes: Float
+  elapsedMs: Float!
+  senderConnected: Boolean!
+  receiverConnected: Boolean!
+}
+
+type Stats {
+  transferredBytes: Float!
+  activePipes: Int!
+  committedMemoryBytes: Float!
+  waiters: Int!
+  rejectedWaiters: Float!
+}
+
+type PipeEvent {
+  type: String!
+  time: String!
+  path: String!
+  transferId: String!
+  requestId: String
+  bytes: Float
+  code: String
+}
+`
+
+// graphqlTypeFields are the fields of the object types in graphqlSchema
+var graphqlTypeFields = map[string][]string{
+	"Pipe":      {"path", "status", "bytes", "totalBytes", "elapsedMs", "senderConnected", "receiverConnected"},
+	"Stats":     {"transferredBytes", "activePipes", "committedMemoryBytes", "waiters", "rejectedWaiters"},
+	"PipeEvent": {"type", "time", "path", "transferId", "requestId", "bytes", "code"},
+}
+
+// maxGraphQLQueryBytes limits the size of a GraphQL request
+const maxGraphQLQueryBytes = 64 * 1024
+
+type graphqlField struct {
+	alias      string
+	name       string
+	args       map[string]interface{}
+	selections []*graphqlField
+}
+
+type graphqlOperation struct {
+	kind       string
+	name       string
+	defaults   map[string]interface{}
+	selections []*graphqlField
+}
+
+// graphqlVariable is a reference to a variable in an argument
+type graphqlVariable string
+
+// graphqlParser parses the subset of GraphQL without fragments and directives
+// ref: https://spec.graphql.org/October2021/#sec-Language
+type graphqlParser struct {
+	src string
+	pos int
+}
+
+func (p *graphqlParser) skipIgnored() {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+				p.pos++
+			}
+		case strings.HasPrefix(p.src[p.pos:], "\uFEFF"):
+			p.pos += len("\uFEFF")
+		default:
+			return
+		}
+	}
+}
+
+func (p *graphqlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Syntax Error at %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// consume skips the punctuator if it is next
+func (p *graphqlParser) consume(punctuator string) bool {
+	p.skipIgnored()
+	if strings.HasPrefix(p.src[p.pos:], punctuator) {
+		p.pos += len(punctuator)
+		return true
+	}
+	return false
+}
+
+func (p *graphqlParser) expect(punctuator string) error {
+	if !p.consume(punctuator) {
+		return p.errorf("expected %q", punctuator)
+	}
+	return nil
+}
+
+func isGraphQLNameByte(c byte, first bool) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || !first && '0' <= c && c <= '9'
+}
+
+func (p *graphqlParser) name() (string, error) {
+	p.skipIgnored()
+	start := p.pos
+	for p.pos < len(p.src) && isGraphQLNameByte(p.src[p.pos], p.pos == start) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected a name")
+	}
+	return p.src[start:p.pos], nil
+}
+
+func (p *graphqlParser) document() ([]*graphqlOperation, error) {
+	var operations []*graphqlOperation
+	for {
+		p.skipIgnored()
+		if p.pos == len(p.src) {
+			break
+		}
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		operations = append(operations, op)
+	}
+	if len(operations) == 0 {
+		return nil, errors.New("the document has no operations")
+	}
+	return operations, nil
+}
+
+func (p *graphqlParser) operation() (*graphqlOperation, error) {
+	op := &graphqlOperation{kind: "query", defaults: map[string]interface{}{}}
+	p.skipIgnored()
+	if p.pos < len(p.src) && p.src[p.pos] != '{' {
+		kind, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case "query", "subscription":
+			op.kind = kind
+		case "mutation":
+			return nil, errors.New("mutations are not supported")
+		case "fragment":
+			return nil, errors.New("fragments are not supported")
+		default:
+			return nil, p.errorf("unexpected %q", kind)
+		}
+		p.skipIgnored()
+		if p.pos < len(p.src) && isGraphQLNameByte(p.src[p.pos], true) {
+			if op.name, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if p.consume("(") {
+			for !p.consume(")") {
+				if err := p.variableDefinition(op.defaults); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if p.consume("@") {
+		return nil, errors.New("directives are not supported")
+	}
+	var err error
+	op.selections, err = p.selectionSet()
+	return op, err
+}
+
+// variableDefinition parses "$name: Type = default", ignoring the type
+func (p *graphqlParser) variableDefinition(defaults map[string]interface{}) error {
+	if err := p.expect("$"); err != nil {
+		return err
+	}
+	name, err := p.name()
+	if err != nil {
+		return err
+	}
+	if err := p.expect(":"); err != nil {
+		return err
+	}
+	for p.consume("[") {
+	}
+	if _, err := p.name(); err != nil {
+		return err
+	}
+	for p.consume("!") || p.consume("]") {
+	}
+	if p.consume("=") {
+		value, err := p.value()
+		if err != nil {
+			return err
+		}
+		defaults[name] = value
+	}
+	return nil
+}
+
+func (p *graphqlParser) selectionSet() ([]*graphqlField, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var fields []*graphqlField
+	for !p.consume("}") {
+		if p.consume("...") {
+			return nil, errors.New("fragments are not supported")
+		}
+		field, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	if len(fields) == 0 {
+		return nil, p.errorf("empty selection set")
+	}
+	return fields, nil
+}
+
+func (p *graphqlParser) field() (*graphqlField, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	field := &graphqlField{alias: name, name: name, args: map[string]interface{}{}}
+	if p.consume(":") {
+		if field.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.consume("(") {
+		for !p.consume(")") {
+			argName, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if field.args[argName], err = p.value(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p.consume("@") {
+		return nil, errors.New("directives are not supported")
+	}
+	p.skipIgnored()
+	if p.pos < len(p.src) && p.src[p.pos] == '{' {
+		if field.selections, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return field, nil
+}
+
+func (p *graphqlParser) value() (interface{}, error) {
+	p.skipIgnored()
+	if p.pos == len(p.src) {
+		return nil, p.errorf("unexpected end")
+	}
+	switch c := p.src[p.pos]; {
+	case c == '$':
+		p.pos++
+		name, err := p.name()
+		return graphqlVariable(name), err
+	case c == '"':
+		return p.stringValue()
+	case c == '[':
+		p.pos++
+		list := []interface{}{}
+		for !p.consume("]") {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case c == '{':
+		p.pos++
+		object := map[string]interface{}{}
+		for !p.consume("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if object[name], err = p.value(); err != nil {
+				return nil, err
+			}
+		}
+		return object, nil
+	case c == '-' || '0' <= c && c <= '9':
+		start := p.pos
+		p.pos++
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) >= 0 {
+			p.pos++
+		}
+		literal := p.src[start:p.pos]
+		if n, err := strconv.ParseInt(literal, 10, 64); err == nil {
+			return n, nil
+		}
+		f, err := strconv.ParseFloat(literal, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", literal)
+		}
+		return f, nil
+	default:
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		// NOTE: Enum values are treated as strings
+		return name, nil
+	}
+}
+
+func (p *graphqlParser) stringValue() (string, error) {
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		end := strings.Index(p.src[p.pos+3:], `"""`)
+		if end < 0 {
+			return "", p.errorf("unterminated block string")
+		}
+		s := p.src[p.pos+3 : p.pos+3+end]
+		p.pos += 3 + end + 3
+		return strings.TrimSpace(s), nil
+	}
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			return b.String(), nil
+		case c == '\n' || c == '\r':
+			return "", p.errorf("unterminated string")
+		case c == '\\' && p.pos+1 < len(p.src):
+			escaped := p.src[p.pos+1]
+			p.pos += 2
+			switch escaped {
+			case 'u':
+				if p.pos+4 > len(p.src) {
+					return "", p.errorf("invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 32)
+				if err != nil {
+					return "", p.errorf("invalid unicode escape")
+				}
+				b.WriteRune(rune(r))
+				p.pos += 4
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case '"', '\\', '/':
+				b.WriteByte(escaped)
+			default:
+				return "", p.errorf("invalid escape \\%c", escaped)
+			}
+		default:
+			r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+			b.WriteRune(r)
+			p.pos += size
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// graphqlObject is a value of an object type with the fields by name
+type graphqlObject struct {
+	typeName string
+	fields   map[string]interface{}
+}
+
+// graphqlResolver resolves a field of the root types with the arguments
+type graphqlResolver func(args map[string]interface{}) (interface{}, error)
+
+// newGraphQLObject converts the struct to the object by its JSON fields, which are named as the schema
+func newGraphQLObject(typeName string, v interface{}) graphqlObject {
+	b, _ := json.Marshal(v)
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	fields := map[string]interface{}{}
+	decoder.Decode(&fields)
+	for _, name := range graphqlTypeFields[typeName] {
+		if _, ok := fields[name]; !ok {
+			fields[name] = nil
+		}
+	}
+	return graphqlObject{typeName: typeName, fields: fields}
+}
+
+// graphqlResult is a JSON object keeping the order of the selection as required
+type graphqlResult struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (r *graphqlResult) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range r.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(r.values[key])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+type graphqlExecutor struct {
+	variables map[string]interface{}
+}
+
+// args resolves the variables in the arguments
+func (e *graphqlExecutor) args(field *graphqlField) map[string]interface{} {
+	var resolve func(v interface{}) interface{}
+	resolve = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case graphqlVariable:
+			return e.variables[string(v)]
+		case []interface{}:
+			list := make([]interface{}, len(v))
+			for i, item := range v {
+				list[i] = resolve(item)
+			}
+			return list
+		}
+		return v
+	}
+	args := map[string]interface{}{}
+	for name, v := range field.args {
+		args[name] = resolve(v)
+	}
+	return args
+}
+
+func (e *graphqlExecutor) selectObject(object graphqlObject, selections []*graphqlField) (*graphqlResult, error) {
+	result := &graphqlResult{values: map[string]interface{}{}}
+	for _, field := range selections {
+		var value interface{}
+		if field.name == "__typename" {
+			value = object.typeName
+		} else {
+			v, ok := object.fields[field.name]
+			if !ok {
+				return nil, fmt.Errorf("Cannot query field %q on type %q.", field.name, object.typeName)
+			}
+			if resolver, ok := v.(graphqlResolver); ok {
+				var err error
+				if v, err = resolver(e.args(field)); err != nil {
+					return nil, fmt.Errorf("%s: %w", field.alias, err)
+				}
+			}
+			var err error
+			if value, err = e.complete(field, v); err != nil {
+				return nil, err
+			}
+		}
+		if _, ok := result.values[field.alias]; !ok {
+			result.keys = append(result.keys, field.alias)
+		}
+		result.values[field.alias] = value
+	}
+	return result, nil
+}
+
+// complete applies the selection set of the field to the value
+func (e *graphqlExecutor) complete(field *graphqlField, v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case graphqlObject:
+		if len(field.selections) == 0 {
+			return nil, fmt.Errorf("Field %q of type %q must have a selection of subfields.", field.name, v.typeName)
+		}
+		return e.selectObject(v, field.selections)
+	case []graphqlObject:
+		if len(field.selections) == 0 {
+			return nil, fmt.Errorf("Field %q must have a selection of subfields.", field.name)
+		}
+		list := make([]interface{}, 0, len(v))
+		for _, object := range v {
+			result, err := e.selectObject(object, field.selections)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, result)
+		}
+		return list, nil
+	}
+	if len(field.selections) != 0 {
+		return nil, fmt.Errorf("Field %q must not have a selection since it is a scalar.", field.name)
+	}
+	return v, nil
+}
+
+func stringArg(args map[string]interface{}, name string) (string, bool, error) {
+	v, ok := args[name]
+	if !ok || v == nil {
+		return "", false, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", false, fmt.Errorf("argument %q must be a String", name)
+	}
+	return s, true, nil
+}
+
+// graphqlQueryRoot returns the Query object with the resolvers of its fields
+func (s *PipingServer) graphqlQueryRoot() graphqlObject {
+	return graphqlObject{typeName: "Query", fields: map[string]interface{}{
+		"pipes": graphqlResolver(func(args map[string]interface{}) (interface{}, error) {
+			pipes := []graphqlObject{}
+			for _, path := range s.activePipePaths() {
+				pipes = append(pipes, newGraphQLObject("Pipe", s.pipeProgress(path)))
+			}
+			return pipes, nil
+		}),
+		"pipe": graphqlResolver(func(args map[string]interface{}) (interface{}, error) {
+			path, ok, err := stringArg(args, "path")
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, errors.New(`argument "path" is required`)
+			}
+			return newGraphQLObject("Pipe", s.pipeProgress(path)), nil
+		}),
+		"stats": graphqlResolver(func(args map[string]interface{}) (interface{}, error) {
+			waiters, rejectedWaiters := s.waiters.counts()
+			return newGraphQLObject("Stats", adminStats{
+				TransferredBytes:     atomic.LoadInt64(&s.transferredBytes),
+				ActivePipes:          len(s.activePipePaths()),
+				CommittedMemoryBytes: s.committedMemoryBytes(),
+				Waiters:              waiters,
+				RejectedWaiters:      rejectedWaiters,
+			}), nil
+		}),
+	}}
+}
+
+// graphqlEventFilter returns the filter of pipeEvents by the "path" and "types" arguments
+func graphqlEventFilter(args map[string]interface{}) (func(e pipeEvent) bool, error) {
+	path, hasPath, err := stringArg(args, "path")
+	if err != nil {
+		return nil, err
+	}
+	types := map[string]bool{}
+	if v, ok := args["types"]; ok && v != nil {
+		list, ok := v.([]interface{})
+		if !ok {
+			// NOTE: A single value is coerced to a list as the specification says
+			list = []interface{}{v}
+		}
+		for _, t := range list {
+			s, ok := t.(string)
+			if !ok {
+				return nil, errors.New(`argument "types" must be a list of String`)
+			}
+			types[s] = true
+		}
+	}
+	return func(e pipeEvent) bool {
+		return (!hasPath || e.Path == path) && (len(types) == 0 || types[e.Type])
+	}, nil
+}
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+type graphqlResponse struct {
+	Data   interface{}    `json:"data,omitempty"`
+	Errors []graphqlError `json:"errors,omitempty"`
+}
+
+type graphqlError struct {
+	Message string `json:"message"`
+}
+
+func graphqlErrorResponse(err error) graphqlResponse {
+	return graphqlResponse{Errors: []graphqlError{{Message: err.Error()}}}
+}
+
+// parseGraphQLRequest reads the request from the query parameters of GET or the JSON body of POST
+func parseGraphQLRequest(req *http.Request) (*graphqlRequest, error) {
+	r := &graphqlRequest{}
+	if req.Method == "GET" {
+		query := req.URL.Query()
+		r.Query = query.Get("query")
+		r.OperationName = query.Get("operationName")
+		if variables := query.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &r.Variables); err != nil {
+				return nil, fmt.Errorf("invalid variables: %w", err)
+			}
+		}
+		return r, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxGraphQLQueryBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxGraphQLQueryBytes {
+		return nil, fmt.Errorf("the request exceeds %d bytes", maxGraphQLQueryBytes)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(r); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	return r, nil
+}
+
+// selectOperation parses the query and returns the operation of the name
+func (r *graphqlRequest) selectOperation() (*graphqlOperation, error) {
+	parser := &graphqlParser{src: r.Query}
+	operations, err := parser.document()
+	if err != nil {
+		return nil, err
+	}
+	if r.OperationName == "" {
+		if len(operations) > 1 {
+			return nil, errors.New("operationName is required for a document with multiple operations")
+		}
+		return operations[0], nil
+	}
+	for _, op := range operations {
+		if op.name == r.OperationName {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operation %q", r.OperationName)
+}
+
+// handleAdminGraphQL executes queries of pipe states, and subscriptions of pipe events as Server-Sent Events
+// in the "distinct connections mode" of GraphQL over SSE. GET without "query" responds the schema.
+// ref: https://github.com/enisdenjo/graphql-sse/blob/master/PROTOCOL.md
+func (s *PipingServer) handleAdminGraphQL(resWriter http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "POST" {
+		resWriter.Header().Set("Allow", "GET, POST")
+		s.writeError(resWriter, req, 405, ErrorCodeMethodNotAllowed, "Unsupported method: "+req.Method+".")
+		return
+	}
+	if req.Method == "GET" && req.URL.Query().Get("query") == "" {
+		resWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		resWriter.Write([]byte(graphqlSchema))
+		return
+	}
+	r, err := parseGraphQLRequest(req)
+	if err != nil {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	op, err := r.selectOperation()
+	if err != nil {
+		writeJSON(resWriter, graphqlErrorResponse(err))
+		return
+	}
+	variables := op.defaults
+	for name, v := range r.Variables {
+		if n, ok := v.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				v = i
+			} else {
+				v, _ = n.Float64()
+			}
+		}
+		variables[name] = v
+	}
+	e := &graphqlExecutor{variables: variables}
+	if op.kind == "subscription" {
+		s.serveGraphQLSubscription(resWriter, req, e, op)
+		return
+	}
+	data, err := e.selectObject(s.graphqlQueryRoot(), op.selections)
+	if err != nil {
+		writeJSON(resWriter, graphqlErrorResponse(err))
+		return
+	}
+	writeJSON(resWriter, graphqlResponse{Data: data})
+}
+
+func (s *PipingServer) serveGraphQLSubscription(resWriter http.ResponseWriter, req *http.Request, e *graphqlExecutor, op *graphqlOperation) {
+	if len(op.selections) != 1 || op.selections[0].name != "pipeEvents" {
+		writeJSON(resWriter, graphqlErrorResponse(errors.New(`a subscription must select only "pipeEvents"`)))
+		return
+	}
+	field := op.selections[0]
+	filter, err := graphqlEventFilter(e.args(field))
+	if err != nil {
+		writeJSON(resWriter, graphqlErrorResponse(err))
+		return
+	}
+	// NOTE: Validates the selection before streaming
+	if _, err := e.complete(field, newGraphQLObject("PipeEvent", pipeEvent{})); err != nil {
+		writeJSON(resWriter, graphqlErrorResponse(err))
+		return
+	}
+	flusher, ok := resWriter.(http.Flusher)
+	if !ok || !accepts(req, "text/event-stream") {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, "Subscriptions require Accept: text/event-stream.")
+		return
+	}
+	eventCh, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+	resWriter.Header().Set("Content-Type", "text/event-stream")
+	resWriter.Header().Set("Cache-Control", "no-store")
+	resWriter.WriteHeader(200)
+	flusher.Flush()
+	for {
+		select {
+		case ev := <-eventCh:
+			if !filter(ev) {
+				continue
+			}
+			value, err := e.complete(field, newGraphQLObject("PipeEvent", ev))
+			if err != nil {
+				return
+			}
+			data, _ := json.Marshal(graphqlResponse{Data: &graphqlResult{keys: []string{field.alias}, values: map[string]interface{}{field.alias: value}}})
+			if _, err := fmt.Fprintf(resWriter, "event: next\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
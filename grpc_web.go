@@ -0,0 +1,100 @@
+package piping_server
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// frameGRPCWeb frames the stream to the receiver as gRPC-Web messages
+// ref: https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-WEB.md
+const frameGRPCWeb = "grpc-web"
+
+const (
+	grpcWebDataFlag    = 0x00
+	grpcWebTrailerFlag = 0x80
+)
+
+// grpcWebWriter writes each chunk as a gRPC-Web data frame and flushes it.
+// An empty frame is written as a keepalive if nothing is written in the interval.
+type grpcWebWriter struct {
+	w       http.ResponseWriter
+	mutex   sync.Mutex
+	written bool
+	doneCh  chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newGRPCWebWriter(w http.ResponseWriter, keepaliveInterval time.Duration) *grpcWebWriter {
+	gw := &grpcWebWriter{w: w, doneCh: make(chan struct{})}
+	if keepaliveInterval <= 0 {
+		return gw
+	}
+	gw.wg.Add(1)
+	go func() {
+		defer gw.wg.Done()
+		ticker := time.NewTicker(keepaliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-gw.doneCh:
+				return
+			case <-ticker.C:
+			}
+			gw.mutex.Lock()
+			if !gw.written {
+				gw.writeFrame(grpcWebDataFlag, nil)
+			}
+			gw.written = false
+			gw.mutex.Unlock()
+		}
+	}()
+	return gw
+}
+
+// writeFrame writes a frame
+// NOTE: gw.mutex should be locked
+func (gw *grpcWebWriter) writeFrame(flag byte, p []byte) error {
+	header := make([]byte, 5)
+	header[0] = flag
+	binary.BigEndian.PutUint32(header[1:], uint32(len(p)))
+	if _, err := gw.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := gw.w.Write(p); err != nil {
+		return err
+	}
+	if f, ok := gw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func (gw *grpcWebWriter) Write(p []byte) (int, error) {
+	gw.mutex.Lock()
+	defer gw.mutex.Unlock()
+	gw.written = true
+	if err := gw.writeFrame(grpcWebDataFlag, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// close stops keepalives and writes the trailer frame with grpc-status 0 if the transfer succeeded
+func (gw *grpcWebWriter) close(succeeded bool) {
+	close(gw.doneCh)
+	gw.wg.Wait()
+	if succeeded {
+		gw.writeFrame(grpcWebTrailerFlag, []byte("grpc-status: 0\r\n"))
+	}
+}
+
+// copyGRPCWeb copies the stream as gRPC-Web frames with keepalives in the interval
+func copyGRPCWeb(w http.ResponseWriter, r io.Reader, keepaliveInterval time.Duration) (int64, error) {
+	gw := newGRPCWebWriter(w, keepaliveInterval)
+	n, err := io.Copy(gw, r)
+	gw.close(err == nil)
+	return n, err
+}
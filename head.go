@@ -0,0 +1,78 @@
+package piping_server
+
+import (
+	"mime"
+	"net/http"
+	"sync/atomic"
+)
+
+// Values of X-Piping-Status
+const (
+	pipeStatusIdle            = "idle"
+	pipeStatusSenderWaiting   = "sender-waiting"
+	pipeStatusReceiverWaiting = "receiver-waiting"
+	pipeStatusTransferring    = "transferring"
+)
+
+// pipeStatus returns the status of the pipe on the path and the header of the connected sender
+// without creating a pipe
+func (s *PipingServer) pipeStatus(path string) (string, http.Header) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pi, ok := s.pathToPipe[path]
+	if !ok {
+		return pipeStatusIdle, nil
+	}
+	switch {
+	case atomic.LoadUint32(&pi.isTransferring) == 1:
+		return pipeStatusTransferring, pi.senderHeader
+	case atomic.LoadUint32(&pi.isSenderConnected) == 1:
+		return pipeStatusSenderWaiting, pi.senderHeader
+	case len(pi.receiverResWriterCh) != 0:
+		return pipeStatusReceiverWaiting, nil
+	}
+	return pipeStatusIdle, nil
+}
+
+// waitingSenders returns the headers of senders waiting for receivers and spooled bodies by path
+func (s *PipingServer) waitingSenders() map[string]http.Header {
+	headers := map[string]http.Header{}
+	s.mutex.Lock()
+	for p, pi := range s.pathToPipe {
+		if atomic.LoadUint32(&pi.isSenderConnected) == 1 && atomic.LoadUint32(&pi.isTransferring) == 0 {
+			headers[p] = pi.senderHeader
+		}
+	}
+	s.mutex.Unlock()
+	if s.spool != nil {
+		s.spool.mutex.Lock()
+		for p, entry := range s.spool.entries {
+			headers[p] = entry.header
+		}
+		s.spool.mutex.Unlock()
+	}
+	return headers
+}
+
+// handleHead responds the headers a receiver would get, without consuming the receiver slot
+func (s *PipingServer) handleHead(resWriter http.ResponseWriter, req *http.Request) {
+	status, senderHeader := s.pipeStatus(req.URL.Path)
+	resWriter.Header()["Content-Type"] = nil // not to sniff
+	if senderHeader != nil {
+		// Headers in a multipart body are unknown until the transfer
+		mediaType, _, _ := mime.ParseMediaType(senderHeader.Get("Content-Type"))
+		if mediaType != "multipart/form-data" {
+			for _, header := range []string{"Content-Type", "Content-Length", "Content-Disposition"} {
+				if values := senderHeader.Values(header); len(values) == 1 {
+					resWriter.Header().Set(header, sanitizeHeaderValue(values[0]))
+				}
+			}
+		}
+	}
+	resWriter.Header().Set("X-Piping-Status", status)
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	resWriter.Header().Set("Access-Control-Expose-Headers", "X-Piping-Status")
+	resWriter.Header().Set("X-Robots-Tag", "none")
+	s.setSecurityHeaders(resWriter, req, s.PipeSecurityHeaders)
+	resWriter.WriteHeader(200)
+}
@@ -0,0 +1,38 @@
+package piping_server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// maxForwardedHeaderValueBytes caps a header value forwarded from a sender to a receiver
+const maxForwardedHeaderValueBytes = 4096
+
+// maxXPipingValues caps the number of X-Piping values forwarded from a sender to a receiver
+const maxXPipingValues = 32
+
+// headerControlCharacterRemover removes characters which would split the response
+var headerControlCharacterRemover = strings.NewReplacer("\r", "", "\n", "", "\x00", "")
+
+// sanitizeHeaderValue strips CR, LF and NUL from the value forwarded to a receiver and truncates it.
+// NOTE: Values of multipart part headers are not validated by net/http
+func sanitizeHeaderValue(value string) string {
+	value = headerControlCharacterRemover.Replace(value)
+	if len(value) > maxForwardedHeaderValueBytes {
+		value = value[:maxForwardedHeaderValueBytes]
+	}
+	return value
+}
+
+// forwardedXPipingValues returns sanitized X-Piping values of the sender up to maxXPipingValues
+func forwardedXPipingValues(header http.Header) []string {
+	values := header.Values("X-Piping")
+	if len(values) > maxXPipingValues {
+		values = values[:maxXPipingValues]
+	}
+	sanitized := make([]string, len(values))
+	for i, value := range values {
+		sanitized[i] = sanitizeHeaderValue(value)
+	}
+	return sanitized
+}
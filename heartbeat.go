@@ -0,0 +1,101 @@
+package piping_server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// The receiver is kept alive by 102 Processing informational responses, which require Go 1.19 or later
+	heartbeatInformational = "informational"
+	// The receiver is kept alive by comment lines of text/event-stream
+	heartbeatEventStream = "event-stream"
+)
+
+// receiverHeartbeatMode returns the heartbeat mode requested by the receiver with the "heartbeat" query parameter.
+// It returns empty string if heartbeats are disabled.
+func (s *PipingServer) receiverHeartbeatMode(req *http.Request) string {
+	if s.ReceiverHeartbeatInterval <= 0 {
+		return ""
+	}
+	mode := req.URL.Query().Get("heartbeat")
+	switch mode {
+	case heartbeatEventStream:
+		return mode
+	case "", "0", "false":
+		return ""
+	}
+	if !informationalSupported {
+		// NOTE: 102 would be the final status of the receiver
+		return ""
+	}
+	return heartbeatInformational
+}
+
+// startReceiverHeartbeat periodically writes heartbeats to the waiting receiver until a sender takes it.
+// The returned function stops the heartbeats and waits for the last one.
+func (s *PipingServer) startReceiverHeartbeat(pi *pipe, resWriter http.ResponseWriter, mode string) func() {
+	if mode == "" {
+		return func() {}
+	}
+	// The sender's Content-Type is unknown yet, so the event stream is declared upfront
+	if mode == heartbeatEventStream {
+		pi.receiverMutex.Lock()
+		resWriter.Header().Set("Content-Type", "text/event-stream")
+		resWriter.Header().Set("Cache-Control", "no-cache")
+		resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+		resWriter.WriteHeader(200)
+		pi.isReceiverHeaderWritten = true
+		pi.receiverMutex.Unlock()
+	}
+	doneCh := make(chan struct{})
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(s.ReceiverHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-doneCh:
+				return
+			case <-ticker.C:
+			}
+			pi.receiverMutex.Lock()
+			if pi.isReceiverTaken {
+				pi.receiverMutex.Unlock()
+				continue
+			}
+			switch mode {
+			case heartbeatInformational:
+				resWriter.WriteHeader(http.StatusProcessing)
+			case heartbeatEventStream:
+				resWriter.Write([]byte(":\n\n"))
+				if f, ok := resWriter.(http.Flusher); ok {
+					f.Flush()
+				}
+			}
+			pi.receiverMutex.Unlock()
+		}
+	}()
+	once := new(sync.Once)
+	return func() {
+		once.Do(func() {
+			close(doneCh)
+			wg.Wait()
+		})
+	}
+}
+
+// writeInformational writes a 103 Early Hints response telling the receiver the state of the pipe.
+// It writes nothing before Go 1.19, where 103 would be the final status of the receiver.
+func writeInformational(resWriter http.ResponseWriter, pipeStatus string) {
+	if !informationalSupported {
+		return
+	}
+	resWriter.Header().Set("X-Piping-Status", pipeStatus)
+	resWriter.WriteHeader(http.StatusEarlyHints)
+	// Not to leak the status to the final response
+	resWriter.Header().Del("X-Piping-Status")
+}
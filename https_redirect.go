@@ -0,0 +1,46 @@
+package piping_server
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const acmeChallengePathPrefix = "/.well-known/acme-challenge/"
+
+// redirectToHTTPS redirects a plain HTTP request to HTTPSRedirectPort, returning true if redirected.
+// ACME challenges, requests from a reverse proxy terminating TLS and requests to pipes which a peer has already joined
+// over plain HTTP are not redirected. Methods other than GET and HEAD are redirected with 308 to keep their bodies.
+func (s *PipingServer) redirectToHTTPS(resWriter http.ResponseWriter, req *http.Request) bool {
+	if s.HTTPSRedirectPort == 0 || req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https" {
+		return false
+	}
+	if strings.HasPrefix(req.URL.Path, acmeChallengePathPrefix) {
+		return false
+	}
+	if strippedReq, ok := s.stripBasePath(req); ok {
+		s.mutex.Lock()
+		_, hasPipe := s.pathToPipe[strippedReq.URL.Path]
+		s.mutex.Unlock()
+		// NOTE: The peer waiting on the pipe may not be able to follow the transfer to HTTPS
+		if hasPipe {
+			return false
+		}
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if s.HTTPSRedirectPort != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(s.HTTPSRedirectPort))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	statusCode := http.StatusMovedPermanently
+	if req.Method != "GET" && req.Method != "HEAD" {
+		statusCode = http.StatusPermanentRedirect
+	}
+	http.Redirect(resWriter, req, "https://"+host+req.URL.RequestURI(), statusCode)
+	return true
+}
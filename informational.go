@@ -0,0 +1,7 @@
+//go:build go1.19
+// +build go1.19
+
+package piping_server
+
+// informationalSupported is true since net/http sends 1xx responses other than 100 Continue as interim responses from Go 1.19
+const informationalSupported = true
@@ -0,0 +1,7 @@
+//go:build !go1.19
+// +build !go1.19
+
+package piping_server
+
+// informationalSupported is false since net/http before Go 1.19 sends a 1xx response as the final response
+const informationalSupported = false
@@ -0,0 +1,80 @@
+package piping_server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// connContextKey is the key of the connection of a request in its context
+type connContextKey struct{}
+
+// ConnContext keeps the connection in the context of its requests so that a transfer stalling on HTTP/1.x can be interrupted
+// (e.g. http.Server{ConnContext: pipingServer.ConnContext}).
+// Without it, a stalled body over HTTP/1.x blocks until the client sends more or disconnects.
+func (s *PipingServer) ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+// requestConn returns the connection of the HTTP/1.x request given by ConnContext
+func requestConn(req *http.Request) (net.Conn, bool) {
+	if req == nil || req.ProtoMajor != 1 {
+		return nil, false
+	}
+	conn, ok := req.Context().Value(connContextKey{}).(net.Conn)
+	return conn, ok
+}
+
+// interruptRead lets a blocking read of the request body fail
+func interruptRead(req *http.Request) {
+	if conn, ok := requestConn(req); ok {
+		// NOTE: The response can still be written after the read deadline
+		conn.SetReadDeadline(time.Unix(1, 0))
+		return
+	}
+	// NOTE: Closing the body of HTTP/1.x blocks while it is read, but HTTP/2 and HTTP/3 bodies are closed immediately
+	if req.ProtoMajor != 1 {
+		go req.Body.Close()
+	}
+}
+
+// interruptWrite lets a blocking write of the response fail
+func interruptWrite(req *http.Request) {
+	if conn, ok := requestConn(req); ok {
+		conn.SetWriteDeadline(time.Unix(1, 0))
+	}
+}
+
+// transferWatcher interrupts a transfer blocking on the sender or the receiver when it has to stop
+type transferWatcher struct {
+	stopCh   chan struct{}
+	exitedCh chan struct{}
+	reason   error
+}
+
+// watchTransfer interrupts the transfer when timeoutCh fires or cancelCh is closed
+func watchTransfer(senderReq *http.Request, receiverReq *http.Request, timeoutCh <-chan time.Time, cancelCh <-chan struct{}) *transferWatcher {
+	w := &transferWatcher{stopCh: make(chan struct{}), exitedCh: make(chan struct{})}
+	go func() {
+		defer close(w.exitedCh)
+		select {
+		case <-w.stopCh:
+			return
+		case <-timeoutCh:
+			w.reason = errTransferTimeout
+		case <-cancelCh:
+			w.reason = errPipeCanceled
+		}
+		interruptRead(senderReq)
+		interruptWrite(receiverReq)
+	}()
+	return w
+}
+
+// stop stops watching and returns the reason if the transfer has been interrupted
+func (w *transferWatcher) stop() error {
+	close(w.stopCh)
+	<-w.exitedCh
+	return w.reason
+}
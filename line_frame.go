@@ -0,0 +1,54 @@
+package piping_server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const lineFrameBufferSize = 64 * 1024
+
+const frameLine = "line"
+
+// isLineFramed returns true if the request has "frame=line"
+func isLineFramed(req *http.Request) bool {
+	return req.URL.Query().Get("frame") == frameLine
+}
+
+// receiverFrame returns the "frame" query parameter of the receiver, or an error if unsupported
+func receiverFrame(req *http.Request) (string, error) {
+	switch frame := req.URL.Query().Get("frame"); frame {
+	case "", frameLine, frameGRPCWeb:
+		return frame, nil
+	default:
+		return "", fmt.Errorf("Unsupported frame '%s'. (line or grpc-web)", frame)
+	}
+}
+
+// copyLines copies and flushes line by line so that receivers get each line as soon as it is sent.
+// A line longer than the buffer is flushed in pieces.
+func copyLines(w http.ResponseWriter, r io.Reader) (int64, error) {
+	flusher, _ := w.(http.Flusher)
+	reader := bufio.NewReaderSize(r, lineFrameBufferSize)
+	var written int64
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(line) != 0 {
+			n, writeErr := w.Write(line)
+			written += int64(n)
+			if writeErr != nil {
+				return written, writeErr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return written, err
+		}
+	}
+}
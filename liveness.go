@@ -0,0 +1,22 @@
+package piping_server
+
+import (
+	"errors"
+	"time"
+)
+
+// CheckLiveness returns an error if the server cannot handle pipes within the timeout (e.g. deadlock)
+func (s *PipingServer) CheckLiveness(timeout time.Duration) error {
+	doneCh := make(chan struct{})
+	go func() {
+		s.mutex.Lock()
+		s.mutex.Unlock()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("pipes are not responsive")
+	}
+}
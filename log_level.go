@@ -0,0 +1,128 @@
+package piping_server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type LogLevel int32
+
+const (
+	LogLevelError LogLevel = iota
+	LogLevelInfo
+	LogLevelDebug
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelError:
+		return "error"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelDebug:
+		return "debug"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int32(l))
+}
+
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "error":
+		return LogLevelError, nil
+	case "info":
+		return LogLevelInfo, nil
+	case "debug":
+		return LogLevelDebug, nil
+	}
+	return 0, fmt.Errorf("invalid log level: %s", s)
+}
+
+// LogLevel returns the current log level
+func (s *PipingServer) LogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(&s.logLevel))
+}
+
+// SetLogLevel changes the log level, which is safe while serving
+func (s *PipingServer) SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&s.logLevel, int32(level))
+}
+
+// DebugPath is a path pattern traced regardless of the log level until it expires
+type DebugPath struct {
+	Pattern   string    `json:"pattern"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// EnableDebugPath traces pipe paths matching the pattern (syntax of path.Match) for the duration
+func (s *PipingServer) EnableDebugPath(pattern string, d time.Duration) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	s.debugPathsMutex.Lock()
+	defer s.debugPathsMutex.Unlock()
+	s.debugPaths[pattern] = s.now().Add(d)
+	return nil
+}
+
+// DisableDebugPath stops tracing of the pattern
+func (s *PipingServer) DisableDebugPath(pattern string) {
+	s.debugPathsMutex.Lock()
+	defer s.debugPathsMutex.Unlock()
+	delete(s.debugPaths, pattern)
+}
+
+// DebugPaths returns unexpired patterns sorted by pattern
+func (s *PipingServer) DebugPaths() []DebugPath {
+	s.debugPathsMutex.Lock()
+	defer s.debugPathsMutex.Unlock()
+	now := s.now()
+	debugPaths := []DebugPath{}
+	for pattern, expiresAt := range s.debugPaths {
+		if now.After(expiresAt) {
+			delete(s.debugPaths, pattern)
+			continue
+		}
+		debugPaths = append(debugPaths, DebugPath{Pattern: pattern, ExpiresAt: expiresAt})
+	}
+	sort.Slice(debugPaths, func(i, j int) bool { return debugPaths[i].Pattern < debugPaths[j].Pattern })
+	return debugPaths
+}
+
+func (s *PipingServer) isDebugPath(p string) bool {
+	s.debugPathsMutex.Lock()
+	defer s.debugPathsMutex.Unlock()
+	now := s.now()
+	for pattern, expiresAt := range s.debugPaths {
+		if now.After(expiresAt) {
+			delete(s.debugPaths, pattern)
+			continue
+		}
+		if matched, _ := path.Match(pattern, p); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// logf logs with the request ID regardless of the log level
+func (s *PipingServer) logf(req *http.Request, format string, v ...interface{}) {
+	s.logger.Printf("["+requestID(req)+"] "+format, v...)
+}
+
+func (s *PipingServer) infof(req *http.Request, format string, v ...interface{}) {
+	if s.LogLevel() >= LogLevelInfo {
+		s.logf(req, format, v...)
+	}
+}
+
+// debugf logs if the level is debug or the path of the request is traced
+func (s *PipingServer) debugf(req *http.Request, format string, v ...interface{}) {
+	if s.LogLevel() >= LogLevelDebug || s.isDebugPath(req.URL.Path) {
+		s.logf(req, "[DEBUG] "+format, v...)
+	}
+}
@@ -0,0 +1,128 @@
+package piping_server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// LogSamplingRule logs only a fraction of request lines of paths matching Pattern or Regexp.
+// Transfers and errors of the requests are logged regardless of the rule.
+type LogSamplingRule struct {
+	// Pattern is a path.Match pattern (e.g. "/static/*")
+	Pattern string
+	// Regexp is used instead of Pattern if set
+	Regexp *regexp.Regexp
+	// Rate is the fraction of request lines logged (e.g. 0.01 for 1%)
+	Rate float64
+}
+
+func (r *LogSamplingRule) matches(p string) bool {
+	if r.Regexp != nil {
+		return r.Regexp.MatchString(p)
+	}
+	matched, _ := path.Match(r.Pattern, p)
+	return matched
+}
+
+func (r *LogSamplingRule) key() string {
+	if r.Regexp != nil {
+		return "regexp=" + r.Regexp.String()
+	}
+	return "pattern=" + r.Pattern
+}
+
+// ParseLogSamplingRule parses comma-separated key=value pairs (e.g. "regexp=\.(js|css|png)$,rate=0.01").
+// Keys are pattern, regexp and rate.
+func ParseLogSamplingRule(s string) (LogSamplingRule, error) {
+	var rule LogSamplingRule
+	hasRate := false
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return rule, fmt.Errorf("invalid log sampling rule %q: %q is not key=value", s, pair)
+		}
+		var err error
+		switch key {
+		case "pattern":
+			_, err = path.Match(value, "")
+			rule.Pattern = value
+		case "regexp":
+			rule.Regexp, err = regexp.Compile(value)
+		case "rate":
+			rule.Rate, err = strconv.ParseFloat(value, 64)
+			if err == nil && (rule.Rate < 0 || rule.Rate > 1) {
+				err = fmt.Errorf("%s is not from 0 to 1", value)
+			}
+			hasRate = true
+		default:
+			return rule, fmt.Errorf("invalid log sampling rule %q: unknown key %q", s, key)
+		}
+		if err != nil {
+			return rule, fmt.Errorf("invalid log sampling rule %q: %s: %w", s, key, err)
+		}
+	}
+	if rule.Pattern == "" && rule.Regexp == nil {
+		return rule, fmt.Errorf("invalid log sampling rule %q: pattern or regexp is required", s)
+	}
+	if !hasRate {
+		return rule, fmt.Errorf("invalid log sampling rule %q: rate is required", s)
+	}
+	return rule, nil
+}
+
+// logSampler counts requests by rule to log evenly spaced ones
+type logSampler struct {
+	mutex  sync.Mutex
+	counts map[string]int64
+}
+
+func newLogSampler() *logSampler {
+	return &logSampler{counts: map[string]int64{}}
+}
+
+// sample returns true if the nth request of the rule is logged, which is when n*rate reaches the next integer
+func (ls *logSampler) sample(rule *LogSamplingRule) bool {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	key := rule.key()
+	ls.counts[key]++
+	n := ls.counts[key]
+	return int64(float64(n)*rule.Rate) != int64(float64(n-1)*rule.Rate)
+}
+
+type sampledOutRequestLineContextKey struct{}
+
+// logRequestLine logs the request line unless it is sampled out, in which case the line is kept in the request to log it on errors
+func (s *PipingServer) logRequestLine(req *http.Request) *http.Request {
+	if s.LogLevel() < LogLevelInfo {
+		return req
+	}
+	line := fmt.Sprintf("%s %s %s %s", req.Method, req.RemoteAddr, req.URL, req.Proto)
+	if s.LogLevel() < LogLevelDebug && !s.isDebugPath(req.URL.Path) {
+		for i := range s.LogSampling {
+			rule := &s.LogSampling[i]
+			if !rule.matches(req.URL.Path) {
+				continue
+			}
+			if !s.logSampler.sample(rule) {
+				return req.WithContext(context.WithValue(req.Context(), sampledOutRequestLineContextKey{}, line))
+			}
+			break
+		}
+	}
+	s.logf(req, "%s", line)
+	return req
+}
+
+// logSampledOutRequestLine logs the request line if it has been sampled out
+func (s *PipingServer) logSampledOutRequestLine(req *http.Request) {
+	if line, ok := req.Context().Value(sampledOutRequestLineContextKey{}).(string); ok {
+		s.logf(req, "%s", line)
+	}
+}
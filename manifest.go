@@ -0,0 +1,244 @@
+package piping_server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifestPathSuffix makes "/p/mypath/meta" the manifest of "/p/mypath"
+const manifestPathSuffix = "/meta"
+
+const manifestHeader = "X-Piping-Manifest"
+
+// DefaultManifestTTL is the lifetime of a manifest declared before its transfer
+const DefaultManifestTTL = time.Hour
+
+const maxManifestBytes = 4096
+
+// maxManifests bounds the memory used by declared manifests
+const maxManifests = 1000
+
+// Manifest describes a transfer so that receivers can confirm it before downloading
+type Manifest struct {
+	Filename string `json:"filename,omitempty"`
+	Size     *int64 `json:"size,omitempty"`
+	Mime     string `json:"mime,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+	Note     string `json:"note,omitempty"`
+}
+
+type declaredManifest struct {
+	manifest  Manifest
+	expiresAt time.Time
+}
+
+type manifestStore struct {
+	mutex     sync.Mutex
+	manifests map[string]declaredManifest
+}
+
+func newManifestStore() *manifestStore {
+	return &manifestStore{manifests: map[string]declaredManifest{}}
+}
+
+// put stores the manifest of the path unless the store is full
+func (st *manifestStore) put(path string, m declaredManifest, now time.Time) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for p, old := range st.manifests {
+		if !now.Before(old.expiresAt) {
+			delete(st.manifests, p)
+		}
+	}
+	if _, ok := st.manifests[path]; !ok && len(st.manifests) >= maxManifests {
+		return false
+	}
+	st.manifests[path] = m
+	return true
+}
+
+func (st *manifestStore) get(path string, now time.Time) (Manifest, bool) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	m, ok := st.manifests[path]
+	if !ok || !now.Before(m.expiresAt) {
+		return Manifest{}, false
+	}
+	return m.manifest, true
+}
+
+func (st *manifestStore) delete(path string) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	_, ok := st.manifests[path]
+	delete(st.manifests, path)
+	return ok
+}
+
+// parseManifest parses the JSON manifest rejecting unknown fields
+func parseManifest(b []byte) (Manifest, error) {
+	var m Manifest
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&m); err != nil {
+		return m, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if m.Size != nil && *m.Size < 0 {
+		return m, fmt.Errorf("invalid manifest: negative size")
+	}
+	if m.SHA256 != "" {
+		if sum, err := hex.DecodeString(m.SHA256); err != nil || len(sum) != 32 {
+			return m, fmt.Errorf("invalid manifest: sha256 should be 64 hex digits")
+		}
+		m.SHA256 = strings.ToLower(m.SHA256)
+	}
+	return m, nil
+}
+
+// senderManifest parses X-Piping-Manifest of the sender, returning nil if it is not specified
+func senderManifest(header http.Header) (*Manifest, error) {
+	value := header.Get(manifestHeader)
+	if value == "" {
+		return nil, nil
+	}
+	if len(value) > maxManifestBytes {
+		return nil, fmt.Errorf("invalid manifest: %s exceeds %d bytes", manifestHeader, maxManifestBytes)
+	}
+	m, err := parseManifest([]byte(value))
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// merge fills the fields of m empty in it with the ones of base
+func (m Manifest) merge(base Manifest) Manifest {
+	if m.Filename == "" {
+		m.Filename = base.Filename
+	}
+	if m.Size == nil {
+		m.Size = base.Size
+	}
+	if m.Mime == "" {
+		m.Mime = base.Mime
+	}
+	if m.SHA256 == "" {
+		m.SHA256 = base.SHA256
+	}
+	if m.Note == "" {
+		m.Note = base.Note
+	}
+	return m
+}
+
+// headerManifest derives the manifest from Content-Type, Content-Length and Content-Disposition of the sender
+func headerManifest(header http.Header) Manifest {
+	var m Manifest
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	// NOTE: Headers in a multipart body are unknown until the transfer
+	if err == nil && mediaType == "multipart/form-data" {
+		return m
+	}
+	m.Mime = header.Get("Content-Type")
+	if size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && size >= 0 {
+		m.Size = &size
+	}
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		m.Filename = params["filename"]
+	}
+	return m
+}
+
+// manifest returns the manifest of the path. X-Piping-Manifest of the connected sender takes precedence over
+// the declared manifest, which takes precedence over the headers of the sender.
+func (s *PipingServer) manifest(path string) (Manifest, bool) {
+	declared, ok := s.manifests.get(path, s.now())
+	_, senderHeader := s.pipeStatus(path)
+	if senderHeader == nil {
+		return declared, ok
+	}
+	m := declared.merge(headerManifest(senderHeader))
+	// NOTE: validated by handleSender
+	if sm, _ := senderManifest(senderHeader); sm != nil {
+		m = sm.merge(m)
+	}
+	return m, true
+}
+
+// manifestTarget returns the path whose manifest is at the path (e.g. "/p/mypath" for "/p/mypath/meta")
+func manifestTarget(path string) (string, bool) {
+	target := strings.TrimSuffix(path, manifestPathSuffix)
+	if target == path || !isPipingPath(target) || strings.HasSuffix(target, "/") {
+		return "", false
+	}
+	return target, true
+}
+
+// handleManifest returns the manifest of the target path by GET, and declares it with a JSON body by POST or PUT
+// before the sender connects. The declared manifest is deleted when the transfer finishes or expires.
+func (s *PipingServer) handleManifest(resWriter http.ResponseWriter, req *http.Request, target string) {
+	if req.Method == "OPTIONS" {
+		s.handleOptions(resWriter, req)
+		return
+	}
+	// Authorize as the target path
+	targetReq := new(http.Request)
+	*targetReq = *req
+	targetReq.URL = new(url.URL)
+	*targetReq.URL = *req.URL
+	targetReq.URL.Path = target
+	targetReq.URL.RawPath = ""
+	if !s.checkRateLimit(resWriter, req) || !s.authorizePathRule(resWriter, targetReq) || !s.authorizeReservation(resWriter, targetReq) {
+		return
+	}
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	switch {
+	case req.Method == "GET" || req.Method == "HEAD":
+		m, ok := s.manifest(target)
+		if !ok {
+			s.writeError(resWriter, req, 404, ErrorCodeManifestNotFound, fmt.Sprintf("No manifest has been declared on '%s'.", target))
+			return
+		}
+		writeJSON(resWriter, m)
+	case s.isSenderMethod(req.Method):
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxManifestBytes+1))
+		if err != nil {
+			return
+		}
+		if len(body) > maxManifestBytes {
+			s.writeError(resWriter, req, 413, ErrorCodePayloadTooLarge, fmt.Sprintf("The manifest exceeds the maximum size of %d bytes.", maxManifestBytes))
+			return
+		}
+		m, err := parseManifest(body)
+		if err != nil {
+			s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+			return
+		}
+		now := s.now()
+		if !s.manifests.put(target, declaredManifest{manifest: m, expiresAt: now.Add(DefaultManifestTTL)}, now) {
+			s.writeError(resWriter, req, 503, ErrorCodeManifestLimit, "The number of manifests has reached limits.")
+			return
+		}
+		s.infof(req, "Manifest of %s has been declared", target)
+		writeJSON(resWriter, m)
+	case req.Method == "DELETE":
+		if !s.manifests.delete(target) {
+			s.writeError(resWriter, req, 404, ErrorCodeManifestNotFound, fmt.Sprintf("No manifest has been declared on '%s'.", target))
+			return
+		}
+		resWriter.WriteHeader(204)
+	default:
+		resWriter.Header().Set("Allow", "GET, HEAD, POST, PUT, DELETE, OPTIONS")
+		s.writeError(resWriter, req, 405, ErrorCodeMethodNotAllowed, fmt.Sprintf("Unsupported method: %s.", req.Method))
+	}
+}
@@ -0,0 +1,33 @@
+package piping_server
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// pipeRequestMemory approximates the memory held by a request on a pipe:
+// the goroutine stack, the buffers of the connection and the copy buffer of the transfer
+const pipeRequestMemory = 64 * 1024
+
+func (s *PipingServer) committedMemoryBytes() int64 {
+	return atomic.LoadInt64(&s.committedMemory) + s.clips.bytes()
+}
+
+// admitMemory commits the memory of the pipe request until release is called,
+// or writes 503 and returns false if the request would create a new pipe above MemoryCeiling
+func (s *PipingServer) admitMemory(resWriter http.ResponseWriter, req *http.Request) (release func(), ok bool) {
+	committed := atomic.AddInt64(&s.committedMemory, pipeRequestMemory)
+	release = func() { atomic.AddInt64(&s.committedMemory, -pipeRequestMemory) }
+	if s.MemoryCeiling <= 0 || committed+s.clips.bytes() <= s.MemoryCeiling {
+		return release, true
+	}
+	// NOTE: Rejecting the other side of a waiting pipe would waste the memory already committed to it
+	if status, _ := s.pipeStatus(req.URL.Path); status != pipeStatusIdle {
+		return release, true
+	}
+	release()
+	resWriter.Header().Set("Retry-After", "1")
+	s.writeError(resWriter, req, 503, ErrorCodeMemoryCeiling, fmt.Sprintf("The server is low on memory. The new pipe on '%s' has been rejected.", req.URL.Path))
+	return nil, false
+}
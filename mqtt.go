@@ -0,0 +1,217 @@
+package piping_server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types in the high nibble of the first byte
+// ref: https://docs.oasis-open.org/mqtt/mqtt/v3.1.1/os/mqtt-v3.1.1-os.html
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPingreq    = 0xc0
+	mqttDisconnect = 0xe0
+)
+
+// mqttRetryInterval is the interval of reconnecting to the broker
+const mqttRetryInterval = 5 * time.Second
+
+// MQTTConfig is the MQTT broker to publish pipe lifecycle events to
+type MQTTConfig struct {
+	// Addr is "host:port" of the broker speaking MQTT 3.1.1 over TCP
+	Addr string
+	// TopicPrefix is the root of topics "<TopicPrefix>/<path>/<event type>" (e.g. "piping-server/p/mypath/transfer-finished")
+	TopicPrefix string
+	ClientID    string
+	Username    string
+	Password    string
+	// KeepAlive is the interval of pings (60s if 0)
+	KeepAlive time.Duration
+}
+
+// mqttTopic returns the topic of the event, replacing the wildcards of MQTT in the path
+func mqttTopic(prefix string, e pipeEvent) string {
+	path := strings.NewReplacer("+", "_", "#", "_").Replace(strings.TrimPrefix(e.Path, "/"))
+	return strings.TrimSuffix(prefix, "/") + "/" + path + "/" + e.Type
+}
+
+func appendMQTTUint16(b []byte, n uint16) []byte {
+	return append(b, byte(n>>8), byte(n))
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	return append(appendMQTTUint16(b, uint16(len(s))), s...)
+}
+
+// writeMQTTPacket writes the packet with the remaining length encoded in variable length
+func writeMQTTPacket(w io.Writer, header byte, body []byte) error {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+// readMQTTPacket reads a packet, returning the first byte and the rest
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		if i == 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		n += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+// mqttConn is a connection to the broker publishing with QoS 0
+type mqttConn struct {
+	conn net.Conn
+	// errCh receives the error which has closed the connection
+	errCh chan error
+}
+
+func dialMQTT(config MQTTConfig, keepAlive time.Duration) (*mqttConn, error) {
+	conn, err := net.DialTimeout("tcp", config.Addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	flags := byte(0x02) // clean session
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4) // protocol level of 3.1.1
+	if config.Username != "" {
+		flags |= 0x80
+		if config.Password != "" {
+			flags |= 0x40
+		}
+	}
+	body = append(body, flags)
+	body = appendMQTTUint16(body, uint16(keepAlive/time.Second))
+	body = appendMQTTString(body, config.ClientID)
+	if config.Username != "" {
+		body = appendMQTTString(body, config.Username)
+		if config.Password != "" {
+			body = appendMQTTString(body, config.Password)
+		}
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := writeMQTTPacket(conn, mqttConnect, body); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	header, ack, err := readMQTTPacket(reader)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if header&0xf0 != mqttConnack || len(ack) != 2 || ack[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("connection refused by the broker (CONNACK %x)", ack)
+	}
+	conn.SetDeadline(time.Time{})
+	c := &mqttConn{conn: conn, errCh: make(chan error, 1)}
+	// NOTE: Reads PINGRESP and detects closing by the broker
+	go func() {
+		for {
+			if _, _, err := readMQTTPacket(reader); err != nil {
+				c.errCh <- err
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+func (c *mqttConn) write(header byte, body []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return writeMQTTPacket(c.conn, header, body)
+}
+
+func (c *mqttConn) publish(topic string, payload []byte) error {
+	return c.write(mqttPublish, append(appendMQTTString(nil, topic), payload...))
+}
+
+// RunMQTTBridge publishes pipe lifecycle events to the broker until stopCh is closed, reconnecting on failures.
+// Events are published with QoS 0 and dropped while disconnected.
+func (s *PipingServer) RunMQTTBridge(config MQTTConfig, stopCh <-chan struct{}) {
+	keepAlive := config.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = 60 * time.Second
+	}
+	eventCh, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+	for {
+		conn, err := dialMQTT(config, keepAlive)
+		if err == nil {
+			s.logger.Printf("Publishing events to MQTT broker %s", config.Addr)
+			err = s.publishMQTT(conn, config, keepAlive, eventCh, stopCh)
+			conn.conn.Close()
+			if err == nil {
+				return
+			}
+		}
+		s.logger.Printf("MQTT bridge to %s has failed: %v", config.Addr, err)
+		select {
+		case <-time.After(mqttRetryInterval):
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// publishMQTT publishes events until stopCh is closed, returning nil, or the connection fails
+func (s *PipingServer) publishMQTT(conn *mqttConn, config MQTTConfig, keepAlive time.Duration, eventCh <-chan pipeEvent, stopCh <-chan struct{}) error {
+	ticker := time.NewTicker(keepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-eventCh:
+			payload, _ := json.Marshal(e)
+			if err := conn.publish(mqttTopic(config.TopicPrefix, e), payload); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := conn.write(mqttPingreq, nil); err != nil {
+				return err
+			}
+		case err := <-conn.errCh:
+			return err
+		case <-stopCh:
+			conn.write(mqttDisconnect, nil)
+			return nil
+		}
+	}
+}
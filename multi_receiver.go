@@ -0,0 +1,428 @@
+package piping_server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// maxMultiReceivers bounds the "n" query parameter
+const maxMultiReceivers = 32
+
+// Match policies of the "match" query parameter of a sender to multiple receivers
+const (
+	// matchAll starts the transfer when all the receivers have connected
+	matchAll = "all"
+	// matchFirst starts the transfer when the first receiver connects, and later receivers miss the head
+	matchFirst = "first"
+)
+
+var (
+	errMultiPipeMismatch = errors.New("the number of receivers does not match")
+	errMultiPipeFull     = errors.New("the number of receivers has been reached")
+	errMultiPipeSender   = errors.New("another sender has been connected")
+	errNoReceiverLeft    = errors.New("no receiver is left")
+	errMultiPipeFinished = fmt.Errorf("%w: the transfer has finished", errPipeCanceled)
+)
+
+// multiPipe is the transfer of a sender to n receivers on a path.
+// Each receiver waits on its own pipe on a hidden path, which the sender feeds.
+type multiPipe struct {
+	id string
+	n  int
+	// NOTE: guarded by multiPipes.mutex
+	nextSlot          int
+	receivers         []int
+	isSenderConnected bool
+	isStarted         bool
+	// changedCh is closed when a receiver joins or leaves before the transfer starts
+	changedCh chan struct{}
+	// lateCh gets the slots of receivers joining after the transfer has started
+	lateCh chan int
+}
+
+// receiverPath returns the hidden path of the pipe of the receiver in the slot
+func (mp *multiPipe) receiverPath(path string, slot int) string {
+	return fmt.Sprintf("%s.receiver%d-%s", path, slot, mp.id)
+}
+
+// multiPipes holds transfers to multiple receivers by path
+type multiPipes struct {
+	mutex sync.Mutex
+	paths map[string]*multiPipe
+}
+
+func newMultiPipes() *multiPipes {
+	return &multiPipes{paths: map[string]*multiPipe{}}
+}
+
+func (m *multiPipes) has(path string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, ok := m.paths[path]
+	return ok
+}
+
+// get returns the transfer on the path, creating it if not found
+// NOTE: m.mutex should be locked
+func (m *multiPipes) get(path string, n int, random io.Reader) (*multiPipe, error) {
+	mp, ok := m.paths[path]
+	if !ok {
+		mp = &multiPipe{id: newID(random), n: n, changedCh: make(chan struct{}), lateCh: make(chan int, n)}
+		m.paths[path] = mp
+	}
+	if mp.n != n {
+		return nil, errMultiPipeMismatch
+	}
+	return mp, nil
+}
+
+// changed wakes up the sender waiting for receivers
+// NOTE: m.mutex should be locked
+func (mp *multiPipe) changed() {
+	close(mp.changedCh)
+	mp.changedCh = make(chan struct{})
+}
+
+// joinReceiver takes a slot for a receiver
+func (m *multiPipes) joinReceiver(path string, n int, random io.Reader) (*multiPipe, int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	mp, err := m.get(path, n, random)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(mp.receivers) >= mp.n {
+		return nil, 0, errMultiPipeFull
+	}
+	slot := mp.nextSlot
+	mp.nextSlot++
+	mp.receivers = append(mp.receivers, slot)
+	if mp.isStarted {
+		mp.lateCh <- slot
+	} else {
+		mp.changed()
+	}
+	return mp, slot, nil
+}
+
+// leaveReceiver gives the slot back if the transfer has not started and returns true if so
+func (m *multiPipes) leaveReceiver(path string, mp *multiPipe, slot int) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if mp.isStarted {
+		return false
+	}
+	for i, s := range mp.receivers {
+		if s == slot {
+			mp.receivers = append(mp.receivers[:i:i], mp.receivers[i+1:]...)
+			break
+		}
+	}
+	mp.changed()
+	m.deleteIfUnused(path, mp)
+	return true
+}
+
+// joinSender connects the sender to the transfer
+func (m *multiPipes) joinSender(path string, n int, random io.Reader) (*multiPipe, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	mp, err := m.get(path, n, random)
+	if err != nil {
+		return nil, err
+	}
+	if mp.isSenderConnected {
+		return nil, errMultiPipeSender
+	}
+	mp.isSenderConnected = true
+	return mp, nil
+}
+
+// start starts the transfer and returns the slots of the receivers if they match the policy,
+// otherwise returns the channel closed when receivers change
+func (m *multiPipes) start(mp *multiPipe, match string) ([]int, <-chan struct{}, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(mp.receivers) == mp.n || (match == matchFirst && len(mp.receivers) != 0) {
+		mp.isStarted = true
+		return append([]int(nil), mp.receivers...), nil, true
+	}
+	return nil, mp.changedCh, false
+}
+
+// leaveSender disconnects the sender, deleting the transfer if it has started
+func (m *multiPipes) leaveSender(path string, mp *multiPipe) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	mp.isSenderConnected = false
+	if mp.isStarted {
+		if m.paths[path] == mp {
+			delete(m.paths, path)
+		}
+		return
+	}
+	m.deleteIfUnused(path, mp)
+}
+
+// NOTE: m.mutex should be locked
+func (m *multiPipes) deleteIfUnused(path string, mp *multiPipe) {
+	if len(mp.receivers) == 0 && !mp.isSenderConnected && m.paths[path] == mp {
+		delete(m.paths, path)
+	}
+}
+
+// hasPipe returns true if a sender or a receiver is on the path
+func (s *PipingServer) hasPipe(path string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.pathToPipe[path]
+	return ok
+}
+
+// multiReceiverCount returns the "n" query parameter, which is 1 without it
+func multiReceiverCount(req *http.Request) (int, error) {
+	value := req.URL.Query().Get("n")
+	if value == "" {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > maxMultiReceivers {
+		return 0, fmt.Errorf("The n parameter should be from 1 to %d.", maxMultiReceivers)
+	}
+	return n, nil
+}
+
+// matchPolicy returns the "match" query parameter of the sender
+func matchPolicy(req *http.Request) (string, error) {
+	switch match := req.URL.Query().Get("match"); match {
+	case "", matchAll:
+		return matchAll, nil
+	case matchFirst:
+		return matchFirst, nil
+	default:
+		return "", fmt.Errorf("Unsupported match '%s'. (all or first)", match)
+	}
+}
+
+// multiPipeRequest returns the request on the pipe of the receiver in the slot
+func multiPipeRequest(req *http.Request, mp *multiPipe, slot int, body io.Reader) *http.Request {
+	path := req.URL.Path
+	pipeReq := req.Clone(req.Context())
+	pipeReq.URL.Path = mp.receiverPath(path, slot)
+	pipeReq.URL.RawPath = ""
+	query := pipeReq.URL.Query()
+	for _, name := range []string{"n", "match", "notify"} {
+		query.Del(name)
+	}
+	pipeReq.URL.RawQuery = query.Encode()
+	pipeReq.RequestURI = pipeReq.URL.RequestURI()
+	if body != nil {
+		pipeReq.Body = io.NopCloser(body)
+	}
+	return pipeReq
+}
+
+// writeMultiPipeError writes the error of joining the transfer to multiple receivers
+func (s *PipingServer) writeMultiPipeError(resWriter http.ResponseWriter, req *http.Request, n int, err error) {
+	path := req.URL.Path
+	switch err {
+	case errMultiPipeFull:
+		s.writeError(resWriter, req, 400, ErrorCodeReceiverLimit, fmt.Sprintf("The number of receivers on '%s' has reached %d.", path, n))
+	case errMultiPipeSender:
+		s.writeError(resWriter, req, 400, ErrorCodeSenderConflict, fmt.Sprintf("Another sender has been connected on '%s'.", path))
+	default:
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, fmt.Sprintf("The number of receivers on '%s' does not match n=%d.", path, n))
+	}
+}
+
+// rejectMultiPipe rejects a sender or a receiver without "n" on the path of a transfer to multiple receivers
+func (s *PipingServer) rejectMultiPipe(resWriter http.ResponseWriter, req *http.Request) bool {
+	if !s.multiPipes.has(req.URL.Path) {
+		return false
+	}
+	s.writeMultiPipeError(resWriter, req, 1, errMultiPipeMismatch)
+	return true
+}
+
+// handleMultiReceiver lets the receiver wait on the pipe of its slot of the transfer
+func (s *PipingServer) handleMultiReceiver(resWriter http.ResponseWriter, req *http.Request, n int) {
+	path := req.URL.Path
+	if s.hasPipe(path) {
+		s.writeMultiPipeError(resWriter, req, n, errMultiPipeMismatch)
+		return
+	}
+	mp, slot, err := s.multiPipes.joinReceiver(path, n, s.random())
+	if err != nil {
+		s.writeMultiPipeError(resWriter, req, n, err)
+		return
+	}
+	pipeReq := multiPipeRequest(req, mp, slot, nil)
+	defer func() {
+		// NOTE: The sender does not feed the pipe of a receiver which has left before the transfer
+		if s.multiPipes.leaveReceiver(path, mp, slot) {
+			s.cancelPipe(pipeReq.URL.Path)
+		}
+	}()
+	s.debugf(req, "Receiver %s has joined %s as %d of %d receivers", req.RemoteAddr, path, slot+1, n)
+	s.handleReceiver(resWriter, pipeReq)
+}
+
+// multiPipeFeed is the sending to the receiver in a slot
+type multiPipeFeed struct {
+	w          *bridgeResponseWriter
+	pipeWriter *io.PipeWriter
+}
+
+// handleMultiSender waits for the receivers by the match policy and sends the body to each of them
+func (s *PipingServer) handleMultiSender(resWriter http.ResponseWriter, req *http.Request, n int) {
+	path := req.URL.Path
+	match, err := matchPolicy(req)
+	if err != nil {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	if s.isSpoolRequested(req) {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, "A transfer to multiple receivers cannot be spooled.")
+		return
+	}
+	if s.hasPipe(path) {
+		s.writeMultiPipeError(resWriter, req, n, errMultiPipeMismatch)
+		return
+	}
+	maxDuration := s.maxDuration(req)
+	timeoutCh, stopTimer := s.timeoutChannel(maxDuration)
+	defer stopTimer()
+	mp, err := s.multiPipes.joinSender(path, n, s.random())
+	if err != nil {
+		s.writeMultiPipeError(resWriter, req, n, err)
+		return
+	}
+	defer s.multiPipes.leaveSender(path, mp)
+	s.debugf(req, "Sender %s is waiting on %s for %d receivers (match: %s)", req.RemoteAddr, path, n, match)
+	var slots []int
+	for {
+		var changedCh <-chan struct{}
+		var ok bool
+		if slots, changedCh, ok = s.multiPipes.start(mp, match); ok {
+			break
+		}
+		select {
+		case <-changedCh:
+		case <-timeoutCh:
+			s.writeError(resWriter, req, 408, ErrorCodeTimeout, fmt.Sprintf("The receivers have not connected to '%s' within %s.", path, maxDuration))
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	var wg sync.WaitGroup
+	var feeds []*multiPipeFeed
+	feed := func(slot int, isLate bool) *multiPipeFeed {
+		pipeReader, pipeWriter := io.Pipe()
+		pipeReq := multiPipeRequest(req, mp, slot, pipeReader)
+		if isLate {
+			// NOTE: A receiver joining after the start misses the head
+			pipeReq.ContentLength = -1
+			pipeReq.Header.Del("Content-Length")
+		}
+		f := &multiPipeFeed{w: newBridgeResponseWriter(nil), pipeWriter: pipeWriter}
+		feeds = append(feeds, f)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveBridgeRequest(f.w, pipeReq)
+			// NOTE: Stops feeding the receiver which has failed
+			pipeReader.CloseWithError(errors.New(f.w.errorMessage()))
+		}()
+		return f
+	}
+	// feedLateReceivers feeds the receivers joining after the start, aborting them with abortErr if not nil
+	feedLateReceivers := func(abortErr error) {
+		// NOTE: The channel is not closed since a receiver may join at any time
+		for {
+			select {
+			case slot := <-mp.lateCh:
+				if f := feed(slot, true); abortErr != nil {
+					f.pipeWriter.CloseWithError(abortErr)
+					f.pipeWriter = nil
+				}
+			default:
+				return
+			}
+		}
+	}
+	for _, slot := range slots {
+		feed(slot, false)
+	}
+	s.debugf(req, "Transferring %s to %d receivers has started", path, len(slots))
+	buf := make([]byte, 32*1024)
+	for {
+		feedLateReceivers(nil)
+		read, readErr := req.Body.Read(buf)
+		if read != 0 {
+			alive := 0
+			for _, f := range feeds {
+				if f.pipeWriter == nil {
+					continue
+				}
+				if _, err := f.pipeWriter.Write(buf[:read]); err != nil {
+					f.pipeWriter = nil
+					continue
+				}
+				alive++
+			}
+			if alive == 0 {
+				err = errNoReceiverLeft
+				break
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			err = readErr
+			break
+		}
+	}
+	for _, f := range feeds {
+		if f.pipeWriter == nil {
+			continue
+		}
+		if err != nil {
+			// NOTE: Aborts the receivers not to let them regard the truncated body as complete
+			f.pipeWriter.CloseWithError(fmt.Errorf("%w: %v", errPipeCanceled, err))
+		} else {
+			f.pipeWriter.Close()
+		}
+	}
+	// NOTE: Receivers joining from now on wait for the next sender
+	s.multiPipes.leaveSender(path, mp)
+	feedLateReceivers(errMultiPipeFinished)
+	wg.Wait()
+	succeeded := 0
+	var failure string
+	for _, f := range feeds {
+		if f.w.succeeded() {
+			succeeded++
+		} else if failure == "" {
+			failure = f.w.errorMessage()
+		}
+	}
+	if err != nil && err != errNoReceiverLeft {
+		s.logf(req, "Failed to read the sender of %s: %v", path, err)
+		return
+	}
+	if succeeded == 0 {
+		s.writeError(resWriter, req, 502, ErrorCodeReceiversFailed, fmt.Sprintf("All the receivers on '%s' have failed: %s", path, failure))
+		return
+	}
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	resWriter.Header().Set("Content-Type", "text/plain")
+	resWriter.Write([]byte(fmt.Sprintf("[INFO] Sent to %d of %d receivers on '%s'.\n", succeeded, len(feeds), path)))
+	s.infof(req, "Transferring %s has finished to %d of %d receivers.", path, succeeded, len(feeds))
+}
@@ -0,0 +1,88 @@
+package piping_server
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+const notifyMailtoPrefix = "mailto:"
+
+// sendMail is replaced in tests
+var sendMail = smtp.SendMail
+
+// SMTPConfig is the SMTP server sending emails requested by senders with the "notify" query parameter (e.g. "?notify=mailto:me@example.com")
+type SMTPConfig struct {
+	// Addr is "host:port" of the SMTP server
+	Addr string
+	From string
+	// Username and Password authenticate with PLAIN auth if Username is not empty
+	Username string
+	Password string
+	// AllowedDomains restricts recipients to the domains to keep the server from being abused to send spam (empty for any)
+	AllowedDomains []string
+}
+
+// parseNotify returns the email address of the "notify" query parameter, or "" if not requested
+func (s *PipingServer) parseNotify(req *http.Request) (string, error) {
+	value := req.URL.Query().Get("notify")
+	if value == "" {
+		return "", nil
+	}
+	if s.SMTP == nil {
+		return "", fmt.Errorf("notify is not enabled on this server")
+	}
+	if !strings.HasPrefix(value, notifyMailtoPrefix) {
+		return "", fmt.Errorf("invalid notify %q (e.g. mailto:me@example.com)", value)
+	}
+	address, err := mail.ParseAddress(strings.TrimPrefix(value, notifyMailtoPrefix))
+	if err != nil || address.Name != "" {
+		return "", fmt.Errorf("invalid notify %q (e.g. mailto:me@example.com)", value)
+	}
+	if len(s.SMTP.AllowedDomains) != 0 {
+		domain := strings.ToLower(address.Address[strings.LastIndex(address.Address, "@")+1:])
+		allowed := false
+		for _, d := range s.SMTP.AllowedDomains {
+			allowed = allowed || strings.ToLower(d) == domain
+		}
+		if !allowed {
+			return "", fmt.Errorf("notify to %s is not allowed", domain)
+		}
+	}
+	return address.Address, nil
+}
+
+// notify emails the result of the transfer on the path in the background
+func (s *PipingServer) notify(to string, path string, result string) {
+	if to == "" || s.SMTP == nil {
+		return
+	}
+	config := s.SMTP
+	subject := sanitizeHeaderValue(fmt.Sprintf("Piping Server: the transfer on %s %s", path, result))
+	message := strings.Join([]string{
+		"From: " + config.From,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + s.now().Format(time.RFC1123Z),
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		fmt.Sprintf("The transfer on %s %s at %s.", path, result, s.now().UTC().Format(time.RFC3339)),
+		"",
+	}, "\r\n")
+	var auth smtp.Auth
+	if config.Username != "" {
+		host := config.Addr
+		if i := strings.LastIndex(host, ":"); i != -1 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", config.Username, config.Password, host)
+	}
+	go func() {
+		if err := sendMail(config.Addr, auth, config.From, []string{to}, []byte(message)); err != nil {
+			s.logger.Printf("Failed to notify the transfer on %s to %s: %v", path, to, err)
+		}
+	}()
+}
@@ -0,0 +1,57 @@
+package piping_server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const openAPIPath = "/openapi.json"
+
+// openAPISpec describes every endpoint. Endpoints of features disabled in the server are removed when served.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// disabledOpenAPIPath returns true if the endpoint of the path is not served by the configuration
+func (s *PipingServer) disabledOpenAPIPath(path string) bool {
+	switch {
+	case isAdminPath(path):
+		return s.adminToken() == ""
+	case strings.HasPrefix(path, clipPathPrefix):
+		return s.ClipMaxBytes <= 0
+	case strings.HasPrefix(path, chatPathPrefix):
+		return s.ChatHistory <= 0
+	case isDAVPath(path):
+		return !s.EnableWebDAV
+	case isS3Path(path):
+		return !s.EnableS3
+	case path == reservationsPath:
+		return s.reservations == nil
+	case path == spoolBlocksPath:
+		return s.spool == nil
+	case path == reportPath:
+		return s.abuse == nil
+	}
+	return false
+}
+
+// handleOpenAPI serves the OpenAPI description whose server is the base URL seen by clients
+func (s *PipingServer) handleOpenAPI(resWriter http.ResponseWriter, req *http.Request) {
+	var spec map[string]interface{}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		http.Error(resWriter, "500 Internal Server Error", 500)
+		return
+	}
+	spec["servers"] = []map[string]string{{"url": s.externalBaseOf(req).URL}}
+	paths := spec["paths"].(map[string]interface{})
+	for path := range paths {
+		if s.disabledOpenAPIPath(path) {
+			delete(paths, path)
+		}
+	}
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	resWriter.Header().Set("Cache-Control", "no-store")
+	writeJSON(resWriter, spec)
+}
@@ -0,0 +1,49 @@
+package piping_server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// matchHost returns true if the host matches one of the patterns, where "*.example.com" matches subdomains
+func matchHost(patterns []string, host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if host == pattern || strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOutboundURL rejects URLs the server should not request to prevent SSRF
+func checkOutboundURL(u *url.URL, allowedHosts []string) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme '%s'", u.Scheme)
+	}
+	if !matchHost(allowedHosts, u.Hostname()) {
+		return fmt.Errorf("host '%s' is not allowed", u.Hostname())
+	}
+	return nil
+}
+
+// outboundClient copies the base client (or a client with the timeout if nil)
+// not to be redirected to a host out of the allowlist
+func outboundClient(base *http.Client, timeout time.Duration, allowedHosts []string) *http.Client {
+	client := http.Client{Timeout: timeout}
+	if base != nil {
+		client = *base
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return checkOutboundURL(req.URL, allowedHosts)
+	}
+	return &client
+}
@@ -0,0 +1,29 @@
+package piping_server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const ownerTokenHeader = "X-Piping-Owner-Token"
+
+// checkOwnership returns false if the sender connected at senderConnectedAt should present the owner token of the receiver,
+// which requires it when the receiver has created the pipe from another IP within OwnershipWindow
+func (s *PipingServer) checkOwnership(req *http.Request, pi *pipe, senderConnectedAt time.Time) bool {
+	if s.OwnershipWindow <= 0 || !pi.receiverConnectedAt.Before(senderConnectedAt) || senderConnectedAt.Sub(pi.receiverConnectedAt) > s.OwnershipWindow {
+		return true
+	}
+	senderIP, receiverIP := clientIP(req), clientIP(pi.receiverReq)
+	if senderIP == receiverIP {
+		return true
+	}
+	s.logf(req, "Sender %s has connected to %s created by receiver %s from another IP %s ago in transfer %s", senderIP, req.URL.Path, receiverIP, senderConnectedAt.Sub(pi.receiverConnectedAt).Round(time.Millisecond), pi.transferID)
+	token := pi.receiverReq.Header.Get(ownerTokenHeader)
+	return token != "" && subtle.ConstantTimeCompare([]byte(req.Header.Get(ownerTokenHeader)), []byte(token)) == 1
+}
+
+func (s *PipingServer) writeOwnershipError(resWriter http.ResponseWriter, req *http.Request) {
+	s.writeError(resWriter, req, 403, ErrorCodeOwnerTokenRequired, fmt.Sprintf("The pipe on '%s' has been created by a receiver from another IP. Send %s shared with the receiver.", req.URL.Path, ownerTokenHeader))
+}
@@ -0,0 +1,249 @@
+package piping_server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+const (
+	// maxParallelParts bounds the "parallel" query parameter of receivers
+	maxParallelParts = 16
+	// parallelStripeSize is the size of stripes, which senders of parts send in turn (e.g. part 1 has stripes 1, 1+K, 1+2K, ...)
+	parallelStripeSize = 1024 * 1024
+	// parallelReadAhead is the number of stripes buffered by part so that all the streams keep transferring
+	parallelReadAhead = 2
+)
+
+var errParallelAborted = errors.New("the parallel transfer has been aborted")
+
+// parallelPart is a part received from the pipe of "<path>.part<N>" or "<path>.parity"
+type parallelPart struct {
+	path string
+	w    *bridgeResponseWriter
+	// header is the header of the sender, or nil if the part has failed before the transfer
+	header     chan http.Header
+	stripes    chan []byte
+	pipeReader *io.PipeReader
+	err        error
+}
+
+// parallelPartPath returns the path of the part (e.g. "/p/mypath.part0")
+func parallelPartPath(path string, i int) string {
+	return fmt.Sprintf("%s.part%d", path, i)
+}
+
+// receiveParallelPart receives the part from its pipe as the receiver of req,
+// reading the prefix of the body as the first stripe if prefixSize is positive
+func (s *PipingServer) receiveParallelPart(ctx context.Context, wg *sync.WaitGroup, req *http.Request, partPath string, prefixSize int) *parallelPart {
+	pipeReader, pipeWriter := io.Pipe()
+	part := &parallelPart{path: partPath, header: make(chan http.Header, 1), stripes: make(chan []byte, parallelReadAhead), pipeReader: pipeReader}
+	part.w = newBridgeResponseWriter(func(header http.Header) (io.Writer, error) {
+		// NOTE: The sender adds trailers to the header during the transfer
+		part.header <- header.Clone()
+		return pipeWriter, nil
+	})
+	partReq := req.Clone(ctx)
+	partReq.URL.Path = partPath
+	partReq.URL.RawPath = ""
+	partReq.URL.RawQuery = ""
+	// NOTE: Other parameters such as "base64" would change the stripes
+	if maxDuration := req.URL.Query().Get("max-duration"); maxDuration != "" {
+		partReq.URL.RawQuery = url.Values{"max-duration": {maxDuration}}.Encode()
+	}
+	partReq.RequestURI = partReq.URL.RequestURI()
+	// NOTE: Logs of the parts have the ID of the receiver
+	partReq.Header.Set(requestIDHeader, requestID(req))
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.serveBridgeRequest(part.w, partReq)
+		if part.w.body == nil {
+			part.header <- nil
+		}
+		if part.w.succeeded() {
+			pipeWriter.Close()
+		} else {
+			pipeWriter.CloseWithError(errors.New(part.w.errorMessage()))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer close(part.stripes)
+		size := prefixSize
+		if size <= 0 {
+			size = parallelStripeSize
+		}
+		for {
+			stripe := make([]byte, size)
+			size = parallelStripeSize
+			n, err := io.ReadFull(pipeReader, stripe)
+			if n != 0 {
+				select {
+				case part.stripes <- stripe[:n]:
+				case <-ctx.Done():
+					part.err = ctx.Err()
+					return
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return
+			}
+			if err != nil {
+				part.err = err
+				return
+			}
+		}
+	}()
+	return part
+}
+
+// handleParallelReceiver receives the parts of the path from their pipes and sends them to the receiver in order.
+// With the parity, the transfer survives a failed part.
+func (s *PipingServer) handleParallelReceiver(resWriter http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	count, err := strconv.Atoi(req.URL.Query().Get("parallel"))
+	if err != nil || count < 2 || count > maxParallelParts {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, fmt.Sprintf("The parallel parameter should be from 2 to %d.", maxParallelParts))
+		return
+	}
+	hasParity, err := parityRequested(req)
+	if err != nil {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	var wg sync.WaitGroup
+	parts := make([]*parallelPart, count)
+	for i := range parts {
+		parts[i] = s.receiveParallelPart(ctx, &wg, req, parallelPartPath(path, i), 0)
+	}
+	var parity *parallelPart
+	if hasParity {
+		parity = s.receiveParallelPart(ctx, &wg, req, parallelParityPath(path), parityHeaderSize)
+	}
+	defer func() {
+		cancel()
+		for _, part := range append(parts, parity) {
+			if part != nil {
+				part.pipeReader.CloseWithError(errParallelAborted)
+			}
+		}
+		wg.Wait()
+	}()
+
+	// failed is the part which has failed, which the parity recovers
+	var failed *parallelPart
+	var contentLength int64
+	for _, part := range append(parts, parity) {
+		if part == nil {
+			continue
+		}
+		var header http.Header
+		select {
+		case header = <-part.header:
+		case <-ctx.Done():
+			return
+		}
+		if header == nil {
+			if hasParity && failed == nil {
+				s.logf(req, "The part %s has failed and the transfer continues without it: %s", part.path, part.w.errorMessage())
+				failed = part
+				contentLength = -1
+				continue
+			}
+			statusCode := part.w.statusCode
+			if statusCode < 400 {
+				statusCode = 502
+			}
+			s.writeError(resWriter, req, statusCode, ErrorCodeParallelPartFailed, fmt.Sprintf("The part '%s' has failed: %s", part.path, part.w.errorMessage()))
+			return
+		}
+		if _, ok := resWriter.Header()["Content-Type"]; !ok && part != parity {
+			for _, name := range []string{"Content-Type", "Content-Disposition", "X-Piping"} {
+				if values, ok := header[name]; ok {
+					resWriter.Header()[name] = values
+				}
+			}
+		}
+		if n, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && contentLength >= 0 && part != parity {
+			contentLength += n
+		} else if part != parity {
+			contentLength = -1
+		}
+	}
+	var total int64 = -1
+	if parity != nil && parity != failed {
+		if total, err = readParityHeader(parity); err != nil {
+			if failed != nil {
+				s.writeError(resWriter, req, 502, ErrorCodeParallelPartFailed, fmt.Sprintf("The part '%s' has failed: %v", parity.path, err))
+				return
+			}
+			s.logf(req, "The part %s has failed and the transfer continues without it: %v", parity.path, err)
+			failed = parity
+			total = -1
+		} else {
+			contentLength = total
+		}
+	}
+	if _, ok := resWriter.Header()["Content-Type"]; !ok {
+		resWriter.Header()["Content-Type"] = nil // not to sniff
+	}
+	if contentLength >= 0 {
+		resWriter.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	}
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	if len(resWriter.Header().Values("X-Piping")) != 0 {
+		resWriter.Header().Add("Access-Control-Expose-Headers", "X-Piping")
+	}
+	resWriter.Header().Set("X-Robots-Tag", "none")
+	s.setSecurityHeaders(resWriter, req, s.PipeSecurityHeaders)
+	resWriter.WriteHeader(200)
+	if total >= 0 {
+		err = reassembleWithParity(resWriter, parts, parity, total, failed, func(part *parallelPart, err error) {
+			s.logf(req, "The part %s has failed and the transfer continues without it: %v", part.path, err)
+		})
+	} else {
+		err = reassembleParallelParts(resWriter, parts)
+	}
+	if err != nil {
+		s.logf(req, "Failed to transfer %s in %d parts: %v", path, count, err)
+		// Abort the response not to let the receiver regard the truncated body as complete
+		panic(http.ErrAbortHandler)
+	}
+	s.infof(req, "Transferring %s has finished in %d parts.", path, count)
+}
+
+// reassembleParallelParts writes the stripes of the parts in turn until a stripe is shorter than the others
+func reassembleParallelParts(w io.Writer, parts []*parallelPart) error {
+	for i := 0; ; i++ {
+		part := parts[i%len(parts)]
+		stripe, ok := <-part.stripes
+		if !ok {
+			if part.err != nil {
+				return fmt.Errorf("part %d: %w", i%len(parts), part.err)
+			}
+		} else if _, err := w.Write(stripe); err != nil {
+			return err
+		}
+		if ok && len(stripe) == parallelStripeSize {
+			continue
+		}
+		// NOTE: The other parts should also end
+		for j := 1; j < len(parts); j++ {
+			part := parts[(i+j)%len(parts)]
+			if _, ok := <-part.stripes; ok {
+				return fmt.Errorf("part %d has more stripes than the others", (i+j)%len(parts))
+			}
+			if part.err != nil {
+				return fmt.Errorf("part %d: %w", (i+j)%len(parts), part.err)
+			}
+		}
+		return nil
+	}
+}
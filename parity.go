@@ -0,0 +1,141 @@
+package piping_server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+)
+
+// parityHeaderSize is the size of the header of the parity, which is the total size of the parts in big-endian
+const parityHeaderSize = 8
+
+// The parity of parallel parts lets a transfer survive one of the parts failing.
+// The body of the parity is the header and the parity of each row of stripes, which is the XOR of the stripes padded with zeros.
+// The parity of a row is as long as the first stripe of the row.
+
+// parallelParityPath returns the path of the parity of the parts (e.g. "/p/mypath.parity")
+func parallelParityPath(path string) string {
+	return path + ".parity"
+}
+
+// parityRequested returns true if the receiver of parallel parts requests the parity by "parity=1"
+func parityRequested(req *http.Request) (bool, error) {
+	switch parity := req.URL.Query().Get("parity"); parity {
+	case "", "0":
+		return false, nil
+	case "1":
+		return true, nil
+	default:
+		return false, fmt.Errorf("Unsupported parity '%s'. (0 or 1)", parity)
+	}
+}
+
+// readParityHeader reads the total size of the parts from the parity
+func readParityHeader(parity *parallelPart) (int64, error) {
+	header, ok := <-parity.stripes
+	if !ok || len(header) != parityHeaderSize {
+		if parity.err != nil {
+			return 0, parity.err
+		}
+		return 0, errors.New("the parity has no header")
+	}
+	total := binary.BigEndian.Uint64(header)
+	if total > math.MaxInt64 {
+		return 0, errors.New("the parity has an invalid header")
+	}
+	return int64(total), nil
+}
+
+// stripeLength returns the length of the stripe at the offset of the body
+func stripeLength(total int64, offset int64) int {
+	if offset >= total {
+		return 0
+	}
+	if total-offset < parallelStripeSize {
+		return int(total - offset)
+	}
+	return parallelStripeSize
+}
+
+// reassembleWithParity writes the stripes of the parts in turn, recovering the stripes of a failed part
+// by the XOR of the parity and the other stripes of each row. onFailure is called when a part fails during the transfer.
+func reassembleWithParity(w io.Writer, parts []*parallelPart, parity *parallelPart, total int64, failed *parallelPart, onFailure func(part *parallelPart, err error)) error {
+	// fail recovers the part by the parity unless another part has failed
+	fail := func(part *parallelPart, ok bool) error {
+		err := errors.New("the stream has a stripe of a wrong length")
+		if !ok {
+			err = errors.New("the stream has ended before the total size")
+			if part.err != nil {
+				err = part.err
+			}
+		}
+		if failed != nil {
+			return fmt.Errorf("%s and %s have failed: %v", failed.path, part.path, err)
+		}
+		failed = part
+		onFailure(part, err)
+		return nil
+	}
+	rowSize := int64(len(parts)) * parallelStripeSize
+	stripes := make([][]byte, len(parts))
+	for row := int64(0); row < total; row += rowSize {
+		for i, part := range parts {
+			stripes[i] = nil
+			n := stripeLength(total, row+int64(i)*parallelStripeSize)
+			if part == failed || n == 0 {
+				continue
+			}
+			stripe, ok := <-part.stripes
+			if !ok || len(stripe) != n {
+				if err := fail(part, ok); err != nil {
+					return err
+				}
+				continue
+			}
+			stripes[i] = stripe
+		}
+		var parityStripe []byte
+		if parity != failed {
+			stripe, ok := <-parity.stripes
+			if !ok || len(stripe) != stripeLength(total, row) {
+				if err := fail(parity, ok); err != nil {
+					return err
+				}
+			} else {
+				parityStripe = stripe
+			}
+		}
+		for i, part := range parts {
+			n := stripeLength(total, row+int64(i)*parallelStripeSize)
+			if part == failed && n != 0 {
+				recovered := make([]byte, n)
+				copy(recovered, parityStripe)
+				for j, stripe := range stripes {
+					if j == i {
+						continue
+					}
+					for k := 0; k < n && k < len(stripe); k++ {
+						recovered[k] ^= stripe[k]
+					}
+				}
+				stripes[i] = recovered
+			}
+			if _, err := w.Write(stripes[i]); err != nil {
+				return err
+			}
+		}
+	}
+	// NOTE: The other parts should also end
+	for _, part := range append(parts, parity) {
+		if part == failed {
+			continue
+		}
+		if _, ok := <-part.stripes; ok {
+			return fmt.Errorf("%s has more stripes than the total size", part.path)
+		}
+	}
+	return nil
+}
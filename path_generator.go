@@ -0,0 +1,70 @@
+package piping_server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const generatePathPath = "/api/path"
+
+// DefaultGeneratedPathWords is the number of words of generated paths if GeneratedPathWords is 0
+const DefaultGeneratedPathWords = 3
+
+const maxGeneratedPathWords = 10
+
+// generatedPathNumbers is the range of the number at the end of generated paths
+const generatedPathNumbers = 100
+
+type generatedPath struct {
+	Path        string  `json:"path"`
+	URL         string  `json:"url"`
+	EntropyBits float64 `json:"entropyBits"`
+}
+
+func pathWords() []string {
+	return append(append([]string{}, adjectiveWords...), nounWords...)
+}
+
+// generatePath returns a path like "/p/maple-otter-cloud-7" and its entropy in bits
+func generatePath(random io.Reader, nWords int) (string, float64) {
+	words := pathWords()
+	parts := make([]string, 0, nWords+1)
+	for i := 0; i < nWords; i++ {
+		parts = append(parts, randomWord(random, words))
+	}
+	parts = append(parts, strconv.Itoa(randomInt(random, generatedPathNumbers)))
+	entropy := float64(nWords)*math.Log2(float64(len(words))) + math.Log2(generatedPathNumbers)
+	return "/p/" + strings.Join(parts, "-"), math.Round(entropy*10) / 10
+}
+
+// generatedPathWords returns the "words" query parameter or the default
+func (s *PipingServer) generatedPathWords(req *http.Request) (int, error) {
+	nWords := s.GeneratedPathWords
+	if nWords <= 0 {
+		nWords = DefaultGeneratedPathWords
+	}
+	if q := req.URL.Query().Get("words"); q != "" {
+		n, err := strconv.Atoi(q)
+		if err != nil || n < 1 || n > maxGeneratedPathWords {
+			return 0, fmt.Errorf("Invalid words '%s'. (1 to %d)", q, maxGeneratedPathWords)
+		}
+		nWords = n
+	}
+	return nWords, nil
+}
+
+// handleGeneratePath responds a new word-based path easy to dictate
+func (s *PipingServer) handleGeneratePath(resWriter http.ResponseWriter, req *http.Request) {
+	nWords, err := s.generatedPathWords(req)
+	if err != nil {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	path, entropy := generatePath(s.random(), nWords)
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	writeJSON(resWriter, generatedPath{Path: path, URL: s.externalURL(req, path), EntropyBits: entropy})
+}
@@ -0,0 +1,93 @@
+package piping_server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// allowedScriptCombinations are the combinations of scripts allowed in a path segment besides a single script,
+// following the "Highly Restrictive" level of UTS #39 (https://www.unicode.org/reports/tr39/#Restriction_Level_Detection)
+var allowedScriptCombinations = [][]string{
+	{"Latin", "Han", "Hiragana", "Katakana"},
+	{"Latin", "Han", "Bopomofo"},
+	{"Latin", "Han", "Hangul"},
+}
+
+// applyPathPolicy normalizes the path of the pipe to NFC if NormalizePaths is enabled,
+// and rejects it with 400 if RejectConfusablePaths is enabled and it is confusable
+func (s *PipingServer) applyPathPolicy(resWriter http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	path := req.URL.Path
+	if s.NormalizePaths && !norm.NFC.IsNormalString(path) {
+		r2 := new(http.Request)
+		*r2 = *req
+		r2.URL = new(url.URL)
+		*r2.URL = *req.URL
+		r2.URL.Path = norm.NFC.String(path)
+		r2.URL.RawPath = ""
+		s.debugf(req, "Path %q has been normalized to %q", path, r2.URL.Path)
+		req = r2
+		path = req.URL.Path
+	}
+	if s.RejectConfusablePaths {
+		if err := checkConfusablePath(path); err != nil {
+			s.writeError(resWriter, req, 400, ErrorCodeConfusablePath, fmt.Sprintf("The path '%s' has been rejected: %v.", path, err))
+			return nil, false
+		}
+	}
+	return req, true
+}
+
+// checkConfusablePath returns an error if the path has invisible characters or a segment mixing scripts
+func checkConfusablePath(path string) error {
+	for _, r := range path {
+		// NOTE: Cf includes zero-width characters and bidirectional controls
+		if unicode.Is(unicode.Cf, r) || unicode.Is(unicode.Variation_Selector, r) || (unicode.IsSpace(r) && r != ' ') {
+			return fmt.Errorf("invisible character %U", r)
+		}
+	}
+	for _, segment := range strings.Split(path, "/") {
+		scripts := map[string]bool{}
+		for _, r := range segment {
+			if script := scriptOf(r); script != "" {
+				scripts[script] = true
+			}
+		}
+		if len(scripts) > 1 && !isAllowedScriptCombination(scripts) {
+			return fmt.Errorf("segment '%s' mixes scripts", segment)
+		}
+	}
+	return nil
+}
+
+// scriptOf returns the script of the letter, or "" for characters shared by scripts such as digits and symbols
+func scriptOf(r rune) string {
+	if !unicode.IsLetter(r) && !unicode.IsMark(r) {
+		return ""
+	}
+	for name, table := range unicode.Scripts {
+		if name != "Common" && name != "Inherited" && unicode.Is(table, r) {
+			return name
+		}
+	}
+	return ""
+}
+
+func isAllowedScriptCombination(scripts map[string]bool) bool {
+	for _, combination := range allowedScriptCombinations {
+		n := 0
+		for _, script := range combination {
+			if scripts[script] {
+				n++
+			}
+		}
+		if n == len(scripts) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,8 +1,8 @@
 package piping_server
 
 import (
-	"embed"
-	_ "embed"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -12,54 +12,344 @@ import (
 	"net/http"
 	"net/textproto"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+const DefaultMaxTransferDuration = 24 * time.Hour
+
+var errTransferTimeout = errors.New("transfer exceeded the maximum duration")
+
+var errPipeCanceled = errors.New("pipe has been canceled")
+
 type pipe struct {
+	// NOTE: 64-bit fields first for atomic operation on 32-bit platforms
+	transferredBytes  int64
+	transferStartedAt int64 // NOTE: UnixNano
+	// NOTE: correlates the sender and the receiver in logs
+	transferID          string
 	receiverResWriterCh chan http.ResponseWriter
 	sendFinishedCh      chan struct{}
-	isSenderConnected   uint32 // NOTE: for atomic operation
-	isTransferring      uint32 // NOTE: for atomic operation
+	cancelCh            chan struct{} // NOTE: closed by PipingServer.CancelPipe
+	isSenderConnected   uint32        // NOTE: for atomic operation
+	isTransferring      uint32        // NOTE: for atomic operation
+	isAborted           uint32        // NOTE: for atomic operation
+	isReceiverConnected uint32        // NOTE: for atomic operation, set under receiverQueues.mutex to claim the receiver slot
+	// NOTE: guarded by PipingServer.mutex
+	senderIdempotencyKey string
+	senderTakeoverCh     chan struct{}
+	senderHeader         http.Header
+	// NOTE: guards writing to the receiver before the sender takes it
+	receiverMutex           sync.Mutex
+	isReceiverTaken         bool
+	isReceiverHeaderWritten bool
+	// NOTE: set before the receiver is passed to the sender
+	receiverDecryptionKey *encryptionKey
+	receiverFrame         string
+	isReceiverBase64      bool
+	receiverPrecondition  *receiverPrecondition
+	receiverConnectedAt   time.Time
+	// NOTE: to write errors to the receiver
+	receiverReq *http.Request
+}
+
+func (pi *pipe) setReceiverTaken(taken bool) {
+	pi.receiverMutex.Lock()
+	defer pi.receiverMutex.Unlock()
+	pi.isReceiverTaken = taken
 }
 
 type PipingServer struct {
-	pathToPipe    map[string]*pipe
-	mutex         *sync.Mutex
-	logger        *log.Logger
-	statichandler http.Handler
+	// NOTE: 64-bit fields first for atomic operation on 32-bit platforms
+	transferredBytes int64
+	// committedMemory is the approximate memory held by pipe requests in flight
+	committedMemory int64
+
+	pathToPipe     map[string]*pipe
+	mutex          *sync.Mutex
+	logger         *log.Logger
+	statichandler  *staticHandler
+	logLevel       int32        // NOTE: for atomic operation
+	configMutex    sync.RWMutex // NOTE: guards the fields of ReloadableConfig
+	recentErrors   *recentErrors
+	spool          *spool
+	bandwidth      *bandwidthScheduler
+	reservations   *reservationStore
+	events         *eventBroker
+	rateLimiter    *rateLimiter
+	aliases        *aliasStore
+	clips          *clipStore
+	chatRooms      *chatRooms
+	tunnels        *tunnels
+	receiverQueues *receiverQueues
+	multiPipes     *multiPipes
+	manifests      *manifestStore
+	waiters        *waiters
+	abuse          *abuseStore
+	logSampler     *logSampler
+	// NOTE: concurrent pipe requests by client certificate identity
+	clientCertQuotas *clientCertQuotas
+	// NOTE: finished transfers for /api/stats
+	transfersToday dailyCounter
+	// NOTE: pattern to expiry
+	debugPaths      map[string]time.Time
+	debugPathsMutex sync.Mutex
+	// MaxTransferDuration is the wall-clock limit of a sender or a receiver (0 for no limit)
+	MaxTransferDuration time.Duration
+	// ReceiverHeartbeatInterval is the interval of heartbeats for receivers opting in with the "heartbeat" query parameter or keepalives of ?frame=grpc-web (0 to disable)
+	ReceiverHeartbeatInterval time.Duration
+	// ReceiverQueueLength is the number of receivers per path waiting FIFO for the next transfer while a receiver is already connected (0 to reject them)
+	ReceiverQueueLength int
+	// ReceiverInformationalResponses enables 103 Early Hints to receivers when they wait and when a sender connects.
+	// It is ignored when built before Go 1.19, whose net/http would send 103 as the final status.
+	ReceiverInformationalResponses bool
+	// TranscodeContentEncoding passes Content-Encoding of senders to receivers accepting it, and decompresses gzip, deflate or zstd (recompressing it into gzip if accepted) for the others.
+	// It also lets senders request compression into zstd with "compress=zstd".
+	TranscodeContentEncoding bool
+	// ErrorStatusCodes overrides HTTP status codes by error code (e.g. ErrorCodeReceiverLimit: 409)
+	ErrorStatusCodes map[string]int
+	// MethodHandlers handles additional methods, which are also listed in Allow and Access-Control-Allow-Methods
+	MethodHandlers map[string]http.Handler
+	// SenderMethods are additional methods behaving as senders like POST and PUT (e.g. PATCH)
+	SenderMethods []string
+	// AllowedRequestHeaders are allowed by preflight in addition to Content-Type, Content-Disposition and X-Piping(-*)
+	AllowedRequestHeaders []string
+	// AllowPrivateNetwork answers Private Network Access preflight to let public origins access this server on a private network
+	AllowPrivateNetwork bool
+	// StaticSecurityHeaders are set to responses of the static handler
+	StaticSecurityHeaders http.Header
+	// PipeSecurityHeaders are set to responses to receivers
+	PipeSecurityHeaders http.Header
+	// HSTSMaxAge enables Strict-Transport-Security on TLS connections (0 to disable)
+	HSTSMaxAge time.Duration
+	// HSTSPreload adds includeSubDomains and preload to Strict-Transport-Security for the HSTS preload list
+	HSTSPreload bool
+	// HTTPSRedirectPort redirects plain HTTP requests to HTTPS on the port (0 to disable)
+	HTTPSRedirectPort int
+	// RobotsTxt is served at /robots.txt
+	RobotsTxt string
+	// Favicon is served at /favicon.ico (204 No Content if empty)
+	Favicon []byte
+	// Templates overrides the top page, help page and error pages (nil for defaults)
+	Templates *Templates
+	// StaticSPA serves index.html for unknown static paths without extension
+	StaticSPA bool
+	// StaticHandler serves non-piping paths instead of the built-in static file server if set
+	StaticHandler http.Handler
+	// BasePath is the URL prefix to mount Piping Server under (e.g. "/piping")
+	BasePath string
+	// ExternalURL is the base URL seen by clients used for links (e.g. "https://piping.example.com/piping"), derived from requests and Forwarded headers if empty
+	ExternalURL string
+	// PushAllowedHosts are hosts senders can push to with the "push" query parameter (e.g. "example.com", "*.example.com")
+	PushAllowedHosts []string
+	// PushMaxBytes limits the body of a push (0 for no limit)
+	PushMaxBytes int64
+	// PushClient performs pushes (nil to use a client with DefaultPushTimeout)
+	PushClient *http.Client
+	// FetchAllowedHosts are hosts senders can let the server download from with X-Piping-Fetch
+	FetchAllowedHosts []string
+	// FetchClient performs downloads of X-Piping-Fetch (nil for a client without timeout)
+	FetchClient *http.Client
+	// TransferFilters inspect or transform the body of transfers in order
+	TransferFilters []TransferFilter
+	// SpoolTTL is the lifetime of spooled bodies enabled by EnableSpool (0 for DefaultSpoolTTL)
+	SpoolTTL time.Duration
+	// SpoolMaxBytes limits the size of a spooled body (0 for no limit)
+	SpoolMaxBytes int64
+	// SpoolSync fsyncs spooled bodies before responding to senders
+	SpoolSync bool
+	// SpoolShared keeps files left in the spool directory at EnableSpool since other processes share it, which SweepSpool deletes instead
+	SpoolShared bool
+	// MaxReservationTTL limits the "ttl" of reservations enabled by EnableReservations (0 for no limit)
+	MaxReservationTTL time.Duration
+	// RateLimitRequests limits requests to pipes per client IP in RateLimitWindow (0 for no limit)
+	RateLimitRequests int
+	// RateLimitWindow is the window of RateLimitRequests (0 for DefaultRateLimitWindow)
+	RateLimitWindow time.Duration
+	// EnableConnect pairs two CONNECT requests with the same authority (e.g. "CONNECT mytunnel:1") as a duplex tunnel
+	EnableConnect bool
+	// EnableWebDAV serves /dav/ as a WebDAV collection for file managers, where a file PUT is sent to the pipe of the same path
+	EnableWebDAV bool
+	// EnableS3 serves /s3/ as an S3 endpoint, where PutObject of <bucket>/<key> sends to the pipe of /p/<bucket>/<key> and GetObject receives from it
+	EnableS3 bool
+	// S3Credentials are secret access keys by access key ID verifying Signature Version 4 of S3 requests (nil for no authentication)
+	S3Credentials map[string]string
+	// ClipMaxBytes limits the size of a clip of /clip/<name> (0 to disable clips)
+	ClipMaxBytes int64
+	// ClipTTL is the max lifetime of a clip (0 for DefaultClipTTL)
+	ClipTTL time.Duration
+	// ChatHistory is the number of lines kept in a chat room of /chat/<room> for joining participants (0 to disable chat)
+	ChatHistory int
+	// GeneratedPathWords is the number of words of paths generated by /api/path (0 for DefaultGeneratedPathWords)
+	GeneratedPathWords int
+	// PathRules override behavior by path. The first matching rule is applied.
+	PathRules []PathRule
+	// ArchiveSink stores copies of transfers on paths matching ArchivePaths. A transfer is aborted if archiving fails.
+	ArchiveSink ArchiveSink
+	// ArchivePaths are path.Match patterns of archived paths (e.g. "/p/reports/*"). Empty for all paths.
+	ArchivePaths []string
+	// ClamdAddress enables virus scanning of transfers by clamd at "unix:///path/to/clamd.sock" or "tcp://host:3310"
+	ClamdAddress string
+	// VirusScanAction is VirusScanActionAbort (default) to abort infected transfers
+	// or VirusScanActionFlag to tell receivers the result in the X-Piping-Virus-Scan trailer
+	VirusScanAction string
+	// EnableChaos lets senders and receivers inject latency, resets and slow transfers with the "chaos" query parameter
+	// (e.g. "?chaos=latency=500ms,reset-after=1024,rate=4096") to test retry logic of clients. Do not enable in production.
+	EnableChaos bool
+	// Clock is the time of expiry of clips, aliases, manifests, reservations and debug paths, rate limit windows and stats,
+	// and fires the timers of max transfer durations, waiting receivers and senders, and spool TTLs (nil for the system clock).
+	// Deadlines of connections such as CONNECT tunnels are of the system clock.
+	Clock Clock
+	// Rand generates IDs, reservation tokens, paths and aliases (nil for crypto/rand). It must be safe for concurrent use and cryptographically secure in production.
+	Rand io.Reader
+	// ZeroCopy relays bodies of plain HTTP/1.1 senders with Content-Length from their connections as is,
+	// which lets Linux splice them to the connections of receivers. Progress is updated when such a transfer finishes.
+	ZeroCopy bool
+	// MemoryCeiling rejects requests creating new pipes with 503 while the approximate memory committed to
+	// pipe requests in flight and clips exceeds the bytes (0 for no limit). Requests joining existing pipes are admitted.
+	MemoryCeiling int64
+	// MaxWaiters rejects requests creating new pipes with 503 while the pipe requests in flight, each parking a goroutine,
+	// reach the number (0 for no limit). Requests joining existing pipes are admitted.
+	MaxWaiters int
+	// NormalizePaths normalizes paths of pipes to Unicode NFC so that the same name typed on different systems shares a pipe
+	NormalizePaths bool
+	// RejectConfusablePaths rejects paths of pipes with invisible characters or segments mixing scripts
+	// such as Latin and Cyrillic, which look the same as other paths
+	RejectConfusablePaths bool
+	// OwnershipWindow requires a sender connecting from another IP within the duration after a receiver has created the pipe
+	// to present X-Piping-Owner-Token equal to that of the receiver, to mitigate interception of guessable paths (0 to disable)
+	OwnershipWindow time.Duration
+	// BlockedSHA256 aborts transfers whose contents have the lowercase hex-encoded SHA-256 hashes when they finish,
+	// and rejects spooled contents before they are received
+	BlockedSHA256 map[string]bool
+	// SMTP enables emails requested by senders with the "notify" query parameter when their transfers complete or expire unclaimed (nil to disable)
+	SMTP *SMTPConfig
+	// LogSampling logs only fractions of request lines by the first matching rule, such as ones of static assets (ignored at the debug level)
+	LogSampling []LogSamplingRule
+	// ClientCertPolicies grant clients with verified certificates paths and quotas by the first policy matching their identities.
+	// Verified clients without a matching policy are rejected if any policy is configured.
+	ClientCertPolicies []ClientCertPolicy
+	// SecurityLogger receives auth failures, rate limit hits and other security events in a stable format for fail2ban (nil for the logger of the server)
+	SecurityLogger *log.Logger
+	// AdminToken enables the admin endpoints under /admin/ authorized by "Authorization: Bearer <AdminToken>"
+	AdminToken string
 }
 
 func isPipingPath(path string) bool {
 	return strings.HasPrefix(path, "/p/")
 }
 
-//our static web server content.
-//go:embed "piping-ui-web/dist"
-var static embed.FS
-
-//-go:embed "piping-ui-web/dist.zip"
-//var zippedStatic []byte
-
-func getStatic(staticPath string) http.Handler {
+func getStatic(staticPath string) *staticHandler {
 	if staticPath == "" {
-		s := fs.FS(static)
-		s, _ = fs.Sub(s, "piping-ui-web/dist")
-		return http.FileServer(http.FS(s))
-		//zr, _ := zip.NewReader(bytes.NewReader(zippedStatic), int64(len(zippedStatic)))
-		//return http.FileServer(http.FS(fs.FS(zr)))
+		return newStaticHandler(embeddedStatic())
 	}
-	return http.FileServer(http.FS(os.DirFS(staticPath)))
+	return newStaticHandler(os.DirFS(staticPath))
+}
+
+// SetStaticFS replaces the UI with the contents of fsys
+func (s *PipingServer) SetStaticFS(fsys fs.FS) {
+	s.statichandler = newStaticHandler(fsys)
 }
 
 func NewServer(staticPath string, logger *log.Logger) *PipingServer {
 	return &PipingServer{
-		pathToPipe:    map[string]*pipe{},
-		mutex:         new(sync.Mutex),
-		logger:        logger,
-		statichandler: getStatic(staticPath),
+		pathToPipe:       map[string]*pipe{},
+		mutex:            new(sync.Mutex),
+		logger:           logger,
+		statichandler:    getStatic(staticPath),
+		logLevel:         int32(LogLevelInfo),
+		recentErrors:     newRecentErrors(maxRecentErrors),
+		events:           newEventBroker(),
+		rateLimiter:      newRateLimiter(),
+		aliases:          newAliasStore(),
+		clips:            newClipStore(),
+		chatRooms:        newChatRooms(),
+		tunnels:          newTunnels(),
+		receiverQueues:   newReceiverQueues(),
+		multiPipes:       newMultiPipes(),
+		manifests:        newManifestStore(),
+		waiters:          newWaiters(),
+		logSampler:       newLogSampler(),
+		clientCertQuotas: newClientCertQuotas(),
+		debugPaths:       map[string]time.Time{},
+
+		MaxTransferDuration:   DefaultMaxTransferDuration,
+		StaticSecurityHeaders: DefaultStaticSecurityHeaders(),
+		PipeSecurityHeaders:   DefaultPipeSecurityHeaders(),
+		RobotsTxt:             DefaultRobotsTxt,
+		ClipMaxBytes:          DefaultClipMaxBytes,
+		ChatHistory:           DefaultChatHistory,
+	}
+}
+
+// maxDuration returns the duration limit of the request.
+// The "max-duration" query parameter can only shorten the server limit.
+func (s *PipingServer) maxDuration(req *http.Request) time.Duration {
+	d := s.MaxTransferDuration
+	if rule := s.pathRule(req.URL.Path); rule != nil && rule.MaxTransferDuration != 0 {
+		d = rule.MaxTransferDuration
+		if d < 0 {
+			d = 0
+		}
+	}
+	if q := req.URL.Query().Get("max-duration"); q != "" {
+		if qd, err := time.ParseDuration(q); err == nil && qd > 0 && (d <= 0 || qd < d) {
+			d = qd
+		}
+	}
+	return d
+}
+
+// deadlineReader fails reading after the deadline
+// NOTE: A read blocking at the deadline is interrupted by watchTransfer
+type deadlineReader struct {
+	r        io.Reader
+	deadline time.Time
+	clock    Clock
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if r.clock.Now().After(r.deadline) {
+		return 0, errTransferTimeout
+	}
+	return r.r.Read(p)
+}
+
+// cancelableReader fails reading after the pipe is canceled
+// NOTE: A read blocking on cancellation is interrupted by watchTransfer
+type cancelableReader struct {
+	r        io.Reader
+	cancelCh <-chan struct{}
+}
+
+func (r *cancelableReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.cancelCh:
+		return 0, errPipeCanceled
+	default:
+	}
+	return r.r.Read(p)
+}
+
+// CancelPipe rejects the waiting sender and receiver on the path or aborts their transfer
+func (s *PipingServer) CancelPipe(path string) bool {
+	_, ok := s.cancelPipe(path)
+	return ok
+}
+
+func (s *PipingServer) cancelPipe(path string) (*pipe, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pi, ok := s.pathToPipe[path]
+	if !ok {
+		return nil, false
 	}
+	delete(s.pathToPipe, path)
+	close(pi.cancelCh)
+	return pi, true
 }
 
 func (s *PipingServer) getPipe(path string) *pipe {
@@ -68,8 +358,10 @@ func (s *PipingServer) getPipe(path string) *pipe {
 	defer s.mutex.Unlock()
 	if _, ok := s.pathToPipe[path]; !ok {
 		pi := &pipe{
+			transferID:          newID(s.random()),
 			receiverResWriterCh: make(chan http.ResponseWriter, 1),
 			sendFinishedCh:      make(chan struct{}),
+			cancelCh:            make(chan struct{}),
 			isSenderConnected:   0,
 		}
 		s.pathToPipe[path] = pi
@@ -78,10 +370,57 @@ func (s *PipingServer) getPipe(path string) *pipe {
 	return s.pathToPipe[path]
 }
 
+// acquireSender marks the pipe as having a sender. A retry carrying the same
+// idempotency key as the connected sender takes over the pipe as long as the
+// transfer has not started yet. The returned channel is closed when the sender is
+// taken over by such a retry.
+func (s *PipingServer) acquireSender(pi *pipe, idempotencyKey string, senderHeader http.Header) (chan struct{}, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !atomic.CompareAndSwapUint32(&pi.isSenderConnected, 0, 1) {
+		if idempotencyKey == "" || idempotencyKey != pi.senderIdempotencyKey || atomic.LoadUint32(&pi.isTransferring) == 1 {
+			return nil, false
+		}
+		close(pi.senderTakeoverCh)
+	}
+	pi.senderIdempotencyKey = idempotencyKey
+	pi.senderHeader = senderHeader
+	pi.senderTakeoverCh = make(chan struct{})
+	return pi.senderTakeoverCh, true
+}
+
+// startTransfer marks the pipe as transferring unless the sender has been taken over.
+func (s *PipingServer) startTransfer(pi *pipe, takeoverCh chan struct{}) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case <-takeoverCh:
+		return false
+	default:
+	}
+	atomic.StoreInt64(&pi.transferStartedAt, time.Now().UnixNano())
+	atomic.StoreUint32(&pi.isTransferring, 1)
+	return true
+}
+
+// releaseSender lets another sender connect unless the sender has been taken over.
+func (s *PipingServer) releaseSender(pi *pipe, takeoverCh chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case <-takeoverCh:
+		return
+	default:
+	}
+	pi.senderIdempotencyKey = ""
+	pi.senderHeader = nil
+	atomic.StoreUint32(&pi.isSenderConnected, 0)
+}
+
 func transferHeaderIfExists(w http.ResponseWriter, reqHeader textproto.MIMEHeader, header string) {
 	values := reqHeader.Values(header)
 	if len(values) == 1 {
-		w.Header().Add(header, values[0])
+		w.Header().Add(header, sanitizeHeaderValue(values[0]))
 	}
 }
 
@@ -100,101 +439,693 @@ func getTransferHeaderAndBody(req *http.Request) (textproto.MIMEHeader, io.ReadC
 	return textproto.MIMEHeader(req.Header), req.Body
 }
 
+// baseMethods are the methods Piping Server always supports
+var baseMethods = []string{"GET", "HEAD", "POST", "PUT", "OPTIONS"}
+
+// allowedMethods returns the supported methods including ones added by MethodHandlers
+func (s *PipingServer) allowedMethods() []string {
+	methods := append([]string{}, baseMethods...)
+	var extraMethods []string
+	for method := range s.MethodHandlers {
+		extraMethods = append(extraMethods, method)
+	}
+	for _, method := range s.SenderMethods {
+		if _, ok := s.MethodHandlers[method]; !ok && !isBaseMethod(method) {
+			extraMethods = append(extraMethods, method)
+		}
+	}
+	sort.Strings(extraMethods)
+	return append(methods, extraMethods...)
+}
+
+func isBaseMethod(method string) bool {
+	for _, m := range baseMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *PipingServer) isSenderMethod(method string) bool {
+	if method == "POST" || method == "PUT" {
+		return true
+	}
+	for _, m := range s.SenderMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *PipingServer) Handler(resWriter http.ResponseWriter, req *http.Request) {
-	s.logger.Printf("%s %s %s %s", req.Method, req.RemoteAddr, req.URL, req.Proto)
+	req = withRequestID(resWriter, req, s.random())
+	req = s.logRequestLine(req)
+	// NOTE: CONNECT has no path to strip
+	if req.Method == "CONNECT" && s.EnableConnect {
+		s.handleConnect(resWriter, req)
+		return
+	}
+	if s.redirectToHTTPS(resWriter, req) {
+		return
+	}
+	strippedReq, ok := s.stripBasePath(req)
+	if !ok {
+		http.NotFound(resWriter, req)
+		return
+	}
+	s.servePath(resWriter, strippedReq)
+}
+
+// servePath serves the request whose base path has been stripped
+func (s *PipingServer) servePath(resWriter http.ResponseWriter, req *http.Request) {
 	path := req.URL.Path
+	if s.adminToken() != "" && isAdminPath(path) {
+		s.handleAdmin(resWriter, req)
+		return
+	}
+
+	if strings.HasPrefix(path, clipPathPrefix) {
+		s.handleClip(resWriter, req)
+		return
+	}
+	if strings.HasPrefix(path, chatPathPrefix) {
+		s.handleChat(resWriter, req)
+		return
+	}
+	if path == reportPath && s.abuse != nil {
+		s.handleReport(resWriter, req)
+		return
+	}
+	if path == shortenPath {
+		s.handleShorten(resWriter, req)
+		return
+	}
+	if isAliasPath(path) {
+		aliasedReq, ok := s.resolveAlias(req)
+		if !ok {
+			s.writeError(resWriter, req, 404, ErrorCodeAliasNotFound, fmt.Sprintf("The alias '%s' does not exist or has expired.", path))
+			return
+		}
+		req = aliasedReq
+		path = req.URL.Path
+	}
+	if s.EnableWebDAV && isDAVPath(path) {
+		pipeReq, ok := s.handleWebDAV(resWriter, req)
+		if !ok {
+			return
+		}
+		req = pipeReq
+		path = req.URL.Path
+	}
+	if s.EnableS3 && isS3Path(path) {
+		pipeReq, ok := s.handleS3(resWriter, req)
+		if !ok {
+			return
+		}
+		req = pipeReq
+		path = req.URL.Path
+	}
+	if isPipingPath(path) && (s.NormalizePaths || s.RejectConfusablePaths) {
+		policyReq, ok := s.applyPathPolicy(resWriter, req)
+		if !ok {
+			return
+		}
+		req = policyReq
+		path = req.URL.Path
+	}
+	if path == reservationsPath {
+		s.handleReservations(resWriter, req)
+		return
+	}
+	if target, ok := manifestTarget(path); ok {
+		s.handleManifest(resWriter, req, target)
+		return
+	}
 
 	if req.Method == "GET" || req.Method == "HEAD" {
 		if !isPipingPath(path) {
-			s.statichandler.ServeHTTP(resWriter, req)
+			if path == progressPath {
+				s.handleProgress(resWriter, req)
+				return
+			}
+			if path == statsPath {
+				s.handleStats(resWriter, req)
+				return
+			}
+			if path == spoolBlocksPath {
+				s.handleSpoolBlocks(resWriter, req)
+				return
+			}
+			if path == generatePathPath {
+				s.handleGeneratePath(resWriter, req)
+				return
+			}
+			if path == qrPath {
+				s.handleQR(resWriter, req)
+				return
+			}
+			if path == hostnamePath {
+				s.handleHostname(resWriter, req)
+				return
+			}
+			if path == openAPIPath {
+				s.handleOpenAPI(resWriter, req)
+				return
+			}
+			s.setSecurityHeaders(resWriter, req, s.StaticSecurityHeaders)
+			if s.handleWellKnown(resWriter, req) || s.handleTemplatePage(resWriter, req) {
+				return
+			}
+			if s.StaticHandler != nil {
+				s.StaticHandler.ServeHTTP(resWriter, req)
+				return
+			}
+			s.statichandler.serve(resWriter, req, s.StaticSPA)
 			return
 		}
 	}
-	// TODO: should close if either sender or receiver closes
-	switch req.Method {
-	case "GET":
-		// If the receiver requests Service Worker registration
-		// (from: https://speakerdeck.com/masatokinugawa/pwa-study-sw?slide=32)
-		if req.Header.Get("Service-Worker") == "script" {
-			resWriter.Header().Set("Access-Control-Allow-Origin", "*")
-			resWriter.WriteHeader(400)
-			resWriter.Write([]byte("[ERROR] Service Worker registration is rejected.\n"))
+	// NOTE: Preflight requests do not have the reservation token
+	if isPipingPath(path) && req.Method != "OPTIONS" && (!s.checkBlocklist(resWriter, req) || !s.checkRateLimit(resWriter, req) || !s.authorizeClientCert(resWriter, req) || !s.authorizePathRule(resWriter, req) || !s.authorizeReservation(resWriter, req)) {
+		return
+	}
+	if isPipingPath(path) && req.Method != "OPTIONS" && req.Method != "HEAD" {
+		release, ok := s.admitMemory(resWriter, req)
+		if !ok {
+			return
+		}
+		defer release()
+		leave, ok := s.admitWaiter(resWriter, req)
+		if !ok {
 			return
 		}
-		pi := s.getPipe(path)
-		// If already get the path or transferring
-		if len(pi.receiverResWriterCh) != 0 || atomic.LoadUint32(&pi.isTransferring) == 1 {
-			resWriter.Header().Set("Access-Control-Allow-Origin", "*")
-			resWriter.WriteHeader(400)
-			resWriter.Write([]byte("[ERROR] The number of receivers has reached limits.\n" + path))
+		defer leave()
+		releaseClientCert, ok := s.admitClientCert(resWriter, req)
+		if !ok {
 			return
 		}
+		defer releaseClientCert()
+	}
+	if s.EnableChaos && isPipingPath(path) && req.Method != "OPTIONS" && !s.applyChaosLatency(resWriter, req) {
+		return
+	}
+	// TODO: should close if either sender or receiver closes
+	switch {
+	case req.Method == "GET":
+		s.handleReceiver(resWriter, req)
+	case req.Method == "HEAD":
+		s.handleHead(resWriter, req)
+	case s.isSenderMethod(req.Method):
+		s.handleSender(resWriter, req)
+	case req.Method == "OPTIONS":
+		s.handleOptions(resWriter, req)
+	default:
+		if handler, ok := s.MethodHandlers[req.Method]; ok {
+			handler.ServeHTTP(resWriter, req)
+			return
+		}
+		resWriter.Header().Set("Allow", strings.Join(s.allowedMethods(), ", "))
+		s.writeError(resWriter, req, 405, ErrorCodeMethodNotAllowed, fmt.Sprintf("Unsupported method: %s.", req.Method))
+	}
+}
+
+func (s *PipingServer) handleReceiver(resWriter http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	maxDuration := s.maxDuration(req)
+	timeoutCh, stopTimer := s.timeoutChannel(maxDuration)
+	defer stopTimer()
+
+	// If the receiver requests Service Worker registration
+	// (from: https://speakerdeck.com/masatokinugawa/pwa-study-sw?slide=32)
+	if req.Header.Get("Service-Worker") == "script" {
+		s.writeError(resWriter, req, 400, ErrorCodeServiceWorkerRejected, "Service Worker registration is rejected.")
+		return
+	}
+	if req.URL.Query().Has("parallel") {
+		s.handleParallelReceiver(resWriter, req)
+		return
+	}
+	receivers, err := multiReceiverCount(req)
+	if err != nil {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	if receivers > 1 {
+		s.handleMultiReceiver(resWriter, req, receivers)
+		return
+	}
+	decryptionKey, err := parseEncryptionKey(req.Header, decryptKeyHeader, decryptPasswordHeader)
+	if err != nil {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	isReceiverBase64, err := base64Requested(req)
+	if err != nil {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	frame, err := receiverFrame(req)
+	if err != nil {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	precondition, err := parseReceiverPrecondition(req.Header)
+	if err != nil {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	if s.serveSpooled(resWriter, req, decryptionKey, precondition) {
+		return
+	}
+	if s.rejectMultiPipe(resWriter, req) {
+		return
+	}
+	// If already get the path or transferring, wait in the queue if enabled
+	pi := s.waitReceiverTurn(resWriter, req, timeoutCh, maxDuration)
+	if pi == nil {
+		return
+	}
 
-		pi.receiverResWriterCh <- resWriter
-		// Wait for finish
+	heartbeatMode := s.receiverHeartbeatMode(req)
+	if s.ReceiverInformationalResponses && heartbeatMode != heartbeatEventStream {
+		writeInformational(resWriter, "waiting")
+	}
+	s.publishEvent(req, pi, eventReceiverConnected, 0, "")
+	pi.receiverDecryptionKey = decryptionKey
+	pi.receiverFrame = frame
+	pi.isReceiverBase64 = isReceiverBase64
+	pi.receiverPrecondition = precondition
+	pi.receiverReq = req
+	pi.receiverConnectedAt = s.now()
+	pi.receiverResWriterCh <- resWriter
+	s.debugf(req, "Receiver %s is waiting on %s in transfer %s (heartbeat: %q)", req.RemoteAddr, path, pi.transferID, heartbeatMode)
+	stopHeartbeat := s.startReceiverHeartbeat(pi, resWriter, heartbeatMode)
+	defer stopHeartbeat()
+	// Wait for finish
+	select {
+	case <-pi.sendFinishedCh:
+	case <-req.Context().Done():
+	case <-timeoutCh:
+		// If no sender has taken this receiver yet
+		select {
+		case <-pi.receiverResWriterCh:
+			stopHeartbeat()
+			atomic.StoreUint32(&pi.isReceiverConnected, 0)
+			s.receiverQueues.next(path)
+			s.writeError(resWriter, req, 408, ErrorCodeTimeout, fmt.Sprintf("No sender has connected to '%s' within %s.", path, maxDuration))
+			return
+		default:
+		}
+		// The sender limits the transfer
 		select {
 		case <-pi.sendFinishedCh:
 		case <-req.Context().Done():
 		}
-	case "POST", "PUT":
-		// If reserved path
-		if !isPipingPath(path) {
-			resWriter.Header().Set("Access-Control-Allow-Origin", "*")
-			resWriter.WriteHeader(400)
-			resWriter.Write([]byte(fmt.Sprintf("[ERROR] Cannot send to the reserved path '%s'. (e.g. '/mypath123')\n", path)))
+	case <-pi.cancelCh:
+		// If no sender has taken this receiver yet
+		select {
+		case <-pi.receiverResWriterCh:
+			stopHeartbeat()
+			atomic.StoreUint32(&pi.isReceiverConnected, 0)
+			s.receiverQueues.next(path)
+			s.writeError(resWriter, req, 410, ErrorCodePipeCanceled, fmt.Sprintf("The pipe on '%s' has been canceled.", path))
 			return
+		default:
 		}
-		// Notify that Content-Range is not supported
-		// In the future, resumable upload using Content-Range might be supported
-		// ref: https://github.com/httpwg/http-core/pull/653
-		if len(req.Header.Values("Content-Range")) != 0 {
-			resWriter.Header().Set("Access-Control-Allow-Origin", "*")
-			resWriter.WriteHeader(400)
-			resWriter.Write([]byte(fmt.Sprintf("[ERROR] Content-Range is not supported for now in %s\n", req.Method)))
-			return
+		// The sender aborts the transfer
+		select {
+		case <-pi.sendFinishedCh:
+		case <-req.Context().Done():
 		}
-		pi := s.getPipe(path)
-		// If a sender is already connected
-		if !atomic.CompareAndSwapUint32(&pi.isSenderConnected, 0, 1) {
-			resWriter.Header().Set("Access-Control-Allow-Origin", "*")
-			resWriter.WriteHeader(400)
-			resWriter.Write([]byte(fmt.Sprintf("[ERROR] Another sender has been connected on '%s'.\n", path)))
+	}
+	if atomic.LoadUint32(&pi.isAborted) == 1 {
+		// Abort the response not to let the receiver regard the truncated body as complete
+		panic(http.ErrAbortHandler)
+	}
+	s.infof(req, "Transferring %s has finished in %s method in transfer %s.\n", req.URL.Path, req.Method, pi.transferID)
+}
+
+func (s *PipingServer) handleSender(resWriter http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	maxDuration := s.maxDuration(req)
+	deadline := s.now().Add(maxDuration)
+	timeoutCh, stopTimer := s.timeoutChannel(maxDuration)
+	defer stopTimer()
+
+	// If reserved path
+	if !isPipingPath(path) {
+		s.writeError(resWriter, req, 400, ErrorCodeReservedPath, fmt.Sprintf("Cannot send to the reserved path '%s'. (e.g. '/p/mypath123')", path))
+		return
+	}
+	// Notify that Content-Range is not supported
+	// In the future, resumable upload using Content-Range might be supported
+	// ref: https://github.com/httpwg/http-core/pull/653
+	if len(req.Header.Values("Content-Range")) != 0 {
+		s.writeError(resWriter, req, 400, ErrorCodeRangeNotSupported, fmt.Sprintf("Content-Range is not supported for now in %s", req.Method))
+		return
+	}
+	rule := s.pathRule(path)
+	if rule != nil && rule.MaxBytes > 0 && req.ContentLength > rule.MaxBytes {
+		s.writeError(resWriter, req, 413, ErrorCodePayloadTooLarge, fmt.Sprintf("The body exceeds the maximum size of %d bytes on '%s'.", rule.MaxBytes, path))
+		return
+	}
+	if target := req.URL.Query().Get("push"); target != "" {
+		s.handlePush(resWriter, req, target)
+		return
+	}
+	encryptionKey, err := parseSenderEncryption(req.Header)
+	if err != nil {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	isSenderBase64, err := base64Requested(req)
+	if err != nil {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	isCompressRequested, err := s.compressRequested(req)
+	if err != nil {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	class, err := s.trafficClass(req)
+	if err != nil {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	if _, err := senderManifest(req.Header); err != nil {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	notifyTo, err := s.parseNotify(req)
+	if err != nil {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	if origin := req.Header.Get(fetchHeader); origin != "" {
+		senderReq, ok := s.fetchAsSender(resWriter, req, origin)
+		if !ok {
 			return
 		}
-		receiverResWriter := <-pi.receiverResWriterCh
-		resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+		defer senderReq.Body.Close()
+		req = senderReq
+	}
+	receivers, err := multiReceiverCount(req)
+	if err != nil {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	if receivers > 1 {
+		s.handleMultiSender(resWriter, req, receivers)
+		return
+	}
+	if s.isSpoolRequested(req) {
+		s.handleSpoolSender(resWriter, req, encryptionKey, notifyTo)
+		return
+	}
+	if req.Header.Get(spoolReuseHeader) != "" {
+		s.writeError(resWriter, req, 409, ErrorCodePartialSpoolNotFound, fmt.Sprintf("The partial spool on '%s' can be resumed only by spooling with no receiver waiting.", path))
+		return
+	}
+	if s.rejectMultiPipe(resWriter, req) {
+		return
+	}
+	pi := s.getPipe(path)
+	senderConnectedAt := s.now()
+	// If a sender is already connected and this is not a retry of it
+	takeoverCh, ok := s.acquireSender(pi, req.Header.Get("X-Piping-Idempotency-Key"), req.Header)
+	if !ok {
+		s.writeError(resWriter, req, 400, ErrorCodeSenderConflict, fmt.Sprintf("Another sender has been connected on '%s'.", path))
+		return
+	}
+	s.publishEvent(req, pi, eventSenderConnected, 0, "")
+	s.debugf(req, "Sender %s is waiting on %s in transfer %s (Content-Type: %q, Content-Length: %d)", req.RemoteAddr, path, pi.transferID, req.Header.Get("Content-Type"), req.ContentLength)
+	var receiverResWriter http.ResponseWriter
+	select {
+	case receiverResWriter = <-pi.receiverResWriterCh:
+		pi.setReceiverTaken(true)
+	case <-takeoverCh:
+	case <-timeoutCh:
+		s.releaseSender(pi, takeoverCh)
+		s.notify(notifyTo, path, "has expired unclaimed")
+		s.writeError(resWriter, req, 408, ErrorCodeTimeout, fmt.Sprintf("No receiver has connected to '%s' within %s.", path, maxDuration))
+		return
+	case <-pi.cancelCh:
+		s.writeError(resWriter, req, 410, ErrorCodePipeCanceled, fmt.Sprintf("The pipe on '%s' has been canceled.", path))
+		return
+	}
+	if receiverResWriter != nil && !s.checkOwnership(req, pi, senderConnectedAt) {
+		// Let the receiver wait for the owner
+		pi.setReceiverTaken(false)
+		pi.receiverResWriterCh <- receiverResWriter
+		s.releaseSender(pi, takeoverCh)
+		s.writeOwnershipError(resWriter, req)
+		return
+	}
+	if receiverResWriter == nil || !s.startTransfer(pi, takeoverCh) {
+		// Hand the receiver over to the retried sender
+		if receiverResWriter != nil {
+			pi.setReceiverTaken(false)
+			pi.receiverResWriterCh <- receiverResWriter
+		}
+		s.writeError(resWriter, req, 409, ErrorCodeSenderTakenOver, fmt.Sprintf("The sender on '%s' has been taken over by a retry with the same idempotency key.", path))
+		return
+	}
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	s.recordReportableTransfer(req, pi, receiverResWriter)
+	if s.ReceiverInformationalResponses && !pi.isReceiverHeaderWritten {
+		writeInformational(receiverResWriter, "sender-connected")
+	}
 
-		atomic.StoreUint32(&pi.isTransferring, 1)
-		transferHeader, transferBody := getTransferHeaderAndBody(req)
-		receiverResWriter.Header()["Content-Type"] = nil // not to sniff
-		transferHeaderIfExists(receiverResWriter, transferHeader, "Content-Type")
-		transferHeaderIfExists(receiverResWriter, transferHeader, "Content-Length")
-		transferHeaderIfExists(receiverResWriter, transferHeader, "Content-Disposition")
-		xPipingValues := req.Header.Values("X-Piping")
-		if len(xPipingValues) != 0 {
-			receiverResWriter.Header()["X-Piping"] = xPipingValues
-		}
-		receiverResWriter.Header().Set("Access-Control-Allow-Origin", "*")
-		if len(xPipingValues) != 0 {
-			receiverResWriter.Header().Set("Access-Control-Expose-Headers", "X-Piping")
-		}
-		receiverResWriter.Header().Set("X-Robots-Tag", "none")
-		io.Copy(receiverResWriter, transferBody)
-		pi.sendFinishedCh <- struct{}{}
-		delete(s.pathToPipe, path)
-	case "OPTIONS":
-		resWriter.Header().Set("Access-Control-Allow-Origin", "*")
-		resWriter.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, OPTIONS")
-		resWriter.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Disposition, X-Piping")
-		resWriter.Header().Set("Access-Control-Max-Age", "86400")
-		resWriter.Header().Set("Content-Length", "0")
-		resWriter.WriteHeader(200)
+	transferHeader, transferBody := getTransferHeaderAndBody(req)
+	if err := pi.receiverPrecondition.check(http.Header(transferHeader), !isSenderBase64); err != nil {
+		message := fmt.Sprintf("The transfer on '%s' has been rejected: %v.", path, err)
+		s.writeError(receiverResWriter, pi.receiverReq, 412, ErrorCodePreconditionFailed, message)
+		s.finishPipe(path, pi)
+		s.publishEvent(req, pi, eventTransferAborted, 0, ErrorCodePreconditionFailed)
+		s.writeError(resWriter, req, 412, ErrorCodePreconditionFailed, message)
 		return
-	default:
-		resWriter.WriteHeader(405)
-		resWriter.Header().Set("Access-Control-Allow-Origin", "*")
-		resWriter.Write([]byte(fmt.Sprintf("[ERROR] Unsupported method: %s.\n", req.Method)))
+	}
+	lineFramed := isLineFramed(req) || pi.receiverFrame == frameLine
+	grpcWebFramed := pi.receiverFrame == frameGRPCWeb
+	reencoded := pi.isReceiverBase64 || (encryptionKey != nil && pi.receiverDecryptionKey == nil) || lineFramed || grpcWebFramed
+	if s.TranscodeContentEncoding {
+		if err := checkContentEncoding(pi.receiverReq.Header.Get("Accept-Encoding"), transferHeader.Get("Content-Encoding"), reencoded); err != nil {
+			message := fmt.Sprintf("The transfer on '%s' has been rejected: %v.", path, err)
+			s.writeError(receiverResWriter, pi.receiverReq, 406, ErrorCodeUnsupportedContentEncoding, message)
+			s.finishPipe(path, pi)
+			s.publishEvent(req, pi, eventTransferAborted, 0, ErrorCodeUnsupportedContentEncoding)
+			s.writeError(resWriter, req, 415, ErrorCodeUnsupportedContentEncoding, message)
+			return
+		}
+	}
+	var senderBody io.Reader = transferBody
+	if isSenderBase64 {
+		senderBody = base64.NewDecoder(base64.StdEncoding, senderBody)
+	}
+	if rule != nil && rule.MaxBytes > 0 {
+		senderBody = &limitedReader{r: senderBody, n: rule.MaxBytes}
+	}
+	if pi.receiverPrecondition != nil && pi.receiverPrecondition.maxSize > 0 {
+		senderBody = &limitedReader{r: senderBody, n: pi.receiverPrecondition.maxSize}
+	}
+	contentHash, senderBody := s.newContentHash(senderBody)
+	receiverResWriter.Header()["Content-Type"] = nil // not to sniff
+	transferHeaderIfExists(receiverResWriter, transferHeader, "Content-Type")
+	if !isSenderBase64 {
+		transferHeaderIfExists(receiverResWriter, transferHeader, "Content-Length")
+	}
+	transferHeaderIfExists(receiverResWriter, transferHeader, "Content-Disposition")
+	xPipingValues := forwardedXPipingValues(req.Header)
+	if len(xPipingValues) != 0 {
+		receiverResWriter.Header()["X-Piping"] = xPipingValues
+	}
+	receiverResWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	if len(xPipingValues) != 0 {
+		receiverResWriter.Header().Add("Access-Control-Expose-Headers", "X-Piping")
+	}
+	receiverResWriter.Header().Set("X-Robots-Tag", "none")
+	s.setSecurityHeaders(receiverResWriter, req, s.PipeSecurityHeaders)
+	if lineFramed || grpcWebFramed {
+		// Disable buffering of reverse proxies such as nginx
+		receiverResWriter.Header().Set("X-Accel-Buffering", "no")
+	}
+	isTranscoded := false
+	if s.TranscodeContentEncoding {
+		senderBody, isTranscoded = s.negotiateContentEncoding(req, pi.receiverReq.Header.Get("Accept-Encoding"), receiverResWriter.Header(), transferHeader.Get("Content-Encoding"), senderBody, reencoded)
+	}
+	declareTransferStatsTrailers(receiverResWriter)
+	if s.ClamdAddress != "" && s.VirusScanAction == VirusScanActionFlag {
+		receiverResWriter.Header().Add("Trailer", virusScanResultTrailer)
+	}
+	filteredBody, err := s.filterTransfer(req, receiverResWriter.Header(), senderBody)
+	if err == nil && isCompressRequested && normalizeContentEncoding(transferHeader.Get("Content-Encoding")) == "" {
+		filteredBody, isTranscoded = s.compressForReceiver(req, pi.receiverReq.Header.Get("Accept-Encoding"), receiverResWriter.Header(), filteredBody, reencoded)
+	}
+	if err == nil && encryptionKey != nil {
+		filteredBody, err = encryptTransfer(pi, receiverResWriter.Header(), filteredBody, encryptionKey)
+	}
+	if pi.isReceiverBase64 {
+		filteredBody = newBase64EncodingReader(filteredBody)
+		receiverResWriter.Header().Set("Content-Type", "text/plain")
+		receiverResWriter.Header().Del("Content-Length")
+	}
+	if grpcWebFramed {
+		receiverResWriter.Header().Set("Content-Type", "application/grpc-web+proto")
+		receiverResWriter.Header().Del("Content-Length")
+	}
+	var reader io.Reader = &countingReader{r: filteredBody, n: &pi.transferredBytes, total: &s.transferredBytes}
+	reader = &cancelableReader{r: reader, cancelCh: pi.cancelCh}
+	reader = s.scheduledReader(reader, class)
+	if maxDuration > 0 {
+		reader = &deadlineReader{r: reader, deadline: deadline, clock: s.clock()}
+	}
+	if s.EnableChaos {
+		reader = chaosReader(reader, req, pi.receiverReq)
+	}
+	s.debugf(req, "Transferring %s has started", path)
+	s.publishEvent(req, pi, eventTransferStarted, 0, "")
+	startedAt := time.Now()
+	var n int64
+	var scan *clamdScan
+	if err == nil {
+		scan, err = s.startVirusScan()
+	}
+	isPlain := encryptionKey == nil && !isSenderBase64 && !isTranscoded && s.bandwidth == nil && (rule == nil || rule.MaxBytes <= 0)
+	var archive ArchiveWriter
+	if err == nil {
+		archive, err = s.startArchive(req)
+	}
+	if err == nil {
+		if scan != nil {
+			defer scan.Close()
+			reader = io.TeeReader(reader, scan)
+		}
+		if archive != nil {
+			reader = io.TeeReader(reader, archiveWriter{w: archive})
+		}
+		watcher := watchTransfer(req, pi.receiverReq, timeoutCh, pi.cancelCh)
+		if grpcWebFramed {
+			n, err = copyGRPCWeb(receiverResWriter, reader, s.ReceiverHeartbeatInterval)
+		} else if lineFramed {
+			n, err = copyLines(receiverResWriter, reader)
+		} else if zeroCopy, ok := s.startZeroCopy(resWriter, req, pi, isPlain); ok {
+			defer zeroCopy.close()
+			// NOTE: The response to the sender is written to the hijacked connection
+			resWriter = zeroCopy
+			var zeroCopyDeadline time.Time
+			if maxDuration > 0 {
+				zeroCopyDeadline = deadline
+			}
+			n, err = zeroCopy.copyTo(receiverResWriter, req.ContentLength, zeroCopyDeadline, pi.cancelCh)
+			atomic.AddInt64(&pi.transferredBytes, n)
+			atomic.AddInt64(&s.transferredBytes, n)
+		} else {
+			n, err = io.Copy(receiverResWriter, reader)
+		}
+		if reason := watcher.stop(); reason != nil && err != nil {
+			err = reason
+		}
+		if err == nil && scan != nil {
+			var result string
+			result, err = s.finishVirusScan(scan)
+			if result != "" {
+				receiverResWriter.Header().Set(http.TrailerPrefix+virusScanResultTrailer, result)
+			}
+		}
+		if err == nil && contentHash != nil {
+			err = s.checkContentHash(req, pi, contentHash)
+		}
+		err = finishArchive(archive, err)
+	}
+	elapsed := time.Since(startedAt)
+	s.debugf(req, "Transferring %s has stopped after %d bytes: %v", path, n, err)
+	abortStatusCode, abortCode, abortMessage := transferAbortError(err, path, maxDuration)
+	if abortCode != "" {
+		atomic.StoreUint32(&pi.isAborted, 1)
+	} else {
+		setTransferStats(receiverResWriter.Header(), http.TrailerPrefix, n, elapsed)
+		s.transfersToday.add(s.now())
+	}
+	s.finishPipe(path, pi)
+	if abortCode != "" {
+		s.publishEvent(req, pi, eventTransferAborted, n, abortCode)
+		if errors.Is(err, errChaosReset) {
+			panic(http.ErrAbortHandler)
+		}
+		s.writeError(resWriter, req, abortStatusCode, abortCode, abortMessage)
 		return
 	}
-	s.logger.Printf("Transferring %s has finished in %s method.\n", req.URL.Path, req.Method)
+	s.publishEvent(req, pi, eventTransferFinished, n, "")
+	s.notify(notifyTo, path, fmt.Sprintf("has completed with %d bytes", n))
+	setTransferStats(resWriter.Header(), "", n, elapsed)
+	exposeTransferStatsHeaders(resWriter)
+	s.infof(req, "Transferring %s has finished in %s method in transfer %s.\n", req.URL.Path, req.Method, pi.transferID)
+}
+
+// finishPipe deletes the pipe and lets the receiver finish
+func (s *PipingServer) finishPipe(path string, pi *pipe) {
+	// NOTE: Delete the pipe before the receiver finishes not to let a next receiver join it
+	s.mutex.Lock()
+	// NOTE: A canceled pipe may have been replaced
+	if s.pathToPipe[path] == pi {
+		delete(s.pathToPipe, path)
+	}
+	s.mutex.Unlock()
+	s.aliases.removeTarget(path)
+	s.manifests.delete(path)
+	s.receiverQueues.next(path)
+	pi.sendFinishedCh <- struct{}{}
+}
+
+// transferAbortError returns the error response to the sender if the transfer has to be aborted
+// not to let the receiver regard the truncated body as complete
+func transferAbortError(err error, path string, maxDuration time.Duration) (int, string, string) {
+	switch {
+	case errors.Is(err, errTransferTimeout):
+		return 408, ErrorCodeTimeout, fmt.Sprintf("The transfer exceeded the maximum duration of %s.", maxDuration)
+	case errors.Is(err, errPipeCanceled):
+		return 410, ErrorCodePipeCanceled, fmt.Sprintf("The pipe on '%s' has been canceled.", path)
+	case errors.Is(err, errVirusFound):
+		return 422, ErrorCodeVirusFound, fmt.Sprintf("The transfer on '%s' has been aborted: %v.", path, err)
+	case errors.Is(err, errVirusScanFailed):
+		return 503, ErrorCodeVirusScanFailed, fmt.Sprintf("The transfer on '%s' has been aborted: %v.", path, err)
+	case errors.Is(err, errDecryptionFailed):
+		return 422, ErrorCodeDecryptionFailed, fmt.Sprintf("The transfer on '%s' has been aborted: %v.", path, err)
+	case errors.Is(err, errBodyTooLarge):
+		return 413, ErrorCodePayloadTooLarge, fmt.Sprintf("The transfer on '%s' has been aborted: %v.", path, err)
+	case errors.Is(err, errInvalidContentEncoding):
+		return 400, ErrorCodeBadRequest, fmt.Sprintf("The transfer on '%s' has been aborted: %v.", path, err)
+	case errors.As(err, new(base64.CorruptInputError)):
+		return 400, ErrorCodeBadRequest, fmt.Sprintf("The transfer on '%s' has been aborted: invalid base64: %v.", path, err)
+	case errors.Is(err, errChaosReset):
+		return 500, ErrorCodeChaosReset, fmt.Sprintf("The transfer on '%s' has been reset by chaos mode.", path)
+	case errors.Is(err, errContentBlocked):
+		return 451, ErrorCodeContentBlocked, fmt.Sprintf("The transfer on '%s' has been aborted: %v.", path, err)
+	case errors.Is(err, ErrTransferRejected):
+		return 422, ErrorCodeTransferRejected, fmt.Sprintf("The transfer on '%s' has been rejected: %v.", path, err)
+	}
+	if errors.Is(err, errArchiveFailed) {
+		return 500, ErrorCodeArchiveFailed, fmt.Sprintf("The transfer on '%s' has been aborted: %v.", path, err)
+	}
+	var filterErr *transferFilterError
+	if errors.As(err, &filterErr) {
+		return 500, ErrorCodeTransferFilterFailed, fmt.Sprintf("The transfer on '%s' has been aborted by a filter: %v.", path, err)
+	}
+	return 0, "", ""
+}
+
+func (s *PipingServer) handleOptions(resWriter http.ResponseWriter, req *http.Request) {
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	resWriter.Header().Set("Access-Control-Allow-Methods", strings.Join(s.allowedMethods(), ", "))
+	resWriter.Header().Set("Access-Control-Allow-Headers", s.allowRequestHeaders(req))
+	resWriter.Header().Add("Vary", "Access-Control-Request-Headers")
+	// ref: https://wicg.github.io/private-network-access/
+	if s.AllowPrivateNetwork && req.Header.Get("Access-Control-Request-Private-Network") == "true" {
+		resWriter.Header().Set("Access-Control-Allow-Private-Network", "true")
+	}
+	resWriter.Header().Set("Access-Control-Max-Age", "86400")
+	resWriter.Header().Set("Content-Length", "0")
+	resWriter.WriteHeader(200)
 }
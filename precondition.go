@@ -0,0 +1,80 @@
+package piping_server
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// receiverMaxSizeHeader is the max size of the body the receiver accepts
+const receiverMaxSizeHeader = "X-Piping-Max-Size"
+
+// receiverAcceptContentTypeHeader is comma-separated media types the receiver accepts (e.g. "image/*, application/pdf")
+const receiverAcceptContentTypeHeader = "X-Piping-Accept-Content-Type"
+
+// receiverPrecondition is the constraints of a receiver that the sender has to satisfy
+type receiverPrecondition struct {
+	// maxSize is 0 for no limit
+	maxSize      int64
+	contentTypes []string
+}
+
+// parseReceiverPrecondition returns nil if the receiver has no constraints
+func parseReceiverPrecondition(header http.Header) (*receiverPrecondition, error) {
+	var p receiverPrecondition
+	if value := header.Get(receiverMaxSizeHeader); value != "" {
+		maxSize, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxSize <= 0 {
+			return nil, fmt.Errorf("invalid %s: %s", receiverMaxSizeHeader, value)
+		}
+		p.maxSize = maxSize
+	}
+	for _, value := range header.Values(receiverAcceptContentTypeHeader) {
+		for _, contentType := range strings.Split(value, ",") {
+			mediaType, _, err := mime.ParseMediaType(contentType)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", receiverAcceptContentTypeHeader, value)
+			}
+			p.contentTypes = append(p.contentTypes, mediaType)
+		}
+	}
+	if p.maxSize == 0 && len(p.contentTypes) == 0 {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+func (p *receiverPrecondition) acceptsContentType(contentType string) bool {
+	if len(p.contentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, accepted := range p.contentTypes {
+		if accepted == "*/*" || accepted == mediaType || strings.HasSuffix(accepted, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(accepted, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns the violation of the transfer header, ignoring Content-Length unless isLengthKnown.
+// A body without a known length is limited while transferring.
+func (p *receiverPrecondition) check(header http.Header, isLengthKnown bool) error {
+	if p == nil {
+		return nil
+	}
+	if !p.acceptsContentType(header.Get("Content-Type")) {
+		return fmt.Errorf("the receiver does not accept Content-Type '%s'", header.Get("Content-Type"))
+	}
+	if p.maxSize > 0 && isLengthKnown {
+		if size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && size > p.maxSize {
+			return fmt.Errorf("the body of %d bytes exceeds the receiver's maximum size of %d bytes", size, p.maxSize)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package piping_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const progressPath = "/api/progress"
+
+const defaultProgressInterval = time.Second
+
+const minProgressInterval = 100 * time.Millisecond
+
+type progress struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Bytes  int64  `json:"bytes"`
+	// TotalBytes is Content-Length of the sender if specified
+	TotalBytes        int64 `json:"totalBytes,omitempty"`
+	ElapsedMs         int64 `json:"elapsedMs"`
+	SenderConnected   bool  `json:"senderConnected"`
+	ReceiverConnected bool  `json:"receiverConnected"`
+}
+
+// countingReader adds the number of read bytes to n and total atomically
+type countingReader struct {
+	r     io.Reader
+	n     *int64
+	total *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	atomic.AddInt64(r.total, int64(n))
+	return n, err
+}
+
+// pipeProgress returns the progress of the pipe on the path without creating a pipe
+func (s *PipingServer) pipeProgress(path string) progress {
+	status, senderHeader := s.pipeStatus(path)
+	p := progress{Path: path, Status: status}
+	if senderHeader != nil {
+		p.TotalBytes, _ = strconv.ParseInt(senderHeader.Get("Content-Length"), 10, 64)
+	}
+	s.mutex.Lock()
+	pi, ok := s.pathToPipe[path]
+	s.mutex.Unlock()
+	if !ok {
+		return p
+	}
+	p.SenderConnected = atomic.LoadUint32(&pi.isSenderConnected) == 1
+	p.ReceiverConnected = status == pipeStatusReceiverWaiting || status == pipeStatusTransferring
+	if status == pipeStatusTransferring {
+		p.Bytes = atomic.LoadInt64(&pi.transferredBytes)
+		p.ElapsedMs = time.Since(time.Unix(0, atomic.LoadInt64(&pi.transferStartedAt))).Milliseconds()
+	}
+	return p
+}
+
+// handleProgress responds the progress of the pipe specified by the "path" query parameter as JSON,
+// or as Server-Sent Events every "interval" if the client accepts text/event-stream
+func (s *PipingServer) handleProgress(resWriter http.ResponseWriter, req *http.Request) {
+	path := req.URL.Query().Get("path")
+	if !isPipingPath(path) {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, fmt.Sprintf("Invalid path '%s'. (e.g. '/p/mypath123')", path))
+		return
+	}
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	if !accepts(req, "text/event-stream") {
+		writeJSON(resWriter, s.pipeProgress(path))
+		return
+	}
+	interval := defaultProgressInterval
+	if d, err := time.ParseDuration(req.URL.Query().Get("interval")); err == nil && d >= minProgressInterval {
+		interval = d
+	}
+	flusher, ok := resWriter.(http.Flusher)
+	if !ok {
+		writeJSON(resWriter, s.pipeProgress(path))
+		return
+	}
+	resWriter.Header().Set("Content-Type", "text/event-stream")
+	resWriter.Header().Set("Cache-Control", "no-store")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		data, _ := json.Marshal(s.pipeProgress(path))
+		if _, err := fmt.Fprintf(resWriter, "event: progress\ndata: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-ticker.C:
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
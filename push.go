@@ -0,0 +1,142 @@
+package piping_server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// DefaultPushTimeout is the timeout of a push to a webhook receiver
+const DefaultPushTimeout = 10 * time.Minute
+
+var errBodyTooLarge = errors.New("body exceeded the maximum size")
+
+var errPushRejectedByTarget = errors.New("push rejected by the target")
+
+// limitedReader fails reading beyond n bytes unlike io.LimitedReader
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	if r.n < 0 {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+// handlePush POSTs the body of the sender to the URL in the "push" query parameter instead of waiting for a receiver
+func (s *PipingServer) handlePush(resWriter http.ResponseWriter, req *http.Request, rawTarget string) {
+	target, err := url.Parse(rawTarget)
+	if err == nil {
+		err = checkOutboundURL(target, s.PushAllowedHosts)
+	}
+	if err != nil {
+		s.writeError(resWriter, req, 403, ErrorCodePushRejected, fmt.Sprintf("Cannot push to '%s': %v.", rawTarget, err))
+		return
+	}
+	if s.PushMaxBytes > 0 && req.ContentLength > s.PushMaxBytes {
+		s.writeError(resWriter, req, 413, ErrorCodePayloadTooLarge, fmt.Sprintf("The body exceeds the maximum push size of %d bytes.", s.PushMaxBytes))
+		return
+	}
+	transferHeader, transferBody := getTransferHeaderAndBody(req)
+	var body io.Reader = transferBody
+	if s.PushMaxBytes > 0 {
+		body = &limitedReader{r: body, n: s.PushMaxBytes}
+	}
+	pushHeader := http.Header{}
+	for _, header := range []string{"Content-Type", "Content-Disposition"} {
+		if values := transferHeader.Values(header); len(values) == 1 {
+			pushHeader.Set(header, values[0])
+		}
+	}
+	if transferBody == req.Body && req.ContentLength > 0 {
+		pushHeader.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+	}
+	// NOTE: Filters get the header of the push request as the header of the receiver
+	body, err = s.filterTransfer(req, pushHeader, body)
+	if err != nil {
+		status, code, message := transferAbortError(err, req.URL.Path, 0)
+		s.writeError(resWriter, req, status, code, message)
+		return
+	}
+	scan, err := s.startVirusScan()
+	if err != nil {
+		status, code, message := transferAbortError(err, req.URL.Path, 0)
+		s.writeError(resWriter, req, status, code, message)
+		return
+	}
+	var virusScan *virusScanReader
+	if scan != nil {
+		defer scan.Close()
+		virusScan = &virusScanReader{r: body, s: s, scan: scan}
+		body = virusScan
+	}
+	archive, err := s.startArchive(req)
+	if err != nil {
+		s.writeError(resWriter, req, 500, ErrorCodeArchiveFailed, fmt.Sprintf("The push to '%s' has been aborted: %v.", target.Redacted(), err))
+		return
+	}
+	if archive != nil {
+		body = io.TeeReader(body, archiveWriter{w: archive})
+	}
+	pushReq, err := http.NewRequestWithContext(req.Context(), "POST", target.String(), body)
+	if err != nil {
+		finishArchive(archive, err)
+		s.writeError(resWriter, req, 403, ErrorCodePushRejected, fmt.Sprintf("Cannot push to '%s': %v.", rawTarget, err))
+		return
+	}
+	contentLength := pushHeader.Get("Content-Length")
+	pushHeader.Del("Content-Length")
+	for name, values := range pushHeader {
+		pushReq.Header[name] = values
+	}
+	if virusScan != nil && s.VirusScanAction == VirusScanActionFlag {
+		// NOTE: The trailer is sent with the chunked body
+		pushReq.Trailer = http.Header{virusScanResultTrailer: nil}
+		virusScan.trailer = pushReq.Trailer
+	} else if contentLength != "" {
+		// NOTE: An invalid length set by a filter leaves the length unknown
+		pushReq.ContentLength, _ = strconv.ParseInt(contentLength, 10, 64)
+	}
+	pushReq.Header["X-Piping"] = forwardedXPipingValues(req.Header)
+	pushReq.Header.Set(requestIDHeader, requestID(req))
+	s.infof(req, "Pushing %s to %s", req.URL.Path, target.Redacted())
+	pushRes, err := outboundClient(s.PushClient, DefaultPushTimeout, s.PushAllowedHosts).Do(pushReq)
+	if err != nil {
+		finishArchive(archive, err)
+	}
+	if errors.Is(err, errBodyTooLarge) {
+		s.writeError(resWriter, req, 413, ErrorCodePayloadTooLarge, fmt.Sprintf("The body exceeds the maximum push size of %d bytes.", s.PushMaxBytes))
+		return
+	}
+	if status, code, message := transferAbortError(err, req.URL.Path, 0); code != "" {
+		s.writeError(resWriter, req, status, code, message)
+		return
+	}
+	if err != nil {
+		s.writeError(resWriter, req, 502, ErrorCodePushFailed, fmt.Sprintf("Failed to push to '%s': %v.", target.Redacted(), err))
+		return
+	}
+	pushRes.Body.Close()
+	if pushRes.StatusCode < 200 || pushRes.StatusCode >= 300 {
+		finishArchive(archive, errPushRejectedByTarget)
+		s.writeError(resWriter, req, 502, ErrorCodePushFailed, fmt.Sprintf("The push target '%s' responded %s.", target.Redacted(), pushRes.Status))
+		return
+	}
+	// NOTE: The copy is archived once the target has accepted it
+	if err := finishArchive(archive, nil); err != nil {
+		s.writeError(resWriter, req, 500, ErrorCodeArchiveFailed, fmt.Sprintf("The push on '%s' has been aborted: %v.", req.URL.Path, err))
+		return
+	}
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	resWriter.Header().Set("Content-Type", "text/plain")
+	resWriter.Write([]byte(fmt.Sprintf("[INFO] Pushed to '%s' (%s).\n", target.Redacted(), pushRes.Status)))
+}
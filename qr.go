@@ -0,0 +1,89 @@
+package piping_server
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+const qrPath = "/qr"
+
+const defaultQRScale = 8
+
+const maxQRScale = 32
+
+// qrQuietZone is the margin in modules required by the specification
+const qrQuietZone = 4
+
+func (qr *qrCode) svg() []byte {
+	var b bytes.Buffer
+	size := qr.size + qrQuietZone*2
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y, row := range qr.modules {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&b, "M%d,%dh1v1h-1z", x+qrQuietZone, y+qrQuietZone)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.Bytes()
+}
+
+func (qr *qrCode) writePNG(w io.Writer, scale int) error {
+	size := (qr.size + qrQuietZone*2) * scale
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{color.White, color.Black})
+	for y, row := range qr.modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex((x+qrQuietZone)*scale+dx, (y+qrQuietZone)*scale+dy, 1)
+				}
+			}
+		}
+	}
+	return png.Encode(w, img)
+}
+
+// handleQR responds the QR code of the receiver URL of the "path" query parameter
+// as PNG, or as SVG with "format=svg"
+func (s *PipingServer) handleQR(resWriter http.ResponseWriter, req *http.Request) {
+	path := req.URL.Query().Get("path")
+	if !isPipingPath(path) {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, fmt.Sprintf("Invalid path '%s'. (e.g. '/p/mypath123')", path))
+		return
+	}
+	qr, err := encodeQRCode([]byte(s.externalURL(req, path)))
+	if err != nil {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, fmt.Sprintf("The URL of '%s' is too long for a QR code.", path))
+		return
+	}
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	resWriter.Header().Set("Cache-Control", "no-store")
+	switch format := req.URL.Query().Get("format"); format {
+	case "svg":
+		resWriter.Header().Set("Content-Type", "image/svg+xml")
+		resWriter.Write(qr.svg())
+	case "", "png":
+		scale := defaultQRScale
+		if q := req.URL.Query().Get("scale"); q != "" {
+			if scale, err = strconv.Atoi(q); err != nil || scale < 1 || scale > maxQRScale {
+				s.writeError(resWriter, req, 400, ErrorCodeBadRequest, fmt.Sprintf("Invalid scale '%s'. (1 to %d)", q, maxQRScale))
+				return
+			}
+		}
+		resWriter.Header().Set("Content-Type", "image/png")
+		qr.writePNG(resWriter, scale)
+	default:
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, fmt.Sprintf("Invalid format '%s'. (png or svg)", format))
+	}
+}
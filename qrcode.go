@@ -0,0 +1,438 @@
+package piping_server
+
+import (
+	"errors"
+)
+
+// A minimal QR code encoder of byte mode with error correction level M up to version 10
+// ref: ISO/IEC 18004 and https://www.nayuki.io/page/qr-code-generator-library
+
+var errQRCodeTooLong = errors.New("data too long for a QR code")
+
+// qrBlocks is the error correction structure of a version with level M
+type qrBlocks struct {
+	ecCodewordsPerBlock int
+	// dataCodewords of each block
+	dataCodewords []int
+}
+
+// qrBlocksM is indexed by version
+var qrBlocksM = [...]qrBlocks{
+	{},
+	{10, []int{16}},
+	{16, []int{28}},
+	{26, []int{44}},
+	{18, []int{32, 32}},
+	{24, []int{43, 43}},
+	{16, []int{27, 27, 27, 27}},
+	{18, []int{31, 31, 31, 31}},
+	{22, []int{38, 38, 39, 39}},
+	{22, []int{36, 36, 36, 37, 37}},
+	{26, []int{43, 43, 43, 43, 44}},
+}
+
+// qrAlignmentPositions is indexed by version
+var qrAlignmentPositions = [...][]int{
+	{}, {},
+	{6, 18},
+	{6, 22},
+	{6, 26},
+	{6, 30},
+	{6, 34},
+	{6, 22, 38},
+	{6, 24, 42},
+	{6, 26, 46},
+	{6, 28, 50},
+}
+
+type qrCode struct {
+	size int
+	// modules[y][x] is true for dark
+	modules    [][]bool
+	isFunction [][]bool
+}
+
+func (b qrBlocks) totalDataCodewords() int {
+	n := 0
+	for _, d := range b.dataCodewords {
+		n += d
+	}
+	return n
+}
+
+// encodeQRCode encodes the data in the smallest version
+func encodeQRCode(data []byte) (*qrCode, error) {
+	for version := 1; version < len(qrBlocksM); version++ {
+		countBits := 8
+		if version >= 10 {
+			countBits = 16
+		}
+		capacityBits := qrBlocksM[version].totalDataCodewords() * 8
+		if 4+countBits+len(data)*8 > capacityBits {
+			continue
+		}
+		codewords := qrDataCodewords(data, countBits, capacityBits/8)
+		qr := newQRCode(version)
+		qr.drawCodewords(qrAddErrorCorrection(codewords, qrBlocksM[version]))
+		qr.applyBestMask()
+		return qr, nil
+	}
+	return nil, errQRCodeTooLong
+}
+
+// qrDataCodewords returns the byte-mode segment with the terminator and padding
+func qrDataCodewords(data []byte, countBits int, capacity int) []byte {
+	var bits []bool
+	appendBits := func(v int, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (v>>i)&1 == 1)
+		}
+	}
+	appendBits(0b0100, 4)
+	appendBits(len(data), countBits)
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+	for i := 0; i < 4 && len(bits) < capacity*8; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	codewords := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << (7 - j)
+			}
+		}
+		codewords = append(codewords, b)
+	}
+	for pad := byte(0xEC); len(codewords) < capacity; pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+	return codewords
+}
+
+// qrAddErrorCorrection splits the data into blocks, adds Reed-Solomon codewords and interleaves them
+func qrAddErrorCorrection(data []byte, blocks qrBlocks) []byte {
+	divisor := qrReedSolomonDivisor(blocks.ecCodewordsPerBlock)
+	var dataBlocks, ecBlocks [][]byte
+	offset := 0
+	for _, n := range blocks.dataCodewords {
+		block := data[offset : offset+n]
+		offset += n
+		dataBlocks = append(dataBlocks, block)
+		ecBlocks = append(ecBlocks, qrReedSolomonRemainder(block, divisor))
+	}
+	var result []byte
+	maxData := blocks.dataCodewords[len(blocks.dataCodewords)-1]
+	for i := 0; i < maxData; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < blocks.ecCodewordsPerBlock; i++ {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// qrMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func qrMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+func qrReedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = qrMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = qrMultiply(root, 0x02)
+	}
+	return result
+}
+
+func qrReedSolomonRemainder(data []byte, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= qrMultiply(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+func newQRCode(version int) *qrCode {
+	size := version*4 + 17
+	qr := &qrCode{size: size, modules: make([][]bool, size), isFunction: make([][]bool, size)}
+	for i := 0; i < size; i++ {
+		qr.modules[i] = make([]bool, size)
+		qr.isFunction[i] = make([]bool, size)
+	}
+	for i := 0; i < size; i++ {
+		qr.setFunction(6, i, i%2 == 0)
+		qr.setFunction(i, 6, i%2 == 0)
+	}
+	qr.drawFinder(3, 3)
+	qr.drawFinder(size-4, 3)
+	qr.drawFinder(3, size-4)
+	positions := qrAlignmentPositions[version]
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			// Skip the corners of the finders
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			qr.drawAlignment(x, y)
+		}
+	}
+	// Reserve the format areas
+	qr.drawFormat(0)
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>i)&1 == 1
+			a := size - 11 + i%3
+			b := i / 3
+			qr.setFunction(a, b, dark)
+			qr.setFunction(b, a, dark)
+		}
+	}
+	return qr
+}
+
+func (qr *qrCode) setFunction(x, y int, dark bool) {
+	qr.modules[y][x] = dark
+	qr.isFunction[y][x] = true
+}
+
+func (qr *qrCode) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if 0 <= xx && xx < qr.size && 0 <= yy && yy < qr.size {
+				dist := qrMax(qrAbs(dx), qrAbs(dy))
+				qr.setFunction(xx, yy, dist != 2 && dist != 4)
+			}
+		}
+	}
+}
+
+func (qr *qrCode) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			qr.setFunction(x+dx, y+dy, qrMax(qrAbs(dx), qrAbs(dy)) != 1)
+		}
+	}
+}
+
+// drawFormat draws the format information of level M with the mask
+func (qr *qrCode) drawFormat(mask int) {
+	// NOTE: The format bits of level M is 0b00
+	data := mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		qr.setFunction(8, i, bit(i))
+	}
+	qr.setFunction(8, 7, bit(6))
+	qr.setFunction(8, 8, bit(7))
+	qr.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		qr.setFunction(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		qr.setFunction(qr.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		qr.setFunction(8, qr.size-15+i, bit(i))
+	}
+	// Dark module
+	qr.setFunction(8, qr.size-8, true)
+}
+
+// drawCodewords places the bits in the zigzag order
+func (qr *qrCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := qr.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < qr.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = qr.size - 1 - vert
+				}
+				if !qr.isFunction[y][x] && i < len(codewords)*8 {
+					qr.modules[y][x] = (codewords[i>>3]>>(7-i&7))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+func qrMaskBit(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// applyMask flips non-function modules. Applying the same mask twice undoes it.
+func (qr *qrCode) applyMask(mask int) {
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if !qr.isFunction[y][x] && qrMaskBit(mask, x, y) {
+				qr.modules[y][x] = !qr.modules[y][x]
+			}
+		}
+	}
+}
+
+func (qr *qrCode) applyBestMask() {
+	bestMask, minPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		qr.applyMask(mask)
+		qr.drawFormat(mask)
+		if penalty := qr.penalty(); minPenalty < 0 || penalty < minPenalty {
+			bestMask, minPenalty = mask, penalty
+		}
+		qr.applyMask(mask)
+	}
+	qr.applyMask(bestMask)
+	qr.drawFormat(bestMask)
+}
+
+// penalty scores the symbol by the rules of the specification
+func (qr *qrCode) penalty() int {
+	result := 0
+	dark := 0
+	line := make([]bool, qr.size)
+	for _, horizontal := range []bool{true, false} {
+		for a := 0; a < qr.size; a++ {
+			for b := 0; b < qr.size; b++ {
+				if horizontal {
+					line[b] = qr.modules[a][b]
+				} else {
+					line[b] = qr.modules[b][a]
+				}
+			}
+			result += qrLinePenalty(line)
+		}
+	}
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if qr.modules[y][x] {
+				dark++
+			}
+			if x+1 < qr.size && y+1 < qr.size {
+				c := qr.modules[y][x]
+				if c == qr.modules[y][x+1] && c == qr.modules[y+1][x] && c == qr.modules[y+1][x+1] {
+					result += 3
+				}
+			}
+		}
+	}
+	total := qr.size * qr.size
+	// 10 points for each 5% deviation from 50% dark
+	k := (qrAbs(dark*20-total*10)+total-1)/total - 1
+	if k > 0 {
+		result += k * 10
+	}
+	return result
+}
+
+var qrFinderLikePatterns = [][]bool{
+	{true, false, true, true, true, false, true, false, false, false, false},
+	{false, false, false, false, true, false, true, true, true, false, true},
+}
+
+func qrLinePenalty(line []bool) int {
+	result := 0
+	run := 1
+	for i := 1; i <= len(line); i++ {
+		if i < len(line) && line[i] == line[i-1] {
+			run++
+			continue
+		}
+		if run >= 5 {
+			result += run - 2
+		}
+		run = 1
+	}
+	for i := 0; i+11 <= len(line); i++ {
+		for _, pattern := range qrFinderLikePatterns {
+			matched := true
+			for j, dark := range pattern {
+				if line[i+j] != dark {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				result += 40
+			}
+		}
+	}
+	return result
+}
+
+func qrAbs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func qrMax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,72 @@
+package piping_server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultRateLimitWindow is the window of RateLimitRequests if RateLimitWindow is 0
+const DefaultRateLimitWindow = time.Minute
+
+// rateLimiter counts requests by client in fixed windows
+type rateLimiter struct {
+	mutex       sync.Mutex
+	windowStart time.Time
+	counts      map[string]int
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{counts: map[string]int{}}
+}
+
+// take counts the request of the client and returns the count in the window and the time until the window resets
+func (l *rateLimiter) take(client string, window time.Duration, now time.Time) (int, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if now.Sub(l.windowStart) >= window {
+		l.windowStart = now
+		l.counts = map[string]int{}
+	}
+	l.counts[client]++
+	return l.counts[client], l.windowStart.Add(window).Sub(now)
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// checkRateLimit sets RateLimit-* headers and responds 429 with Retry-After if the client exceeds RateLimitRequests
+// ref: https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/
+func (s *PipingServer) checkRateLimit(resWriter http.ResponseWriter, req *http.Request) bool {
+	limit, window := s.rateLimit()
+	if limit <= 0 {
+		return true
+	}
+	count, reset := s.rateLimiter.take(clientIP(req), window, s.now())
+	resetSeconds := strconv.Itoa(int(math.Ceil(reset.Seconds())))
+	remaining := limit - count
+	if remaining < 0 {
+		remaining = 0
+	}
+	header := resWriter.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	header.Set("RateLimit-Reset", resetSeconds)
+	header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit, int(window.Seconds())))
+	header.Add("Access-Control-Expose-Headers", "RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, RateLimit-Policy, Retry-After")
+	if count <= limit {
+		return true
+	}
+	header.Set("Retry-After", resetSeconds)
+	s.writeError(resWriter, req, 429, ErrorCodeRateLimited, fmt.Sprintf("Too many requests. Retry after %s seconds.", resetSeconds))
+	return false
+}
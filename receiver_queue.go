@@ -0,0 +1,107 @@
+package piping_server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// receiverQueues holds receivers waiting FIFO for the receiver of the pipe on the path to finish
+type receiverQueues struct {
+	mutex sync.Mutex
+	// NOTE: a ticket is closed when it is the turn of the receiver
+	paths map[string][]chan struct{}
+}
+
+func newReceiverQueues() *receiverQueues {
+	return &receiverQueues{paths: map[string][]chan struct{}{}}
+}
+
+// next lets the first receiver queued on the path retry
+func (q *receiverQueues) next(path string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	queue := q.paths[path]
+	if len(queue) == 0 {
+		return
+	}
+	close(queue[0])
+	if len(queue) == 1 {
+		delete(q.paths, path)
+		return
+	}
+	q.paths[path] = queue[1:]
+}
+
+// leave removes the ticket from the queue, passing the turn on if the ticket has already been called
+func (q *receiverQueues) leave(path string, ticket chan struct{}) {
+	q.mutex.Lock()
+	queue := q.paths[path]
+	for i, t := range queue {
+		if t == ticket {
+			queue = append(queue[:i:i], queue[i+1:]...)
+			if len(queue) == 0 {
+				delete(q.paths, path)
+			} else {
+				q.paths[path] = queue
+			}
+			q.mutex.Unlock()
+			return
+		}
+	}
+	q.mutex.Unlock()
+	q.next(path)
+}
+
+func isReceiverSlotTaken(pi *pipe) bool {
+	return atomic.LoadUint32(&pi.isReceiverConnected) == 1 || atomic.LoadUint32(&pi.isTransferring) == 1
+}
+
+// waitReceiverTurn returns the pipe on the path once its receiver slot is free, claiming the slot.
+// A receiver finding the slot taken waits in the queue of up to ReceiverQueueLength receivers,
+// so that it receives the next transfer on the path. It writes the error response and returns nil otherwise.
+func (s *PipingServer) waitReceiverTurn(resWriter http.ResponseWriter, req *http.Request, timeoutCh <-chan time.Time, maxDuration time.Duration) *pipe {
+	path := req.URL.Path
+	// NOTE: a receiver whose turn has come keeps its place if another receiver took the slot first
+	isCalled := false
+	for {
+		s.receiverQueues.mutex.Lock()
+		pi := s.getPipe(path)
+		if !isReceiverSlotTaken(pi) {
+			// NOTE: The slot is claimed under the lock not to let concurrent receivers take it together
+			atomic.StoreUint32(&pi.isReceiverConnected, 1)
+			s.receiverQueues.mutex.Unlock()
+			return pi
+		}
+		queue := s.receiverQueues.paths[path]
+		if !isCalled && len(queue) >= s.ReceiverQueueLength {
+			s.receiverQueues.mutex.Unlock()
+			s.writeError(resWriter, req, 400, ErrorCodeReceiverLimit, fmt.Sprintf("The number of receivers has reached limits on '%s'.", path))
+			return nil
+		}
+		ticket := make(chan struct{})
+		if isCalled {
+			s.receiverQueues.paths[path] = append([]chan struct{}{ticket}, queue...)
+		} else {
+			s.receiverQueues.paths[path] = append(queue, ticket)
+		}
+		position := len(s.receiverQueues.paths[path])
+		s.receiverQueues.mutex.Unlock()
+		if !isCalled {
+			s.debugf(req, "Receiver %s is queued on %s at position %d", req.RemoteAddr, path, position)
+		}
+		select {
+		case <-ticket:
+			isCalled = true
+		case <-req.Context().Done():
+			s.receiverQueues.leave(path, ticket)
+			return nil
+		case <-timeoutCh:
+			s.receiverQueues.leave(path, ticket)
+			s.writeError(resWriter, req, 408, ErrorCodeTimeout, fmt.Sprintf("No sender has connected to '%s' within %s.", path, maxDuration))
+			return nil
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package piping_server
+
+import (
+	"sync"
+	"time"
+)
+
+const maxRecentErrors = 100
+
+type recentError struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	StatusCode int       `json:"statusCode"`
+	Code       string    `json:"code"`
+	Message    string    `json:"message"`
+	RequestID  string    `json:"requestId"`
+}
+
+// recentErrors is a ring buffer of error responses for the admin dashboard
+type recentErrors struct {
+	mutex  sync.Mutex
+	errors []recentError
+	next   int
+}
+
+func newRecentErrors(size int) *recentErrors {
+	return &recentErrors{errors: make([]recentError, 0, size)}
+}
+
+func (r *recentErrors) add(e recentError) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.errors) < cap(r.errors) {
+		r.errors = append(r.errors, e)
+		return
+	}
+	r.errors[r.next] = e
+	r.next = (r.next + 1) % len(r.errors)
+}
+
+// list returns the errors from the newest
+func (r *recentErrors) list() []recentError {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	errors := make([]recentError, 0, len(r.errors))
+	for i := len(r.errors) - 1; i >= 0; i-- {
+		errors = append(errors, r.errors[(r.next+i)%len(r.errors)])
+	}
+	return errors
+}
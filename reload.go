@@ -0,0 +1,55 @@
+package piping_server
+
+import "time"
+
+// ReloadableConfig is the configuration which Reload replaces while serving.
+// The fields of PipingServer with the same names should not be changed directly after serving has started.
+type ReloadableConfig struct {
+	AdminToken        string
+	RateLimitRequests int
+	RateLimitWindow   time.Duration
+	PathRules         []PathRule
+	BlockedSHA256     map[string]bool
+}
+
+// Reload replaces the configuration, which is safe while serving.
+// Active transfers keep running with the path rules matched when they started.
+func (s *PipingServer) Reload(config ReloadableConfig) {
+	s.configMutex.Lock()
+	defer s.configMutex.Unlock()
+	s.AdminToken = config.AdminToken
+	s.RateLimitRequests = config.RateLimitRequests
+	s.RateLimitWindow = config.RateLimitWindow
+	// NOTE: The slice and the map are replaced, not modified, so that readers can keep the old ones
+	s.PathRules = config.PathRules
+	s.BlockedSHA256 = config.BlockedSHA256
+}
+
+func (s *PipingServer) adminToken() string {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	return s.AdminToken
+}
+
+// rateLimit returns RateLimitRequests and RateLimitWindow defaulting to DefaultRateLimitWindow
+func (s *PipingServer) rateLimit() (int, time.Duration) {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	window := s.RateLimitWindow
+	if window <= 0 {
+		window = DefaultRateLimitWindow
+	}
+	return s.RateLimitRequests, window
+}
+
+func (s *PipingServer) pathRules() []PathRule {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	return s.PathRules
+}
+
+func (s *PipingServer) blockedSHA256() map[string]bool {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	return s.BlockedSHA256
+}
@@ -0,0 +1,50 @@
+package piping_server
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+const maxRequestIDLength = 128
+
+type requestIDContextKey struct{}
+
+func newID(random io.Reader) string {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(random, b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// isValidRequestID accepts IDs which are safe to write in logs
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID honors the incoming X-Request-Id or generates one, and returns it in the response
+func withRequestID(resWriter http.ResponseWriter, req *http.Request, random io.Reader) *http.Request {
+	id := req.Header.Get(requestIDHeader)
+	if !isValidRequestID(id) {
+		id = newID(random)
+	}
+	resWriter.Header().Set(requestIDHeader, id)
+	return req.WithContext(context.WithValue(req.Context(), requestIDContextKey{}, id))
+}
+
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDContextKey{}).(string)
+	return id
+}
@@ -0,0 +1,260 @@
+package piping_server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const reservationsPath = "/api/reservations"
+
+const reservationTokenHeader = "X-Piping-Reservation-Token"
+
+// DefaultReservationTTL is the lifetime of a reservation without the "ttl" query parameter
+const DefaultReservationTTL = 24 * time.Hour
+
+type reservation struct {
+	Path string `json:"path"`
+	// NOTE: Only the hash is stored so that the file does not leak tokens
+	TokenHash string    `json:"tokenHash"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type reservationResponse struct {
+	Path      string    `json:"path"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type reservationStore struct {
+	// filePath is the file persisting reservations, or empty for memory only
+	filePath     string
+	mutex        sync.Mutex
+	reservations map[string]reservation
+}
+
+func hashReservationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// EnableReservations lets clients reserve paths via /api/reservations.
+// Reservations are persisted to the file if filePath is not empty, so that they survive restarts.
+func (s *PipingServer) EnableReservations(filePath string) error {
+	store := &reservationStore{filePath: filePath, reservations: map[string]reservation{}}
+	if filePath != "" {
+		if err := store.load(); err != nil {
+			return err
+		}
+	}
+	s.reservations = store
+	return nil
+}
+
+func (rs *reservationStore) load() error {
+	b, err := os.ReadFile(rs.filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var reservations []reservation
+	if err := json.Unmarshal(b, &reservations); err != nil {
+		return fmt.Errorf("invalid reservations file %s: %w", rs.filePath, err)
+	}
+	now := time.Now()
+	for _, r := range reservations {
+		if now.Before(r.ExpiresAt) {
+			rs.reservations[r.Path] = r
+		}
+	}
+	return nil
+}
+
+// save writes the reservations to a temporary file and renames it, so that a crash leaves either the old or the new file
+// NOTE: rs.mutex should be locked
+func (rs *reservationStore) save(now time.Time) error {
+	if rs.filePath == "" {
+		return nil
+	}
+	reservations := []reservation{}
+	for _, r := range rs.reservations {
+		if now.Before(r.ExpiresAt) {
+			reservations = append(reservations, r)
+		}
+	}
+	b, err := json.Marshal(reservations)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(rs.filePath)
+	file, err := os.CreateTemp(dir, filepath.Base(rs.filePath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(b); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), rs.filePath); err != nil {
+		return err
+	}
+	// Persist the rename
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// reserve reserves the path for the token hash unless it is reserved by someone else
+func (rs *reservationStore) reserve(r reservation, now time.Time) (bool, error) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	old, hadOld := rs.reservations[r.Path]
+	if hadOld && now.Before(old.ExpiresAt) {
+		return false, nil
+	}
+	rs.reservations[r.Path] = r
+	if err := rs.save(now); err != nil {
+		if hadOld {
+			rs.reservations[r.Path] = old
+		} else {
+			delete(rs.reservations, r.Path)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (rs *reservationStore) release(path string, now time.Time) error {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	old := rs.reservations[path]
+	delete(rs.reservations, path)
+	if err := rs.save(now); err != nil {
+		rs.reservations[path] = old
+		return err
+	}
+	return nil
+}
+
+// lookup returns the unexpired reservation of the path
+func (rs *reservationStore) lookup(path string, now time.Time) (reservation, bool) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	r, ok := rs.reservations[path]
+	if !ok || !now.Before(r.ExpiresAt) {
+		return reservation{}, false
+	}
+	return r, true
+}
+
+func (r reservation) isHeldBy(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashReservationToken(token)), []byte(r.TokenHash)) == 1
+}
+
+// authorizeReservation rejects the request to a path reserved with another token
+func (s *PipingServer) authorizeReservation(resWriter http.ResponseWriter, req *http.Request) bool {
+	if s.reservations == nil {
+		return true
+	}
+	r, ok := s.reservations.lookup(req.URL.Path, s.now())
+	if !ok || r.isHeldBy(req.Header.Get(reservationTokenHeader)) {
+		return true
+	}
+	s.writeError(resWriter, req, 403, ErrorCodePathReserved, fmt.Sprintf("The path '%s' is reserved. Specify %s.", req.URL.Path, reservationTokenHeader))
+	return false
+}
+
+// handleReservations reserves the path specified by the "path" query parameter, or a generated path, with POST
+// and releases it with DELETE
+func (s *PipingServer) handleReservations(resWriter http.ResponseWriter, req *http.Request) {
+	if s.reservations == nil {
+		http.NotFound(resWriter, req)
+		return
+	}
+	path := req.URL.Query().Get("path")
+	// Generate a word-based path to reserve if not specified
+	if path == "" && req.Method == "POST" {
+		nWords, err := s.generatedPathWords(req)
+		if err != nil {
+			s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+			return
+		}
+		path, _ = generatePath(s.random(), nWords)
+	}
+	if !isPipingPath(path) {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, fmt.Sprintf("Invalid path '%s'. (e.g. '/p/mypath123')", path))
+		return
+	}
+	switch req.Method {
+	case "POST":
+		ttl := DefaultReservationTTL
+		if q := req.URL.Query().Get("ttl"); q != "" {
+			d, err := time.ParseDuration(q)
+			if err != nil || d <= 0 {
+				s.writeError(resWriter, req, 400, ErrorCodeBadRequest, fmt.Sprintf("Invalid ttl '%s'. (e.g. '1h')", q))
+				return
+			}
+			ttl = d
+		}
+		if s.MaxReservationTTL > 0 && ttl > s.MaxReservationTTL {
+			ttl = s.MaxReservationTTL
+		}
+		token := newID(s.random())
+		now := s.now()
+		r := reservation{Path: path, TokenHash: hashReservationToken(token), ExpiresAt: now.Add(ttl).UTC()}
+		ok, err := s.reservations.reserve(r, now)
+		if err != nil {
+			s.logf(req, "Failed to persist the reservation of %s: %v", path, err)
+			s.writeError(resWriter, req, 500, ErrorCodeReservationFailed, "Failed to persist the reservation.")
+			return
+		}
+		if !ok {
+			s.writeError(resWriter, req, 409, ErrorCodePathReserved, fmt.Sprintf("The path '%s' is already reserved.", path))
+			return
+		}
+		s.infof(req, "Reserved %s until %s", path, r.ExpiresAt.Format(time.RFC3339))
+		resWriter.Header().Set("Content-Type", "application/json")
+		resWriter.Header().Set("Cache-Control", "no-store")
+		resWriter.WriteHeader(201)
+		json.NewEncoder(resWriter).Encode(reservationResponse{Path: path, Token: token, ExpiresAt: r.ExpiresAt})
+	case "DELETE":
+		r, ok := s.reservations.lookup(path, s.now())
+		if !ok {
+			s.writeError(resWriter, req, 404, ErrorCodeReservationNotFound, fmt.Sprintf("The path '%s' is not reserved.", path))
+			return
+		}
+		if !r.isHeldBy(req.Header.Get(reservationTokenHeader)) {
+			s.writeError(resWriter, req, 403, ErrorCodePathReserved, fmt.Sprintf("The path '%s' is reserved with another token.", path))
+			return
+		}
+		if err := s.reservations.release(path, s.now()); err != nil {
+			s.logf(req, "Failed to persist the release of %s: %v", path, err)
+			s.writeError(resWriter, req, 500, ErrorCodeReservationFailed, "Failed to persist the release.")
+			return
+		}
+		s.infof(req, "Released %s", path)
+		resWriter.WriteHeader(204)
+	default:
+		resWriter.Header().Set("Allow", "POST, DELETE")
+		s.writeError(resWriter, req, 405, ErrorCodeMethodNotAllowed, fmt.Sprintf("Unsupported method: %s.", req.Method))
+	}
+}
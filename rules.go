@@ -0,0 +1,113 @@
+package piping_server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PathRule overrides the behavior of transfers on paths matching Pattern or Regexp
+type PathRule struct {
+	// Pattern is a path.Match pattern (e.g. "/p/public/*")
+	Pattern string
+	// Regexp is used instead of Pattern if set
+	Regexp *regexp.Regexp
+	// AuthTokens require senders and receivers to have "Authorization: Bearer <token>" with one of them (empty for anonymous)
+	AuthTokens []string
+	// MaxBytes limits the body of a sender relayed or spooled (0 for no limit)
+	MaxBytes int64
+	// MaxTransferDuration overrides PipingServer.MaxTransferDuration (0 to inherit, negative for no limit)
+	MaxTransferDuration time.Duration
+	// DisableSpool ignores ?spool=true to relay transfers without buffering
+	DisableSpool bool
+	// TrafficClass overrides X-Piping-Traffic-Class of senders for the bandwidth scheduler (empty to inherit)
+	TrafficClass string
+}
+
+func (r *PathRule) matches(p string) bool {
+	if r.Regexp != nil {
+		return r.Regexp.MatchString(p)
+	}
+	matched, _ := path.Match(r.Pattern, p)
+	return matched
+}
+
+// ParsePathRule parses comma-separated key=value pairs
+// (e.g. "pattern=/p/public/*,max-bytes=1048576,max-transfer-duration=10m").
+// Keys are pattern, regexp, auth-token (repeatable), max-bytes, max-transfer-duration, spool and traffic-class.
+func ParsePathRule(s string) (PathRule, error) {
+	var rule PathRule
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return rule, fmt.Errorf("invalid path rule %q: %q is not key=value", s, pair)
+		}
+		var err error
+		switch key {
+		case "pattern":
+			_, err = path.Match(value, "")
+			rule.Pattern = value
+		case "regexp":
+			rule.Regexp, err = regexp.Compile(value)
+		case "auth-token":
+			rule.AuthTokens = append(rule.AuthTokens, value)
+		case "max-bytes":
+			rule.MaxBytes, err = strconv.ParseInt(value, 10, 64)
+		case "max-transfer-duration":
+			rule.MaxTransferDuration, err = time.ParseDuration(value)
+			if err == nil && rule.MaxTransferDuration == 0 {
+				// NOTE: 0 means no limit like --max-transfer-duration
+				rule.MaxTransferDuration = -1
+			}
+		case "spool":
+			var spool bool
+			spool, err = strconv.ParseBool(value)
+			rule.DisableSpool = !spool
+		case "traffic-class":
+			rule.TrafficClass = value
+		default:
+			return rule, fmt.Errorf("invalid path rule %q: unknown key %q", s, key)
+		}
+		if err != nil {
+			return rule, fmt.Errorf("invalid path rule %q: %s: %w", s, key, err)
+		}
+	}
+	if rule.Pattern == "" && rule.Regexp == nil {
+		return rule, fmt.Errorf("invalid path rule %q: pattern or regexp is required", s)
+	}
+	return rule, nil
+}
+
+// pathRule returns the first rule matching the path, or nil
+func (s *PipingServer) pathRule(path string) *PathRule {
+	rules := s.pathRules()
+	for i := range rules {
+		if rules[i].matches(path) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// authorizePathRule checks the bearer token if the rule of the path requires it
+func (s *PipingServer) authorizePathRule(resWriter http.ResponseWriter, req *http.Request) bool {
+	rule := s.pathRule(req.URL.Path)
+	if rule == nil || len(rule.AuthTokens) == 0 {
+		return true
+	}
+	if token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "); token != req.Header.Get("Authorization") {
+		for _, authToken := range rule.AuthTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(authToken)) == 1 {
+				return true
+			}
+		}
+	}
+	resWriter.Header().Set("WWW-Authenticate", "Bearer")
+	s.writeError(resWriter, req, 401, ErrorCodeUnauthorized, fmt.Sprintf("The path '%s' requires authorization.", req.URL.Path))
+	return false
+}
@@ -0,0 +1,426 @@
+package piping_server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const s3PathPrefix = "/s3/"
+
+const (
+	s3Algorithm     = "AWS4-HMAC-SHA256"
+	s3TimeLayout    = "20060102T150405Z"
+	s3MaxClockSkew  = 15 * time.Minute
+	s3MaxPresignTTL = 7 * 24 * time.Hour
+	s3XMLNamespace  = "http://s3.amazonaws.com/doc/2006-03-01/"
+)
+
+func isS3Path(path string) bool {
+	return path == strings.TrimSuffix(s3PathPrefix, "/") || strings.HasPrefix(path, s3PathPrefix)
+}
+
+// s3Error is an error of the S3 API
+// ref: https://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html
+type s3Error struct {
+	statusCode int
+	// code is the error code of Piping Server for logs
+	code    string
+	s3Code  string
+	message string
+}
+
+func (s *PipingServer) writeS3Error(resWriter http.ResponseWriter, req *http.Request, e *s3Error) {
+	s.recentErrors.add(recentError{
+		Time:       time.Now(),
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		StatusCode: e.statusCode,
+		Code:       e.code,
+		Message:    e.message,
+		RequestID:  requestID(req),
+	})
+	s.logSecurityEvent(req, e.code)
+	resWriter.Header().Set("Content-Type", "application/xml")
+	resWriter.WriteHeader(e.statusCode)
+	if req.Method == "HEAD" {
+		return
+	}
+	body, _ := xml.Marshal(struct {
+		XMLName   xml.Name `xml:"Error"`
+		Code      string   `xml:"Code"`
+		Message   string   `xml:"Message"`
+		Resource  string   `xml:"Resource"`
+		RequestID string   `xml:"RequestId"`
+	}{Code: e.s3Code, Message: e.message, Resource: req.URL.Path, RequestID: requestID(req)})
+	io.WriteString(resWriter, xml.Header)
+	resWriter.Write(body)
+}
+
+// s3URIEncode encodes the string as UriEncode of Signature Version 4
+func s3URIEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery returns the sorted query without the signature
+func s3CanonicalQuery(query url.Values) string {
+	var pairs []string
+	for key, values := range query {
+		if key == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, s3URIEncode(key)+"="+s3URIEncode(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func s3CanonicalHeaders(req *http.Request, signedHeaders []string) string {
+	var b strings.Builder
+	for _, name := range signedHeaders {
+		var value string
+		switch name {
+		case "host":
+			value = req.Host
+		case "content-length":
+			value = strconv.FormatInt(req.ContentLength, 10)
+		default:
+			var values []string
+			for _, v := range req.Header.Values(name) {
+				values = append(values, strings.Join(strings.Fields(v), " "))
+			}
+			value = strings.Join(values, ",")
+		}
+		b.WriteString(name + ":" + value + "\n")
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// verifyS3Signature verifies Signature Version 4 in the Authorization header or the query of a presigned URL.
+// The payload hash is not verified because the body is streamed to the receiver.
+// ref: https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+func (s *PipingServer) verifyS3Signature(req *http.Request) *s3Error {
+	query := req.URL.Query()
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+	presigned := query.Get("X-Amz-Algorithm") != ""
+	if presigned {
+		if query.Get("X-Amz-Algorithm") != s3Algorithm {
+			return &s3Error{400, ErrorCodeBadRequest, "AuthorizationQueryParametersError", "X-Amz-Algorithm should be " + s3Algorithm + "."}
+		}
+		credential, signedHeaders, signature, amzDate = query.Get("X-Amz-Credential"), query.Get("X-Amz-SignedHeaders"), query.Get("X-Amz-Signature"), query.Get("X-Amz-Date")
+		payloadHash = "UNSIGNED-PAYLOAD"
+	} else {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, s3Algorithm+" ") {
+			return &s3Error{403, ErrorCodeUnauthorized, "AccessDenied", "Signature Version 4 is required."}
+		}
+		for _, param := range strings.Split(strings.TrimPrefix(auth, s3Algorithm+" "), ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			switch key {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				signature = value
+			}
+		}
+		amzDate = req.Header.Get("X-Amz-Date")
+		payloadHash = req.Header.Get("X-Amz-Content-Sha256")
+	}
+	scope := strings.Split(credential, "/")
+	if len(scope) != 5 || scope[3] != "s3" || scope[4] != "aws4_request" || signedHeaders == "" || signature == "" || payloadHash == "" {
+		return &s3Error{400, ErrorCodeBadRequest, "AuthorizationHeaderMalformed", "The authorization is malformed."}
+	}
+	// NOTE: The host is always signed not to let a signature be replayed to another host
+	if !containsHost(strings.Split(signedHeaders, ";")) {
+		return &s3Error{400, ErrorCodeBadRequest, "AuthorizationHeaderMalformed", "SignedHeaders should include host."}
+	}
+	secret, ok := s.S3Credentials[scope[0]]
+	if !ok {
+		return &s3Error{403, ErrorCodeUnauthorized, "InvalidAccessKeyId", "The access key ID does not exist."}
+	}
+	signedAt, err := time.Parse(s3TimeLayout, amzDate)
+	if err != nil || scope[1] != amzDate[:8] {
+		return &s3Error{403, ErrorCodeUnauthorized, "AccessDenied", "X-Amz-Date is invalid."}
+	}
+	now := s.now()
+	if presigned {
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires <= 0 || time.Duration(expires)*time.Second > s3MaxPresignTTL {
+			return &s3Error{400, ErrorCodeBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires should be from 1 to 604800 seconds."}
+		}
+		if now.Before(signedAt.Add(-s3MaxClockSkew)) || !now.Before(signedAt.Add(time.Duration(expires)*time.Second)) {
+			return &s3Error{403, ErrorCodeUnauthorized, "AccessDenied", "Request has expired."}
+		}
+	} else if now.Sub(signedAt) > s3MaxClockSkew || signedAt.Sub(now) > s3MaxClockSkew {
+		return &s3Error{403, ErrorCodeUnauthorized, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large."}
+	}
+
+	// NOTE: The path is the one sent by the client, which includes the base path
+	canonicalURI := req.URL.EscapedPath()
+	if u, err := url.ParseRequestURI(req.RequestURI); err == nil {
+		canonicalURI = u.EscapedPath()
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		s3CanonicalQuery(query),
+		s3CanonicalHeaders(req, strings.Split(signedHeaders, ";")),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{s3Algorithm, amzDate, strings.Join(scope[1:], "/"), hex.EncodeToString(hash[:])}, "\n")
+	key := []byte("AWS4" + secret)
+	for _, part := range scope[1:] {
+		key = hmacSHA256(key, part)
+	}
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return &s3Error{403, ErrorCodeUnauthorized, "SignatureDoesNotMatch", "The request signature does not match."}
+	}
+	return nil
+}
+
+// isAWSChunked returns true if the body is encoded by "Content-Encoding: aws-chunked", which the S3 facade decodes
+func isAWSChunked(req *http.Request) bool {
+	for _, encoding := range strings.Split(req.Header.Get("Content-Encoding"), ",") {
+		if strings.TrimSpace(encoding) == "aws-chunked" {
+			return true
+		}
+	}
+	return false
+}
+
+func containsHost(signedHeaders []string) bool {
+	for _, name := range signedHeaders {
+		if name == "host" {
+			return true
+		}
+	}
+	return false
+}
+
+// removeAWSChunked removes aws-chunked decoded by the facade from Content-Encoding, leaving the codings of the object
+func removeAWSChunked(header http.Header) {
+	var encodings []string
+	for _, encoding := range strings.Split(header.Get("Content-Encoding"), ",") {
+		if encoding = strings.TrimSpace(encoding); encoding != "" && encoding != "aws-chunked" {
+			encodings = append(encodings, encoding)
+		}
+	}
+	if len(encodings) == 0 {
+		header.Del("Content-Encoding")
+		return
+	}
+	header.Set("Content-Encoding", strings.Join(encodings, ", "))
+}
+
+// awsChunkedReader decodes a body such as "5;chunk-signature=...\r\nhello\r\n0;chunk-signature=...\r\n\r\n".
+// Chunk signatures and trailing checksums are not verified.
+// ref: https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-streaming.html
+type awsChunkedReader struct {
+	r *bufio.Reader
+	// remaining is the size left in the current chunk
+	remaining int64
+	eof       bool
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	if c.eof {
+		return 0, io.EOF
+	}
+	if c.remaining == 0 {
+		line, err := c.r.ReadSlice('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		sizeString, _, _ := strings.Cut(strings.TrimSpace(string(line)), ";")
+		size, err := strconv.ParseInt(sizeString, 16, 64)
+		if err != nil || size < 0 {
+			return 0, fmt.Errorf("invalid aws-chunked size: %q", sizeString)
+		}
+		if size == 0 {
+			c.eof = true
+			return 0, io.EOF
+		}
+		c.remaining = size
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err == nil && c.remaining == 0 {
+		crlf := make([]byte, 2)
+		if _, err := io.ReadFull(c.r, crlf); err != nil || string(crlf) != "\r\n" {
+			return n, fmt.Errorf("invalid aws-chunked chunk terminator")
+		}
+	}
+	return n, err
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+// handleS3List lists buckets, or objects whose senders are waiting or spooled in the bucket
+func (s *PipingServer) handleS3List(resWriter http.ResponseWriter, req *http.Request, bucket string) {
+	now := s.now().UTC().Format("2006-01-02T15:04:05.000Z")
+	senders := s.waitingSenders()
+	var result interface{}
+	if bucket == "" {
+		type s3Bucket struct {
+			Name         string `xml:"Name"`
+			CreationDate string `xml:"CreationDate"`
+		}
+		names := map[string]bool{}
+		var buckets []s3Bucket
+		for p := range senders {
+			name, _, ok := strings.Cut(strings.TrimPrefix(p, "/p/"), "/")
+			if ok && name != "" && !names[name] {
+				names[name] = true
+				buckets = append(buckets, s3Bucket{Name: name, CreationDate: now})
+			}
+		}
+		sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name < buckets[j].Name })
+		result = struct {
+			XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+			XMLNS   string     `xml:"xmlns,attr"`
+			Buckets []s3Bucket `xml:"Buckets>Bucket"`
+		}{XMLNS: s3XMLNamespace, Buckets: buckets}
+	} else {
+		prefix := req.URL.Query().Get("prefix")
+		var objects []s3Object
+		for p, header := range senders {
+			key := strings.TrimPrefix(p, "/p/"+bucket+"/")
+			if len(key) == len(p) || !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			size, _ := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+			objects = append(objects, s3Object{Key: key, LastModified: now, Size: size, StorageClass: "STANDARD"})
+		}
+		sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+		result = struct {
+			XMLName     xml.Name   `xml:"ListBucketResult"`
+			XMLNS       string     `xml:"xmlns,attr"`
+			Name        string     `xml:"Name"`
+			Prefix      string     `xml:"Prefix"`
+			KeyCount    int        `xml:"KeyCount"`
+			MaxKeys     int        `xml:"MaxKeys"`
+			IsTruncated bool       `xml:"IsTruncated"`
+			Contents    []s3Object `xml:"Contents"`
+		}{XMLNS: s3XMLNamespace, Name: bucket, Prefix: prefix, KeyCount: len(objects), MaxKeys: 1000, Contents: objects}
+	}
+	body, err := xml.Marshal(result)
+	if err != nil {
+		http.Error(resWriter, "500 Internal Server Error", 500)
+		return
+	}
+	resWriter.Header().Set("Content-Type", "application/xml")
+	io.WriteString(resWriter, xml.Header)
+	resWriter.Write(body)
+}
+
+// handleS3 implements a subset of the S3 API where PutObject sends to the pipe of "/p/<bucket>/<key>" and GetObject receives from it.
+// It returns the request rewritten to the pipe for objects, or false after responding other operations.
+func (s *PipingServer) handleS3(resWriter http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	if len(s.S3Credentials) != 0 {
+		if e := s.verifyS3Signature(req); e != nil {
+			s.writeS3Error(resWriter, req, e)
+			return nil, false
+		}
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(s3PathPrefix, "/")), "/"), "/")
+	query := req.URL.Query()
+	if key == "" {
+		switch req.Method {
+		case "GET":
+			s.handleS3List(resWriter, req, bucket)
+		case "HEAD", "PUT":
+			// NOTE: Buckets exist virtually as the first segments of paths
+			resWriter.WriteHeader(200)
+		case "DELETE":
+			resWriter.WriteHeader(204)
+		default:
+			s.writeS3Error(resWriter, req, &s3Error{405, ErrorCodeMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("Unsupported method: %s.", req.Method)})
+		}
+		return nil, false
+	}
+	if query.Has("uploads") || query.Has("uploadId") || req.Header.Get("X-Amz-Copy-Source") != "" {
+		s.writeS3Error(resWriter, req, &s3Error{501, ErrorCodeBadRequest, "NotImplemented", "Only single-part PutObject and GetObject are supported."})
+		return nil, false
+	}
+	switch req.Method {
+	case "GET", "HEAD", "PUT":
+	case "DELETE":
+		resWriter.WriteHeader(204)
+		return nil, false
+	default:
+		s.writeS3Error(resWriter, req, &s3Error{405, ErrorCodeMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("Unsupported method: %s.", req.Method)})
+		return nil, false
+	}
+	r2 := new(http.Request)
+	*r2 = *req
+	r2.URL = new(url.URL)
+	*r2.URL = *req.URL
+	r2.URL.Path = "/p/" + bucket + "/" + key
+	r2.URL.RawPath = ""
+	// NOTE: Parameters of the facade, which may be signed, are not passed to the pipe
+	r2.URL.RawQuery = ""
+	if req.Method == "PUT" {
+		if isAWSChunked(req) {
+			r2.Header = req.Header.Clone()
+			removeAWSChunked(r2.Header)
+			r2.ContentLength = -1
+			r2.Header.Del("Content-Length")
+			if decodedLength, err := strconv.ParseInt(req.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64); err == nil {
+				r2.ContentLength = decodedLength
+				r2.Header.Set("Content-Length", strconv.FormatInt(decodedLength, 10))
+			}
+			r2.Body = io.NopCloser(&awsChunkedReader{r: bufio.NewReader(req.Body)})
+		}
+		if s.spool != nil {
+			// NOTE: Spools the object if no receiver is waiting, since clients time out waiting for receivers
+			r2.URL.RawQuery = "spool=true"
+		}
+	}
+	return r2, true
+}
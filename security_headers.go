@@ -0,0 +1,40 @@
+package piping_server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// DefaultStaticSecurityHeaders returns security headers suitable for the bundled piping-ui
+func DefaultStaticSecurityHeaders() http.Header {
+	return http.Header{
+		// NOTE: piping-ui may connect to any Piping Server
+		"Content-Security-Policy": {"default-src 'self'; script-src 'self' 'unsafe-inline' 'unsafe-eval'; style-src 'self' 'unsafe-inline'; img-src 'self' data: blob:; media-src 'self' blob:; connect-src *; frame-ancestors 'none'"},
+		"X-Content-Type-Options":  {"nosniff"},
+		"Referrer-Policy":         {"no-referrer"},
+		"X-Frame-Options":         {"DENY"},
+	}
+}
+
+// DefaultPipeSecurityHeaders returns security headers for receivers not to render untrusted contents as the server origin
+func DefaultPipeSecurityHeaders() http.Header {
+	return http.Header{
+		"Content-Security-Policy": {"sandbox"},
+		"X-Content-Type-Options":  {"nosniff"},
+		"Referrer-Policy":         {"no-referrer"},
+	}
+}
+
+// setSecurityHeaders sets the headers and HSTS on TLS connections
+func (s *PipingServer) setSecurityHeaders(resWriter http.ResponseWriter, req *http.Request, headers http.Header) {
+	for name, values := range headers {
+		resWriter.Header()[name] = values
+	}
+	if s.HSTSMaxAge > 0 && req.TLS != nil {
+		value := fmt.Sprintf("max-age=%d", int64(s.HSTSMaxAge.Seconds()))
+		if s.HSTSPreload {
+			value += "; includeSubDomains; preload"
+		}
+		resWriter.Header().Set("Strict-Transport-Security", value)
+	}
+}
@@ -0,0 +1,38 @@
+package piping_server
+
+import (
+	"net/http"
+)
+
+// Security events logged for fail2ban by error code
+const (
+	securityEventAuthFailure = "auth_failure"
+	securityEventRateLimited = "rate_limited"
+	securityEventBlocked     = "blocked"
+)
+
+var securityEventsByErrorCode = map[string]string{
+	ErrorCodeUnauthorized:        securityEventAuthFailure,
+	ErrorCodePathReserved:        securityEventAuthFailure,
+	ErrorCodeOwnerTokenRequired:  securityEventAuthFailure,
+	ErrorCodeClientCertForbidden: securityEventAuthFailure,
+	ErrorCodeRateLimited:         securityEventRateLimited,
+	ErrorCodeClientCertQuota:     securityEventRateLimited,
+	ErrorCodeBlocked:             securityEventBlocked,
+	ErrorCodeContentBlocked:      securityEventBlocked,
+}
+
+// logSecurityEvent logs the error as a security event in the stable format regardless of the log level, e.g.
+// "security event=auth_failure ip=192.0.2.1 code=unauthorized method=GET path="/admin/stats" request_id=..."
+// to be matched by a fail2ban filter such as "security event=\S+ ip=<HOST> "
+func (s *PipingServer) logSecurityEvent(req *http.Request, code string) {
+	event, ok := securityEventsByErrorCode[code]
+	if !ok {
+		return
+	}
+	logger := s.SecurityLogger
+	if logger == nil {
+		logger = s.logger
+	}
+	logger.Printf("security event=%s ip=%s code=%s method=%s path=%q request_id=%s", event, clientIP(req), code, req.Method, req.URL.Path, requestID(req))
+}
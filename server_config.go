@@ -0,0 +1,70 @@
+package piping_server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// HTTPServerConfig is a set of http.Server settings suitable for Piping Server.
+// Use Apply to set them when embedding PipingServer into your own http.Server.
+type HTTPServerConfig struct {
+	// ReadHeaderTimeout limits the time to read request headers to mitigate slowloris
+	ReadHeaderTimeout time.Duration
+	// IdleTimeout limits the time to wait for the next request on a keep-alive connection
+	IdleTimeout time.Duration
+	// WriteTimeout should be 0 because transfers are streamed without a known end
+	WriteTimeout   time.Duration
+	MaxHeaderBytes int
+	TLSConfig      *tls.Config
+	// HTTP2MaxConcurrentStreams limits streams per HTTP/2 connection (0 for the default of golang.org/x/net/http2)
+	HTTP2MaxConcurrentStreams uint32
+	// HTTP2MaxReadFrameSize is the largest HTTP/2 frame the server reads (0 for the default)
+	HTTP2MaxReadFrameSize uint32
+	// HTTP2MaxUploadBufferPerStream is the flow-control window of a stream, which bounds the throughput of a sender
+	// to the window per round trip (0 for the default)
+	HTTP2MaxUploadBufferPerStream int32
+	// HTTP2MaxUploadBufferPerConnection is the flow-control window of a connection (0 for the default)
+	HTTP2MaxUploadBufferPerConnection int32
+}
+
+func DefaultHTTPServerConfig() HTTPServerConfig {
+	return HTTPServerConfig{
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		WriteTimeout:      0,
+		MaxHeaderBytes:    http.DefaultMaxHeaderBytes,
+	}
+}
+
+// Apply sets the config to the server
+func (c HTTPServerConfig) Apply(server *http.Server) {
+	server.ReadHeaderTimeout = c.ReadHeaderTimeout
+	server.IdleTimeout = c.IdleTimeout
+	server.WriteTimeout = c.WriteTimeout
+	server.MaxHeaderBytes = c.MaxHeaderBytes
+	if c.TLSConfig != nil {
+		server.TLSConfig = c.TLSConfig.Clone()
+	}
+	if c.hasHTTP2Settings() {
+		// NOTE: Fails only if TLSConfig.CipherSuites lacks the ones required by HTTP/2, in which case the bundled HTTP/2 of net/http is used
+		http2.ConfigureServer(server, c.HTTP2Server())
+	}
+}
+
+// HTTP2Server returns the HTTP/2 settings for TLS and h2c (e.g. h2c.NewHandler(handler, c.HTTP2Server()))
+func (c HTTPServerConfig) HTTP2Server() *http2.Server {
+	return &http2.Server{
+		MaxConcurrentStreams:         c.HTTP2MaxConcurrentStreams,
+		MaxReadFrameSize:             c.HTTP2MaxReadFrameSize,
+		MaxUploadBufferPerStream:     c.HTTP2MaxUploadBufferPerStream,
+		MaxUploadBufferPerConnection: c.HTTP2MaxUploadBufferPerConnection,
+		IdleTimeout:                  c.IdleTimeout,
+	}
+}
+
+func (c HTTPServerConfig) hasHTTP2Settings() bool {
+	return c.HTTP2MaxConcurrentStreams != 0 || c.HTTP2MaxReadFrameSize != 0 || c.HTTP2MaxUploadBufferPerStream != 0 || c.HTTP2MaxUploadBufferPerConnection != 0
+}
@@ -0,0 +1,434 @@
+package piping_server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+
+	gliderssh "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP version 3 packet types and status codes
+// ref: https://datatracker.ietf.org/doc/html/draft-ietf-secsh-filexfer-02
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpSetstat  = 9
+	sftpFsetstat = 10
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpBadMessage       = 5
+	sftpOpUnsupported    = 8
+
+	sftpOpenWrite = 0x2
+
+	sftpAttrSize        = 0x1
+	sftpAttrPermissions = 0x4
+
+	// maxSFTPPacketBytes bounds a packet, which is about 32 KiB for reads and writes of OpenSSH
+	maxSFTPPacketBytes = 1024 * 1024
+	// maxSFTPReadBytes bounds the length of a read
+	maxSFTPReadBytes = 256 * 1024
+)
+
+// sftpFile is an opened file or directory
+type sftpFile struct {
+	path string
+	// entries is the listing of a directory, which is nil after read
+	entries  []davEntry
+	isDir    bool
+	isWriter bool
+	// pipeWriter is the body of the sender for writing, and pipeReader is the body of the receiver for reading
+	pipeWriter *io.PipeWriter
+	pipeReader *io.PipeReader
+	offset     uint64
+	eof        bool
+	w          *bridgeResponseWriter
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+// sftpServer serves SFTP on a session, sending written files to pipes and reading files from pipes.
+// Reads and writes should be sequential as OpenSSH does.
+type sftpServer struct {
+	server  *PipingServer
+	session gliderssh.Session
+	files   map[string]*sftpFile
+	nextID  int
+}
+
+func newSFTPServer(s *PipingServer, session gliderssh.Session) *sftpServer {
+	return &sftpServer{server: s, session: session, files: map[string]*sftpFile{}}
+}
+
+func (f *sftpServer) serve() {
+	defer func() {
+		for handle := range f.files {
+			f.close(handle)
+		}
+	}()
+	for {
+		var length uint32
+		if err := binary.Read(f.session, binary.BigEndian, &length); err != nil {
+			return
+		}
+		if length == 0 || length > maxSFTPPacketBytes {
+			return
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(f.session, packet); err != nil {
+			return
+		}
+		if err := f.handle(packet[0], packet[1:]); err != nil {
+			return
+		}
+	}
+}
+
+func (f *sftpServer) send(packetType byte, payload []byte) error {
+	packet := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(packet, uint32(1+len(payload)))
+	packet[4] = packetType
+	_, err := f.session.Write(append(packet, payload...))
+	return err
+}
+
+func (f *sftpServer) sendStatus(id uint32, code uint32, message string) error {
+	return f.send(sftpStatus, ssh.Marshal(struct {
+		ID       uint32
+		Code     uint32
+		Message  string
+		Language string
+	}{id, code, message, ""}))
+}
+
+// marshalSFTPAttrs returns attributes of a directory or a file, whose size is given if known
+func marshalSFTPAttrs(isDir bool, size string) []byte {
+	if isDir {
+		return ssh.Marshal(struct{ Flags, Permissions uint32 }{sftpAttrPermissions, 0040755})
+	}
+	if n, err := strconv.ParseUint(size, 10, 64); err == nil {
+		return ssh.Marshal(struct {
+			Flags       uint32
+			Size        uint64
+			Permissions uint32
+		}{sftpAttrSize | sftpAttrPermissions, n, 0100644})
+	}
+	return ssh.Marshal(struct{ Flags, Permissions uint32 }{sftpAttrPermissions, 0100644})
+}
+
+func (f *sftpServer) sendName(id uint32, entries []davEntry) error {
+	b := ssh.Marshal(struct{ ID, Count uint32 }{id, uint32(len(entries))})
+	now := f.server.now()
+	for _, entry := range entries {
+		b = append(b, ssh.Marshal(struct{ Name, LongName string }{entry.name, listLine(entry, now)})...)
+		b = append(b, marshalSFTPAttrs(entry.isCollection, entry.contentLength)...)
+	}
+	return f.send(sftpName, b)
+}
+
+// stat returns the entry of the path, which is a file unless it is a directory of waiting senders
+func (f *sftpServer) stat(p string) (davEntry, bool) {
+	if p == "/" || p == sshHome {
+		return davEntry{name: path.Base(p), isCollection: true}, true
+	}
+	if !isPipingPath(p) {
+		return davEntry{}, false
+	}
+	dir, name := path.Split(p)
+	for _, entry := range f.server.davEntries(dir) {
+		if entry.name == name {
+			return entry, true
+		}
+	}
+	// NOTE: A path without its sender yet is a file of an unknown size to be received
+	return davEntry{name: name}, true
+}
+
+func (f *sftpServer) handle(packetType byte, payload []byte) error {
+	if packetType == sftpInit {
+		return f.send(sftpVersion, ssh.Marshal(struct{ Version uint32 }{3}))
+	}
+	var request struct {
+		ID   uint32
+		Rest []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(payload, &request); err != nil {
+		return err
+	}
+	id := request.ID
+	var pathRequest struct {
+		Path string
+		Rest []byte `ssh:"rest"`
+	}
+	switch packetType {
+	case sftpRealpath, sftpStat, sftpLstat, sftpOpendir, sftpOpen, sftpSetstat, sftpRemove, sftpMkdir, sftpRmdir:
+		if err := ssh.Unmarshal(request.Rest, &pathRequest); err != nil {
+			return f.sendStatus(id, sftpBadMessage, "Bad message.")
+		}
+		pathRequest.Path = resolveSSHPath(pathRequest.Path)
+	}
+	switch packetType {
+	case sftpRealpath:
+		return f.sendName(id, []davEntry{{name: pathRequest.Path, isCollection: true}})
+	case sftpStat, sftpLstat:
+		entry, ok := f.stat(pathRequest.Path)
+		if !ok {
+			return f.sendStatus(id, sftpNoSuchFile, "No such file.")
+		}
+		return f.send(sftpAttrs, append(ssh.Marshal(struct{ ID uint32 }{id}), marshalSFTPAttrs(entry.isCollection, entry.contentLength)...))
+	case sftpOpendir:
+		entry, ok := f.stat(pathRequest.Path)
+		if !ok || !entry.isCollection {
+			return f.sendStatus(id, sftpNoSuchFile, "No such directory.")
+		}
+		entries := []davEntry{{name: "p", isCollection: true}}
+		if pathRequest.Path != "/" {
+			entries = f.server.davEntries(pathRequest.Path + "/")
+		}
+		return f.sendHandle(id, &sftpFile{path: pathRequest.Path, isDir: true, entries: entries})
+	case sftpReaddir:
+		file, status := f.file(request.Rest)
+		if file == nil || !file.isDir {
+			return f.sendStatus(id, status, "Invalid handle.")
+		}
+		if file.entries == nil {
+			return f.sendStatus(id, sftpEOF, "End of directory.")
+		}
+		entries := file.entries
+		file.entries = nil
+		if len(entries) == 0 {
+			return f.sendStatus(id, sftpEOF, "End of directory.")
+		}
+		return f.sendName(id, entries)
+	case sftpOpen:
+		var open struct {
+			Flags uint32
+			Rest  []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(pathRequest.Rest, &open); err != nil {
+			return f.sendStatus(id, sftpBadMessage, "Bad message.")
+		}
+		if !isPipingPath(pathRequest.Path) {
+			return f.sendStatus(id, sftpPermissionDenied, "Files can be opened only under /p/.")
+		}
+		file, err := f.open(pathRequest.Path, open.Flags&sftpOpenWrite != 0)
+		if err != nil {
+			return f.sendStatus(id, sftpFailure, err.Error())
+		}
+		return f.sendHandle(id, file)
+	case sftpRead:
+		return f.read(id, request.Rest)
+	case sftpWrite:
+		return f.write(id, request.Rest)
+	case sftpFstat:
+		file, status := f.file(request.Rest)
+		if file == nil {
+			return f.sendStatus(id, status, "Invalid handle.")
+		}
+		size := ""
+		if file.w != nil && file.w.statusCode != 0 {
+			size = file.w.header.Get("Content-Length")
+		}
+		return f.send(sftpAttrs, append(ssh.Marshal(struct{ ID uint32 }{id}), marshalSFTPAttrs(file.isDir, size)...))
+	case sftpClose:
+		var handle struct {
+			Handle string
+		}
+		if err := ssh.Unmarshal(request.Rest, &handle); err != nil {
+			return f.sendStatus(id, sftpBadMessage, "Bad message.")
+		}
+		if _, ok := f.files[handle.Handle]; !ok {
+			return f.sendStatus(id, sftpFailure, "Invalid handle.")
+		}
+		if err := f.close(handle.Handle); err != nil {
+			return f.sendStatus(id, sftpFailure, err.Error())
+		}
+		return f.sendStatus(id, sftpOK, "OK.")
+	case sftpSetstat, sftpFsetstat, sftpRemove, sftpMkdir, sftpRmdir:
+		// NOTE: Attributes such as times of "scp -p" are discarded, and directories exist virtually as prefixes of paths
+		return f.sendStatus(id, sftpOK, "OK.")
+	}
+	return f.sendStatus(id, sftpOpUnsupported, "Unsupported operation.")
+}
+
+func (f *sftpServer) sendHandle(id uint32, file *sftpFile) error {
+	f.nextID++
+	handle := strconv.Itoa(f.nextID)
+	f.files[handle] = file
+	return f.send(sftpHandle, ssh.Marshal(struct {
+		ID     uint32
+		Handle string
+	}{id, handle}))
+}
+
+// file returns the file of the handle at the beginning of the payload
+func (f *sftpServer) file(payload []byte) (*sftpFile, uint32) {
+	var handle struct {
+		Handle string
+		Rest   []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(payload, &handle); err != nil {
+		return nil, sftpBadMessage
+	}
+	file, ok := f.files[handle.Handle]
+	if !ok {
+		return nil, sftpFailure
+	}
+	return file, sftpOK
+}
+
+// open starts sending to the pipe with the body written to the file, or receiving from the pipe with the body read from the file
+func (f *sftpServer) open(p string, isWriter bool) (*sftpFile, error) {
+	ctx, cancel := context.WithCancel(f.session.Context())
+	pipeReader, pipeWriter := io.Pipe()
+	file := &sftpFile{path: p, isWriter: isWriter, pipeReader: pipeReader, pipeWriter: pipeWriter, cancel: cancel, done: make(chan struct{})}
+	method := "GET"
+	var body io.Reader
+	if isWriter {
+		method = "PUT"
+		body = pipeReader
+		file.w = newBridgeResponseWriter(nil)
+	} else {
+		file.w = newBridgeResponseWriter(func(http.Header) (io.Writer, error) { return pipeWriter, nil })
+	}
+	req, err := f.server.newBridgeRequest(ctx, "SSH", method, p, body, f.session)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go func() {
+		defer close(file.done)
+		f.server.serveBridgeRequest(file.w, req)
+		// NOTE: Lets writes fail after the sender has finished, and reads end with the result of the receiver
+		var err error
+		if !file.w.succeeded() {
+			err = errors.New(file.w.errorMessage())
+		}
+		if isWriter {
+			pipeReader.CloseWithError(err)
+		} else {
+			pipeWriter.CloseWithError(err)
+		}
+	}()
+	return file, nil
+}
+
+func (f *sftpServer) read(id uint32, payload []byte) error {
+	var read struct {
+		Handle string
+		Offset uint64
+		Length uint32
+	}
+	if err := ssh.Unmarshal(payload, &read); err != nil {
+		return f.sendStatus(id, sftpBadMessage, "Bad message.")
+	}
+	file, ok := f.files[read.Handle]
+	if !ok || file.isDir || file.isWriter {
+		return f.sendStatus(id, sftpFailure, "Invalid handle.")
+	}
+	// NOTE: Reads after the short read at the end are pipelined ones
+	if file.eof {
+		return f.sendStatus(id, sftpEOF, "End of file.")
+	}
+	if read.Offset != file.offset {
+		return f.sendStatus(id, sftpFailure, fmt.Sprintf("Reads should be sequential (offset %d expected).", file.offset))
+	}
+	length := read.Length
+	if length > maxSFTPReadBytes {
+		length = maxSFTPReadBytes
+	}
+	// NOTE: Reads are full except at the end, since OpenSSH requests the rest of a short read after pipelined reads
+	data := make([]byte, length)
+	n, err := io.ReadFull(file.pipeReader, data)
+	file.offset += uint64(n)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		file.eof = true
+		err = nil
+	}
+	if err != nil {
+		return f.sendStatus(id, sftpFailure, err.Error())
+	}
+	if n == 0 {
+		return f.sendStatus(id, sftpEOF, "End of file.")
+	}
+	return f.send(sftpData, ssh.Marshal(struct {
+		ID   uint32
+		Data []byte
+	}{id, data[:n]}))
+}
+
+func (f *sftpServer) write(id uint32, payload []byte) error {
+	var write struct {
+		Handle string
+		Offset uint64
+		Data   []byte
+	}
+	if err := ssh.Unmarshal(payload, &write); err != nil {
+		return f.sendStatus(id, sftpBadMessage, "Bad message.")
+	}
+	file, ok := f.files[write.Handle]
+	if !ok || !file.isWriter {
+		return f.sendStatus(id, sftpFailure, "Invalid handle.")
+	}
+	if write.Offset != file.offset {
+		return f.sendStatus(id, sftpFailure, fmt.Sprintf("Writes should be sequential (offset %d expected).", file.offset))
+	}
+	// NOTE: Blocks until the receiver reads
+	n, err := file.pipeWriter.Write(write.Data)
+	file.offset += uint64(n)
+	if err != nil {
+		return f.sendStatus(id, sftpFailure, err.Error())
+	}
+	return f.sendStatus(id, sftpOK, "OK.")
+}
+
+// close finishes the body of the sender and waits for the transfer, or cancels the receiver which has not read to the end
+func (f *sftpServer) close(handle string) error {
+	file := f.files[handle]
+	delete(f.files, handle)
+	if file.isDir {
+		return nil
+	}
+	defer file.cancel()
+	if !file.isWriter {
+		// NOTE: Cancels the receiver if the client has not read to the end
+		file.pipeReader.Close()
+		<-file.done
+		return nil
+	}
+	file.pipeWriter.Close()
+	<-file.done
+	if !file.w.succeeded() {
+		return errors.New(file.w.errorMessage())
+	}
+	return nil
+}
@@ -0,0 +1,430 @@
+package piping_server
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultSpoolTTL is the lifetime of a spooled body not received
+const DefaultSpoolTTL = time.Hour
+
+const spoolFilePattern = "piping-spool-*"
+
+// spoolEntry is a body spooled to disk, encrypted with the ephemeral key only in memory
+type spoolEntry struct {
+	fileName string
+	key      *encryptionKey
+	header   http.Header
+	// NOTE: X-Piping-Encrypt of the sender
+	isSenderEncrypted bool
+	// contentEncoding is Content-Encoding of the sender kept with PipingServer.TranscodeContentEncoding, negotiated with the receiver
+	contentEncoding string
+	// trafficClass is the class of the sender, which the receiver is served in
+	trafficClass string
+	expiryTimer  Timer
+	// notifyTo is the email address of the "notify" query parameter of the sender
+	notifyTo string
+}
+
+type spool struct {
+	dir     string
+	mutex   sync.Mutex
+	entries map[string]*spoolEntry
+	// partials are spools of interrupted senders by path
+	partials map[string]*partialSpool
+}
+
+// EnableSpool lets senders with ?spool=true store the body in the directory when no receiver is waiting.
+// Files left by a previous process are deleted because their keys have been lost, unless SpoolShared is set.
+func (s *PipingServer) EnableSpool(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	s.spool = &spool{dir: dir, entries: map[string]*spoolEntry{}, partials: map[string]*partialSpool{}}
+	if s.SpoolShared {
+		return nil
+	}
+	_, err := s.sweepSpool(0)
+	return err
+}
+
+// SweepSpool deletes files in the spool directory older than the spool TTL which this process does not own.
+// They are left by processes which have exited or shared the directory with SpoolShared, and their keys have been lost.
+// Only one of the processes sharing the directory should sweep it periodically.
+func (s *PipingServer) SweepSpool() (int, error) {
+	if s.spool == nil {
+		return 0, nil
+	}
+	return s.sweepSpool(s.spoolTTL())
+}
+
+func (s *PipingServer) sweepSpool(minAge time.Duration) (int, error) {
+	leftovers, err := filepath.Glob(filepath.Join(s.spool.dir, spoolFilePattern))
+	if err != nil {
+		return 0, err
+	}
+	owned := map[string]bool{}
+	s.spool.mutex.Lock()
+	for _, entry := range s.spool.entries {
+		owned[entry.fileName] = true
+	}
+	for _, partial := range s.spool.partials {
+		owned[partial.fileName] = true
+	}
+	s.spool.mutex.Unlock()
+	now := time.Now()
+	removed := 0
+	for _, leftover := range leftovers {
+		if owned[leftover] {
+			continue
+		}
+		if minAge > 0 {
+			// NOTE: A file being written by a sender is not old since writes update its modification time
+			info, err := os.Stat(leftover)
+			if err != nil || now.Sub(info.ModTime()) < minAge {
+				continue
+			}
+		}
+		if err := os.Remove(leftover); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func (s *PipingServer) spoolTTL() time.Duration {
+	if s.SpoolTTL <= 0 {
+		return DefaultSpoolTTL
+	}
+	return s.SpoolTTL
+}
+
+// remove deletes the entry, returning false if it has been taken
+func (sp *spool) remove(path string, entry *spoolEntry) bool {
+	sp.mutex.Lock()
+	removed := sp.entries[path] == entry
+	if removed {
+		delete(sp.entries, path)
+	}
+	sp.mutex.Unlock()
+	entry.expiryTimer.Stop()
+	os.Remove(entry.fileName)
+	return removed
+}
+
+// take removes the entry on the path from the spool to be received only once,
+// leaving it if the precondition of the receiver or check fails
+func (sp *spool) take(path string, precondition *receiverPrecondition, check func(entry *spoolEntry) error) (*spoolEntry, bool, error) {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	entry, ok := sp.entries[path]
+	if !ok {
+		return nil, false, nil
+	}
+	if err := precondition.check(entry.header, true); err != nil {
+		return nil, true, err
+	}
+	if err := check(entry); err != nil {
+		return nil, true, err
+	}
+	delete(sp.entries, path)
+	entry.expiryTimer.Stop()
+	return entry, true, nil
+}
+
+func (sp *spool) has(path string) bool {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	_, ok := sp.entries[path]
+	return ok
+}
+
+// isSpoolRequested returns true if the sender requests spooling and no receiver is waiting
+func (s *PipingServer) isSpoolRequested(req *http.Request) bool {
+	if s.spool == nil || req.URL.Query().Get("spool") != "true" {
+		return false
+	}
+	if rule := s.pathRule(req.URL.Path); rule != nil && rule.DisableSpool {
+		return false
+	}
+	status, _ := s.pipeStatus(req.URL.Path)
+	return status == pipeStatusIdle
+}
+
+// spoolMaxBytes returns the smaller limit of SpoolMaxBytes and the path rule (0 for no limit)
+func (s *PipingServer) spoolMaxBytes(path string) int64 {
+	maxBytes := s.SpoolMaxBytes
+	if rule := s.pathRule(path); rule != nil && rule.MaxBytes > 0 && (maxBytes <= 0 || rule.MaxBytes < maxBytes) {
+		maxBytes = rule.MaxBytes
+	}
+	return maxBytes
+}
+
+func (s *PipingServer) writeSpoolFile(req *http.Request, entry *spoolEntry, body io.Reader) (int64, error) {
+	file, err := os.CreateTemp(s.spool.dir, spoolFilePattern)
+	if err != nil {
+		return 0, err
+	}
+	entry.fileName = file.Name()
+	defer file.Close()
+	if maxBytes := s.spoolMaxBytes(req.URL.Path); maxBytes > 0 {
+		body = &limitedReader{r: body, n: maxBytes}
+	}
+	counter := &countingReader{r: body, n: new(int64), total: &s.transferredBytes}
+	encrypted, err := newEncryptReader(counter, entry.key)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(file, encrypted); err != nil {
+		return 0, err
+	}
+	if s.SpoolSync {
+		if err := file.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	return *counter.n, file.Close()
+}
+
+// handleSpoolSender stores the body of the sender encrypted with an ephemeral key
+func (s *PipingServer) handleSpoolSender(resWriter http.ResponseWriter, req *http.Request, senderKey *encryptionKey, notifyTo string) {
+	path := req.URL.Path
+	if s.spool.has(path) {
+		s.writeError(resWriter, req, 400, ErrorCodeSenderConflict, fmt.Sprintf("Another sender has been spooled on '%s'.", path))
+		return
+	}
+	maxBytes := s.spoolMaxBytes(path)
+	if maxBytes > 0 && req.ContentLength > maxBytes {
+		s.writeError(resWriter, req, 413, ErrorCodePayloadTooLarge, fmt.Sprintf("The body exceeds the maximum spool size of %d bytes.", maxBytes))
+		return
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		s.writeError(resWriter, req, 500, ErrorCodeSpoolFailed, "Failed to spool.")
+		return
+	}
+	transferHeader, transferBody := getTransferHeaderAndBody(req)
+	idempotencyKey := req.Header.Get("X-Piping-Idempotency-Key")
+	resumedBody, finishResume, ok := s.resumeSpool(resWriter, req, transferBody, idempotencyKey)
+	if !ok {
+		return
+	}
+	defer finishResume()
+	// NOTE: Blocks of a body encrypted by the sender change on every retry
+	var blockHashing *blockHashingReader
+	if idempotencyKey != "" && senderKey == nil {
+		blockHashing = newBlockHashingReader(resumedBody)
+		resumedBody = blockHashing
+	}
+	entry := &spoolEntry{key: &encryptionKey{key: key}, header: http.Header{}, isSenderEncrypted: senderKey != nil, notifyTo: notifyTo}
+	for _, header := range []string{"Content-Type", "Content-Disposition"} {
+		if values := transferHeader.Values(header); len(values) == 1 {
+			entry.header.Set(header, sanitizeHeaderValue(values[0]))
+		}
+	}
+	if values := forwardedXPipingValues(req.Header); len(values) != 0 {
+		entry.header["X-Piping"] = values
+	}
+	if s.TranscodeContentEncoding {
+		entry.contentEncoding = sanitizeHeaderValue(transferHeader.Get("Content-Encoding"))
+	}
+	// NOTE: handleSender has validated the compression
+	isCompressRequested, _ := s.compressRequested(req)
+	// NOTE: A resumed body cannot continue the zstd frame of the partial spool, and a receiver without the key of the sender gets the ciphertext without Content-Encoding
+	isCompressed := isCompressRequested && normalizeContentEncoding(entry.contentEncoding) == "" && idempotencyKey == "" && senderKey == nil
+	if isCompressed {
+		entry.contentEncoding = zstdEncoding
+	}
+	// NOTE: handleSender has validated the class
+	entry.trafficClass, _ = s.trafficClass(req)
+	contentHash, body := s.newContentHash(resumedBody)
+	// NOTE: Filters get the header spooled for the receiver
+	body, err := s.filterTransfer(req, entry.header, body)
+	if err != nil {
+		status, code, message := transferAbortError(err, path, 0)
+		s.writeError(resWriter, req, status, code, message)
+		return
+	}
+	scan, err := s.startVirusScan()
+	if err != nil {
+		status, code, message := transferAbortError(err, path, 0)
+		s.writeError(resWriter, req, status, code, message)
+		return
+	}
+	// NOTE: The body is scanned before encrypted by the key of the sender
+	var virusScan *virusScanReader
+	if scan != nil {
+		defer scan.Close()
+		virusScan = &virusScanReader{r: body, s: s, scan: scan}
+		body = virusScan
+	}
+	if isCompressed {
+		body = newZstdEncodingReader(body)
+	}
+	if senderKey != nil {
+		encrypted, err := newEncryptReader(body, senderKey)
+		if err != nil {
+			s.writeError(resWriter, req, 500, ErrorCodeSpoolFailed, "Failed to spool.")
+			return
+		}
+		body = encrypted
+	}
+	archive, err := s.startArchive(req)
+	if err != nil {
+		s.writeError(resWriter, req, 500, ErrorCodeArchiveFailed, fmt.Sprintf("The spool on '%s' has been aborted: %v.", path, err))
+		return
+	}
+	if archive != nil {
+		body = io.TeeReader(body, archiveWriter{w: archive})
+	}
+	n, err := s.writeSpoolFile(req, entry, body)
+	if err != nil {
+		finishArchive(archive, err)
+		status, code, message := transferAbortError(err, path, 0)
+		if entry.fileName != "" {
+			// NOTE: A body rejected for its content is not kept for a retry
+			if blockHashing != nil && err != errBodyTooLarge && code == "" {
+				s.keepPartialSpool(req, idempotencyKey, entry, blockHashing.committedHashes())
+			} else {
+				os.Remove(entry.fileName)
+			}
+		}
+		if err == errBodyTooLarge {
+			s.writeError(resWriter, req, 413, ErrorCodePayloadTooLarge, fmt.Sprintf("The body exceeds the maximum spool size of %d bytes.", maxBytes))
+			return
+		}
+		if err == errSpoolReuseMissing {
+			s.writeError(resWriter, req, 400, ErrorCodeBadRequest, fmt.Sprintf("Resuming the spool on '%s' failed: %v.", path, err))
+			return
+		}
+		if code != "" {
+			s.writeError(resWriter, req, status, code, message)
+			return
+		}
+		s.logf(req, "Failed to spool %s: %v", path, err)
+		s.writeError(resWriter, req, 500, ErrorCodeSpoolFailed, "Failed to spool.")
+		return
+	}
+	if contentHash != nil {
+		if err := s.checkContentHash(req, nil, contentHash); err != nil {
+			finishArchive(archive, err)
+			os.Remove(entry.fileName)
+			s.writeError(resWriter, req, 451, ErrorCodeContentBlocked, fmt.Sprintf("The spool on '%s' has been rejected: %v.", path, err))
+			return
+		}
+	}
+	if err := finishArchive(archive, nil); err != nil {
+		os.Remove(entry.fileName)
+		s.writeError(resWriter, req, 500, ErrorCodeArchiveFailed, fmt.Sprintf("The spool on '%s' has been aborted: %v.", path, err))
+		return
+	}
+	if !entry.isSenderEncrypted {
+		entry.header.Set("Content-Length", strconv.FormatInt(n, 10))
+	}
+	if virusScan != nil && virusScan.result != "" {
+		entry.header.Set(virusScanResultTrailer, virusScan.result)
+	}
+	ttl := s.spoolTTL()
+	s.spool.mutex.Lock()
+	if _, ok := s.spool.entries[path]; ok {
+		s.spool.mutex.Unlock()
+		os.Remove(entry.fileName)
+		s.writeError(resWriter, req, 400, ErrorCodeSenderConflict, fmt.Sprintf("Another sender has been spooled on '%s'.", path))
+		return
+	}
+	s.spool.entries[path] = entry
+	entry.expiryTimer = s.clock().AfterFunc(ttl, func() {
+		if s.spool.remove(path, entry) {
+			s.notify(entry.notifyTo, path, "has expired unclaimed")
+		}
+	})
+	s.spool.mutex.Unlock()
+	s.infof(req, "Spooled %d bytes on %s for %s", n, path, ttl)
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	resWriter.Header().Set("Content-Type", "text/plain")
+	resWriter.WriteHeader(202)
+	resWriter.Write([]byte(fmt.Sprintf("[INFO] Spooled on '%s' until a receiver connects within %s.\n", path, ttl)))
+}
+
+// serveSpooled sends the spooled body to the receiver and deletes it, returning false if nothing is spooled
+func (s *PipingServer) serveSpooled(resWriter http.ResponseWriter, req *http.Request, decryptionKey *encryptionKey, precondition *receiverPrecondition) bool {
+	if s.spool == nil {
+		return false
+	}
+	path := req.URL.Path
+	entry, ok, err := s.spool.take(path, precondition, func(entry *spoolEntry) error {
+		if entry.contentEncoding == "" {
+			return nil
+		}
+		reencoded := entry.isSenderEncrypted && decryptionKey == nil
+		return checkContentEncoding(req.Header.Get("Accept-Encoding"), entry.contentEncoding, reencoded)
+	})
+	if !ok {
+		return false
+	}
+	if errors.Is(err, errUnsupportedContentEncoding) {
+		s.writeError(resWriter, req, 406, ErrorCodeUnsupportedContentEncoding, fmt.Sprintf("The spooled transfer on '%s' has been rejected: %v.", path, err))
+		return true
+	}
+	if err != nil {
+		s.writeError(resWriter, req, 412, ErrorCodePreconditionFailed, fmt.Sprintf("The spooled transfer on '%s' has been rejected: %v.", path, err))
+		return true
+	}
+	defer os.Remove(entry.fileName)
+	file, err := os.Open(entry.fileName)
+	if err != nil {
+		s.logf(req, "Failed to open the spool of %s: %v", path, err)
+		s.writeError(resWriter, req, 500, ErrorCodeSpoolFailed, "Failed to read the spool.")
+		return true
+	}
+	defer file.Close()
+	var body io.Reader = newDecryptReader(file, entry.key)
+	for name, values := range entry.header {
+		resWriter.Header()[name] = values
+	}
+	if entry.isSenderEncrypted {
+		if decryptionKey != nil {
+			body = newDecryptReader(body, decryptionKey)
+		} else {
+			resWriter.Header().Set("Content-Type", "application/octet-stream")
+			resWriter.Header().Set(encryptedHeader, encryptionAES256GCM)
+			resWriter.Header().Add("Access-Control-Expose-Headers", encryptedHeader)
+		}
+	}
+	if entry.contentEncoding != "" {
+		reencoded := entry.isSenderEncrypted && decryptionKey == nil
+		body, _ = s.negotiateContentEncoding(req, req.Header.Get("Accept-Encoding"), resWriter.Header(), entry.contentEncoding, body, reencoded)
+	}
+	if _, ok := resWriter.Header()["Content-Type"]; !ok {
+		resWriter.Header()["Content-Type"] = nil // not to sniff
+	}
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	if len(entry.header.Values("X-Piping")) != 0 {
+		resWriter.Header().Add("Access-Control-Expose-Headers", "X-Piping")
+	}
+	if len(entry.header.Values(virusScanResultTrailer)) != 0 {
+		resWriter.Header().Add("Access-Control-Expose-Headers", virusScanResultTrailer)
+	}
+	resWriter.Header().Set("X-Robots-Tag", "none")
+	s.setSecurityHeaders(resWriter, req, s.PipeSecurityHeaders)
+	if _, err := io.Copy(resWriter, s.scheduledReader(body, entry.trafficClass)); err != nil {
+		s.logf(req, "Failed to send the spool of %s: %v", path, err)
+		// Abort the response not to let the receiver regard the truncated body as complete
+		panic(http.ErrAbortHandler)
+	}
+	s.transfersToday.add(s.now())
+	s.aliases.removeTarget(path)
+	s.manifests.delete(path)
+	s.notify(entry.notifyTo, path, "has completed from the spool")
+	s.infof(req, "Transferring %s has finished from the spool.", path)
+	return true
+}
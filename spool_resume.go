@@ -0,0 +1,287 @@
+package piping_server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const spoolBlocksPath = "/api/spool/blocks"
+
+// spoolBlockSize is the size of blocks of a partial spool, which a resuming sender compares with its own blocks
+const spoolBlockSize = 1024 * 1024
+
+// spoolReuseHeader lists the blocks of the partial spool reused by a resuming sender (e.g. "0-99,101")
+const spoolReuseHeader = "X-Piping-Spool-Reuse"
+
+// partialSpool is the beginning of a spooled body whose sender has been interrupted, kept for a retry with the same idempotency key
+type partialSpool struct {
+	fileName       string
+	key            *encryptionKey
+	idempotencyKey string
+	// blockHashes are SHA-256 hashes of the complete blocks written to the file
+	blockHashes [][]byte
+	expiryTimer Timer
+}
+
+type spoolBlocks struct {
+	BlockSize int `json:"blockSize"`
+	// Blocks are hex-encoded SHA-256 hashes of the blocks
+	Blocks []string `json:"blocks"`
+}
+
+// blockHashingReader hashes each block of the body.
+// Bytes of a read are committed when the next read is called, since the spool has written them to the file by then.
+type blockHashingReader struct {
+	r          io.Reader
+	hash       hash.Hash
+	blockBytes int
+	hashes     [][]byte
+	read       int64
+	committed  int64
+}
+
+func newBlockHashingReader(r io.Reader) *blockHashingReader {
+	return &blockHashingReader{r: r, hash: sha256.New()}
+}
+
+func (r *blockHashingReader) Read(p []byte) (int, error) {
+	r.committed = r.read
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	for b := p[:n]; len(b) != 0; {
+		m := spoolBlockSize - r.blockBytes
+		if m > len(b) {
+			m = len(b)
+		}
+		r.hash.Write(b[:m])
+		r.blockBytes += m
+		b = b[m:]
+		if r.blockBytes == spoolBlockSize {
+			r.hashes = append(r.hashes, r.hash.Sum(nil))
+			r.hash.Reset()
+			r.blockBytes = 0
+		}
+	}
+	return n, err
+}
+
+// committedHashes returns the hashes of the complete blocks written to the file
+func (r *blockHashingReader) committedHashes() [][]byte {
+	return r.hashes[:r.committed/spoolBlockSize]
+}
+
+// parseSpoolReuse parses the blocks of X-Piping-Spool-Reuse, which should be less than count
+func parseSpoolReuse(value string, count int) (map[int]bool, error) {
+	reuse := map[int]bool{}
+	for _, part := range strings.Split(value, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s (e.g. 0-99,101)", spoolReuseHeader, value)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil {
+				return nil, fmt.Errorf("invalid %s: %s (e.g. 0-99,101)", spoolReuseHeader, value)
+			}
+		}
+		if start < 0 || end < start || end >= count {
+			return nil, fmt.Errorf("%s should be blocks less than %d", spoolReuseHeader, count)
+		}
+		for i := start; i <= end; i++ {
+			reuse[i] = true
+		}
+	}
+	return reuse, nil
+}
+
+var errSpoolReuseMissing = errors.New("the body has ended before reused blocks")
+
+// spoolDeltaReader reconstructs the body of a resuming sender from the reused blocks of the partial spool
+// and the other blocks, which are sent in order in the body
+type spoolDeltaReader struct {
+	partial       io.Reader
+	partialOffset int64
+	body          io.Reader
+	reuse         map[int]bool
+	maxReused     int
+	block         int
+	blockRead     int
+	finished      bool
+}
+
+func newSpoolDeltaReader(partial io.Reader, body io.Reader, reuse map[int]bool) *spoolDeltaReader {
+	r := &spoolDeltaReader{partial: partial, body: body, reuse: reuse, maxReused: -1}
+	for i := range reuse {
+		if i > r.maxReused {
+			r.maxReused = i
+		}
+	}
+	return r
+}
+
+func (r *spoolDeltaReader) Read(p []byte) (int, error) {
+	for !r.finished {
+		if r.blockRead == spoolBlockSize {
+			r.block++
+			r.blockRead = 0
+		}
+		if len(p) > spoolBlockSize-r.blockRead {
+			p = p[:spoolBlockSize-r.blockRead]
+		}
+		if r.reuse[r.block] {
+			if r.blockRead == 0 {
+				skip := int64(r.block)*spoolBlockSize - r.partialOffset
+				if _, err := io.CopyN(io.Discard, r.partial, skip); err != nil {
+					return 0, fmt.Errorf("failed to read the partial spool: %w", err)
+				}
+				r.partialOffset += skip
+			}
+			n, err := r.partial.Read(p)
+			r.partialOffset += int64(n)
+			r.blockRead += n
+			if err != nil && (err != io.EOF || r.blockRead != spoolBlockSize) {
+				return n, fmt.Errorf("failed to read the partial spool: %w", err)
+			}
+			return n, nil
+		}
+		n, err := r.body.Read(p)
+		r.blockRead += n
+		if err == io.EOF {
+			end := r.block
+			if r.blockRead == spoolBlockSize {
+				end++
+			}
+			if end <= r.maxReused {
+				return n, errSpoolReuseMissing
+			}
+			r.finished = true
+		} else if err != nil {
+			return n, err
+		}
+		if n != 0 {
+			return n, nil
+		}
+	}
+	return 0, io.EOF
+}
+
+// takePartial removes the partial spool on the path from the spool if the idempotency key matches
+func (sp *spool) takePartial(path string, idempotencyKey string) *partialSpool {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	partial, ok := sp.partials[path]
+	if !ok || idempotencyKey == "" || partial.idempotencyKey != idempotencyKey {
+		return nil
+	}
+	delete(sp.partials, path)
+	partial.expiryTimer.Stop()
+	return partial
+}
+
+func (sp *spool) removePartial(path string, partial *partialSpool) {
+	sp.mutex.Lock()
+	if sp.partials[path] == partial {
+		delete(sp.partials, path)
+	}
+	sp.mutex.Unlock()
+	partial.expiryTimer.Stop()
+	os.Remove(partial.fileName)
+}
+
+// keepPartialSpool keeps the complete blocks written before the sender was interrupted for its retry until the spool TTL,
+// replacing the partial spool of another sender on the path
+func (s *PipingServer) keepPartialSpool(req *http.Request, idempotencyKey string, entry *spoolEntry, blockHashes [][]byte) {
+	path := req.URL.Path
+	if len(blockHashes) == 0 {
+		os.Remove(entry.fileName)
+		return
+	}
+	partial := &partialSpool{fileName: entry.fileName, key: entry.key, idempotencyKey: idempotencyKey, blockHashes: blockHashes}
+	s.spool.mutex.Lock()
+	replaced := s.spool.partials[path]
+	s.spool.partials[path] = partial
+	partial.expiryTimer = s.clock().AfterFunc(s.spoolTTL(), func() {
+		s.spool.removePartial(path, partial)
+	})
+	s.spool.mutex.Unlock()
+	if replaced != nil {
+		replaced.expiryTimer.Stop()
+		os.Remove(replaced.fileName)
+	}
+	s.infof(req, "Kept %d blocks of the interrupted spool on %s for a retry", len(blockHashes), path)
+}
+
+// resumeSpool returns the body reconstructed with the partial spool if the sender resumes with X-Piping-Spool-Reuse.
+// The returned function deletes the partial spool after the body is read.
+func (s *PipingServer) resumeSpool(resWriter http.ResponseWriter, req *http.Request, body io.Reader, idempotencyKey string) (io.Reader, func(), bool) {
+	path := req.URL.Path
+	partial := s.spool.takePartial(path, idempotencyKey)
+	value := req.Header.Get(spoolReuseHeader)
+	if value == "" {
+		if partial != nil {
+			// NOTE: The sender starts over
+			s.spool.removePartial(path, partial)
+		}
+		return body, func() {}, true
+	}
+	if partial == nil {
+		s.writeError(resWriter, req, 409, ErrorCodePartialSpoolNotFound, fmt.Sprintf("No partial spool on '%s' has been kept for the idempotency key.", path))
+		return nil, nil, false
+	}
+	reuse, err := parseSpoolReuse(value, len(partial.blockHashes))
+	if err != nil {
+		s.spool.removePartial(path, partial)
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, err.Error())
+		return nil, nil, false
+	}
+	file, err := os.Open(partial.fileName)
+	if err != nil {
+		s.spool.removePartial(path, partial)
+		s.logf(req, "Failed to open the partial spool of %s: %v", path, err)
+		s.writeError(resWriter, req, 500, ErrorCodeSpoolFailed, "Failed to read the partial spool.")
+		return nil, nil, false
+	}
+	s.infof(req, "Resuming the spool on %s reusing %d of %d blocks", path, len(reuse), len(partial.blockHashes))
+	return newSpoolDeltaReader(newDecryptReader(file, partial.key), body, reuse), func() {
+		file.Close()
+		s.spool.removePartial(path, partial)
+	}, true
+}
+
+// handleSpoolBlocks responds the hashes of the blocks of the partial spool on the "path" query parameter
+// to its sender retrying with the same X-Piping-Idempotency-Key
+func (s *PipingServer) handleSpoolBlocks(resWriter http.ResponseWriter, req *http.Request) {
+	path := req.URL.Query().Get("path")
+	if !isPipingPath(path) {
+		s.writeError(resWriter, req, 400, ErrorCodeBadRequest, fmt.Sprintf("Invalid path '%s'. (e.g. '/p/mypath123')", path))
+		return
+	}
+	idempotencyKey := req.Header.Get("X-Piping-Idempotency-Key")
+	blocks := spoolBlocks{BlockSize: spoolBlockSize, Blocks: []string{}}
+	found := false
+	if s.spool != nil {
+		s.spool.mutex.Lock()
+		if partial, ok := s.spool.partials[path]; ok && idempotencyKey != "" && partial.idempotencyKey == idempotencyKey {
+			found = true
+			for _, blockHash := range partial.blockHashes {
+				blocks.Blocks = append(blocks.Blocks, hex.EncodeToString(blockHash))
+			}
+		}
+		s.spool.mutex.Unlock()
+	}
+	if !found {
+		s.writeError(resWriter, req, 404, ErrorCodePartialSpoolNotFound, fmt.Sprintf("No partial spool on '%s' has been kept for the idempotency key.", path))
+		return
+	}
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	writeJSON(resWriter, blocks)
+}
@@ -0,0 +1,260 @@
+package piping_server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	gliderssh "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// sshHandshakeTimeout is the timeout of the handshake and authentication until the client starts a session
+	sshHandshakeTimeout = 30 * time.Second
+	// sshHome is the directory of relative paths, such as "mypath" in "scp file host:mypath"
+	sshHome = "/p"
+	// sshUsage is the message for other commands than scp and sftp
+	sshUsage = "Piping Server supports only scp and sftp (e.g. scp myfile host:/p/mypath)."
+)
+
+// sshHandshakeTimerKey is the key of the timer closing the connection in the context of the connection
+var sshHandshakeTimerKey = &struct{ name string }{"ssh-handshake-timer"}
+
+// SSHConfig is the configuration of the SSH bridge.
+// Any client is accepted if neither Password nor AuthorizedKeys is specified.
+type SSHConfig struct {
+	HostKey ssh.Signer
+	// Password is accepted for any user if not empty
+	Password string
+	// AuthorizedKeys are public keys accepted for any user
+	AuthorizedKeys []ssh.PublicKey
+}
+
+// ServeSSH accepts SSH connections on the listener until it is closed.
+// Files sent by scp or sftp to a path under /p/ are sent to the pipe of the path, and files received by them are received from it.
+func (s *PipingServer) ServeSSH(ln net.Listener, config SSHConfig) error {
+	server := &gliderssh.Server{
+		Version:           "PipingServer",
+		Handler:           s.serveSSHSession,
+		SubsystemHandlers: map[string]gliderssh.SubsystemHandler{"sftp": s.serveSFTP},
+		// NOTE: gliderlabs/ssh resets deadlines of connections on every read, so the timer closes stalled ones
+		ConnCallback: func(ctx gliderssh.Context, conn net.Conn) net.Conn {
+			ctx.SetValue(sshHandshakeTimerKey, time.AfterFunc(sshHandshakeTimeout, func() { conn.Close() }))
+			return conn
+		},
+		SessionRequestCallback: func(session gliderssh.Session, requestType string) bool {
+			session.Context().Value(sshHandshakeTimerKey).(*time.Timer).Stop()
+			return true
+		},
+	}
+	if config.Password != "" {
+		server.PasswordHandler = func(ctx gliderssh.Context, password string) bool {
+			return subtle.ConstantTimeCompare([]byte(password), []byte(config.Password)) == 1
+		}
+	}
+	if len(config.AuthorizedKeys) != 0 {
+		server.PublicKeyHandler = func(ctx gliderssh.Context, key gliderssh.PublicKey) bool {
+			for _, authorizedKey := range config.AuthorizedKeys {
+				if gliderssh.KeysEqual(key, authorizedKey) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	server.AddHostKey(config.HostKey)
+	return server.Serve(ln)
+}
+
+// serveSSHSession runs scp by exec, and exits with the status.
+// Transfers are canceled when the connection is closed.
+func (s *PipingServer) serveSSHSession(session gliderssh.Session) {
+	if session.RawCommand() == "" {
+		fmt.Fprintf(session.Stderr(), "%s\r\n", sshUsage)
+		session.Exit(1)
+		return
+	}
+	if err := s.runSCP(session); err != nil {
+		if err != errSCPReported {
+			fmt.Fprintf(session.Stderr(), "%v\r\n", err)
+		}
+		session.Exit(1)
+		return
+	}
+	session.Exit(0)
+}
+
+// serveSFTP runs sftp by the subsystem
+func (s *PipingServer) serveSFTP(session gliderssh.Session) {
+	newSFTPServer(s, session).serve()
+}
+
+// resolveSSHPath returns the absolute path of the path relative to sshHome
+func resolveSSHPath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = sshHome + "/" + p
+	}
+	return path.Clean(p)
+}
+
+// runSCP runs "scp -t" receiving files from the client or "scp -f" sending a file to the client in the protocol of scp -O
+func (s *PipingServer) runSCP(session gliderssh.Session) error {
+	words := session.Command()
+	if len(words) == 0 || words[0] != "scp" {
+		return errors.New(sshUsage)
+	}
+	var isSink, isSource, isDir bool
+	var paths []string
+	for _, word := range words[1:] {
+		switch word {
+		case "-t":
+			isSink = true
+		case "-f":
+			isSource = true
+		case "-d":
+			isDir = true
+		case "-r":
+			return errors.New("scp: directories are not supported")
+		case "--":
+		default:
+			if strings.HasPrefix(word, "-") {
+				// NOTE: Options such as -p and -v do not change the protocol
+				continue
+			}
+			paths = append(paths, word)
+		}
+	}
+	if len(paths) != 1 || isSink == isSource {
+		return errors.New("scp: invalid arguments")
+	}
+	p := resolveSSHPath(paths[0])
+	reader := bufio.NewReader(session)
+	if isSink {
+		return s.runSCPSink(session, reader, p, isDir || strings.HasSuffix(paths[0], "/") || p == sshHome)
+	}
+	return s.runSCPSource(session, reader, p)
+}
+
+// errSCPReported is the error which has been reported to the client in the protocol of scp
+var errSCPReported = errors.New("scp: reported error")
+
+// reportSCPError reports the fatal error to the client, which prints it
+func reportSCPError(session gliderssh.Session, format string, v ...interface{}) error {
+	fmt.Fprintf(session, "\x02scp: "+format+"\n", v...)
+	return errSCPReported
+}
+
+// readSCPAck reads the response of the client, which is 0 for success
+func readSCPAck(reader *bufio.Reader) error {
+	b, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	message, _ := reader.ReadString('\n')
+	return errors.New(strings.TrimSpace(message))
+}
+
+// runSCPSink sends each file from the client to the pipe of the target path, or of the file name under the target directory
+func (s *PipingServer) runSCPSink(session gliderssh.Session, reader *bufio.Reader, target string, isDir bool) error {
+	session.Write([]byte{0})
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch line[0] {
+		case 'T':
+			// NOTE: Times of -p are discarded
+			session.Write([]byte{0})
+			continue
+		case 'C':
+		case 'D':
+			return reportSCPError(session, "directories are not supported")
+		default:
+			return errors.New(strings.TrimSpace(line[1:]))
+		}
+		// e.g. "C0644 12 myfile.txt"
+		fields := strings.SplitN(strings.TrimSuffix(line[1:], "\n"), " ", 3)
+		if len(fields) != 3 {
+			return errors.New("scp: invalid file header")
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || size < 0 {
+			return errors.New("scp: invalid file size")
+		}
+		p := target
+		if isDir {
+			p = path.Join(target, fields[2])
+		}
+		if !isPipingPath(p) {
+			return reportSCPError(session, "%s: files can be sent only under /p/", p)
+		}
+		session.Write([]byte{0})
+		body := io.LimitReader(reader, size)
+		req, err := s.newBridgeRequest(session.Context(), "SSH", "PUT", p, body, session)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+		w := newBridgeResponseWriter(nil)
+		s.serveBridgeRequest(w, req)
+		if !w.succeeded() {
+			return reportSCPError(session, "%s: %s", p, w.errorMessage())
+		}
+		// The client ends the file with 0
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return err
+		}
+		if err := readSCPAck(reader); err != nil {
+			return err
+		}
+		session.Write([]byte{0})
+	}
+}
+
+// runSCPSource sends the body of the sender of the pipe to the client, which requires Content-Length
+func (s *PipingServer) runSCPSource(session gliderssh.Session, reader *bufio.Reader, source string) error {
+	if err := readSCPAck(reader); err != nil {
+		return err
+	}
+	req, err := s.newBridgeRequest(session.Context(), "SSH", "GET", source, nil, session)
+	if err != nil {
+		return err
+	}
+	w := newBridgeResponseWriter(func(header http.Header) (io.Writer, error) {
+		size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+		if err != nil {
+			return nil, errors.New("the sender has not specified Content-Length, which scp requires (sftp can receive it)")
+		}
+		fmt.Fprintf(session, "C0644 %d %s\n", size, path.Base(source))
+		if err := readSCPAck(reader); err != nil {
+			return nil, err
+		}
+		return session, nil
+	})
+	s.serveBridgeRequest(w, req)
+	if w.err != nil {
+		return reportSCPError(session, "%s: %v", source, w.err)
+	}
+	if !w.succeeded() {
+		return reportSCPError(session, "%s: %s", source, w.errorMessage())
+	}
+	session.Write([]byte{0})
+	return readSCPAck(reader)
+}
@@ -0,0 +1,167 @@
+package piping_server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hashedAssetRegexp matches asset names containing a content hash (e.g. js/app.3f2a1c9d.js)
+var hashedAssetRegexp = regexp.MustCompile(`[.-][0-9a-f]{8,}\.[a-z0-9]+$`)
+
+type staticETag struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+// staticHandler serves static files with ETag, Cache-Control and pre-compressed variants
+type staticHandler struct {
+	fsys fs.FS
+	// name -> staticETag
+	etags sync.Map
+}
+
+func newStaticHandler(fsys fs.FS) *staticHandler {
+	return &staticHandler{fsys: fsys}
+}
+
+// open opens a regular file
+func (h *staticHandler) open(name string) (fs.File, fs.FileInfo, error) {
+	f, err := h.fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, nil, fs.ErrNotExist
+	}
+	return f, info, nil
+}
+
+// readSeeker returns the file as io.ReadSeeker
+func readSeeker(f fs.File) (io.ReadSeeker, error) {
+	if rs, ok := f.(io.ReadSeeker); ok {
+		return rs, nil
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
+
+// etag returns a strong ETag of the content, cached while the file is unchanged
+func (h *staticHandler) etag(name string, info fs.FileInfo) (string, error) {
+	if cached, ok := h.etags.Load(name); ok {
+		e := cached.(staticETag)
+		if e.modTime.Equal(info.ModTime()) && e.size == info.Size() {
+			return e.etag, nil
+		}
+	}
+	f, err := h.fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	etag := `"` + hex.EncodeToString(hash.Sum(nil))[:32] + `"`
+	h.etags.Store(name, staticETag{modTime: info.ModTime(), size: info.Size(), etag: etag})
+	return etag, nil
+}
+
+// resolve returns the file name to serve for the URL path
+func (h *staticHandler) resolve(urlPath string, spa bool) (string, bool) {
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		name = "index.html"
+	}
+	if info, err := fs.Stat(h.fsys, name); err == nil {
+		if !info.IsDir() {
+			return name, true
+		}
+		name = path.Join(name, "index.html")
+		if _, err := fs.Stat(h.fsys, name); err == nil {
+			return name, true
+		}
+	}
+	// Serve the top page for routes of the single page application
+	if spa && path.Ext(urlPath) == "" {
+		if _, err := fs.Stat(h.fsys, "index.html"); err == nil {
+			return "index.html", true
+		}
+	}
+	return "", false
+}
+
+func (h *staticHandler) serve(resWriter http.ResponseWriter, req *http.Request, spa bool) {
+	name, ok := h.resolve(req.URL.Path, spa)
+	if !ok {
+		http.NotFound(resWriter, req)
+		return
+	}
+	f, info, err := h.open(name)
+	if err != nil {
+		http.NotFound(resWriter, req)
+		return
+	}
+	defer f.Close()
+	etag, err := h.etag(name, info)
+	if err != nil {
+		http.Error(resWriter, "500 Internal Server Error", 500)
+		return
+	}
+	if hashedAssetRegexp.MatchString(name) {
+		resWriter.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		resWriter.Header().Set("Cache-Control", "no-cache")
+	}
+	resWriter.Header().Add("Vary", "Accept-Encoding")
+
+	// Serve the pre-compressed file if exists
+	content := f
+	acceptEncoding := req.Header.Get("Accept-Encoding")
+	for _, encoding := range []struct{ name, ext string }{{"br", ".br"}, {"gzip", ".gz"}} {
+		if !strings.Contains(acceptEncoding, encoding.name) {
+			continue
+		}
+		compressed, _, err := h.open(name + encoding.ext)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			break
+		}
+		defer compressed.Close()
+		content = compressed
+		resWriter.Header().Set("Content-Encoding", encoding.name)
+		// Distinguish the representation from the uncompressed one
+		etag = strings.TrimSuffix(etag, `"`) + "-" + encoding.name + `"`
+		break
+	}
+	resWriter.Header().Set("ETag", etag)
+	rs, err := readSeeker(content)
+	if err != nil {
+		http.Error(resWriter, "500 Internal Server Error", 500)
+		return
+	}
+	// NOTE: The name of the original file determines Content-Type
+	http.ServeContent(resWriter, req, name, info.ModTime(), rs)
+}
@@ -0,0 +1,19 @@
+//go:build !zipui
+// +build !zipui
+
+package piping_server
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// our static web server content.
+//
+//go:embed "piping-ui-web/dist"
+var static embed.FS
+
+func embeddedStatic() fs.FS {
+	s, _ := fs.Sub(static, "piping-ui-web/dist")
+	return s
+}
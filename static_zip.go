@@ -0,0 +1,25 @@
+//go:build zipui
+// +build zipui
+
+package piping_server
+
+import (
+	"archive/zip"
+	"bytes"
+	_ "embed"
+	"io/fs"
+)
+
+// our static web server content zipped to shrink the binary
+// (e.g. cd piping-ui-web/dist && zip -9r ../dist.zip .)
+//
+//go:embed "piping-ui-web/dist.zip"
+var zippedStatic []byte
+
+func embeddedStatic() fs.FS {
+	zr, err := zip.NewReader(bytes.NewReader(zippedStatic), int64(len(zippedStatic)))
+	if err != nil {
+		panic(err)
+	}
+	return newCachedFS(zr)
+}
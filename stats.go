@@ -0,0 +1,72 @@
+package piping_server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const statsPath = "/api/stats"
+
+// dailyCounter counts events in the current UTC day
+type dailyCounter struct {
+	mutex sync.Mutex
+	day   string
+	count int64
+}
+
+func (c *dailyCounter) add(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if day := now.UTC().Format("2006-01-02"); day != c.day {
+		c.day = day
+		c.count = 0
+	}
+	c.count++
+}
+
+func (c *dailyCounter) get(now time.Time) int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if now.UTC().Format("2006-01-02") != c.day {
+		return 0
+	}
+	return c.count
+}
+
+type statsLimits struct {
+	// MaxTransferDurationSeconds is 0 for no limit
+	MaxTransferDurationSeconds int64 `json:"maxTransferDurationSeconds"`
+	RateLimitRequests          int   `json:"rateLimitRequests,omitempty"`
+	RateLimitWindowSeconds     int64 `json:"rateLimitWindowSeconds,omitempty"`
+	SpoolEnabled               bool  `json:"spoolEnabled"`
+	SpoolMaxBytes              int64 `json:"spoolMaxBytes,omitempty"`
+	ReservationsEnabled        bool  `json:"reservationsEnabled"`
+}
+
+type stats struct {
+	ActivePipes    int         `json:"activePipes"`
+	TransfersToday int64       `json:"transfersToday"`
+	Limits         statsLimits `json:"limits"`
+}
+
+// handleStats responds anonymous aggregate stats and limits for UIs
+func (s *PipingServer) handleStats(resWriter http.ResponseWriter, req *http.Request) {
+	now := s.now()
+	st := stats{
+		ActivePipes:    len(s.activePipePaths()),
+		TransfersToday: s.transfersToday.get(now),
+		Limits: statsLimits{
+			MaxTransferDurationSeconds: int64(s.MaxTransferDuration.Seconds()),
+			SpoolEnabled:               s.spool != nil,
+			SpoolMaxBytes:              s.SpoolMaxBytes,
+			ReservationsEnabled:        s.reservations != nil,
+		},
+	}
+	if limit, window := s.rateLimit(); limit > 0 {
+		st.Limits.RateLimitRequests = limit
+		st.Limits.RateLimitWindowSeconds = int64(window.Seconds())
+	}
+	resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+	writeJSON(resWriter, st)
+}
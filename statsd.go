@@ -0,0 +1,120 @@
+package piping_server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// statsdMaxPacketBytes keeps a packet of batched metrics within the MTU of typical networks
+const statsdMaxPacketBytes = 1432
+
+// maxStatsDTimings bounds the transfers whose start times are kept for durations
+const maxStatsDTimings = 10000
+
+// StatsDConfig is the StatsD server to emit metrics to
+type StatsDConfig struct {
+	// Addr is "host:port" of the server receiving metrics over UDP
+	Addr string
+	// Prefix is prepended to metric names (e.g. "piping_server.")
+	Prefix string
+	// Tags are DogStatsD tags such as "env:prod", which plain StatsD servers do not support
+	Tags []string
+	// Interval is the interval of flushing gauges and byte counts (10s if 0)
+	Interval time.Duration
+}
+
+// statsdEmitter batches metric lines into packets
+type statsdEmitter struct {
+	config StatsDConfig
+	tags   string
+	buf    bytes.Buffer
+	conn   net.Conn
+}
+
+func (e *statsdEmitter) emit(name string, value interface{}, metricType string) {
+	line := fmt.Sprintf("%s%s:%v|%s%s\n", e.config.Prefix, name, value, metricType, e.tags)
+	if e.buf.Len()+len(line) > statsdMaxPacketBytes {
+		e.flush()
+	}
+	e.buf.WriteString(line)
+}
+
+func (e *statsdEmitter) flush() {
+	if e.buf.Len() == 0 {
+		return
+	}
+	// NOTE: Metrics are lost when the server is unreachable like StatsD clients usually do
+	e.conn.Write(bytes.TrimSuffix(e.buf.Bytes(), []byte("\n")))
+	e.buf.Reset()
+}
+
+// statsdEventMetrics are counters of pipe lifecycle events
+var statsdEventMetrics = map[string]string{
+	eventSenderConnected:   "senders",
+	eventReceiverConnected: "receivers",
+	eventTransferStarted:   "transfers.started",
+	eventTransferFinished:  "transfers.finished",
+	eventTransferAborted:   "transfers.aborted",
+	eventPipeCanceled:      "pipes.canceled",
+}
+
+// RunStatsD emits metrics to the StatsD server until stopCh is closed:
+// counters of pipe lifecycle events and transferred bytes, timings of transfers,
+// and gauges of active pipes, committed memory and waiters.
+func (s *PipingServer) RunStatsD(config StatsDConfig, stopCh <-chan struct{}) error {
+	conn, err := net.Dial("udp", config.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	interval := config.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	e := &statsdEmitter{config: config, conn: conn}
+	if len(config.Tags) != 0 {
+		e.tags = "|#" + strings.Join(config.Tags, ",")
+	}
+	eventCh, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// startedAt is the start time of each transfer by transfer ID
+	startedAt := map[string]time.Time{}
+	lastTransferredBytes := atomic.LoadInt64(&s.transferredBytes)
+	for {
+		select {
+		case ev := <-eventCh:
+			e.emit(statsdEventMetrics[ev.Type], 1, "c")
+			switch ev.Type {
+			case eventTransferStarted:
+				if len(startedAt) < maxStatsDTimings {
+					startedAt[ev.TransferID] = ev.Time
+				}
+			case eventTransferFinished, eventTransferAborted:
+				if t, ok := startedAt[ev.TransferID]; ok {
+					delete(startedAt, ev.TransferID)
+					if ev.Type == eventTransferFinished {
+						e.emit("transfers.duration", ev.Time.Sub(t).Milliseconds(), "ms")
+					}
+				}
+			}
+			e.flush()
+		case <-ticker.C:
+			transferredBytes := atomic.LoadInt64(&s.transferredBytes)
+			waiters, _ := s.waiters.counts()
+			e.emit("bytes", transferredBytes-lastTransferredBytes, "c")
+			e.emit("pipes.active", len(s.activePipePaths()), "g")
+			e.emit("memory.committed", s.committedMemoryBytes(), "g")
+			e.emit("waiters", waiters, "g")
+			e.flush()
+			lastTransferredBytes = transferredBytes
+		case <-stopCh:
+			return nil
+		}
+	}
+}
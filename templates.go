@@ -0,0 +1,88 @@
+package piping_server
+
+import (
+	htmltemplate "html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	texttemplate "text/template"
+
+	"github.com/nwtgck/go-piping-server/version"
+)
+
+// Templates overrides pages. A nil template keeps the default page.
+type Templates struct {
+	// Index overrides the top page (index.html)
+	Index *htmltemplate.Template
+	// Help overrides /help (help.txt)
+	Help *texttemplate.Template
+	// Error overrides error responses to browsers (error.html)
+	Error *htmltemplate.Template
+}
+
+// templateData is passed to templates
+type templateData struct {
+	// ServerURL includes the base path
+	ServerURL  string
+	BasePath   string
+	Version    string
+	StatusCode int
+	Code       string
+	Message    string
+	RequestID  string
+}
+
+// LoadTemplates loads index.html, help.txt and error.html in the directory if they exist
+func LoadTemplates(dir string) (*Templates, error) {
+	t := &Templates{}
+	exists := func(name string) (string, bool) {
+		p := filepath.Join(dir, name)
+		_, err := os.Stat(p)
+		return p, err == nil
+	}
+	var err error
+	if p, ok := exists("index.html"); ok {
+		if t.Index, err = htmltemplate.ParseFiles(p); err != nil {
+			return nil, err
+		}
+	}
+	if p, ok := exists("help.txt"); ok {
+		if t.Help, err = texttemplate.ParseFiles(p); err != nil {
+			return nil, err
+		}
+	}
+	if p, ok := exists("error.html"); ok {
+		if t.Error, err = htmltemplate.ParseFiles(p); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (s *PipingServer) newTemplateData(req *http.Request) templateData {
+	base := s.externalBaseOf(req)
+	return templateData{ServerURL: base.URL, BasePath: base.BasePath, Version: version.Version}
+}
+
+// handleTemplatePage serves the overridden top page and help page and returns true if handled
+func (s *PipingServer) handleTemplatePage(resWriter http.ResponseWriter, req *http.Request) bool {
+	if s.Templates == nil {
+		return false
+	}
+	switch {
+	case (req.URL.Path == "/" || req.URL.Path == "/index.html") && s.Templates.Index != nil:
+		resWriter.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := s.Templates.Index.Execute(resWriter, s.newTemplateData(req)); err != nil {
+			s.logf(req, "failed to render index template: %v", err)
+		}
+		return true
+	case req.URL.Path == "/help" && s.Templates.Help != nil:
+		resWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+		if err := s.Templates.Help.Execute(resWriter, s.newTemplateData(req)); err != nil {
+			s.logf(req, "failed to render help template: %v", err)
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package piping_server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// TransferFilter inspects or transforms the body of a transfer, for DLP scanning, watermarking and so on.
+//
+// Filters in PipingServer.TransferFilters are chained in order, so the first filter reads the body of the sender
+// and the receiver reads the last filter. FilterTransfer is called after a receiver connects and before its
+// header is written, so it can modify the header (e.g. delete Content-Length when changing the length).
+// For a spooled transfer, it is called when the sender connects with the header stored for the receiver,
+// and for a pushed transfer with the header of the push request.
+//
+// The transfer is aborted, the receiver gets a truncated response and the sender gets
+//   - 422 if an error wrapping ErrTransferRejected is returned from FilterTransfer or a read
+//   - 500 if another error is returned from FilterTransfer or a read
+//
+// Errors reading the body of the sender are passed through filters and do not abort the transfer
+// as without filters.
+type TransferFilter interface {
+	FilterTransfer(req *http.Request, receiverHeader http.Header, body io.Reader) (io.Reader, error)
+}
+
+// TransferFilterFunc is a function implementing TransferFilter
+type TransferFilterFunc func(req *http.Request, receiverHeader http.Header, body io.Reader) (io.Reader, error)
+
+func (f TransferFilterFunc) FilterTransfer(req *http.Request, receiverHeader http.Header, body io.Reader) (io.Reader, error) {
+	return f(req, receiverHeader, body)
+}
+
+// ErrTransferRejected is wrapped by errors of filters rejecting the content
+var ErrTransferRejected = errors.New("transfer rejected")
+
+type senderReadError struct {
+	err error
+}
+
+func (e *senderReadError) Error() string { return e.err.Error() }
+
+func (e *senderReadError) Unwrap() error { return e.err }
+
+type transferFilterError struct {
+	err error
+}
+
+func (e *transferFilterError) Error() string { return e.err.Error() }
+
+func (e *transferFilterError) Unwrap() error { return e.err }
+
+// senderReader marks errors reading the body of the sender
+type senderReader struct {
+	r io.Reader
+}
+
+func (r *senderReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &senderReadError{err: err}
+	}
+	return n, err
+}
+
+// filterReader marks errors of a filter
+type filterReader struct {
+	r io.Reader
+}
+
+func (r *filterReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	var senderErr *senderReadError
+	var filterErr *transferFilterError
+	if err != nil && err != io.EOF && !errors.As(err, &senderErr) && !errors.As(err, &filterErr) {
+		err = &transferFilterError{err: err}
+	}
+	return n, err
+}
+
+// filterTransfer chains TransferFilters on the body of the sender
+func (s *PipingServer) filterTransfer(req *http.Request, receiverHeader http.Header, body io.Reader) (io.Reader, error) {
+	if len(s.TransferFilters) == 0 {
+		return body, nil
+	}
+	var reader io.Reader = &senderReader{r: body}
+	for _, filter := range s.TransferFilters {
+		filtered, err := filter.FilterTransfer(req, receiverHeader, reader)
+		if err != nil {
+			return nil, &transferFilterError{err: err}
+		}
+		reader = &filterReader{r: filtered}
+	}
+	return reader, nil
+}
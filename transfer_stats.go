@@ -0,0 +1,35 @@
+package piping_server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var transferStatsHeaders = []string{"X-Piping-Bytes", "X-Piping-Duration-Ms", "X-Piping-Bytes-Per-Second"}
+
+// declareTransferStatsTrailers keeps a receiver response chunked to have the trailers
+// NOTE: Net/http omits chunked encoding for a short body unless trailers are declared before writing it
+func declareTransferStatsTrailers(resWriter http.ResponseWriter) {
+	for _, header := range transferStatsHeaders {
+		resWriter.Header().Add("Trailer", header)
+	}
+}
+
+// setTransferStats sets the statistics of a finished transfer.
+// The prefix is http.TrailerPrefix to set them as trailers after the body has been written.
+// NOTE: HTTP/1.1 drops trailers of a response with Content-Length
+func setTransferStats(header http.Header, prefix string, n int64, d time.Duration) {
+	var bytesPerSecond int64
+	if d > 0 {
+		bytesPerSecond = int64(float64(n) / d.Seconds())
+	}
+	header.Set(prefix+"X-Piping-Bytes", strconv.FormatInt(n, 10))
+	header.Set(prefix+"X-Piping-Duration-Ms", strconv.FormatInt(d.Milliseconds(), 10))
+	header.Set(prefix+"X-Piping-Bytes-Per-Second", strconv.FormatInt(bytesPerSecond, 10))
+}
+
+func exposeTransferStatsHeaders(resWriter http.ResponseWriter) {
+	resWriter.Header().Add("Access-Control-Expose-Headers", strings.Join(transferStatsHeaders, ", "))
+}
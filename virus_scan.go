@@ -0,0 +1,177 @@
+package piping_server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Actions on a virus found by VirusScanAction
+const (
+	VirusScanActionAbort = "abort"
+	VirusScanActionFlag  = "flag"
+)
+
+// virusScanResultTrailer is the result of a scan for receivers with VirusScanActionFlag
+const virusScanResultTrailer = "X-Piping-Virus-Scan"
+
+// clamdChunkSize is the max size of a chunk of INSTREAM
+const clamdChunkSize = 64 * 1024
+
+const clamdTimeout = 30 * time.Second
+
+var errVirusFound = errors.New("virus found")
+
+var errVirusScanFailed = errors.New("virus scan failed")
+
+// clamdScan streams data to clamd with the INSTREAM command
+// ref: https://docs.clamav.net/manual/Usage/Scanning.html#clamd
+type clamdScan struct {
+	conn net.Conn
+}
+
+// dialClamd connects to clamd at "unix:///path/to/clamd.sock" or "tcp://host:3310"
+func dialClamd(address string) (*clamdScan, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	switch u.Scheme {
+	case "unix":
+		conn, err = net.DialTimeout("unix", u.Path, clamdTimeout)
+	case "tcp":
+		conn, err = net.DialTimeout("tcp", u.Host, clamdTimeout)
+	default:
+		return nil, fmt.Errorf("unsupported clamd address: %s", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &clamdScan{conn: conn}, nil
+}
+
+func (c *clamdScan) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > clamdChunkSize {
+			chunk = chunk[:clamdChunkSize]
+		}
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(chunk)))
+		if _, err := c.conn.Write(size[:]); err != nil {
+			return written, fmt.Errorf("%w: %v", errVirusScanFailed, err)
+		}
+		n, err := c.conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, fmt.Errorf("%w: %v", errVirusScanFailed, err)
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// result ends the stream and returns the name of the found virus or "" if clean
+func (c *clamdScan) result() (string, error) {
+	c.conn.SetDeadline(time.Now().Add(clamdTimeout))
+	if _, err := c.conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", fmt.Errorf("%w: %v", errVirusScanFailed, err)
+	}
+	reply, err := bufio.NewReader(c.conn).ReadString(0)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errVirusScanFailed, err)
+	}
+	// e.g. "stream: OK", "stream: Eicar-Signature FOUND"
+	reply = strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), "\x00")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	}
+	return "", fmt.Errorf("%w: %s", errVirusScanFailed, reply)
+}
+
+func (c *clamdScan) Close() error {
+	return c.conn.Close()
+}
+
+// startVirusScan connects to clamd if ClamdAddress is set, otherwise returns nil
+func (s *PipingServer) startVirusScan() (*clamdScan, error) {
+	if s.ClamdAddress == "" {
+		return nil, nil
+	}
+	scan, err := dialClamd(s.ClamdAddress)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errVirusScanFailed, err)
+	}
+	return scan, nil
+}
+
+// finishVirusScan returns an error to abort the transfer if a virus is found,
+// or the result to tell receivers with VirusScanActionFlag ("" otherwise)
+func (s *PipingServer) finishVirusScan(scan *clamdScan) (string, error) {
+	virus, err := scan.result()
+	if err != nil {
+		return "", err
+	}
+	if s.VirusScanAction == VirusScanActionFlag {
+		if virus != "" {
+			return "FOUND " + virus, nil
+		}
+		return "OK", nil
+	}
+	if virus != "" {
+		return "", fmt.Errorf("%w: %s", errVirusFound, virus)
+	}
+	return "", nil
+}
+
+// virusScanReader streams the body to clamd while reading it and finishes the scan before EOF,
+// so that the reader of an infected body fails instead of getting a complete body
+type virusScanReader struct {
+	r    io.Reader
+	s    *PipingServer
+	scan *clamdScan
+	// trailer gets the result for VirusScanActionFlag before EOF if not nil
+	trailer http.Header
+	result  string
+	err     error
+}
+
+func (r *virusScanReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.r.Read(p)
+	if n != 0 {
+		if _, scanErr := r.scan.Write(p[:n]); scanErr != nil {
+			r.err = scanErr
+			return n, scanErr
+		}
+	}
+	if err == io.EOF {
+		r.result, r.err = r.s.finishVirusScan(r.scan)
+		if r.result != "" && r.trailer != nil {
+			r.trailer.Set(virusScanResultTrailer, r.result)
+		}
+		if r.err == nil {
+			r.err = io.EOF
+		}
+		return n, r.err
+	}
+	return n, err
+}
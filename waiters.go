@@ -0,0 +1,107 @@
+package piping_server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// defaultTopWaiterPaths is the number of paths listed by /admin/waiters
+const defaultTopWaiterPaths = 20
+
+// waiters counts pipe requests in flight, each of which parks a goroutine, by path
+type waiters struct {
+	mutex    sync.Mutex
+	paths    map[string]int
+	total    int
+	rejected int64
+}
+
+type waiterPath struct {
+	Path    string `json:"path"`
+	Waiters int    `json:"waiters"`
+}
+
+func newWaiters() *waiters {
+	return &waiters{paths: map[string]int{}}
+}
+
+// enter counts the request unless the total has reached max, in which case only requests joining existing pipes are counted
+func (w *waiters) enter(path string, max int, isJoining bool) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if max > 0 && w.total >= max && !isJoining {
+		w.rejected++
+		return false
+	}
+	w.paths[path]++
+	w.total++
+	return true
+}
+
+func (w *waiters) leave(path string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.paths[path]--; w.paths[path] <= 0 {
+		delete(w.paths, path)
+	}
+	w.total--
+}
+
+func (w *waiters) counts() (total int, rejected int64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.total, w.rejected
+}
+
+// top returns the n paths holding the most waiters
+func (w *waiters) top(n int) []waiterPath {
+	w.mutex.Lock()
+	paths := make([]waiterPath, 0, len(w.paths))
+	for path, count := range w.paths {
+		paths = append(paths, waiterPath{Path: path, Waiters: count})
+	}
+	w.mutex.Unlock()
+	sort.Slice(paths, func(i, j int) bool {
+		if paths[i].Waiters != paths[j].Waiters {
+			return paths[i].Waiters > paths[j].Waiters
+		}
+		return paths[i].Path < paths[j].Path
+	})
+	if len(paths) > n {
+		paths = paths[:n]
+	}
+	return paths
+}
+
+// admitWaiter counts the pipe request until leave is called,
+// or writes 503 and returns false if the request would create a new pipe while MaxWaiters are parked
+func (s *PipingServer) admitWaiter(resWriter http.ResponseWriter, req *http.Request) (leave func(), ok bool) {
+	path := req.URL.Path
+	isJoining := false
+	if s.MaxWaiters > 0 {
+		status, _ := s.pipeStatus(path)
+		isJoining = status != pipeStatusIdle
+	}
+	if !s.waiters.enter(path, s.MaxWaiters, isJoining) {
+		resWriter.Header().Set("Retry-After", "1")
+		s.writeError(resWriter, req, 503, ErrorCodeWaiterBudget, fmt.Sprintf("Too many requests are waiting. The new pipe on '%s' has been rejected.", path))
+		return nil, false
+	}
+	return func() { s.waiters.leave(path) }, true
+}
+
+// handleAdminWaiters lists the paths holding the most waiters, as many as the "limit" query parameter
+func (s *PipingServer) handleAdminWaiters(resWriter http.ResponseWriter, req *http.Request) {
+	limit := defaultTopWaiterPaths
+	if q := req.URL.Query().Get("limit"); q != "" {
+		var err error
+		if limit, err = strconv.Atoi(q); err != nil || limit <= 0 {
+			s.writeError(resWriter, req, 400, ErrorCodeBadRequest, "Invalid limit: "+q)
+			return
+		}
+	}
+	writeJSON(resWriter, s.waiters.top(limit))
+}
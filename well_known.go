@@ -0,0 +1,35 @@
+package piping_server
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const DefaultRobotsTxt = "User-agent: *\nDisallow: /\n"
+
+// handleWellKnown serves /robots.txt and /favicon.ico and returns true if handled
+func (s *PipingServer) handleWellKnown(resWriter http.ResponseWriter, req *http.Request) bool {
+	switch req.URL.Path {
+	case "/robots.txt":
+		resWriter.Header().Set("Content-Type", "text/plain")
+		resWriter.Header().Set("Content-Length", strconv.Itoa(len(s.RobotsTxt)))
+		resWriter.WriteHeader(200)
+		if req.Method == "GET" {
+			resWriter.Write([]byte(s.RobotsTxt))
+		}
+		return true
+	case "/favicon.ico":
+		if len(s.Favicon) == 0 {
+			resWriter.WriteHeader(204)
+			return true
+		}
+		resWriter.Header().Set("Content-Type", "image/x-icon")
+		resWriter.Header().Set("Content-Length", strconv.Itoa(len(s.Favicon)))
+		resWriter.WriteHeader(200)
+		if req.Method == "GET" {
+			resWriter.Write(s.Favicon)
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package piping_server
+
+import (
+	"crypto/rand"
+	"io"
+	"math/big"
+)
+
+// NOTE: Short and distinct words easy to dictate
+var adjectiveWords = []string{
+	"amber", "bold", "brave", "bright", "calm", "clever", "cool", "crisp",
+	"dark", "eager", "early", "fair", "fast", "fierce", "fresh", "gentle",
+	"glad", "golden", "grand", "green", "happy", "honest", "jolly", "keen",
+	"kind", "lively", "lucky", "merry", "mighty", "misty", "noble", "odd",
+	"pale", "plain", "proud", "quick", "quiet", "rapid", "red", "rosy",
+	"royal", "rusty", "shy", "silent", "silver", "simple", "sleek", "smart",
+	"snowy", "soft", "solid", "spicy", "steady", "stormy", "sunny", "swift",
+	"tidy", "tiny", "vivid", "warm", "wild", "wise", "witty", "young",
+}
+
+var nounWords = []string{
+	"badger", "bear", "beaver", "bee", "bison", "cat", "cloud", "comet",
+	"crane", "crow", "deer", "dove", "eagle", "falcon", "fern", "finch",
+	"fox", "frog", "gecko", "goat", "hawk", "heron", "horse", "koala",
+	"lake", "lark", "lemon", "lion", "lynx", "maple", "meadow", "moon",
+	"moose", "moth", "newt", "oak", "otter", "owl", "panda", "pine",
+	"plum", "pond", "puma", "quail", "rabbit", "raven", "river", "robin",
+	"salmon", "seal", "shark", "sparrow", "star", "stone", "swan", "tiger",
+	"trout", "tulip", "turtle", "whale", "willow", "wolf", "wren", "zebra",
+}
+
+// randomInt returns a uniform random integer in [0, n)
+func randomInt(random io.Reader, n int) int {
+	v, err := rand.Int(random, big.NewInt(int64(n)))
+	if err != nil {
+		panic(err)
+	}
+	return int(v.Int64())
+}
+
+func randomWord(random io.Reader, words []string) string {
+	return words[randomInt(random, len(words))]
+}
@@ -0,0 +1,139 @@
+package piping_server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// zeroCopySender relays the body of the sender from its hijacked connection as is, so that
+// the connection of the receiver reads it with splice(2) on Linux instead of copying it through user space.
+// It also writes the response to the sender as an http.ResponseWriter.
+type zeroCopySender struct {
+	conn        net.Conn
+	buffered    *bufio.Reader
+	header      http.Header
+	wroteHeader bool
+}
+
+// canZeroCopy returns true if the body of the sender can be relayed without being read by the server.
+// isPlain is false if the transfer is encrypted, encoded, framed or limited.
+func (s *PipingServer) canZeroCopy(req *http.Request, pi *pipe, isPlain bool) bool {
+	if !s.ZeroCopy || !isPlain || pi.isReceiverBase64 || pi.receiverFrame != "" {
+		return false
+	}
+	// NOTE: TLS connections and HTTP/2 streams cannot be spliced
+	if req.ProtoMajor != 1 || req.TLS != nil || pi.receiverReq == nil || pi.receiverReq.ProtoMajor != 1 || pi.receiverReq.TLS != nil {
+		return false
+	}
+	// NOTE: aws-chunked bodies are decoded by the S3 facade
+	if req.ContentLength <= 0 || len(req.TransferEncoding) != 0 || isAWSChunked(req) {
+		return false
+	}
+	if mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err == nil && mediaType == "multipart/form-data" {
+		return false
+	}
+	return len(s.TransferFilters) == 0 && s.ClamdAddress == "" && !s.EnableChaos && !s.isContentHashed() && (s.ArchiveSink == nil || !s.isArchivedPath(req.URL.Path))
+}
+
+// startZeroCopy takes over the connection of the sender if the transfer can be zero-copy
+func (s *PipingServer) startZeroCopy(resWriter http.ResponseWriter, req *http.Request, pi *pipe, isPlain bool) (*zeroCopySender, bool) {
+	if !s.canZeroCopy(req, pi, isPlain) {
+		return nil, false
+	}
+	hijacker, ok := resWriter.(http.Hijacker)
+	if !ok {
+		return nil, false
+	}
+	header := resWriter.Header()
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, false
+	}
+	z := &zeroCopySender{conn: conn, buffered: rw.Reader, header: header}
+	// NOTE: net/http sends 100 Continue when the handler reads the body, which is bypassed here
+	if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		if _, err := io.WriteString(conn, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			conn.Close()
+			return nil, false
+		}
+	}
+	return z, true
+}
+
+// copyTo writes the body of n bytes to the receiver. Reading the sender fails when cancelCh is closed.
+func (z *zeroCopySender) copyTo(receiverResWriter http.ResponseWriter, n int64, deadline time.Time, cancelCh <-chan struct{}) (int64, error) {
+	if !deadline.IsZero() {
+		z.conn.SetReadDeadline(deadline)
+	}
+	var isCanceled uint32
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go func() {
+		select {
+		case <-cancelCh:
+			atomic.StoreUint32(&isCanceled, 1)
+			z.conn.SetReadDeadline(time.Unix(1, 0))
+		case <-stopCh:
+		}
+	}()
+	// Bytes read ahead by net/http
+	buffered := int64(z.buffered.Buffered())
+	if buffered > n {
+		buffered = n
+	}
+	written, err := io.CopyN(receiverResWriter, z.buffered, buffered)
+	if err == nil {
+		var spliced int64
+		// NOTE: net/http passes io.LimitedReader of *net.TCPConn to (*net.TCPConn).ReadFrom, which splices it
+		spliced, err = io.Copy(receiverResWriter, &io.LimitedReader{R: z.conn, N: n - written})
+		written += spliced
+		if err == nil && written < n {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	var netErr net.Error
+	switch {
+	case err != nil && atomic.LoadUint32(&isCanceled) == 1:
+		err = errPipeCanceled
+	case errors.As(err, &netErr) && netErr.Timeout():
+		err = errTransferTimeout
+	}
+	z.conn.SetReadDeadline(time.Time{})
+	return written, err
+}
+
+func (z *zeroCopySender) Header() http.Header {
+	return z.header
+}
+
+// WriteHeader writes the header closing the connection after the body because the rest of the request may be unread
+func (z *zeroCopySender) WriteHeader(statusCode int) {
+	if z.wroteHeader {
+		return
+	}
+	z.wroteHeader = true
+	z.header.Del("Content-Length")
+	z.header.Set("Connection", "close")
+	fmt.Fprintf(z.conn, "HTTP/1.1 %d %s\r\n", statusCode, http.StatusText(statusCode))
+	z.header.Write(z.conn)
+	io.WriteString(z.conn, "\r\n")
+}
+
+func (z *zeroCopySender) Write(p []byte) (int, error) {
+	z.WriteHeader(200)
+	return z.conn.Write(p)
+}
+
+// close responds 200 if nothing has been written and closes the connection
+func (z *zeroCopySender) close() {
+	z.WriteHeader(200)
+	z.conn.Close()
+}